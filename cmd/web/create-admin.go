@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/mrkouhadi/go-booking-app/internal/config"
+	"github.com/mrkouhadi/go-booking-app/internal/driver"
+	"github.com/mrkouhadi/go-booking-app/internal/forms"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
+	"github.com/mrkouhadi/go-booking-app/internal/repository/dbrepo"
+)
+
+// createAdmin creates an owner account, it's how the first user of a fresh database is made:
+//
+//	go run ./cmd/web create-admin -email me@example.com -first-name Bakr -last-name Kouhadi -- -db-dsn "..."
+//
+// The password is read from in so that it doesn't end up in the shell history. The arguments after --,
+// the config file and the BOOKINGS_* environment variables configure the database like for the web server.
+func createAdmin(args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	fs.SetOutput(out)
+	email := fs.String("email", "", "email address the owner logs in with (required)")
+	firstName := fs.String("first-name", "Admin", "first name of the owner")
+	lastName := fs.String("last-name", "", "last name of the owner")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !govalidator.IsEmail(*email) {
+		return fmt.Errorf("-email: %q is not an email address", *email)
+	}
+
+	fmt.Fprint(out, "Password: ")
+	password, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("cannot read the password: %w", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	form := forms.New(url.Values{"password": {password}})
+	if !form.StrongPassword("password", *firstName, *lastName, *email) {
+		return errors.New(strings.ToLower(form.Errors.Get("password")))
+	}
+
+	var c config.AppConfig
+	if err := config.Load(&c, fs.Args()); err != nil {
+		return err
+	}
+	db, err := driver.ConnectSQL(c.DB)
+	if err != nil {
+		return fmt.Errorf("cannot connect to the database: %w", err)
+	}
+	defer db.SQL.Close()
+
+	user := models.User{
+		FirstName:   *firstName,
+		LastName:    *lastName,
+		Email:       *email,
+		AccessLevel: int(models.RoleOwner),
+	}
+	id, err := dbrepo.NewPostgresRepo(db.SQL, &c).InsertUser(context.Background(), user, password)
+	if errors.Is(err, repository.ErrDuplicateEmail) {
+		return fmt.Errorf("a user with the email %s already exists", *email)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\nCreated the owner %s (id %d), you can log in at /user/login\n", *email, id)
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCreateAdmin_InvalidInput(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		password string
+		expected string
+	}{
+		{"missing email", nil, "a long password 1\n", "-email"},
+		{"invalid email", []string{"-email", "admin"}, "a long password 1\n", "-email"},
+		{"short password", []string{"-email", "admin@example.com"}, "short\n", "at least 10 characters"},
+		{"no password", []string{"-email", "admin@example.com"}, "", "at least 10 characters"},
+		{"no database", []string{"-email", "admin@example.com", "--", "-db-dsn", ""}, "a long password 1\n", "db.dsn"},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := createAdmin(tt.args, strings.NewReader(tt.password), &out)
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: expected an error about %q, got %v", tt.name, tt.expected, err)
+		}
+	}
+}
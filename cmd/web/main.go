@@ -1,51 +1,114 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
 	"github.com/alexedwards/scs/v2"
 	"github.com/mrkouhadi/go-booking-app/internal/config"
 	"github.com/mrkouhadi/go-booking-app/internal/driver"
+	"github.com/mrkouhadi/go-booking-app/internal/emails"
 	"github.com/mrkouhadi/go-booking-app/internal/handlers"
 	"github.com/mrkouhadi/go-booking-app/internal/helpers"
+	"github.com/mrkouhadi/go-booking-app/internal/mailer"
 	"github.com/mrkouhadi/go-booking-app/internal/models"
 	"github.com/mrkouhadi/go-booking-app/internal/render"
+	"github.com/mrkouhadi/go-booking-app/internal/sessionstore"
 )
 
-const portNumber = ":8080"
-
 var app config.AppConfig
 var session *scs.SessionManager
+var sessionStore *sessionstore.Postgres // nil while the sessions are kept in memory
 var infoLog *log.Logger
 var errorLog *log.Logger
 
 func main() {
-	db, err := run()
+	if len(os.Args) > 1 && os.Args[1] == "create-admin" {
+		if err := createAdmin(os.Args[2:], os.Stdin, os.Stdout); err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	db, err := run(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer db.SQL.Close()
-	defer close(app.MailChan)
 	fmt.Println("Started mail listener ")
-	listenForMail()
+	listenForMail(handlers.Repo.DB)
+	listenForWebhooks(handlers.Repo.DB)
 
-	fmt.Println("Listening to Port:8080")
 	srv := &http.Server{
-		Addr:    portNumber,
+		Addr:    app.Addr,
 		Handler: Routes(&app),
 	}
-	err = srv.ListenAndServe()
 
-	log.Fatal(err)
+	// SIGINT (ctrl+c) and SIGTERM (sent on deploys) start a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		fmt.Printf("Listening on %s\n", app.Addr)
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err = <-serverErr:
+		// the server could not start, e.g. the address is already in use
+	case <-ctx.Done():
+		infoLog.Println("shutting down...")
+	}
+	// a second signal kills the app right away
+	stop()
+
+	if shutdownErr := shutdown(srv, db); shutdownErr != nil {
+		errorLog.Println(shutdownErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	infoLog.Println("stopped")
 }
 
-func run() (*driver.DB, error) {
+// shutdown stops the app in order: it waits for in-flight requests, then stores the queued mail
+// in the outbox, lets the webhook workers finish what they are sending and only then closes the database pool. Everything has to be done within app.ShutdownTimeout.
+func shutdown(srv *http.Server, db *driver.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), app.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		errorLog.Println("could not drain all requests:", err)
+	}
+	if err := stopMail(ctx); err != nil {
+		errorLog.Println("could not store all queued mail:", err)
+	}
+	if err := stopWebhooks(ctx); err != nil {
+		errorLog.Println("could not finish sending the webhooks:", err)
+	}
+	if err := mailSender.Close(); err != nil {
+		errorLog.Println(err)
+	}
+	if sessionStore != nil {
+		sessionStore.Close()
+	}
+	return db.SQL.Close()
+}
+
+// run loads the config from the command-line args (and the environment) and sets up the app
+func run(args []string) (*driver.DB, error) {
 	// what am I going to store in the session
 	gob.Register(models.Reservation{})
 	gob.Register(models.User{})
@@ -53,10 +116,12 @@ func run() (*driver.DB, error) {
 	gob.Register(models.Restriction{})
 	gob.Register(map[string]int{})
 
-	mailChan := make(chan models.MailData)
-	app.MailChan = mailChan
+	if err := config.Load(&app, args); err != nil {
+		return nil, err
+	}
 
-	app.InProduction = false
+	mailChan := make(chan models.MailData, mailQueueSize)
+	app.MailChan = mailChan
 
 	infoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime) // \t means tab (bunch of spaces)
 	app.InfoLog = infoLog
@@ -64,20 +129,39 @@ func run() (*driver.DB, error) {
 	app.ErrorLog = errorLog
 
 	session = scs.New()
-	session.Lifetime = 24 * time.Hour
+	session.Lifetime = app.SessionLifetime
 	session.Cookie.Persist = true
 	session.Cookie.SameSite = http.SameSiteLaxMode
-	session.Cookie.Secure = app.InProduction
+	session.Cookie.Secure = app.CookieSecure
 
 	app.Session = session
+	// the email templates are embedded in the binary, parse them once
+	templates, err := emails.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the email templates: %w", err)
+	}
+	app.Emails = templates
+
+	sender, err := mailer.New(app.Mail, app.SMTP)
+	if err != nil {
+		return nil, fmt.Errorf("cannot set up the mail transport: %w", err)
+	}
+	mailSender = sender
+
 	// connect to the database
 	log.Println("CNNECTING TO A DATABASE...")
-	db, err := driver.ConnectSQL("host=localhost port=5432 dbname=bookings user=kouhadi password=")
+	db, err := driver.ConnectSQL(app.DB)
 	if err != nil {
-		log.Fatal("Cannot connect to the database ! Dying...")
+		return nil, fmt.Errorf("cannot connect to the database: %w", err)
 	}
 	log.Println("SUCCESSFULLY CONNECTed TO A DATABASE !")
 
+	// sessions kept in postgres survive restarts and are shared by every instance of the app
+	if app.SessionStore == "postgres" {
+		sessionStore = sessionstore.NewPostgres(db.SQL, app.DB.QueryTimeout, app.SessionCleanup, errorLog)
+		session.Store = sessionStore
+	}
+
 	// create templates cache
 	tc, err := render.CreateTemplateCache()
 	if err != nil {
@@ -86,8 +170,6 @@ func run() (*driver.DB, error) {
 	}
 	app.TemplateCache = tc
 
-	app.UseCache = false
-
 	repo := handlers.NewRepo(&app, db)
 	handlers.NewHandlers(repo)
 	render.NewRenderer(&app)
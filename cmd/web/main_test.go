@@ -1,10 +1,24 @@
 package main
 
-import "testing"
+import (
+	"errors"
+	"flag"
+	"strings"
+	"testing"
+)
 
 func TestRun(t *testing.T) {
-	_, err := run()
-	if err != nil {
-		t.Error("failed run")
+	// run checks the config before it connects to the database, so these need none
+	t.Setenv("BOOKINGS_CONFIG", "")
+	t.Setenv("BOOKINGS_DB_DSN", "")
+	saved := app
+	defer func() { app = saved }()
+
+	_, err := run([]string{"-mail-owner", "owner@example.com"})
+	if err == nil || !strings.Contains(err.Error(), "db.dsn") {
+		t.Errorf("expected run to refuse a config without db.dsn, got %v", err)
+	}
+	if _, err := run([]string{"-h"}); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("expected -h to only print the usage, got %v", err)
 	}
 }
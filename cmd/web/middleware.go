@@ -1,10 +1,19 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/justinas/nosurf"
+	"github.com/mrkouhadi/go-booking-app/internal/handlers"
 	"github.com/mrkouhadi/go-booking-app/internal/helpers"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
+	"github.com/mrkouhadi/go-booking-app/internal/token"
 )
 
 // csrf : ignore any POST request that doesn't have CSRF token
@@ -14,7 +23,7 @@ func Nosurf(next http.Handler) http.Handler {
 	csrfHandler.SetBaseCookie(http.Cookie{
 		HttpOnly: true,
 		Path:     "/",
-		Secure:   app.InProduction,
+		Secure:   app.CookieSecure,
 		SameSite: http.SameSiteLaxMode,
 	})
 	return csrfHandler
@@ -25,14 +34,138 @@ func LoadSession(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
 
-// auth
+// changePasswordPath is the only admin page a user who must reset their password can reach
+const changePasswordPath = "/admin/change-password"
+
+// twoFactorPath starts the admin pages a user whose role requires two-factor authentication can reach before
+// setting it up
+const twoFactorPath = "/admin/two-factor"
+
+// Auth lets only logged in, active users through and puts the user, loaded from the database, in the request context.
+// Sessions started before the user's password changed are ended, users who must reset their password are
+// sent to choose a new one first and users whose role requires two-factor authentication to set it up.
 func Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !helpers.IsAuthenticated(r) {
-			session.Put(r.Context(), "error", "Please Log in first !")
-			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			deny(w, r, "Please Log in first !", "/user/login")
+			return
+		}
+		user, err := handlers.Repo.DB.GetUserByID(r.Context(), session.GetInt(r.Context(), "user_id"))
+		if err != nil {
+			// e.g. the user has been deleted since logging in
+			errorLog.Println(err)
+			_ = session.Destroy(r.Context())
+			deny(w, r, "Please Log in first !", "/user/login")
+			return
+		}
+		if session.GetInt(r.Context(), "session_version") != user.SessionVersion {
+			// the password has changed since logging in
+			_ = session.Destroy(r.Context())
+			deny(w, r, "Your password has changed, please log in again", "/user/login")
+			return
+		}
+		if !user.Active {
+			// deactivated since logging in
+			_ = session.Destroy(r.Context())
+			deny(w, r, "This account has been deactivated", "/user/login")
+			return
+		}
+		if user.PasswordResetRequired && r.URL.Path != changePasswordPath {
+			deny(w, r, "Please choose a new password first", changePasswordPath)
+			return
+		}
+		if app.Login.RequiresTwoFactor(user.Role()) && !user.TOTPEnabled && !strings.HasPrefix(r.URL.Path, twoFactorPath) {
+			deny(w, r, "Please set up two-factor authentication first", twoFactorPath)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(helpers.WithUser(r.Context(), user)))
+	})
+}
+
+// Require lets through only the users whose role has permission p, it must run after Auth
+func Require(p models.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := helpers.CurrentUser(r)
+			if !ok || !user.Role().Can(p) {
+				deny(w, r, "You don't have permission to do that", "/admin/dashboard")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// APIAuth lets through only the API callers that send a working API key as "Authorization: Bearer <key>" and
+// puts the key in the request context. Keys are made and revoked by the owner at /admin/api-keys.
+func APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, bearer := cutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !bearer || key == "" {
+			unauthorized(w)
+			return
+		}
+		apiKey, err := handlers.Repo.DB.GetAPIKeyByHash(r.Context(), token.Hash(key))
+		if errors.Is(err, repository.ErrNotFound) || (err == nil && apiKey.Revoked()) {
+			unauthorized(w)
 			return
 		}
-		next.ServeHTTP(w, r)
+		if err != nil {
+			helpers.APIServerError(w, err)
+			return
+		}
+		if err := handlers.Repo.DB.TouchAPIKey(r.Context(), apiKey.ID, time.Now()); err != nil {
+			// not worth turning the caller away for
+			errorLog.Println(err)
+		}
+		next.ServeHTTP(w, r.WithContext(helpers.WithAPIKey(r.Context(), apiKey)))
 	})
 }
+
+// RequireScope lets through only the API keys with scope s, it must run after APIAuth
+func RequireScope(s models.APIScope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiKey, ok := helpers.CurrentAPIKey(r)
+			if !ok || !apiKey.Can(s) {
+				helpers.WriteAPIError(w, helpers.APIError{
+					Status:  http.StatusForbidden,
+					Code:    "forbidden",
+					Message: fmt.Sprintf("This API key doesn't have the %s scope", s),
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// unauthorized turns away an API caller without a working API key
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	helpers.WriteAPIError(w, helpers.APIError{
+		Status:  http.StatusUnauthorized,
+		Code:    "unauthorized",
+		Message: "A valid API key is required",
+	})
+}
+
+// cutPrefix returns s without prefix and whether s started with it
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// deny turns a request away: JSON callers get a 403, browsers are sent to redirect with msg as an error
+func deny(w http.ResponseWriter, r *http.Request, msg, redirect string) {
+	if helpers.WantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "message": msg})
+		return
+	}
+	session.Put(r.Context(), "error", msg)
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"testing"
+
+	"github.com/mrkouhadi/go-booking-app/internal/helpers"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/repository/dbrepo"
 )
 
 func TestNoSurf(t *testing.T) {
@@ -28,3 +33,217 @@ func TestSessionLoad(t *testing.T) {
 		t.Errorf("type is not http.Handler but is %T", v)
 	}
 }
+
+// loggedIn returns a request whose session holds userID, 0 for a visitor who hasn't logged in
+func loggedIn(t *testing.T, method, target string, userID int) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	ctx, err := session.Load(req.Context(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID > 0 {
+		session.Put(ctx, "user_id", userID)
+	}
+	return req.WithContext(ctx)
+}
+
+func TestAuth(t *testing.T) {
+	var seen models.User
+	h := Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = helpers.CurrentUser(r)
+	}))
+
+	// a visitor is sent to the login page
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, loggedIn(t, "GET", "/admin/dashboard", 0))
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/user/login" {
+		t.Errorf("expected a redirect to the login page, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// a JSON caller gets a 403 instead
+	rr = httptest.NewRecorder()
+	req := loggedIn(t, "GET", "/admin/dashboard", 0)
+	req.Header.Set("Accept", "application/json")
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a JSON caller, got %d", rr.Code)
+	}
+
+	// the user of a session can't be found anymore
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, loggedIn(t, "GET", "/admin/dashboard", 99))
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("expected a redirect for an unknown user, got %d", rr.Code)
+	}
+
+	// the password has changed since the session started
+	rr = httptest.NewRecorder()
+	req = loggedIn(t, "GET", "/admin/dashboard", int(models.RoleManager))
+	session.Put(req.Context(), "session_version", 3)
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/user/login" {
+		t.Errorf("expected a session of an older password to end, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// user 5 of the test repo has been deactivated
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, loggedIn(t, "GET", "/admin/dashboard", 5))
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/user/login" {
+		t.Errorf("expected a deactivated user to be logged out, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// user 6 of the test repo must choose a new password before anything else
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, loggedIn(t, "GET", "/admin/dashboard", 6))
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != changePasswordPath {
+		t.Errorf("expected a redirect to choose a new password, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, loggedIn(t, "GET", changePasswordPath, 6))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected the user to reach the change password page, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, loggedIn(t, "GET", "/admin/dashboard", int(models.RoleManager)))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected a logged in user to get through, got %d", rr.Code)
+	}
+	if seen.Role() != models.RoleManager {
+		t.Errorf("expected the user to be in the request context, got %+v", seen)
+	}
+}
+
+func TestAuth_TwoFactorRoles(t *testing.T) {
+	h := Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	app.Login.TwoFactorRoles = []models.Role{models.RoleFrontDesk}
+	defer func() { app.Login.TwoFactorRoles = nil }()
+
+	tests := []struct {
+		name     string
+		userID   int
+		target   string
+		expected string // where the user is sent, empty when they get through
+	}{
+		{"not set up", int(models.RoleFrontDesk), "/admin/dashboard", twoFactorPath},
+		{"setting it up", int(models.RoleFrontDesk), twoFactorPath, ""},
+		{"confirming it", int(models.RoleFrontDesk), twoFactorPath + "/enable", ""},
+		{"set up", 7, "/admin/dashboard", ""},
+		{"role without the requirement", int(models.RoleManager), "/admin/dashboard", ""},
+	}
+	for _, e := range tests {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, loggedIn(t, "GET", e.target, e.userID))
+		if rr.Header().Get("Location") != e.expected {
+			t.Errorf("%s: expected to be sent to %q, got %d to %q", e.name, e.expected, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	tests := []struct {
+		name       string
+		role       models.Role
+		permission models.Permission
+		json       bool
+		expected   int
+	}{
+		{"read-only views", models.RoleReadOnly, models.PermViewReservations, false, http.StatusOK},
+		{"read-only can't process", models.RoleReadOnly, models.PermProcessReservations, false, http.StatusSeeOther},
+		{"front-desk processes", models.RoleFrontDesk, models.PermProcessReservations, false, http.StatusOK},
+		{"front-desk can't delete", models.RoleFrontDesk, models.PermDeleteReservations, false, http.StatusSeeOther},
+		{"front-desk can't delete over json", models.RoleFrontDesk, models.PermDeleteReservations, true, http.StatusForbidden},
+		{"manager deletes", models.RoleManager, models.PermDeleteReservations, false, http.StatusOK},
+		{"manager can't manage users", models.RoleManager, models.PermManageUsers, false, http.StatusSeeOther},
+		{"owner does anything", models.RoleOwner, models.PermManageMail, false, http.StatusOK},
+		{"owner manages users", models.RoleOwner, models.PermManageUsers, false, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		h := Auth(Require(tt.permission)(&myHandler{}))
+		req := loggedIn(t, "GET", "/admin/reservations-all", int(tt.role))
+		if tt.json {
+			req.Header.Set("X-Requested-With", "XMLHttpRequest")
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != tt.expected {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.expected, rr.Code)
+		}
+		if rr.Code == http.StatusSeeOther && rr.Header().Get("Location") != "/admin/dashboard" {
+			t.Errorf("%s: expected a redirect to the dashboard, got %q", tt.name, rr.Header().Get("Location"))
+		}
+	}
+}
+
+func TestAdminRoutesRequireLogin(t *testing.T) {
+	mux := Routes(&app)
+	for _, target := range []string{"/admin/dashboard", "/admin/reservations-all", "/admin/delete-reservation/all/1/do", "/admin/mail-failed", "/admin/users", "/admin/webhooks"} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/user/login" {
+			t.Errorf("%s: expected a redirect to the login page, got %d", target, rr.Code)
+		}
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	var seen models.APIKey
+	h := APIAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = helpers.CurrentAPIKey(r)
+	}))
+
+	tests := []struct {
+		name           string
+		header         string
+		expectedStatus int
+		expectedKey    int
+	}{
+		{"valid key", "Bearer " + dbrepo.TestAPIKeyAvailability, http.StatusOK, 1},
+		{"no key", "", http.StatusUnauthorized, 0},
+		{"unknown key", "Bearer bk_00000000_nope", http.StatusUnauthorized, 0},
+		{"revoked key", "Bearer " + dbrepo.TestAPIKeyRevoked, http.StatusUnauthorized, 0},
+		{"key without the scheme", dbrepo.TestAPIKeyAdmin, http.StatusUnauthorized, 0},
+		{"empty key", "Bearer ", http.StatusUnauthorized, 0},
+	}
+	for _, e := range tests {
+		seen = models.APIKey{}
+		req := httptest.NewRequest("GET", "/api/v1/rooms", nil)
+		if e.header != "" {
+			req.Header.Set("Authorization", e.header)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != e.expectedStatus || seen.ID != e.expectedKey {
+			t.Errorf("%s: expected %d with key %d, got %d with key %d", e.name, e.expectedStatus, e.expectedKey, rr.Code, seen.ID)
+		}
+		if rr.Code == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a WWW-Authenticate header", e.name)
+		}
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	h := RequireScope(models.ScopeWriteReservations)(&myHandler{})
+
+	tests := []struct {
+		name           string
+		scopes         []models.APIScope
+		expectedStatus int
+	}{
+		{"scope granted", []models.APIScope{models.ScopeReadAvailability, models.ScopeWriteReservations}, http.StatusOK},
+		{"admin", []models.APIScope{models.ScopeAdmin}, http.StatusOK},
+		{"other scope", []models.APIScope{models.ScopeReadAvailability}, http.StatusForbidden},
+		{"no scope", nil, http.StatusForbidden},
+	}
+	for _, e := range tests {
+		req := httptest.NewRequest("POST", "/api/v1/reservations", nil)
+		req = req.WithContext(helpers.WithAPIKey(req.Context(), models.APIKey{ID: 1, Scopes: e.scopes}))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
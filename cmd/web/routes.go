@@ -7,6 +7,7 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/mrkouhadi/go-booking-app/internal/config"
 	"github.com/mrkouhadi/go-booking-app/internal/handlers"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
 )
 
 func Routes(app *config.AppConfig) http.Handler {
@@ -15,52 +16,170 @@ func Routes(app *config.AppConfig) http.Handler {
 
 	// midlwares
 	mux.Use(middleware.Recoverer)
-	mux.Use(Nosurf) //  ignore any POST request that doesn't have CSRF token
-	mux.Use(LoadSession)
-
-	// GET methods
-	mux.Get("/", handlers.Repo.Home)
-	mux.Get("/features", handlers.Repo.Features)
-	mux.Get("/about", handlers.Repo.About)
-	mux.Get("/contact", handlers.Repo.Contact)
-	mux.Get("/make-reservation", handlers.Repo.MakeReservation)
-	mux.Get("/generals-quarters", handlers.Repo.GeneralRooms)
-	mux.Get("/majors-suite", handlers.Repo.MajorSuite)
-	mux.Get("/search-availability", handlers.Repo.SearchAvailability)
-	mux.Get("/reservation-summary", handlers.Repo.ReservationSummary)
-	mux.Get("/choose-room/{id}", handlers.Repo.ChooseRoom)
-	mux.Get("/book-room", handlers.Repo.BookRoom)
-	mux.Get("/user/login", handlers.Repo.ShowLogin)
-	mux.Get("/user/logout", handlers.Repo.Logout)
-
-	// POST methods
-	mux.Post("/search-availability", handlers.Repo.PostSearchAvailability)
-	mux.Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
-	mux.Post("/make-reservation", handlers.Repo.PostMakeReservation)
-	mux.Post("/reservation-summary", handlers.Repo.ReservationSummary)
-	mux.Post("/user/login", handlers.Repo.PostShowLogin)
-
-	// render files in the template(html)
-	fileServer := http.FileServer(http.Dir("./static/"))
-	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
-
-	// protected routes
-	mux.Route("/admin", func(mux chi.Router) {
-		// FIXME: UNCOMMENT the line below for enabling authentication
-		// mux.Use(Auth)
-
-		mux.Get("/dashboard", handlers.Repo.AminDashboard) // route will be : admin/dashboard
-
-		mux.Get("/reservations-new", handlers.Repo.AdminNewReservations)                     // admin/reservations-new
-		mux.Get("/reservations-all", handlers.Repo.AdminAllReservations)                     // admin/reservations-all
-		mux.Get("/reservations-calendar", handlers.Repo.AdminReservationsCalendar)           // admin/reservations-calendar
-		mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation)         // admin/reservations/all/2
-		mux.Get("/process-reservation/{src}/{id}/do", handlers.Repo.AdminProcessReservation) // admin/process-reservation/new/3
-		mux.Get("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)   // admin/delete-reservation/new/3
-
-		mux.Post("/reservations-calendar", handlers.Repo.AdminPostReservationsCalendar)
-		mux.Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
 
+	// the JSON API authenticates its callers with an API key instead of a session, so it has no CSRF check
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.Use(APIAuth)
+		mux.NotFound(handlers.Repo.APINotFound)
+		mux.MethodNotAllowed(handlers.Repo.APIMethodNotAllowed)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireScope(models.ScopeReadAvailability))
+			mux.Get("/rooms", handlers.Repo.APIRooms)
+			mux.Get("/rooms/{id}/availability", handlers.Repo.APIRoomAvailability)
+			mux.Get("/availability", handlers.Repo.APIAvailability)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireScope(models.ScopeWriteReservations))
+			mux.Post("/reservations", handlers.Repo.APICreateReservation)
+			mux.Get("/reservations/{id}", handlers.Repo.APIReservation)
+			mux.Patch("/reservations/{id}", handlers.Repo.APIUpdateReservation)
+			mux.Delete("/reservations/{id}", handlers.Repo.APIDeleteReservation)
+		})
+	})
+
+	// the contract of the API, for partners to generate their clients from
+	mux.Get("/api/openapi.json", handlers.Repo.OpenAPI)
+
+	// the website
+	mux.Group(func(mux chi.Router) {
+		mux.Use(Nosurf) //  ignore any POST request that doesn't have CSRF token
+		mux.Use(LoadSession)
+
+		// GET methods
+		mux.Get("/", handlers.Repo.Home)
+		mux.Get("/features", handlers.Repo.Features)
+		mux.Get("/about", handlers.Repo.About)
+		mux.Get("/contact", handlers.Repo.Contact)
+		mux.Get("/make-reservation", handlers.Repo.MakeReservation)
+		mux.Get("/rooms", handlers.Repo.Rooms)
+		mux.Get("/rooms/{slug}", handlers.Repo.RoomPage)
+		for old, page := range handlers.OldRoomPages {
+			mux.Get(old, http.RedirectHandler(page, http.StatusMovedPermanently).ServeHTTP)
+		}
+		mux.Get("/search-availability", handlers.Repo.SearchAvailability)
+		mux.Get("/reservation-summary", handlers.Repo.ReservationSummary)
+		mux.Get("/choose-room/{id}", handlers.Repo.ChooseRoom)
+		mux.Get("/book-room", handlers.Repo.BookRoom)
+		mux.Get("/user/login", handlers.Repo.ShowLogin)
+		mux.Get("/user/logout", handlers.Repo.Logout)
+		mux.Get("/user/forgot-password", handlers.Repo.ForgotPassword)
+		mux.Get("/user/reset-password", handlers.Repo.ResetPassword)
+		mux.Get("/user/two-factor", handlers.Repo.TwoFactor)
+		mux.Get("/api/docs", handlers.Repo.APIDocs)
+
+		// POST methods
+		mux.Post("/search-availability", handlers.Repo.PostSearchAvailability)
+		mux.Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
+		mux.Post("/make-reservation", handlers.Repo.PostMakeReservation)
+		mux.Post("/reservation-summary", handlers.Repo.ReservationSummary)
+		mux.Post("/user/login", handlers.Repo.PostShowLogin)
+		mux.Post("/user/forgot-password", handlers.Repo.PostForgotPassword)
+		mux.Post("/user/reset-password", handlers.Repo.PostResetPassword)
+		mux.Post("/user/two-factor", handlers.Repo.PostTwoFactor)
+
+		// render files in the template(html)
+		fileServer := http.FileServer(http.Dir("./static/"))
+		mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
+
+		// protected routes, every staff member can reach the dashboard and the rest depends on their role
+		mux.Route("/admin", func(mux chi.Router) {
+			mux.Use(Auth)
+
+			mux.Get("/dashboard", handlers.Repo.AminDashboard) // route will be : admin/dashboard
+			mux.Get("/change-password", handlers.Repo.ChangePassword)
+			mux.Post("/change-password", handlers.Repo.PostChangePassword)
+			mux.Get("/two-factor", handlers.Repo.AdminTwoFactor)
+			mux.Post("/two-factor/enable", handlers.Repo.AdminPostEnableTwoFactor)
+			mux.Post("/two-factor/recovery-codes", handlers.Repo.AdminPostRecoveryCodes)
+			mux.Post("/two-factor/disable", handlers.Repo.AdminPostDisableTwoFactor)
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(Require(models.PermViewReservations))
+				mux.Get("/reservations-new", handlers.Repo.AdminNewReservations)             // admin/reservations-new
+				mux.Get("/reservations-all", handlers.Repo.AdminAllReservations)             // admin/reservations-all
+				mux.Get("/reservations-calendar", handlers.Repo.AdminReservationsCalendar)   // admin/reservations-calendar
+				mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation) // admin/reservations/all/2
+				mux.Get("/reservations/{src}/{id}/invoice", handlers.Repo.AdminReservationInvoice)
+				mux.Get("/reservations/{src}/{id}/invoice.pdf", handlers.Repo.AdminReservationInvoicePDF)
+			})
+
+			mux.With(Require(models.PermEditReservations)).Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
+			mux.With(Require(models.PermEditReservations)).Post("/reservations/{src}/{id}/invoice", handlers.Repo.AdminIssueInvoice)
+			mux.With(Require(models.PermProcessReservations)).Post("/process-reservation/{src}/{id}/do", handlers.Repo.AdminProcessReservation) // admin/process-reservation/new/3/do
+			mux.With(Require(models.PermDeleteReservations)).Post("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)    // admin/delete-reservation/new/3/do
+			mux.With(Require(models.PermManageCalendar)).Post("/reservations-calendar", handlers.Repo.AdminPostReservationsCalendar)
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(Require(models.PermManageMail))
+				mux.Get("/mail-failed", handlers.Repo.AdminFailedMail) // admin/mail-failed
+				mux.Post("/mail-failed/{id}/resend", handlers.Repo.AdminResendMail)
+			})
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(Require(models.PermManagePromoCodes))
+				mux.Get("/promo-codes", handlers.Repo.AdminPromoCodes) // admin/promo-codes
+				mux.Get("/promo-codes/new", handlers.Repo.AdminNewPromoCode)
+				mux.Post("/promo-codes/new", handlers.Repo.AdminPostNewPromoCode)
+				mux.Get("/promo-codes/report", handlers.Repo.AdminPromoReport)
+				mux.Get("/promo-codes/{id}", handlers.Repo.AdminShowPromoCode) // admin/promo-codes/2
+				mux.Post("/promo-codes/{id}", handlers.Repo.AdminPostPromoCode)
+				mux.Post("/promo-codes/{id}/delete", handlers.Repo.AdminDeletePromoCode)
+			})
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(Require(models.PermManageRooms))
+				mux.Get("/room-types", handlers.Repo.AdminRoomTypes) // admin/room-types
+				mux.Get("/room-types/new", handlers.Repo.AdminNewRoomType)
+				mux.Post("/room-types/new", handlers.Repo.AdminPostNewRoomType)
+				mux.Get("/room-types/{id}", handlers.Repo.AdminShowRoomType) // admin/room-types/2
+				mux.Post("/room-types/{id}", handlers.Repo.AdminPostRoomType)
+				mux.Post("/room-types/{id}/delete", handlers.Repo.AdminDeleteRoomType)
+				mux.Get("/rooms", handlers.Repo.AdminRooms) // admin/rooms
+				mux.Get("/rooms/new", handlers.Repo.AdminNewRoom)
+				mux.Post("/rooms/new", handlers.Repo.AdminPostNewRoom)
+				mux.Get("/rooms/{id}", handlers.Repo.AdminShowRoom) // admin/rooms/2
+				mux.Post("/rooms/{id}", handlers.Repo.AdminPostRoom)
+				mux.Post("/rooms/{id}/deactivate", handlers.Repo.AdminDeactivateRoom)
+				mux.Post("/rooms/{id}/activate", handlers.Repo.AdminActivateRoom)
+				mux.Post("/rooms/{id}/move-up", handlers.Repo.AdminMoveRoomUp)
+				mux.Post("/rooms/{id}/move-down", handlers.Repo.AdminMoveRoomDown)
+			})
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(Require(models.PermManageUsers))
+				mux.Get("/users", handlers.Repo.AdminUsers) // admin/users
+				mux.Get("/users/new", handlers.Repo.AdminNewUser)
+				mux.Post("/users/new", handlers.Repo.AdminPostNewUser)
+				mux.Get("/users/{id}", handlers.Repo.AdminShowUser) // admin/users/2
+				mux.Post("/users/{id}", handlers.Repo.AdminPostUser)
+				mux.Post("/users/{id}/deactivate", handlers.Repo.AdminDeactivateUser)
+				mux.Post("/users/{id}/activate", handlers.Repo.AdminActivateUser)
+				mux.Post("/users/{id}/reset-password", handlers.Repo.AdminResetUserPassword)
+				mux.Post("/users/{id}/reset-two-factor", handlers.Repo.AdminResetUserTwoFactor)
+				mux.Post("/users/{id}/delete", handlers.Repo.AdminDeleteUser)
+			})
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(Require(models.PermManageAPIKeys))
+				mux.Get("/api-keys", handlers.Repo.AdminAPIKeys) // admin/api-keys
+				mux.Post("/api-keys", handlers.Repo.AdminPostAPIKey)
+				mux.Post("/api-keys/{id}/revoke", handlers.Repo.AdminRevokeAPIKey)
+			})
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(Require(models.PermManageWebhooks))
+				mux.Get("/webhooks", handlers.Repo.AdminWebhooks) // admin/webhooks
+				mux.Get("/webhooks/new", handlers.Repo.AdminNewWebhook)
+				mux.Post("/webhooks/new", handlers.Repo.AdminPostNewWebhook)
+				mux.Get("/webhooks/deliveries", handlers.Repo.AdminWebhookDeliveries) // admin/webhooks/deliveries
+				mux.Post("/webhooks/deliveries/{id}/redeliver", handlers.Repo.AdminRedeliverWebhook)
+				mux.Get("/webhooks/{id}", handlers.Repo.AdminShowWebhook) // admin/webhooks/2
+				mux.Post("/webhooks/{id}", handlers.Repo.AdminPostWebhook)
+				mux.Post("/webhooks/{id}/delete", handlers.Repo.AdminDeleteWebhook)
+			})
+		})
 	})
 	return mux
 }
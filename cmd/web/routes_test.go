@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/mrkouhadi/go-booking-app/internal/config"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/openapi"
+	"github.com/mrkouhadi/go-booking-app/internal/repository/dbrepo"
 )
 
 func TestRoutes(t *testing.T) {
@@ -19,3 +26,117 @@ func TestRoutes(t *testing.T) {
 		t.Errorf("type is not *chi.Mux, but is %T", v)
 	}
 }
+
+func TestRoutes_API(t *testing.T) {
+	mux := Routes(&app)
+
+	tests := []struct {
+		name           string
+		method         string
+		target         string
+		key            string
+		body           string
+		expectedStatus int
+	}{
+		{"no key", "GET", "/api/v1/rooms", "", "", http.StatusUnauthorized},
+		{"rooms", "GET", "/api/v1/rooms", dbrepo.TestAPIKeyAvailability, "", http.StatusOK},
+		{"reservations without the scope", "GET", "/api/v1/reservations/1", dbrepo.TestAPIKeyAvailability, "", http.StatusForbidden},
+		{"reservation", "GET", "/api/v1/reservations/1", dbrepo.TestAPIKeyReservations, "", http.StatusOK},
+		{"rooms without the scope", "GET", "/api/v1/rooms", dbrepo.TestAPIKeyReservations, "", http.StatusForbidden},
+		{"admin", "GET", "/api/v1/availability?start=2050-01-01&end=2050-01-03", dbrepo.TestAPIKeyAdmin, "", http.StatusOK},
+		// the test repository refuses room 3 as taken, which shows the request reached the handler
+		{"post without a CSRF token", "POST", "/api/v1/reservations", dbrepo.TestAPIKeyReservations,
+			`{"room_id":3,"first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"555","start_date":"2050-01-01","end_date":"2050-01-03"}`,
+			http.StatusConflict},
+		{"unknown route", "GET", "/api/v1/guests", dbrepo.TestAPIKeyAdmin, "", http.StatusNotFound},
+		{"wrong method", "PUT", "/api/v1/rooms", dbrepo.TestAPIKeyAdmin, "", http.StatusMethodNotAllowed},
+		{"website post still needs a CSRF token", "POST", "/search-availability", "", "", http.StatusBadRequest},
+	}
+	for _, e := range tests {
+		req := httptest.NewRequest(e.method, e.target, strings.NewReader(e.body))
+		if e.key != "" {
+			req.Header.Set("Authorization", "Bearer "+e.key)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d %s", e.name, e.expectedStatus, rr.Code, rr.Body.String())
+		}
+		if strings.HasPrefix(e.target, "/api/") && rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: expected a JSON response, got %q", e.name, rr.Header().Get("Content-Type"))
+		}
+	}
+}
+
+// documented lists the routes outside /api/v1 that the OpenAPI document describes
+var documented = map[string]bool{
+	"POST /search-availability-json": true,
+}
+
+func TestRoutes_OpenAPI(t *testing.T) {
+	mux, ok := Routes(&app).(*chi.Mux)
+	if !ok {
+		t.Fatal("expected a *chi.Mux")
+	}
+	spec := openapi.Spec(app.BaseURL)
+
+	routed := make(map[string]bool)
+	err := chi.Walk(mux, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		route = strings.TrimSuffix(route, "/")
+		routed[method+" "+route] = true
+		if (strings.HasPrefix(route, "/api/v1/") || documented[method+" "+route]) && !spec.Has(method, route) {
+			t.Errorf("%s %s is missing from the OpenAPI document", method, route)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range spec.Routes() {
+		if !routed[r.Method+" "+r.Path] {
+			t.Errorf("the OpenAPI document describes %s %s, which has no route", r.Method, r.Path)
+		}
+	}
+
+	// the document is served without an API key
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"openapi":"3.0.3"`) {
+		t.Errorf("expected the OpenAPI document, got %d", rr.Code)
+	}
+}
+
+func TestRoutes_ReservationActionsArePost(t *testing.T) {
+	mux := Routes(&app)
+
+	// the session cookie of an owner, so that the request gets past Auth and Require
+	ctx, err := session.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Put(ctx, "user_id", int(models.RoleOwner))
+	token, _, err := session.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/admin/process-reservation/new/1/do", "/admin/delete-reservation/new/1/do"} {
+		req := httptest.NewRequest("GET", target, nil)
+		req.AddCookie(&http.Cookie{Name: session.Cookie.Name, Value: token})
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s: expected %d, got %d", target, http.StatusMethodNotAllowed, rr.Code)
+		}
+
+		// and a POST without the CSRF token of the form is refused too
+		req = httptest.NewRequest("POST", target, nil)
+		req.AddCookie(&http.Cookie{Name: session.Cookie.Name, Value: token})
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("POST %s without a CSRF token: expected %d, got %d", target, http.StatusBadRequest, rr.Code)
+		}
+	}
+}
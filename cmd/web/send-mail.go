@@ -1,62 +1,199 @@
 package main
 
 import (
-	"fmt"
-	"log"
-	"os"
-	"strings"
+	"context"
+	"sync"
 	"time"
 
+	"github.com/mrkouhadi/go-booking-app/internal/mailer"
 	"github.com/mrkouhadi/go-booking-app/internal/models"
-	mail "github.com/xhit/go-simple-mail/v2"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
 )
 
-func listenForMail() {
+// mailQueueSize is how many messages can wait for the mail listener before handlers block
+const mailQueueSize = 100
+
+// mailBatchSize is how many emails a worker claims from the outbox at once
+const mailBatchSize = 10
+
+// mailLease is how long a worker has to send the emails it claimed. Emails still marked as sending
+// after that, e.g. because the app was killed, are handed to another worker.
+const mailLease = 5 * time.Minute
+
+// mailSender delivers the email, it's picked by the mail.transport setting
+var mailSender mailer.Mailer
+
+// mailStop asks the mail listener and workers to stop, mailDone is closed once they all have.
+// mailWake tells the workers there is new mail without waiting for the next poll.
+var mailStop chan struct{}
+var mailDone chan struct{}
+var mailWake chan struct{}
+
+// listenForMail stores the messages put on app.MailChan in the outbox and starts the workers delivering it
+func listenForMail(db repository.DatabaseRepo) {
+	mailStop = make(chan struct{})
+	mailDone = make(chan struct{})
+	mailWake = make(chan struct{}, 1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
 	// an anonymous function that runs in the background
 	go func() {
+		defer wg.Done()
 		for {
-			msg := <-app.MailChan
-			sendMsg(msg)
+			select {
+			case msg := <-app.MailChan:
+				queueMail(db, msg)
+			case <-mailStop:
+				// store whatever is still queued before giving up, the next start sends it
+				for {
+					select {
+					case msg := <-app.MailChan:
+						queueMail(db, msg)
+					default:
+						return
+					}
+				}
+			}
 		}
 	}()
+
+	for i := 0; i < app.Mail.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mailWorker(db)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(mailDone)
+	}()
 }
 
-func sendMsg(msg models.MailData) {
+// stopMail stops the mail listener and workers and waits until the queued messages are stored or ctx is done
+func stopMail(ctx context.Context) error {
+	close(mailStop)
+	select {
+	case <-mailDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	server := mail.NewSMTPClient()
-	server.Host = "localhost"
-	server.Port = 1025
-	server.KeepAlive = false
-	server.ConnectTimeout = 10 * time.Second
-	server.SendTimeout = 10 * time.Second
+// queueMail puts a message in the outbox and wakes up a worker. When the outbox can't be reached
+// the message is sent right away, as it was before there was an outbox.
+func queueMail(db repository.DatabaseRepo, msg models.MailData) {
+	if _, err := db.InsertMail(context.Background(), msg); err != nil {
+		errorLog.Println("cannot store mail in the outbox, sending it now:", err)
+		if err := sendMsg(msg); err != nil {
+			errorLog.Println("mail to", msg.To, "is lost:", err)
+		}
+		return
+	}
+	select {
+	case mailWake <- struct{}{}:
+	default:
+		// a wake-up is already pending
+	}
+}
 
-	client, err := server.Connect()
-	if err != nil {
-		errorLog.Println(err)
+// mailWorker delivers the outbox until the mail is stopped
+func mailWorker(db repository.DatabaseRepo) {
+	ticker := time.NewTicker(app.Mail.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		deliverOutbox(db)
+		select {
+		case <-mailStop:
+			return
+		case <-mailWake:
+		case <-ticker.C:
+		}
 	}
+}
 
-	email := mail.NewMSG()
-	email.SetFrom(msg.From).AddTo(msg.To).SetSubject(msg.Subject)
-	// we haven't specified the template do this
-	if msg.Template == "" {
-		email.SetBody(mail.TextHTML, msg.Content)
-	} else {
-		// otherwise get the specified template from disk
-		data, err := os.ReadFile(fmt.Sprintf("./email-templates/%s", msg.Template))
+// deliverOutbox sends the emails that are due, batch by batch, until there are none left
+func deliverOutbox(db repository.DatabaseRepo) {
+	for {
+		mails, err := db.ClaimMail(context.Background(), mailBatchSize, mailLease)
 		if err != nil {
-			app.ErrorLog.Println(err)
+			errorLog.Println("cannot read the mail outbox:", err)
+			return
+		}
+		if len(mails) == 0 {
+			return
+		}
+		for _, m := range mails {
+			deliverOutboxMail(db, m)
+		}
+
+		select {
+		case <-mailStop:
+			return
+		default:
 		}
-		// since data is of type array of bytes ([]bytes) we need to convert it
-		mailTmpl := string(data)
-		//args:  string to be replace in, txt to be replaced, content, how many times
-		msgToSend := strings.Replace(mailTmpl, "[%body%]", msg.Content, 1)
-		email.SetBody(mail.TextHTML, msgToSend)
 	}
+}
 
-	err = email.Send(client)
-	if err != nil {
-		log.Println(err)
+// deliverOutboxMail sends a claimed email and records the outcome. A failed email is retried later,
+// waiting longer after every attempt, until it has failed app.Mail.MaxAttempts times and is dead.
+func deliverOutboxMail(db repository.DatabaseRepo, m models.OutboxMail) {
+	ctx := context.Background()
+
+	err := sendMsg(m.MailData)
+	if err == nil {
+		if err := db.MarkMailSent(ctx, m.ID); err != nil {
+			errorLog.Println(err)
+		}
+		return
+	}
+
+	dead := m.Attempts >= app.Mail.MaxAttempts
+	if dead {
+		errorLog.Printf("giving up on mail %d to %s after %d attempts: %s", m.ID, m.To, m.Attempts, err)
 	} else {
-		log.Println("EMAIL HAS BEEN SENT SUCCESFULLY")
+		errorLog.Printf("cannot send mail %d to %s (attempt %d): %s", m.ID, m.To, m.Attempts, err)
+	}
+	err = db.MarkMailFailed(ctx, m.ID, err.Error(), time.Now().Add(retryDelay(m.Attempts)), dead)
+	if err != nil {
+		errorLog.Println(err)
+	}
+}
+
+// retryDelay returns how long to wait after the given number of failed attempts:
+// app.Mail.RetryBase after the first one, doubled after every other one, up to app.Mail.RetryMax
+func retryDelay(attempts int) time.Duration {
+	return backoff(attempts, app.Mail.RetryBase, app.Mail.RetryMax)
+}
+
+// backoff returns base after the first failed attempt, doubled after every other one, up to max
+func backoff(attempts int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// sendMsg sends msg through mailSender
+func sendMsg(msg models.MailData) error {
+	var attachments []mailer.Attachment
+	for _, a := range msg.Attachments {
+		attachments = append(attachments, mailer.Attachment{Name: a.Name, ContentType: a.ContentType, Data: a.Data})
 	}
+	return mailSender.Send(context.Background(), mailer.Message{
+		From:        msg.From,
+		To:          msg.To,
+		Subject:     msg.Subject,
+		HTML:        msg.Content,
+		Text:        msg.Text,
+		Attachments: attachments,
+	})
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/mailer"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
+	"github.com/mrkouhadi/go-booking-app/internal/repository/dbrepo"
+)
+
+// setupMailTest points the mail workers at an in-memory outbox and an in-memory mailer
+func setupMailTest(t *testing.T) (repository.DatabaseRepo, *mailer.Memory) {
+	errorLog = log.New(io.Discard, "", 0)
+	app.MailChan = make(chan models.MailData, mailQueueSize)
+	app.Mail.Workers = 2
+	app.Mail.MaxAttempts = 3
+	app.Mail.RetryBase = time.Millisecond
+	app.Mail.RetryMax = 2 * time.Millisecond
+	app.Mail.PollInterval = 5 * time.Millisecond
+
+	sender := mailer.NewMemory()
+	mailSender = sender
+	return dbrepo.NewTestingRepo(&app), sender
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func stopMailTest(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := stopMail(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMailIsDeliveredFromTheOutbox(t *testing.T) {
+	db, sender := setupMailTest(t)
+
+	listenForMail(db)
+	app.MailChan <- models.MailData{To: "one@example.com", Subject: "Hello", Content: "<p>hi</p>"}
+	app.MailChan <- models.MailData{To: "two@example.com"}
+	app.MailChan <- models.MailData{To: "three@example.com"}
+
+	waitFor(t, "3 messages to be sent", func() bool {
+		return len(sender.Sent()) == 3
+	})
+	stopMailTest(t)
+
+	for _, msg := range sender.Sent() {
+		if msg.To == "one@example.com" && (msg.Subject != "Hello" || msg.HTML != "<p>hi</p>") {
+			t.Errorf("the message was not sent as it was queued: %+v", msg)
+		}
+	}
+}
+
+func TestStopMailStoresQueue(t *testing.T) {
+	db, sender := setupMailTest(t)
+
+	app.MailChan <- models.MailData{To: "one@example.com"}
+	app.MailChan <- models.MailData{To: "two@example.com"}
+	app.MailChan <- models.MailData{To: "three@example.com"}
+
+	listenForMail(db)
+	stopMailTest(t)
+
+	if len(app.MailChan) != 0 {
+		t.Errorf("expected the queue to be empty after the shutdown, %d messages are left", len(app.MailChan))
+	}
+	// whatever hasn't been sent before the workers stopped waits in the outbox
+	left, err := db.ClaimMail(context.Background(), 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := len(sender.Sent()); sent+len(left) != 3 {
+		t.Errorf("expected the 3 queued messages to be sent or stored, got %d sent and %d stored", sent, len(left))
+	}
+}
+
+func TestFailingMailIsRetriedThenDead(t *testing.T) {
+	db, sender := setupMailTest(t)
+	sender.Fail(errors.New("smtp is down"))
+
+	listenForMail(db)
+	app.MailChan <- models.MailData{To: "guest@example.com"}
+
+	waitFor(t, "the mail to be dead", func() bool {
+		failed, err := db.AllFailedMail(context.Background())
+		return err == nil && len(failed) == 1 && failed[0].Status == models.MailDead
+	})
+	stopMailTest(t)
+
+	failed, _ := db.AllFailedMail(context.Background())
+	if failed[0].Attempts != app.Mail.MaxAttempts {
+		t.Errorf("expected %d attempts, got %d", app.Mail.MaxAttempts, failed[0].Attempts)
+	}
+	if failed[0].LastError != "smtp is down" {
+		t.Errorf("expected the last error to be stored, got %q", failed[0].LastError)
+	}
+}
+
+func TestMailIsSentDirectlyWhenTheOutboxFails(t *testing.T) {
+	db, sender := setupMailTest(t)
+
+	listenForMail(db)
+	// the test repo can't store mail to this address
+	app.MailChan <- models.MailData{To: "fail@example.com"}
+	stopMailTest(t)
+
+	if len(sender.Sent()) != 1 {
+		t.Errorf("expected the message to be sent directly, got %d sent", len(sender.Sent()))
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	app.Mail.RetryBase = 30 * time.Second
+	app.Mail.RetryMax = 5 * time.Minute
+
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{5, 5 * time.Minute},
+		{50, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		if d := retryDelay(tt.attempts); d != tt.expected {
+			t.Errorf("after %d attempts: expected %s, got %s", tt.attempts, tt.expected, d)
+		}
+	}
+}
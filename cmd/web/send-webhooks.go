@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
+	"github.com/mrkouhadi/go-booking-app/internal/webhook"
+)
+
+// webhookBatchSize is how many deliveries a worker claims at once
+const webhookBatchSize = 10
+
+// webhookLease is how long a worker has to send the deliveries it claimed before they are handed
+// to another worker, it has to be longer than webhookBatchSize times app.Webhook.Timeout
+const webhookLease = 5 * time.Minute
+
+// webhookStop asks the webhook workers to stop, webhookDone is closed once they all have
+var webhookStop chan struct{}
+var webhookDone chan struct{}
+
+// listenForWebhooks starts the workers delivering the webhooks the handlers queue in the database
+func listenForWebhooks(db repository.DatabaseRepo) {
+	webhookStop = make(chan struct{})
+	webhookDone = make(chan struct{})
+	client := &http.Client{Timeout: app.Webhook.Timeout}
+
+	var wg sync.WaitGroup
+	for i := 0; i < app.Webhook.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			webhookWorker(db, client)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(webhookDone)
+	}()
+}
+
+// stopWebhooks stops the webhook workers and waits until the deliveries they are sending are done or ctx is.
+// Whatever hasn't been sent stays queued for the next start.
+func stopWebhooks(ctx context.Context) error {
+	close(webhookStop)
+	select {
+	case <-webhookDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// webhookWorker delivers the queued webhooks until the webhooks are stopped
+func webhookWorker(db repository.DatabaseRepo, client *http.Client) {
+	ticker := time.NewTicker(app.Webhook.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		deliverWebhooks(db, client)
+		select {
+		case <-webhookStop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverWebhooks sends the deliveries that are due, batch by batch, until there are none left
+func deliverWebhooks(db repository.DatabaseRepo, client *http.Client) {
+	for {
+		deliveries, err := db.ClaimWebhooks(context.Background(), webhookBatchSize, webhookLease)
+		if err != nil {
+			errorLog.Println("cannot read the webhook deliveries:", err)
+			return
+		}
+		if len(deliveries) == 0 {
+			return
+		}
+		for _, d := range deliveries {
+			deliverWebhook(db, client, d)
+		}
+
+		select {
+		case <-webhookStop:
+			return
+		default:
+		}
+	}
+}
+
+// deliverWebhook sends a claimed delivery and records the outcome. A failed delivery is retried later,
+// waiting longer after every attempt, until it has failed app.Webhook.MaxAttempts times and is dead.
+func deliverWebhook(db repository.DatabaseRepo, client *http.Client, d models.WebhookDelivery) {
+	ctx := context.Background()
+
+	status, err := webhook.Send(ctx, client, d)
+	if err == nil {
+		if err := db.MarkWebhookDelivered(ctx, d.ID, status); err != nil {
+			errorLog.Println(err)
+		}
+		return
+	}
+
+	dead := d.Attempts >= app.Webhook.MaxAttempts
+	if dead {
+		errorLog.Printf("giving up on webhook %d to %s after %d attempts: %s", d.ID, d.URL, d.Attempts, err)
+	} else {
+		errorLog.Printf("cannot deliver webhook %d to %s (attempt %d): %s", d.ID, d.URL, d.Attempts, err)
+	}
+	retryAt := time.Now().Add(backoff(d.Attempts, app.Webhook.RetryBase, app.Webhook.RetryMax))
+	if err := db.MarkWebhookFailed(ctx, d.ID, status, err.Error(), retryAt, dead); err != nil {
+		errorLog.Println(err)
+	}
+}
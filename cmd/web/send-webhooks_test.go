@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
+	"github.com/mrkouhadi/go-booking-app/internal/repository/dbrepo"
+	"github.com/mrkouhadi/go-booking-app/internal/webhook"
+)
+
+// receiver stands in for the accounting system: it records what it's sent and answers with status
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	received []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.received = append(rc.received, r)
+	rc.bodies = append(rc.bodies, body)
+	w.WriteHeader(rc.status)
+}
+
+func (rc *receiver) count() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.received)
+}
+
+// setupWebhookTest points the webhook workers at a test repository with a single endpoint, served by
+// a local receiver answering with status
+func setupWebhookTest(t *testing.T, status int) (repository.DatabaseRepo, *receiver) {
+	errorLog = log.New(io.Discard, "", 0)
+	app.Webhook.Workers = 2
+	app.Webhook.Timeout = time.Second
+	app.Webhook.MaxAttempts = 3
+	app.Webhook.RetryBase = time.Millisecond
+	app.Webhook.RetryMax = 2 * time.Millisecond
+	app.Webhook.PollInterval = 5 * time.Millisecond
+
+	rc := &receiver{status: status}
+	srv := httptest.NewServer(rc)
+	t.Cleanup(srv.Close)
+
+	db := dbrepo.NewTestingRepo(&app)
+	ctx := context.Background()
+	if err := db.DeleteWebhookEndpoint(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.InsertWebhookEndpoint(ctx, models.WebhookEndpoint{
+		URL:    srv.URL,
+		Secret: "secret",
+		Events: []models.WebhookEvent{models.EventReservationCreated},
+		Active: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, rc
+}
+
+func stopWebhooksTest(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := stopWebhooks(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookIsDeliveredAndSigned(t *testing.T) {
+	db, rc := setupWebhookTest(t, http.StatusOK)
+
+	listenForWebhooks(db)
+	payload := []byte(`{"event":"reservation.created"}`)
+	if n, _ := db.QueueWebhook(context.Background(), models.EventReservationCreated, payload); n != 1 {
+		t.Fatalf("expected the delivery to be queued for the endpoint, got %d", n)
+	}
+	// the endpoint isn't subscribed to deletions
+	if n, _ := db.QueueWebhook(context.Background(), models.EventReservationDeleted, payload); n != 0 {
+		t.Errorf("expected no delivery for an event the endpoint isn't subscribed to, got %d", n)
+	}
+
+	waitFor(t, "the webhook to be received", func() bool {
+		return rc.count() == 1
+	})
+	stopWebhooksTest(t)
+
+	r := rc.received[0]
+	if r.Header.Get(webhook.EventHeader) != "reservation.created" || string(rc.bodies[0]) != string(payload) {
+		t.Errorf("unexpected delivery %v %s", r.Header, rc.bodies[0])
+	}
+	if err := webhook.Verify("secret", r.Header.Get(webhook.SignatureHeader), rc.bodies[0], time.Now(), time.Minute); err != nil {
+		t.Errorf("expected a valid signature, got %v", err)
+	}
+
+	deliveries, _ := db.RecentWebhookDeliveries(context.Background(), 10)
+	if len(deliveries) != 1 || deliveries[0].Status != models.WebhookDelivered || deliveries[0].ResponseStatus != http.StatusOK {
+		t.Errorf("expected the delivery to be logged as delivered, got %+v", deliveries)
+	}
+}
+
+func TestFailingWebhookIsRetriedThenDead(t *testing.T) {
+	db, rc := setupWebhookTest(t, http.StatusInternalServerError)
+
+	listenForWebhooks(db)
+	if _, err := db.QueueWebhook(context.Background(), models.EventReservationCreated, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the webhook to be dead", func() bool {
+		deliveries, err := db.RecentWebhookDeliveries(context.Background(), 10)
+		return err == nil && len(deliveries) == 1 && deliveries[0].Status == models.WebhookDead
+	})
+	stopWebhooksTest(t)
+
+	deliveries, _ := db.RecentWebhookDeliveries(context.Background(), 10)
+	d := deliveries[0]
+	if d.Attempts != app.Webhook.MaxAttempts || rc.count() != app.Webhook.MaxAttempts {
+		t.Errorf("expected %d attempts, got %d logged and %d received", app.Webhook.MaxAttempts, d.Attempts, rc.count())
+	}
+	if d.ResponseStatus != http.StatusInternalServerError || d.LastError == "" {
+		t.Errorf("expected the answer of the endpoint to be logged, got %d %q", d.ResponseStatus, d.LastError)
+	}
+
+	// once the endpoint is back, a manual redelivery goes through
+	rc.mu.Lock()
+	rc.status = http.StatusAccepted
+	rc.mu.Unlock()
+	if err := db.RedeliverWebhook(context.Background(), d.ID); err != nil {
+		t.Fatal(err)
+	}
+	listenForWebhooks(db)
+	waitFor(t, "the webhook to be redelivered", func() bool {
+		deliveries, err := db.RecentWebhookDeliveries(context.Background(), 10)
+		return err == nil && deliveries[0].Status == models.WebhookDelivered
+	})
+	stopWebhooksTest(t)
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 6 * time.Minute},
+		{50, 6 * time.Minute},
+	}
+	for _, tt := range tests {
+		if d := backoff(tt.attempts, 30*time.Second, 6*time.Minute); d != tt.expected {
+			t.Errorf("after %d attempts: expected %s, got %s", tt.attempts, tt.expected, d)
+		}
+	}
+}
@@ -1,12 +1,27 @@
 package main
 
 import (
+	"io"
+	"log"
 	"net/http"
 	"os"
 	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/mrkouhadi/go-booking-app/internal/handlers"
+	"github.com/mrkouhadi/go-booking-app/internal/helpers"
 )
 
 func TestMain(m *testing.M) {
+	infoLog = log.New(io.Discard, "", 0)
+	errorLog = log.New(io.Discard, "", 0)
+	app.InfoLog = infoLog
+	app.ErrorLog = errorLog
+
+	session = scs.New()
+	app.Session = session
+	helpers.Newhelpers(&app)
+	handlers.NewHandlers(handlers.NewTestRepo(&app))
 
 	os.Exit(m.Run())
 }
@@ -1,10 +1,12 @@
 package config
 
 import (
+	"html/template"
 	"log"
-	"text/template"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/mrkouhadi/go-booking-app/internal/emails"
 	"github.com/mrkouhadi/go-booking-app/internal/models"
 )
 
@@ -17,4 +19,112 @@ type AppConfig struct {
 	InfoLog       *log.Logger
 	ErrorLog      *log.Logger
 	MailChan      chan models.MailData
+	Emails        *emails.Templates
+
+	// the settings below are filled by Load at startup
+	Addr            string        // address the web server listens on, e.g. ":8080"
+	BaseURL         string        // where the app is reached from outside, used in the links of emails
+	Currency        string        // ISO 4217 code of the room rates and the totals of new reservations, e.g. "USD"
+	ShutdownTimeout time.Duration // how long a shutdown waits for requests and queued mail
+	SessionLifetime time.Duration
+	SessionStore    string        // where the sessions are kept: "memory" or "postgres" (survives restarts, shared by every instance)
+	SessionCleanup  time.Duration // how often the expired sessions are deleted from postgres
+	CookieSecure    bool          // only send the session and csrf cookies over https
+	DB              DBConfig
+	SMTP            SMTPConfig
+	Mail            MailConfig
+	Webhook         WebhookConfig
+	Login           LoginConfig
+	Property        PropertyConfig
+	Invoice         InvoiceConfig
+}
+
+// DBConfig holds the database connection settings
+type DBConfig struct {
+	DSN             string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// QueryTimeout is the deadline of a single database query, on top of the request's own context
+	QueryTimeout time.Duration
+}
+
+// SMTPConfig holds the settings of the mail server
+type SMTPConfig struct {
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	Encryption string        // "none", "starttls" or "tls" (implicit TLS, usually on port 465)
+	Auth       string        // "plain", "login" or "none"
+	PoolSize   int           // idle connections kept open between emails, 0 opens one per email
+	Timeout    time.Duration // deadline to connect and to send a single email
+	DKIM       DKIMConfig
+}
+
+// DKIMConfig holds the key emails are signed with. Signing is off when the key file isn't set.
+type DKIMConfig struct {
+	Domain         string
+	Selector       string
+	PrivateKeyFile string // PEM encoded RSA key
+}
+
+// MailConfig holds the settings of the mail workers delivering the outbox
+type MailConfig struct {
+	Transport    string        // "smtp", "file" (one .eml file per email in Dir) or "stdout"
+	Dir          string        // directory of the file transport
+	From         string        // sender of the emails to guests
+	Owner        string        // address notified of new reservations
+	Workers      int           // number of goroutines sending mail
+	MaxAttempts  int           // attempts before an email is dead-lettered
+	RetryBase    time.Duration // wait after the first failure, doubled after every other one
+	RetryMax     time.Duration // longest wait between two attempts
+	PollInterval time.Duration // how often the workers look for new mail
+}
+
+// WebhookConfig holds the settings of the workers delivering the webhooks to their endpoints
+type WebhookConfig struct {
+	Workers      int           // number of goroutines delivering webhooks
+	Timeout      time.Duration // how long an endpoint has to answer
+	MaxAttempts  int           // attempts before a delivery is dead-lettered
+	RetryBase    time.Duration // wait after the first failure, doubled after every other one
+	RetryMax     time.Duration // longest wait between two attempts
+	PollInterval time.Duration // how often the workers look for new deliveries
+}
+
+// PropertyConfig describes the property issuing the invoices
+type PropertyConfig struct {
+	Name    string
+	Address string // printed under the name, a comma starts a new line
+	TaxID   string // VAT or tax registration number, left out of the invoices when empty
+}
+
+// InvoiceConfig holds the settings of the invoices issued with the reservations
+type InvoiceConfig struct {
+	Prefix string // put before the number of every invoice, e.g. "INV-" makes INV-000042
+	Attach bool   // attach the invoice, as a PDF, to the confirmation email
+}
+
+// LoginConfig holds the brute-force protection of the login form
+type LoginConfig struct {
+	Store           string        // where the rate limits are counted: "memory" or "postgres" (shared by every instance)
+	IPLimit         int           // login attempts allowed from an IP address per Window
+	AccountLimit    int           // login attempts allowed on an email address per Window
+	Window          time.Duration // period the rate limits are counted over
+	LockoutAfter    int           // failed logins in a row that lock an account
+	LockoutDuration time.Duration // how long an account stays locked
+	DelayBase       time.Duration // wait after the second failed attempt, doubled after every other one
+	DelayMax        time.Duration // longest wait after a failed attempt
+	ResetTTL        time.Duration // how long an emailed password reset link works
+	TwoFactorRoles  []models.Role // roles that can't use the admin until they have set up two-factor authentication
+}
+
+// RequiresTwoFactor reports whether users with role r must log in with two-factor authentication
+func (c LoginConfig) RequiresTwoFactor(r models.Role) bool {
+	for _, required := range c.TwoFactorRoles {
+		if required == r {
+			return true
+		}
+	}
+	return false
 }
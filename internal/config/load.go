@@ -0,0 +1,447 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is put in front of every environment variable the app reads
+const envPrefix = "BOOKINGS_"
+
+// setting is a single configurable value. It can come from the config file under key (e.g. "db.dsn"),
+// from the environment as BOOKINGS_DB_DSN or from the command line as -db-dsn
+type setting struct {
+	key    string
+	usage  string
+	isBool bool
+	set    func(value string) error
+}
+
+// envName returns the environment variable of the setting
+func (s setting) envName() string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(s.key, ".", "_"))
+}
+
+// flagName returns the command-line flag of the setting
+func (s setting) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.key)
+}
+
+// settings lists everything that can be configured, pointing at the fields of app they fill
+func settings(app *AppConfig) []setting {
+	return []setting{
+		stringSetting("addr", "address the web server listens on", &app.Addr),
+		stringSetting("base_url", "where the app is reached from outside, e.g. https://bookings.example.com, used in the links of emails", &app.BaseURL),
+		stringSetting("currency", "ISO 4217 code of the room rates, e.g. USD, frozen onto every new reservation", &app.Currency),
+		durationSetting("shutdown_timeout", "how long a shutdown waits for in-flight requests and queued mail", &app.ShutdownTimeout),
+		boolSetting("in_production", "run in production mode", &app.InProduction),
+		boolSetting("use_cache", "use the template cache instead of reading templates on every request (defaults to in_production)", &app.UseCache),
+
+		stringSetting("db.dsn", "postgres connection string, e.g. \"host=localhost port=5432 dbname=bookings user=postgres\"", &app.DB.DSN),
+		intSetting("db.max_open_conns", "maximum number of open database connections", &app.DB.MaxOpenConns),
+		intSetting("db.max_idle_conns", "maximum number of idle database connections", &app.DB.MaxIdleConns),
+		durationSetting("db.conn_max_lifetime", "maximum amount of time a database connection may be reused", &app.DB.ConnMaxLifetime),
+		durationSetting("db.query_timeout", "deadline of a single database query", &app.DB.QueryTimeout),
+
+		stringSetting("smtp.host", "host of the mail server", &app.SMTP.Host),
+		intSetting("smtp.port", "port of the mail server", &app.SMTP.Port),
+		stringSetting("smtp.username", "user name for the mail server", &app.SMTP.Username),
+		stringSetting("smtp.password", "password for the mail server", &app.SMTP.Password),
+		stringSetting("smtp.encryption", "none, starttls or tls", &app.SMTP.Encryption),
+		stringSetting("smtp.auth", "authentication mechanism: plain, login or none", &app.SMTP.Auth),
+		intSetting("smtp.pool_size", "idle connections kept open to the mail server, 0 opens one per email", &app.SMTP.PoolSize),
+		durationSetting("smtp.timeout", "deadline to connect to the mail server and to send an email", &app.SMTP.Timeout),
+		stringSetting("smtp.dkim.domain", "domain emails are signed for", &app.SMTP.DKIM.Domain),
+		stringSetting("smtp.dkim.selector", "DNS selector of the DKIM key", &app.SMTP.DKIM.Selector),
+		stringSetting("smtp.dkim.private_key_file", "PEM file of the RSA key emails are signed with, signing is off when empty", &app.SMTP.DKIM.PrivateKeyFile),
+
+		stringSetting("mail.transport", "how email is sent: smtp, file or stdout", &app.Mail.Transport),
+		stringSetting("mail.dir", "directory the file transport writes emails to", &app.Mail.Dir),
+		stringSetting("mail.from", "sender of the emails to guests", &app.Mail.From),
+		stringSetting("mail.owner", "address notified of new reservations", &app.Mail.Owner),
+
+		intSetting("mail.workers", "number of workers delivering mail from the outbox", &app.Mail.Workers),
+		intSetting("mail.max_attempts", "attempts before an email is marked as dead", &app.Mail.MaxAttempts),
+		durationSetting("mail.retry_base", "wait after the first failed attempt, doubled after every other one", &app.Mail.RetryBase),
+		durationSetting("mail.retry_max", "longest wait between two attempts", &app.Mail.RetryMax),
+		durationSetting("mail.poll_interval", "how often the mail workers look for new mail", &app.Mail.PollInterval),
+
+		intSetting("webhook.workers", "number of workers delivering webhooks", &app.Webhook.Workers),
+		durationSetting("webhook.timeout", "how long a webhook endpoint has to answer", &app.Webhook.Timeout),
+		intSetting("webhook.max_attempts", "attempts before a webhook delivery is marked as dead", &app.Webhook.MaxAttempts),
+		durationSetting("webhook.retry_base", "wait after the first failed delivery, doubled after every other one", &app.Webhook.RetryBase),
+		durationSetting("webhook.retry_max", "longest wait between two deliveries", &app.Webhook.RetryMax),
+		durationSetting("webhook.poll_interval", "how often the webhook workers look for new deliveries", &app.Webhook.PollInterval),
+
+		stringSetting("property.name", "name of the property, printed on the invoices", &app.Property.Name),
+		stringSetting("property.address", "address of the property printed on the invoices, a comma starts a new line", &app.Property.Address),
+		stringSetting("property.tax_id", "VAT or tax registration number printed on the invoices", &app.Property.TaxID),
+		stringSetting("invoice.prefix", "put before the number of every invoice, e.g. INV-", &app.Invoice.Prefix),
+		boolSetting("invoice.attach", "attach the invoice as a PDF to the confirmation email", &app.Invoice.Attach),
+
+		stringSetting("login.store", "where login rate limits are counted: memory or postgres (shared by every instance)", &app.Login.Store),
+		intSetting("login.ip_limit", "login attempts allowed from an IP address per login.window", &app.Login.IPLimit),
+		intSetting("login.account_limit", "login attempts allowed on an email address per login.window", &app.Login.AccountLimit),
+		durationSetting("login.window", "period login attempts are counted over", &app.Login.Window),
+		intSetting("login.lockout_after", "failed logins in a row that lock an account", &app.Login.LockoutAfter),
+		durationSetting("login.lockout_duration", "how long an account stays locked", &app.Login.LockoutDuration),
+		durationSetting("login.delay_base", "wait after the second failed login, doubled after every other one", &app.Login.DelayBase),
+		durationSetting("login.delay_max", "longest wait after a failed login", &app.Login.DelayMax),
+		durationSetting("login.reset_ttl", "how long an emailed password reset link works", &app.Login.ResetTTL),
+		rolesSetting("login.two_factor_roles", "comma separated roles that must use two-factor authentication, e.g. manager,owner", &app.Login.TwoFactorRoles),
+
+		durationSetting("session.lifetime", "how long a session lasts", &app.SessionLifetime),
+		stringSetting("session.store", "where the sessions are kept: memory or postgres (defaults to postgres in_production)", &app.SessionStore),
+		durationSetting("session.cleanup_interval", "how often the expired sessions are deleted from postgres", &app.SessionCleanup),
+		boolSetting("session.cookie_secure", "only send cookies over https (defaults to in_production)", &app.CookieSecure),
+	}
+}
+
+func stringSetting(key, usage string, p *string) setting {
+	return setting{key: key, usage: usage, set: func(v string) error {
+		*p = v
+		return nil
+	}}
+}
+
+func intSetting(key, usage string, p *int) setting {
+	return setting{key: key, usage: usage, set: func(v string) error {
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", v)
+		}
+		*p = i
+		return nil
+	}}
+}
+
+func boolSetting(key, usage string, p *bool) setting {
+	return setting{key: key, usage: usage, isBool: true, set: func(v string) error {
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", v)
+		}
+		*p = b
+		return nil
+	}}
+}
+
+func durationSetting(key, usage string, p *time.Duration) setting {
+	return setting{key: key, usage: usage, set: func(v string) error {
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like 30s, 5m or 24h", v)
+		}
+		*p = d
+		return nil
+	}}
+}
+
+func rolesSetting(key, usage string, p *[]models.Role) setting {
+	return setting{key: key, usage: usage, set: func(v string) error {
+		var roles []models.Role
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			r, ok := models.ParseRole(name)
+			if !ok {
+				return fmt.Errorf("%q is not a role, use read-only, front-desk, manager or owner", name)
+			}
+			roles = append(roles, r)
+		}
+		*p = roles
+		return nil
+	}}
+}
+
+// setDefaults puts the values used for anything that isn't configured
+func setDefaults(app *AppConfig) {
+	app.Addr = ":8080"
+	app.BaseURL = "http://localhost:8080"
+	app.Currency = "USD"
+	app.ShutdownTimeout = 30 * time.Second
+	app.DB.MaxOpenConns = 10
+	app.DB.MaxIdleConns = 5
+	app.DB.ConnMaxLifetime = 5 * time.Minute
+	app.DB.QueryTimeout = 3 * time.Second
+	app.SMTP.Host = "localhost"
+	app.SMTP.Port = 1025
+	app.SMTP.Encryption = "none"
+	app.SMTP.Auth = "plain"
+	app.SMTP.PoolSize = 2
+	app.SMTP.Timeout = 10 * time.Second
+	app.Mail.Transport = "smtp"
+	app.Mail.Dir = "tmp/mail"
+	app.Mail.From = "contact@bookingapp.com"
+	app.Mail.Workers = 2
+	app.Mail.MaxAttempts = 8
+	app.Mail.RetryBase = 30 * time.Second
+	app.Mail.RetryMax = time.Hour
+	app.Mail.PollInterval = 5 * time.Second
+	app.Webhook.Workers = 2
+	app.Webhook.Timeout = 10 * time.Second
+	app.Webhook.MaxAttempts = 10
+	app.Webhook.RetryBase = 30 * time.Second
+	app.Webhook.RetryMax = 6 * time.Hour
+	app.Webhook.PollInterval = 5 * time.Second
+	app.Property.Name = "Fort Smythe Bed and Breakfast"
+	app.Invoice.Prefix = "INV-"
+	app.Invoice.Attach = true
+	app.Login.Store = "memory"
+	app.Login.IPLimit = 20
+	app.Login.AccountLimit = 10
+	app.Login.Window = 15 * time.Minute
+	app.Login.LockoutAfter = 5
+	app.Login.LockoutDuration = 15 * time.Minute
+	app.Login.DelayBase = 500 * time.Millisecond
+	app.Login.DelayMax = 5 * time.Second
+	app.Login.ResetTTL = time.Hour
+	app.SessionLifetime = 24 * time.Hour
+	app.SessionStore = "memory"
+	app.SessionCleanup = 5 * time.Minute
+}
+
+// flagValue collects a command-line flag so that it can be applied after the file and the environment
+type flagValue struct {
+	s      setting
+	values map[string]string
+}
+
+func (f *flagValue) String() string { return "" }
+
+func (f *flagValue) Set(v string) error {
+	f.values[f.s.key] = v
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool { return f.s.isBool }
+
+// Load fills app from, in increasing order of priority: defaults, the optional YAML config file given by
+// -config or BOOKINGS_CONFIG, BOOKINGS_* environment variables and command-line flags.
+// It returns an error describing every missing or invalid value.
+func Load(app *AppConfig, args []string) error {
+	setDefaults(app)
+	all := settings(app)
+
+	fs := flag.NewFlagSet("bookings", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "path to a YAML config file")
+	fromFlags := map[string]string{}
+	for _, s := range all {
+		fs.Var(&flagValue{s: s, values: fromFlags}, s.flagName(), fmt.Sprintf("%s (env %s)", s.usage, s.envName()))
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	values := map[string]string{}
+	sources := map[string]string{}
+	if *configFile != "" {
+		fromFile, err := readFile(*configFile)
+		if err != nil {
+			return err
+		}
+		for k, v := range fromFile {
+			values[k] = v
+			sources[k] = *configFile
+		}
+	}
+	for _, s := range all {
+		if v, ok := os.LookupEnv(s.envName()); ok {
+			values[s.key] = v
+			sources[s.key] = s.envName()
+		}
+	}
+	for k, v := range fromFlags {
+		values[k] = v
+		sources[k] = "-" + settingByKey(all, k).flagName()
+	}
+
+	var problems []string
+	for k := range values {
+		if settingByKey(all, k).set == nil {
+			problems = append(problems, fmt.Sprintf("%s: unknown setting %q", sources[k], k))
+		}
+	}
+	for _, s := range all {
+		v, ok := values[s.key]
+		if !ok {
+			continue
+		}
+		if err := s.set(v); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (from %s): %s", s.key, sources[s.key], err))
+		}
+	}
+
+	// a production setup gets secure cookies and the template cache unless told otherwise
+	if _, ok := values["use_cache"]; !ok {
+		app.UseCache = app.InProduction
+	}
+	if _, ok := values["session.cookie_secure"]; !ok {
+		app.CookieSecure = app.InProduction
+	}
+	if _, ok := values["session.store"]; !ok && app.InProduction {
+		app.SessionStore = "postgres"
+	}
+
+	problems = append(problems, validate(app)...)
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// settingByKey finds a setting by its config file key, returning the zero setting when there is none
+func settingByKey(all []setting, key string) setting {
+	for _, s := range all {
+		if s.key == key {
+			return s
+		}
+	}
+	return setting{}
+}
+
+// readFile reads a YAML config file and flattens it into dotted keys, e.g. db: {dsn: x} becomes "db.dsn"
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file: %w", err)
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("cannot parse config file %s: %w", path, err)
+	}
+	values := map[string]string{}
+	flatten("", doc, values)
+	return values, nil
+}
+
+func flatten(prefix string, doc map[string]interface{}, values map[string]string) {
+	for k, v := range doc {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flatten(key, v, values)
+		case []interface{}:
+			// lists are read like comma separated values
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case nil:
+			values[key] = ""
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+}
+
+// oneOf reports whether v is one of the allowed values
+func oneOf(v string, allowed ...string) bool {
+	for _, a := range allowed {
+		if v == a {
+			return true
+		}
+	}
+	return false
+}
+
+// validBaseURL reports whether u is an absolute http or https URL
+func validBaseURL(u string) bool {
+	parsed, err := url.Parse(u)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// validCurrency reports whether c looks like an ISO 4217 code: 3 capital letters
+func validCurrency(c string) bool {
+	if len(c) != 3 {
+		return false
+	}
+	for _, r := range c {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// maxInvoicePrefix is the longest invoice prefix, the numbers are stored in a column of 32 characters
+const maxInvoicePrefix = 20
+
+// validate returns a message for every setting that can't be used to start the app
+func validate(app *AppConfig) []string {
+	var problems []string
+	required := func(ok bool, key, msg string) {
+		if !ok {
+			s := setting{key: key}
+			problems = append(problems, fmt.Sprintf("%s: %s (set it in the config file, %s or -%s)", key, msg, s.envName(), s.flagName()))
+		}
+	}
+
+	required(app.Addr != "", "addr", "is required")
+	required(validBaseURL(app.BaseURL), "base_url", "must be an http or https URL")
+	required(validCurrency(app.Currency), "currency", "must be a 3 letter ISO 4217 code, e.g. USD")
+	required(app.ShutdownTimeout > 0, "shutdown_timeout", "must be longer than 0")
+	required(app.DB.DSN != "", "db.dsn", "is required")
+	required(app.DB.MaxOpenConns > 0, "db.max_open_conns", "must be at least 1")
+	required(app.DB.MaxIdleConns >= 0 && app.DB.MaxIdleConns <= app.DB.MaxOpenConns, "db.max_idle_conns", "must be between 0 and db.max_open_conns")
+	required(app.DB.ConnMaxLifetime >= 0, "db.conn_max_lifetime", "can't be negative")
+	required(app.DB.QueryTimeout > 0, "db.query_timeout", "must be longer than 0")
+	required(oneOf(app.Mail.Transport, "smtp", "file", "stdout"), "mail.transport", "must be smtp, file or stdout")
+	required(app.Mail.Transport != "file" || app.Mail.Dir != "", "mail.dir", "is required by the file transport")
+	required(app.Mail.From != "", "mail.from", "is required")
+	required(app.Mail.Owner != "", "mail.owner", "is required")
+	required(app.SMTP.Host != "", "smtp.host", "is required")
+	required(app.SMTP.Port > 0 && app.SMTP.Port < 65536, "smtp.port", "must be between 1 and 65535")
+	required(oneOf(app.SMTP.Encryption, "none", "starttls", "tls"), "smtp.encryption", "must be none, starttls or tls")
+	required(oneOf(app.SMTP.Auth, "plain", "login", "none"), "smtp.auth", "must be plain, login or none")
+	required(app.SMTP.PoolSize >= 0, "smtp.pool_size", "can't be negative")
+	required(app.SMTP.Timeout > 0, "smtp.timeout", "must be longer than 0")
+	dkim := app.SMTP.DKIM
+	required(dkim.PrivateKeyFile == "" || dkim.Domain != "", "smtp.dkim.domain", "is required to sign emails")
+	required(dkim.PrivateKeyFile == "" || dkim.Selector != "", "smtp.dkim.selector", "is required to sign emails")
+	required(app.Mail.Workers > 0, "mail.workers", "must be at least 1")
+	required(app.Mail.MaxAttempts > 0, "mail.max_attempts", "must be at least 1")
+	required(app.Mail.RetryBase > 0, "mail.retry_base", "must be longer than 0")
+	required(app.Mail.RetryMax >= app.Mail.RetryBase, "mail.retry_max", "can't be shorter than mail.retry_base")
+	required(app.Mail.PollInterval > 0, "mail.poll_interval", "must be longer than 0")
+	required(app.Webhook.Workers > 0, "webhook.workers", "must be at least 1")
+	required(app.Webhook.Timeout > 0, "webhook.timeout", "must be longer than 0")
+	required(app.Webhook.MaxAttempts > 0, "webhook.max_attempts", "must be at least 1")
+	required(app.Webhook.RetryBase > 0, "webhook.retry_base", "must be longer than 0")
+	required(app.Webhook.RetryMax >= app.Webhook.RetryBase, "webhook.retry_max", "can't be shorter than webhook.retry_base")
+	required(app.Webhook.PollInterval > 0, "webhook.poll_interval", "must be longer than 0")
+	required(app.Property.Name != "", "property.name", "is required")
+	required(len(app.Invoice.Prefix) <= maxInvoicePrefix, "invoice.prefix", fmt.Sprintf("can't be longer than %d characters", maxInvoicePrefix))
+	required(oneOf(app.Login.Store, "memory", "postgres"), "login.store", "must be memory or postgres")
+	required(app.Login.IPLimit > 0, "login.ip_limit", "must be at least 1")
+	required(app.Login.AccountLimit > 0, "login.account_limit", "must be at least 1")
+	required(app.Login.Window > 0, "login.window", "must be longer than 0")
+	required(app.Login.LockoutAfter > 0, "login.lockout_after", "must be at least 1")
+	required(app.Login.LockoutDuration > 0, "login.lockout_duration", "must be longer than 0")
+	required(app.Login.DelayBase >= 0, "login.delay_base", "can't be negative")
+	required(app.Login.DelayMax >= app.Login.DelayBase, "login.delay_max", "can't be shorter than login.delay_base")
+	required(app.Login.ResetTTL > 0, "login.reset_ttl", "must be longer than 0")
+	required(app.SessionLifetime > 0, "session.lifetime", "must be longer than 0")
+	required(oneOf(app.SessionStore, "memory", "postgres"), "session.store", "must be memory or postgres")
+	required(app.SessionCleanup > 0, "session.cleanup_interval", "must be longer than 0")
+	return problems
+}
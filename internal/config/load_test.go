@@ -0,0 +1,227 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+)
+
+func TestLoad_Defaults(t *testing.T) {
+	var app AppConfig
+	err := Load(&app, []string{"-db-dsn", "host=localhost dbname=bookings", "-mail-owner", "owner@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Addr != ":8080" {
+		t.Errorf("expected default addr :8080, got %s", app.Addr)
+	}
+	if app.DB.MaxOpenConns != 10 || app.DB.MaxIdleConns != 5 {
+		t.Errorf("expected default pool of 10/5, got %d/%d", app.DB.MaxOpenConns, app.DB.MaxIdleConns)
+	}
+	if app.SMTP.Host != "localhost" || app.SMTP.Port != 1025 {
+		t.Errorf("expected default smtp localhost:1025, got %s:%d", app.SMTP.Host, app.SMTP.Port)
+	}
+	if app.UseCache || app.CookieSecure {
+		t.Error("template cache and secure cookies should be off outside production")
+	}
+	if app.SessionStore != "memory" {
+		t.Errorf("expected sessions in memory outside production, got %s", app.SessionStore)
+	}
+	if app.Currency != "USD" {
+		t.Errorf("expected rates in USD by default, got %s", app.Currency)
+	}
+	if app.Invoice.Prefix != "INV-" || !app.Invoice.Attach {
+		t.Errorf("expected INV- invoices attached to the confirmation by default, got %+v", app.Invoice)
+	}
+}
+
+func TestLoad_Priority(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "bookings.yml")
+	content := `
+addr: ":9000"
+in_production: true
+db:
+  dsn: "host=file"
+  max_open_conns: 20
+mail:
+  owner: owner@example.com
+smtp:
+  host: smtp.example.com
+  port: 587
+session:
+  lifetime: 12h
+`
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BOOKINGS_CONFIG", file)
+	t.Setenv("BOOKINGS_DB_DSN", "host=env")
+	t.Setenv("BOOKINGS_SMTP_PORT", "2525")
+
+	var app AppConfig
+	err := Load(&app, []string{"-smtp-port", "465"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Addr != ":9000" {
+		t.Errorf("addr from the file was not used, got %s", app.Addr)
+	}
+	if app.DB.DSN != "host=env" {
+		t.Errorf("environment should win over the file, got dsn %s", app.DB.DSN)
+	}
+	if app.SMTP.Port != 465 {
+		t.Errorf("flags should win over the environment, got port %d", app.SMTP.Port)
+	}
+	if app.DB.MaxOpenConns != 20 {
+		t.Errorf("expected 20 open conns from the file, got %d", app.DB.MaxOpenConns)
+	}
+	if app.SessionLifetime != 12*time.Hour {
+		t.Errorf("expected a session lifetime of 12h, got %s", app.SessionLifetime)
+	}
+	if !app.UseCache || !app.CookieSecure {
+		t.Error("template cache and secure cookies should default to on in production")
+	}
+	if app.SessionStore != "postgres" {
+		t.Errorf("expected sessions in postgres in production, got %s", app.SessionStore)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	var app AppConfig
+	err := Load(&app, []string{"-smtp-port", "not-a-port", "-db-max-idle-conns", "50", "-session-store", "redis"})
+	if err == nil {
+		t.Fatal("expected an error for an invalid configuration")
+	}
+	for _, want := range []string{"db.dsn: is required", "BOOKINGS_DB_DSN", "smtp.port", "db.max_idle_conns", "session.store"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %q, got: %s", want, err)
+		}
+	}
+}
+
+func TestLoad_InvalidMail(t *testing.T) {
+	var app AppConfig
+	err := Load(&app, []string{
+		"-db-dsn", "host=localhost",
+		"-smtp-encryption", "ssl",
+		"-smtp-auth", "cram-md5",
+		"-smtp-dkim-private-key-file", "dkim.pem",
+		"-mail-transport", "pigeon",
+	})
+	if err == nil {
+		t.Fatal("expected an error for an invalid mail configuration")
+	}
+	for _, want := range []string{"smtp.encryption", "smtp.auth", "smtp.dkim.domain", "smtp.dkim.selector", "mail.transport"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %q, got: %s", want, err)
+		}
+	}
+}
+
+func TestLoad_InvalidCurrency(t *testing.T) {
+	for _, currency := range []string{"usd", "US", "DOLLAR", "$"} {
+		var app AppConfig
+		err := Load(&app, []string{"-db-dsn", "host=localhost", "-currency", currency})
+		if err == nil || !strings.Contains(err.Error(), "currency") {
+			t.Errorf("%q: expected an error about the currency, got %v", currency, err)
+		}
+	}
+}
+
+func TestLoad_InvalidInvoice(t *testing.T) {
+	var app AppConfig
+	err := Load(&app, []string{"-db-dsn", "host=localhost", "-property-name", "", "-invoice-prefix", strings.Repeat("X", 21)})
+	if err == nil || !strings.Contains(err.Error(), "property.name") || !strings.Contains(err.Error(), "invoice.prefix") {
+		t.Errorf("expected errors about the property name and the invoice prefix, got %v", err)
+	}
+}
+
+func TestLoad_MailOwnerRequired(t *testing.T) {
+	var app AppConfig
+	err := Load(&app, []string{"-db-dsn", "host=localhost"})
+	if err == nil || !strings.Contains(err.Error(), "mail.owner") {
+		t.Errorf("expected the owner's address to be required, got %v", err)
+	}
+}
+
+func TestLoad_InvalidWebhook(t *testing.T) {
+	var app AppConfig
+	err := Load(&app, []string{
+		"-db-dsn", "host=localhost",
+		"-webhook-workers", "0",
+		"-webhook-retry-base", "1h",
+		"-webhook-retry-max", "1m",
+	})
+	if err == nil {
+		t.Fatal("expected an error for an invalid webhook configuration")
+	}
+	for _, want := range []string{"webhook.workers", "webhook.retry_max"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %q, got: %s", want, err)
+		}
+	}
+}
+
+func TestLoad_InvalidLogin(t *testing.T) {
+	var app AppConfig
+	err := Load(&app, []string{
+		"-db-dsn", "host=localhost",
+		"-login-store", "redis",
+		"-login-lockout-after", "0",
+		"-login-delay-base", "10s",
+		"-login-delay-max", "1s",
+		"-login-two-factor-roles", "manager,admin",
+		"-base-url", "bookings.example.com",
+	})
+	if err == nil {
+		t.Fatal("expected an error for an invalid login configuration")
+	}
+	for _, want := range []string{"login.store", "login.lockout_after", "login.delay_max", "login.two_factor_roles", "base_url"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %q, got: %s", want, err)
+		}
+	}
+}
+
+func TestLoad_TwoFactorRoles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bookings.yml")
+	if err := os.WriteFile(file, []byte("db:\n  dsn: x\nmail:\n  owner: owner@example.com\nlogin:\n  two_factor_roles: [manager, owner]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var app AppConfig
+	if err := Load(&app, []string{"-config", file}); err != nil {
+		t.Fatal(err)
+	}
+	if !app.Login.RequiresTwoFactor(models.RoleManager) || !app.Login.RequiresTwoFactor(models.RoleOwner) {
+		t.Errorf("expected managers and owners to require two-factor authentication, got %v", app.Login.TwoFactorRoles)
+	}
+	if app.Login.RequiresTwoFactor(models.RoleFrontDesk) {
+		t.Error("expected front desk users not to require two-factor authentication")
+	}
+
+	// a flag replaces the list of the file
+	app = AppConfig{}
+	if err := Load(&app, []string{"-config", file, "-login-two-factor-roles", "owner"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(app.Login.TwoFactorRoles) != 1 || app.Login.TwoFactorRoles[0] != models.RoleOwner {
+		t.Errorf("expected only owners, got %v", app.Login.TwoFactorRoles)
+	}
+}
+
+func TestLoad_UnknownSetting(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bookings.yml")
+	if err := os.WriteFile(file, []byte("db:\n  dsn: x\n  pasword: oops\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var app AppConfig
+	err := Load(&app, []string{"-config", file})
+	if err == nil || !strings.Contains(err.Error(), `unknown setting "db.pasword"`) {
+		t.Errorf("expected an unknown setting error, got %v", err)
+	}
+}
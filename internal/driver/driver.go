@@ -2,10 +2,10 @@ package driver
 
 import (
 	"database/sql"
-	"time"
 
 	_ "github.com/jackc/pgx/v5"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/mrkouhadi/go-booking-app/internal/config"
 )
 
 // DB holds the database connection pool
@@ -15,19 +15,15 @@ type DB struct {
 
 var dbConn = &DB{}
 
-const maxOpenDbConn = 10
-const maxIdleDbConn = 5
-const maxDbLifetime = 5 * time.Minute
-
-// ConnectSQL creates database pool for postgres
-func ConnectSQL(dsn string) (*DB, error) {
-	d, err := NewDatabase(dsn)
+// ConnectSQL creates database pool for postgres, sized by the database config
+func ConnectSQL(c config.DBConfig) (*DB, error) {
+	d, err := NewDatabase(c.DSN)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	d.SetMaxIdleConns(maxIdleDbConn)
-	d.SetMaxOpenConns(maxOpenDbConn)
-	d.SetConnMaxLifetime(maxDbLifetime)
+	d.SetMaxIdleConns(c.MaxIdleConns)
+	d.SetMaxOpenConns(c.MaxOpenConns)
+	d.SetConnMaxLifetime(c.ConnMaxLifetime)
 
 	dbConn.SQL = d
 	err = testDB(d)
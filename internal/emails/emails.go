@@ -0,0 +1,165 @@
+// Package emails renders the emails the app sends from the templates embedded in the binary.
+// Every template defines a "subject", an "html" and a "text" part; the html part is rendered with
+// html/template inside layout.html.tmpl, the subject and the text part with text/template.
+package emails
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/pricing"
+)
+
+//go:embed templates
+var files embed.FS
+
+const layout = "layout.html.tmpl"
+
+// Email is the data of one of the templates, the type picks the template
+type Email interface {
+	template() string
+}
+
+// ReservationConfirmation is sent to the guest once a reservation has been made
+type ReservationConfirmation struct {
+	Reservation models.Reservation
+}
+
+// OwnerNotification tells the owner about a new reservation
+type OwnerNotification struct {
+	Reservation models.Reservation
+}
+
+// ReservationCancelled tells the guest that a reservation has been cancelled
+type ReservationCancelled struct {
+	Reservation models.Reservation
+	Reason      string // optional
+}
+
+// ReservationReminder reminds the guest of a stay that starts soon
+type ReservationReminder struct {
+	Reservation models.Reservation
+	DaysLeft    int
+}
+
+// PasswordReset sends a staff member the link to choose a new password
+type PasswordReset struct {
+	User     models.User
+	Link     string
+	ValidFor time.Duration
+}
+
+func (ReservationConfirmation) template() string { return "reservation-confirmation" }
+func (OwnerNotification) template() string       { return "owner-notification" }
+func (ReservationCancelled) template() string    { return "reservation-cancelled" }
+func (ReservationReminder) template() string     { return "reservation-reminder" }
+func (PasswordReset) template() string           { return "password-reset" }
+
+// all lists every template, Parse fails when one of them is missing
+var all = []Email{
+	ReservationConfirmation{},
+	OwnerNotification{},
+	ReservationCancelled{},
+	ReservationReminder{},
+	PasswordReset{},
+}
+
+var functions = map[string]interface{}{
+	"date": func(t time.Time) string {
+		return t.Format("Monday, January 2, 2006")
+	},
+	"nights": func(start, end time.Time) int {
+		return int(end.Sub(start).Hours() / 24)
+	},
+	"minutes": func(d time.Duration) int {
+		return int(d.Minutes())
+	},
+	"money": pricing.FormatMoney,
+}
+
+// Templates holds the parsed templates
+type Templates struct {
+	html map[string]*htmltemplate.Template
+	text map[string]*texttemplate.Template
+}
+
+// Parse parses the embedded templates, it's meant to be called once at startup
+func Parse() (*Templates, error) {
+	t := &Templates{
+		html: map[string]*htmltemplate.Template{},
+		text: map[string]*texttemplate.Template{},
+	}
+	for _, e := range all {
+		name := e.template()
+		page := "templates/" + name + ".tmpl"
+
+		h, err := htmltemplate.New(layout).Funcs(functions).ParseFS(files, "templates/"+layout, page)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse email template %s: %w", name, err)
+		}
+		txt, err := texttemplate.New(name).Funcs(functions).ParseFS(files, page)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse email template %s: %w", name, err)
+		}
+		for _, part := range []string{"subject", "html", "text"} {
+			if txt.Lookup(part) == nil {
+				return nil, fmt.Errorf("email template %s doesn't define %q", name, part)
+			}
+		}
+		t.html[name] = h
+		t.text[name] = txt
+	}
+	return t, nil
+}
+
+// Render returns the subject, the html and the text part of e
+func (t *Templates) Render(e Email) (subject, html, text string, err error) {
+	name := e.template()
+	h, ok := t.html[name]
+	if !ok {
+		return "", "", "", fmt.Errorf("no email template %s", name)
+	}
+	txt := t.text[name]
+
+	var buf bytes.Buffer
+	if err := txt.ExecuteTemplate(&buf, "subject", e); err != nil {
+		return "", "", "", err
+	}
+	// a subject is a single line
+	subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	buf.Reset()
+	if err := h.ExecuteTemplate(&buf, layout, e); err != nil {
+		return "", "", "", err
+	}
+	html = buf.String()
+
+	buf.Reset()
+	if err := txt.ExecuteTemplate(&buf, "text", e); err != nil {
+		return "", "", "", err
+	}
+	text = strings.TrimSpace(buf.String()) + "\n"
+	return subject, html, text, nil
+}
+
+// Mail renders e into an email from from to to
+func (t *Templates) Mail(from, to string, e Email) (models.MailData, error) {
+	subject, html, text, err := t.Render(e)
+	if err != nil {
+		return models.MailData{}, err
+	}
+	return models.MailData{
+		To:       to,
+		From:     from,
+		Subject:  subject,
+		Content:  html,
+		Text:     text,
+		Template: e.template(),
+	}, nil
+}
@@ -0,0 +1,145 @@
+package emails
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+)
+
+var reservation = models.Reservation{
+	ID:        42,
+	FirstName: `<script>alert("hi")</script>`,
+	LastName:  "O'Brien",
+	Email:     "guest@example.com",
+	Phone:     "555-0100",
+	StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+	EndDate:   time.Date(2050, 1, 4, 0, 0, 0, 0, time.UTC),
+	Room:      models.Room{RoomName: "General's Quarters"},
+}
+
+var staff = models.User{FirstName: `<script>alert("hi")</script>`, Email: "staff@example.com"}
+
+func TestRender(t *testing.T) {
+	templates, err := Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		email   Email
+		subject string
+		text    []string
+	}{
+		{ReservationConfirmation{Reservation: reservation}, "Confirming your reservation", []string{"3 nights", "Saturday, January 1, 2050"}},
+		{OwnerNotification{Reservation: reservation}, "New reservation for General's Quarters", []string{"O'Brien", "555-0100"}},
+		{ReservationCancelled{Reservation: reservation, Reason: "The room is closed."}, "Your reservation has been cancelled", []string{"The room is closed."}},
+		{ReservationReminder{Reservation: reservation, DaysLeft: 1}, "Your stay starts tomorrow", []string{"reservation 42"}},
+		{ReservationReminder{Reservation: reservation, DaysLeft: 3}, "Your stay starts in 3 days", nil},
+		{PasswordReset{User: staff, Link: "https://bookings.example.com/user/reset-password?token=abc", ValidFor: time.Hour},
+			"Reset your password", []string{"https://bookings.example.com/user/reset-password?token=abc", "60 minutes"}},
+	}
+
+	for _, tt := range tests {
+		name := tt.email.template()
+		subject, html, text, err := templates.Render(tt.email)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if subject != tt.subject {
+			t.Errorf("%s: expected subject %q, got %q", name, tt.subject, subject)
+		}
+		// the html part escapes what the guest typed, the text part keeps it as is
+		if strings.Contains(html, "<script>") {
+			t.Errorf("%s: the guest's name is not escaped in the html part", name)
+		}
+		if !strings.Contains(html, "&lt;script&gt;") {
+			t.Errorf("%s: expected the escaped name in the html part", name)
+		}
+		if !strings.Contains(html, "<title>"+strings.ReplaceAll(tt.subject, "'", "&#39;")+"</title>") {
+			t.Errorf("%s: expected the html part to be wrapped in the layout", name)
+		}
+		if !strings.Contains(text, `<script>alert("hi")</script>`) {
+			t.Errorf("%s: expected the raw name in the text part, got:\n%s", name, text)
+		}
+		for _, want := range tt.text {
+			if !strings.Contains(text, want) {
+				t.Errorf("%s: expected %q in the text part, got:\n%s", name, want, text)
+			}
+		}
+	}
+}
+
+func TestRender_Total(t *testing.T) {
+	templates, err := Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	priced := reservation
+	priced.TotalCents = 123450
+	priced.Currency = "USD"
+
+	for _, email := range []Email{ReservationConfirmation{Reservation: priced}, OwnerNotification{Reservation: priced}} {
+		_, html, text, err := templates.Render(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(html, "$1,234.50") || !strings.Contains(text, "$1,234.50") {
+			t.Errorf("%s: expected the total in both parts, got:\n%s", email.template(), text)
+		}
+	}
+
+	// the reservations made before there were prices have no total
+	for _, email := range []Email{ReservationConfirmation{Reservation: reservation}, OwnerNotification{Reservation: reservation}} {
+		_, _, text, err := templates.Render(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(strings.ToLower(text), "total") || strings.Contains(text, "\n\n\n") {
+			t.Errorf("%s: expected no total, got:\n%s", email.template(), text)
+		}
+	}
+}
+
+func TestRender_PromoCode(t *testing.T) {
+	templates, err := Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := reservation
+	res.TotalCents, res.Currency, res.PromoCode, res.PromoCents = 19800, "USD", "SUMMER10", 2200
+
+	_, html, text, err := templates.Render(OwnerNotification{Reservation: res})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range []string{html, text} {
+		if !strings.Contains(part, "Promo code: SUMMER10, -$22.00") {
+			t.Errorf("expected the promo code in the notification, got:\n%s", part)
+		}
+	}
+	if strings.Contains(text, "\n\n\n") {
+		t.Errorf("expected no blank lines around the promo code, got:\n%s", text)
+	}
+}
+
+func TestMail(t *testing.T) {
+	templates, err := Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := templates.Mail("contact@bookingapp.com", "guest@example.com", ReservationConfirmation{Reservation: reservation})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.From != "contact@bookingapp.com" || msg.To != "guest@example.com" {
+		t.Errorf("wrong addresses: %+v", msg)
+	}
+	if msg.Subject == "" || msg.Content == "" || msg.Text == "" {
+		t.Errorf("expected a subject, an html and a text part: %+v", msg)
+	}
+	if msg.Template != "reservation-confirmation" {
+		t.Errorf("expected the template name to be recorded, got %q", msg.Template)
+	}
+}
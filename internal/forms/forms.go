@@ -5,10 +5,35 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"unicode"
 
 	"github.com/asaskevich/govalidator"
 )
 
+// MinPasswordLength is the shortest password a staff member may choose
+const MinPasswordLength = 10
+
+// maxPasswordLength is the longest password bcrypt can hash, it ignores anything after that
+const maxPasswordLength = 72
+
+// commonPasswords are refused even though they follow the other rules
+var commonPasswords = map[string]bool{
+	"password123":    true,
+	"password1234":   true,
+	"password1!":     true,
+	"passw0rd123":    true,
+	"qwerty12345":    true,
+	"qwertyuiop1":    true,
+	"1q2w3e4r5t":     true,
+	"letmein123":     true,
+	"welcome123":     true,
+	"iloveyou123":    true,
+	"admin12345":     true,
+	"administrator1": true,
+	"abc1234567":     true,
+	"bookings123":    true,
+}
+
 // Form create a custom Form struct, and embeds url.Values Object
 type Form struct {
 	url.Values
@@ -54,8 +79,81 @@ func (f *Form) IsEmail(field string) {
 	}
 }
 
+// IsURL checks that field is an absolute http or https URL, e.g. of a webhook endpoint
+func (f *Form) IsURL(field string) {
+	u, err := url.Parse(strings.TrimSpace(f.Get(field)))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		f.Errors.Add(field, "Enter a URL starting with http:// or https://")
+	}
+}
+
+// Check validates field with check, a rule of the caller, e.g. one looking the value up in the database.
+// A field left blank isn't checked. check returns the message of the error, or "" when the value is valid;
+// its error, e.g. of the database, is returned rather than shown on the form.
+func (f *Form) Check(field string, check func(value string) (string, error)) error {
+	value := strings.TrimSpace(f.Get(field))
+	if value == "" {
+		return nil
+	}
+	msg, err := check(value)
+	if err != nil {
+		return err
+	}
+	if msg != "" {
+		f.Errors.Add(field, msg)
+	}
+	return nil
+}
+
 // Has checks if form field is in post and not empty
 func (f *Form) Has(field string, r *http.Request) bool {
 	x := f.Get(field)
 	return x != ""
 }
+
+// StrongPassword checks the password in field: it must be between MinPasswordLength and 72 characters long,
+// mix letters with digits or symbols, not be a well-known password and not contain any of the personal values,
+// e.g. the user's name or the part of their email before the @
+func (f *Form) StrongPassword(field string, personal ...string) bool {
+	password := f.Get(field)
+	valid := true
+	fail := func(msg string) {
+		f.Errors.Add(field, msg)
+		valid = false
+	}
+
+	if len(password) < MinPasswordLength {
+		fail(fmt.Sprintf("The password must be at least %d Characters long", MinPasswordLength))
+	}
+	if len(password) > maxPasswordLength {
+		fail(fmt.Sprintf("The password can't be longer than %d Characters", maxPasswordLength))
+	}
+
+	var letters, others bool
+	for _, c := range password {
+		if unicode.IsLetter(c) {
+			letters = true
+		} else if !unicode.IsSpace(c) {
+			others = true
+		}
+	}
+	if !letters || !others {
+		fail("The password must have letters and digits or symbols")
+	}
+
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		fail("This password is too common")
+	}
+	for _, p := range personal {
+		value := strings.ToLower(strings.TrimSpace(p))
+		if i := strings.Index(value, "@"); i >= 0 {
+			value = value[:i]
+		}
+		if len(value) >= 3 && strings.Contains(lower, value) {
+			fail("The password can't contain your name or email")
+			break
+		}
+	}
+	return valid
+}
@@ -1,9 +1,11 @@
 package forms
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -52,8 +54,8 @@ func TestForm_Has(t *testing.T) {
 	postedData.Add("a", "a")
 	form = New(postedData)
 	has = form.Has("a", r)
-	if has {
-		t.Error("Form shows that it has a field when it does NOT !!")
+	if !has {
+		t.Error("Form shows that it does NOT have a field when it does !!")
 	}
 }
 
@@ -73,7 +75,7 @@ func TestForm_Minlength(t *testing.T) {
 	postedValues.Add("some_field", "some value")
 	form = New(postedValues)
 	form.MinLength("some_field", 1000)
-	if !form.Valid() {
+	if form.Valid() {
 		t.Error("form shows minlength of 1000 met when data is shorter")
 	}
 
@@ -116,3 +118,91 @@ func TestForm_IsEmail(t *testing.T) {
 		t.Error("Got Valid for an invalid email")
 	}
 }
+
+func TestForm_IsURL(t *testing.T) {
+	var tests = []struct {
+		value string
+		valid bool
+	}{
+		{"https://accounting.example.com/hooks", true},
+		{"http://localhost:8080/hooks?source=bookings", true},
+		{"", false},
+		{"accounting.example.com/hooks", false},
+		{"ftp://example.com/hooks", false},
+		{"https://", false},
+		{"https://exa mple.com", false},
+	}
+	for _, e := range tests {
+		form := New(url.Values{"url": {e.value}})
+		form.IsURL("url")
+		if form.Valid() != e.valid {
+			t.Errorf("%q: expected valid to be %t", e.value, e.valid)
+		}
+	}
+}
+
+func TestForm_Check(t *testing.T) {
+	failure := fmt.Errorf("database down")
+	check := func(value string) (string, error) {
+		switch value {
+		case "FAIL":
+			return "", failure
+		case "GOOD":
+			return "", nil
+		}
+		return "Unknown code", nil
+	}
+	tests := []struct {
+		value string
+		valid bool
+		err   error
+	}{
+		{"GOOD", true, nil},
+		{"  GOOD ", true, nil},
+		{"", true, nil},
+		{"   ", true, nil},
+		{"BAD", false, nil},
+		{"FAIL", true, failure},
+	}
+	for _, e := range tests {
+		form := New(url.Values{"code": {e.value}})
+		err := form.Check("code", check)
+		if err != e.err {
+			t.Errorf("%q: expected the error %v, got %v", e.value, e.err, err)
+		}
+		if form.Valid() != e.valid {
+			t.Errorf("%q: expected valid to be %t", e.value, e.valid)
+		}
+	}
+	form := New(url.Values{"code": {"BAD"}})
+	_ = form.Check("code", check)
+	if form.Errors.Get("code") != "Unknown code" {
+		t.Errorf("expected the message of the check, got %q", form.Errors.Get("code"))
+	}
+}
+
+func TestForm_StrongPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		valid    bool
+	}{
+		{"letters and digits", "correct horse 42", true},
+		{"letters and symbols", "correct-horse-battery", true},
+		{"too short", "abc123", false},
+		{"only letters", "correcthorsebattery", false},
+		{"only digits", "12345678901234", false},
+		{"too long", strings.Repeat("a1", 40), false},
+		{"common", "Password123", false},
+		{"contains the email", "jane.doe2024!", false},
+		{"contains the name", "xx-Kouhadi-99", false},
+	}
+
+	for _, tt := range tests {
+		form := New(url.Values{"password": {tt.password}})
+		valid := form.StrongPassword("password", "jane.doe@example.com", "Kouhadi")
+		if valid != tt.valid || form.Valid() != tt.valid {
+			t.Errorf("%s: expected valid to be %t, got %t (%s)", tt.name, tt.valid, valid, form.Errors.Get("password"))
+		}
+	}
+}
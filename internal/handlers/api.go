@@ -0,0 +1,600 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mrkouhadi/go-booking-app/internal/forms"
+	"github.com/mrkouhadi/go-booking-app/internal/helpers"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/openapi"
+	"github.com/mrkouhadi/go-booking-app/internal/pricing"
+	"github.com/mrkouhadi/go-booking-app/internal/render"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
+)
+
+// The handlers of the JSON API under /api/v1, used by the front desk tablet app and by partners. Requests
+// and responses are JSON, a response is either {"data": ...} or {"error": ...} (see helpers.APIError).
+
+// apiDateLayout is how the API reads and writes dates
+const apiDateLayout = "2006-01-02"
+
+// maxAPIBody is the largest request body the API reads
+const maxAPIBody = 1 << 20
+
+// apiRoom is a room as the API shows it
+type apiRoom struct {
+	ID          int          `json:"id"`
+	Name        string       `json:"name"`
+	Slug        string       `json:"slug"`
+	Description string       `json:"description"`
+	Photos      []string     `json:"photos"`
+	Amenities   []string     `json:"amenities"` // on top of the amenities of the type
+	Type        *apiRoomType `json:"type,omitempty"`
+}
+
+// apiRoomType is the type of a room as the API shows it
+type apiRoomType struct {
+	ID           int      `json:"id"`
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	MaxOccupancy int      `json:"max_occupancy"`
+	Beds         string   `json:"beds"`
+	Amenities    []string `json:"amenities"`
+}
+
+// apiReservation is a reservation as the API shows it
+type apiReservation struct {
+	ID         int       `json:"id"`
+	FirstName  string    `json:"first_name"`
+	LastName   string    `json:"last_name"`
+	Email      string    `json:"email"`
+	Phone      string    `json:"phone"`
+	StartDate  string    `json:"start_date"`
+	EndDate    string    `json:"end_date"`
+	RoomID     int       `json:"room_id"`
+	Room       *apiRoom  `json:"room,omitempty"`
+	Adults     int       `json:"adults"`
+	Children   int       `json:"children"`
+	Processed  bool      `json:"processed"`
+	TotalCents int       `json:"total_cents"` // the price when it was booked, 0 for the reservations made before there were prices
+	Currency   string    `json:"currency"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// apiAvailability tells whether a room is free for a stay
+type apiAvailability struct {
+	RoomID    int    `json:"room_id"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+	Available bool   `json:"available"`
+}
+
+// apiNewReservation is the body of POST /reservations
+type apiNewReservation struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+	RoomID    int    `json:"room_id"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+	Adults    *int   `json:"adults"` // 1 when it's left out
+	Children  int    `json:"children"`
+}
+
+// apiReservationChanges is the body of PATCH /reservations/{id}, only the fields that are set change.
+// The stay itself can't be changed, the reservation has to be deleted and made again.
+type apiReservationChanges struct {
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	Email     *string `json:"email"`
+	Phone     *string `json:"phone"`
+	Processed *bool   `json:"processed"`
+
+	RoomID    *int    `json:"room_id"`
+	StartDate *string `json:"start_date"`
+	EndDate   *string `json:"end_date"`
+}
+
+// APIRooms lists the rooms guests can book, the inactive ones are left out
+func (m *Repository) APIRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.APIServerError(w, err)
+		return
+	}
+	active := []models.Room{}
+	for _, room := range rooms {
+		if room.Active {
+			active = append(active, room)
+		}
+	}
+	writeData(w, http.StatusOK, toAPIRooms(active))
+}
+
+// APIRoomAvailability tells whether a room is free from the start date to the end date of the query
+func (m *Repository) APIRoomAvailability(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return
+	}
+	fields := make(map[string]string)
+	start, end := parseStay(r.URL.Query().Get("start"), r.URL.Query().Get("end"), "start", "end", fields)
+	if len(fields) > 0 {
+		validationFailed(w, fields)
+		return
+	}
+
+	room, err := m.DB.GetRoomById(r.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) || err == nil && !room.Active {
+		notFound(w, "room")
+		return
+	}
+	if err != nil {
+		helpers.APIServerError(w, err)
+		return
+	}
+	available, err := m.DB.SearchAvailabilityByDatesByRoomID(r.Context(), start, end, id)
+	if err != nil {
+		helpers.APIServerError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, apiAvailability{
+		RoomID:    id,
+		StartDate: start.Format(apiDateLayout),
+		EndDate:   end.Format(apiDateLayout),
+		Available: available,
+	})
+}
+
+// APIAvailability lists the rooms that are free from the start date to the end date of the query and can
+// hold its adults and children
+func (m *Repository) APIAvailability(w http.ResponseWriter, r *http.Request) {
+	fields := make(map[string]string)
+	query := r.URL.Query()
+	start, end := parseStay(query.Get("start"), query.Get("end"), "start", "end", fields)
+	adults, children := parseParty(query.Get("adults"), query.Get("children"), fields)
+	if len(fields) > 0 {
+		validationFailed(w, fields)
+		return
+	}
+	rooms, err := m.DB.SearchAvailablityForAllRooms(r.Context(), start, end, adults+children)
+	if err != nil {
+		helpers.APIServerError(w, err)
+		return
+	}
+	writeData(w, http.StatusOK, toAPIRooms(rooms))
+}
+
+// APICreateReservation books a room, the guest and the owner are emailed like for a booking on the website.
+// A request sent again with the Idempotency-Key of a successful one gets the reservation it made.
+func (m *Repository) APICreateReservation(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKey {
+		helpers.WriteAPIError(w, helpers.APIError{
+			Status:  http.StatusBadRequest,
+			Code:    "invalid_idempotency_key",
+			Message: fmt.Sprintf("The Idempotency-Key can't be longer than %d characters", maxIdempotencyKey),
+		})
+		return
+	}
+	var body apiNewReservation
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	// keys are scoped to the API key, so that two clients can't collide
+	apiKey, _ := helpers.CurrentAPIKey(r)
+	request, err := json.Marshal(body)
+	if err != nil {
+		helpers.APIServerError(w, err)
+		return
+	}
+	idempotency := idempotencyKey(fmt.Sprintf("api:%d", apiKey.ID), key, string(request))
+
+	res := models.Reservation{
+		FirstName: strings.TrimSpace(body.FirstName),
+		LastName:  strings.TrimSpace(body.LastName),
+		Email:     strings.TrimSpace(body.Email),
+		Phone:     strings.TrimSpace(body.Phone),
+		RoomId:    body.RoomID,
+		Adults:    1,
+		Children:  body.Children,
+	}
+	if body.Adults != nil {
+		res.Adults = *body.Adults
+	}
+	fields := validateGuest(res)
+	res.StartDate, res.EndDate = parseStay(body.StartDate, body.EndDate, "start_date", "end_date", fields)
+	if body.RoomID == 0 {
+		fields["room_id"] = "This field cannot be Blank !"
+	} else {
+		room, err := m.DB.GetRoomById(r.Context(), body.RoomID)
+		if errors.Is(err, repository.ErrNotFound) {
+			fields["room_id"] = "No room has this id"
+		} else if err != nil {
+			helpers.APIServerError(w, err)
+			return
+		} else if !room.Active {
+			fields["room_id"] = "This room can't be booked"
+		}
+		res.Room = room
+	}
+	if _, ok := fields["room_id"]; !ok {
+		for field, problem := range checkParty(res.Adults, res.Children, &res.Room) {
+			fields[field] = problem
+		}
+	}
+	if len(fields) == 0 {
+		// the price is frozen onto the reservation, later changes of the rates don't change it
+		quote, err := m.Pricing.QuoteStay(r.Context(), res.Room, res.StartDate, res.EndDate)
+		if errors.Is(err, pricing.ErrInvalidStay) {
+			fields["end_date"] = "A stay can't last more than a year"
+		} else if err != nil {
+			helpers.APIServerError(w, err)
+			return
+		}
+		res.TotalCents, res.Currency = quote.TotalCents, quote.Currency
+	}
+	if len(fields) > 0 {
+		validationFailed(w, fields)
+		return
+	}
+
+	inv, err := m.bookingInvoice(r.Context(), res)
+	if err != nil {
+		helpers.APIServerError(w, err)
+		return
+	}
+	res, err = m.DB.CreateBooking(r.Context(), models.Booking{
+		Reservation: res,
+		Invoice:     inv,
+		Mail:        m.reservationMail,
+		Webhooks:    createdWebhooks,
+		Idempotency: idempotency,
+	})
+	if errors.Is(err, repository.ErrDuplicateRequest) {
+		// a retry: answer like the first request did
+		w.Header().Set("Idempotent-Replayed", "true")
+		err = nil
+	}
+	if errors.Is(err, repository.ErrIdempotencyKeyReused) {
+		helpers.WriteAPIError(w, helpers.APIError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "idempotency_key_reused",
+			Message: "This Idempotency-Key has already been used for another request",
+		})
+		return
+	}
+	if errors.Is(err, repository.ErrRoomNotAvailable) {
+		helpers.WriteAPIError(w, helpers.APIError{
+			Status:  http.StatusConflict,
+			Code:    "room_not_available",
+			Message: "The room is already booked or blocked for some of these dates",
+		})
+		return
+	}
+	if err != nil {
+		helpers.APIServerError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/reservations/%d", res.ID))
+	writeData(w, http.StatusCreated, toAPIReservation(res))
+}
+
+// APIReservation shows a reservation
+func (m *Repository) APIReservation(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.apiReservationFromURL(w, r)
+	if !ok {
+		return
+	}
+	writeData(w, http.StatusOK, toAPIReservation(res))
+}
+
+// APIUpdateReservation changes the guest of a reservation or marks it as processed
+func (m *Repository) APIUpdateReservation(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.apiReservationFromURL(w, r)
+	if !ok {
+		return
+	}
+	var body apiReservationChanges
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+
+	set := func(field *string, value *string) {
+		if value != nil {
+			*field = strings.TrimSpace(*value)
+		}
+	}
+	set(&res.FirstName, body.FirstName)
+	set(&res.LastName, body.LastName)
+	set(&res.Email, body.Email)
+	set(&res.Phone, body.Phone)
+
+	fields := validateGuest(res)
+	for field, changed := range map[string]bool{
+		"room_id":    body.RoomID != nil,
+		"start_date": body.StartDate != nil,
+		"end_date":   body.EndDate != nil,
+	} {
+		if changed {
+			fields[field] = "The stay can't be changed, delete the reservation and make a new one"
+		}
+	}
+	if len(fields) > 0 {
+		validationFailed(w, fields)
+		return
+	}
+
+	wasProcessed := res.Processed == 1
+	if body.Processed != nil {
+		res.Processed = 0
+		if *body.Processed {
+			res.Processed = 1
+		}
+	}
+	res.UpdatedAt = time.Now()
+	events := []models.WebhookEvent{models.EventReservationUpdated}
+	if res.Processed == 1 && !wasProcessed {
+		events = append(events, models.EventReservationProcessed)
+	}
+	webhooks, err := reservationWebhooks(res, events...)
+	if err != nil {
+		helpers.APIServerError(w, err)
+		return
+	}
+	// the guest, the processed flag and the webhooks are stored together
+	err = m.DB.UpdateReservation(r.Context(), res, webhooks)
+	if err != nil {
+		apiRepositoryError(w, err, "reservation")
+		return
+	}
+	writeData(w, http.StatusOK, toAPIReservation(res))
+}
+
+// APIDeleteReservation deletes a reservation, which frees its room
+func (m *Repository) APIDeleteReservation(w http.ResponseWriter, r *http.Request) {
+	// the webhook tells what has been deleted, read it while it's there
+	res, ok := m.apiReservationFromURL(w, r)
+	if !ok {
+		return
+	}
+	webhooks, err := reservationWebhooks(res, models.EventReservationDeleted)
+	if err != nil {
+		helpers.APIServerError(w, err)
+		return
+	}
+	err = m.DB.DeleteReservation(r.Context(), res.ID, webhooks)
+	if err != nil {
+		apiRepositoryError(w, err, "reservation")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APINotFound answers the requests to no route of the API
+func (m *Repository) APINotFound(w http.ResponseWriter, r *http.Request) {
+	helpers.WriteAPIError(w, helpers.APIError{Status: http.StatusNotFound, Code: "not_found", Message: "There is nothing at this URL"})
+}
+
+// APIMethodNotAllowed answers the requests with a method the route doesn't take
+func (m *Repository) APIMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	helpers.WriteAPIError(w, helpers.APIError{
+		Status:  http.StatusMethodNotAllowed,
+		Code:    "method_not_allowed",
+		Message: fmt.Sprintf("%s isn't allowed on this URL", r.Method),
+	})
+}
+
+// OpenAPI serves the OpenAPI document of the API
+func (m *Repository) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	helpers.WriteJSON(w, http.StatusOK, openapi.Spec(m.App.BaseURL))
+}
+
+// APIDocs shows the OpenAPI document of the API as a page
+func (m *Repository) APIDocs(w http.ResponseWriter, r *http.Request) {
+	spec := openapi.Spec(m.App.BaseURL)
+	data := make(map[string]interface{})
+	data["spec"] = spec
+	data["routes"] = spec.Routes()
+	render.Template(w, r, "api-docs.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// apiReservationFromURL loads the reservation whose id is in the URL, it writes the error response and
+// returns false when it can't
+func (m *Repository) apiReservationFromURL(w http.ResponseWriter, r *http.Request) (models.Reservation, bool) {
+	id, ok := apiID(w, r)
+	if !ok {
+		return models.Reservation{}, false
+	}
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if err != nil {
+		apiRepositoryError(w, err, "reservation")
+		return res, false
+	}
+	return res, true
+}
+
+// apiID reads the id in the URL, a URL without a valid id points at nothing
+func apiID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id < 1 {
+		helpers.WriteAPIError(w, helpers.APIError{Status: http.StatusNotFound, Code: "not_found", Message: "There is nothing at this URL"})
+		return 0, false
+	}
+	return id, true
+}
+
+// decodeJSON reads the JSON body of the request into dst, it writes the error response and returns false
+// when the body isn't valid JSON for dst
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		helpers.WriteAPIError(w, helpers.APIError{
+			Status:  http.StatusBadRequest,
+			Code:    "invalid_json",
+			Message: fmt.Sprintf("The body isn't valid JSON for this request: %s", err),
+		})
+		return false
+	}
+	return true
+}
+
+// parseStay reads the dates of a stay, the problems are added to fields under the names of the dates
+func parseStay(start, end, startField, endField string, fields map[string]string) (time.Time, time.Time) {
+	parse := func(value, field string) time.Time {
+		if value == "" {
+			fields[field] = "This field cannot be Blank !"
+			return time.Time{}
+		}
+		t, err := time.Parse(apiDateLayout, value)
+		if err != nil {
+			fields[field] = "This date must look like 2050-01-31"
+		}
+		return t
+	}
+	startDate := parse(start, startField)
+	endDate := parse(end, endField)
+	if _, ok := fields[endField]; !ok && !startDate.IsZero() && !endDate.After(startDate) {
+		fields[endField] = "The end date must be after the start date"
+	}
+	return startDate, endDate
+}
+
+// parseParty reads the adults and children of a query, 1 adult and no children when they're left out. The
+// problems are added to fields.
+func parseParty(adults, children string, fields map[string]string) (int, int) {
+	parse := func(value, field string, blank int) int {
+		if value == "" {
+			return blank
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			fields[field] = "This must be a whole number"
+		}
+		return n
+	}
+	a := parse(adults, "adults", 1)
+	c := parse(children, "children", 0)
+	if len(fields) == 0 {
+		for field, problem := range checkParty(a, c, nil) {
+			fields[field] = problem
+		}
+	}
+	return a, c
+}
+
+// validateGuest checks the guest of a reservation like the reservation form does
+func validateGuest(res models.Reservation) map[string]string {
+	form := forms.New(url.Values{
+		"first_name": {res.FirstName},
+		"last_name":  {res.LastName},
+		"email":      {res.Email},
+		"phone":      {res.Phone},
+	})
+	form.Required("first_name", "last_name", "email", "phone")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+
+	fields := make(map[string]string)
+	for field := range form.Errors {
+		fields[field] = form.Errors.Get(field)
+	}
+	return fields
+}
+
+// validationFailed answers a request with invalid fields
+func validationFailed(w http.ResponseWriter, fields map[string]string) {
+	helpers.WriteAPIError(w, helpers.APIError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    "validation_failed",
+		Message: "Some fields are invalid",
+		Fields:  fields,
+	})
+}
+
+// notFound answers a request for a thing that doesn't exist, e.g. "room"
+func notFound(w http.ResponseWriter, thing string) {
+	helpers.WriteAPIError(w, helpers.APIError{Status: http.StatusNotFound, Code: "not_found", Message: fmt.Sprintf("No %s has this id", thing)})
+}
+
+// apiRepositoryError answers with a 404 when the thing wasn't found, with a 500 otherwise
+func apiRepositoryError(w http.ResponseWriter, err error, thing string) {
+	if errors.Is(err, repository.ErrNotFound) {
+		notFound(w, thing)
+		return
+	}
+	helpers.APIServerError(w, err)
+}
+
+// writeData sends v in the envelope of the successful API responses
+func writeData(w http.ResponseWriter, status int, v interface{}) {
+	helpers.WriteJSON(w, status, map[string]interface{}{"data": v})
+}
+
+func toAPIRooms(rooms []models.Room) []apiRoom {
+	out := make([]apiRoom, len(rooms))
+	for i, room := range rooms {
+		out[i] = toAPIRoom(room)
+	}
+	return out
+}
+
+func toAPIRoom(room models.Room) apiRoom {
+	out := apiRoom{
+		ID:          room.ID,
+		Name:        room.RoomName,
+		Slug:        room.Slug,
+		Description: room.Description,
+		Photos:      append([]string{}, room.Photos...),
+		Amenities:   append([]string{}, room.Amenities...),
+	}
+	if room.RoomTypeID != 0 {
+		t := room.RoomType
+		out.Type = &apiRoomType{
+			ID:           t.ID,
+			Name:         t.Name,
+			Description:  t.Description,
+			MaxOccupancy: t.MaxOccupancy,
+			Beds:         t.Beds,
+			Amenities:    append([]string{}, t.Amenities...),
+		}
+	}
+	return out
+}
+
+func toAPIReservation(res models.Reservation) apiReservation {
+	out := apiReservation{
+		ID:         res.ID,
+		FirstName:  res.FirstName,
+		LastName:   res.LastName,
+		Email:      res.Email,
+		Phone:      res.Phone,
+		StartDate:  res.StartDate.Format(apiDateLayout),
+		EndDate:    res.EndDate.Format(apiDateLayout),
+		RoomID:     res.RoomId,
+		Adults:     res.Adults,
+		Children:   res.Children,
+		Processed:  res.Processed == 1,
+		TotalCents: res.TotalCents,
+		Currency:   res.Currency,
+		CreatedAt:  res.CreatedAt,
+		UpdatedAt:  res.UpdatedAt,
+	}
+	if res.Room.ID != 0 {
+		out.Room = &apiRoom{ID: res.Room.ID, Name: res.Room.RoomName}
+	}
+	return out
+}
@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// apiResponse is the envelope of the API responses
+type apiResponse struct {
+	Data  json.RawMessage `json:"data"`
+	Error struct {
+		Status int               `json:"status"`
+		Code   string            `json:"code"`
+		Fields map[string]string `json:"fields"`
+	} `json:"error"`
+}
+
+// callAPI serves an API request to handler, id is the {id} of the URL
+func callAPI(t *testing.T, handler http.HandlerFunc, method, target, id, body string) (*httptest.ResponseRecorder, apiResponse) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	var resp apiResponse
+	if rr.Code != http.StatusNoContent {
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: expected a JSON response, got %q", method, target, ct)
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s %s: invalid JSON %q: %s", method, target, rr.Body.String(), err)
+		}
+	}
+	return rr, resp
+}
+
+func TestRepository_APIRooms(t *testing.T) {
+	rr, resp := callAPI(t, Repo.APIRooms, "GET", "/api/v1/rooms", "", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", rr.Code, rr.Body.String())
+	}
+	var rooms []apiRoom
+	if err := json.Unmarshal(resp.Data, &rooms); err != nil {
+		t.Fatal(err)
+	}
+	// room 4 is inactive
+	if len(rooms) != 3 || rooms[0].Slug != "room-1" || rooms[0].Amenities[0] != "Sea view" || len(rooms[2].Photos) != 1 {
+		t.Errorf("expected the active rooms with their details, got %+v", rooms)
+	}
+}
+
+func TestRepository_APIRoomAvailability(t *testing.T) {
+	tests := []struct {
+		name           string
+		id             string
+		query          string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"available", "1", "start=2050-01-01&end=2050-01-03", http.StatusOK, ""},
+		{"missing dates", "1", "", http.StatusUnprocessableEntity, "validation_failed"},
+		{"end before start", "1", "start=2050-01-03&end=2050-01-01", http.StatusUnprocessableEntity, "validation_failed"},
+		{"bad date", "1", "start=01/01/2050&end=2050-01-03", http.StatusUnprocessableEntity, "validation_failed"},
+		{"unknown room", "99", "start=2050-01-01&end=2050-01-03", http.StatusNotFound, "not_found"},
+		{"inactive room", "4", "start=2050-01-01&end=2050-01-03", http.StatusNotFound, "not_found"},
+		{"invalid id", "x", "start=2050-01-01&end=2050-01-03", http.StatusNotFound, "not_found"},
+		{"database error", "1000000", "start=2050-01-01&end=2050-01-03", http.StatusInternalServerError, "internal_error"},
+	}
+	for _, e := range tests {
+		rr, resp := callAPI(t, Repo.APIRoomAvailability, "GET", "/api/v1/rooms/"+e.id+"/availability?"+e.query, e.id, "")
+		if rr.Code != e.expectedStatus || resp.Error.Code != e.expectedCode {
+			t.Errorf("%s: expected %d %q, got %d %s", e.name, e.expectedStatus, e.expectedCode, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestRepository_APIAvailability(t *testing.T) {
+	rr, resp := callAPI(t, Repo.APIAvailability, "GET", "/api/v1/availability?start=2050-01-01&end=2050-01-03", "", "")
+	if rr.Code != http.StatusOK || string(resp.Data) != "[]" {
+		t.Errorf("expected 200 and an empty list, got %d %s", rr.Code, rr.Body.String())
+	}
+	rr, resp = callAPI(t, Repo.APIAvailability, "GET", "/api/v1/availability?start=2050-01-01", "", "")
+	if rr.Code != http.StatusUnprocessableEntity || resp.Error.Fields["end"] == "" {
+		t.Errorf("expected the missing end date to be reported, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRepository_APICreateReservation(t *testing.T) {
+	const guest = `"first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"555-555-5555","start_date":"2050-01-01","end_date":"2050-01-03"`
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedCode   string
+		expectedField  string
+	}{
+		{"booked", `{"room_id":1,` + guest + `}`, http.StatusCreated, "", ""},
+		{"invalid JSON", `{"room_id":1,`, http.StatusBadRequest, "invalid_json", ""},
+		{"unknown field", `{"room_id":1,"colour":"red",` + guest + `}`, http.StatusBadRequest, "invalid_json", ""},
+		{"short first name", `{"room_id":1,"first_name":"Jo","last_name":"Smith","email":"john@smith.com","phone":"555","start_date":"2050-01-01","end_date":"2050-01-03"}`, http.StatusUnprocessableEntity, "validation_failed", "first_name"},
+		{"invalid email", `{"room_id":1,"first_name":"John","last_name":"Smith","email":"john","phone":"555","start_date":"2050-01-01","end_date":"2050-01-03"}`, http.StatusUnprocessableEntity, "validation_failed", "email"},
+		{"no room", `{` + guest + `}`, http.StatusUnprocessableEntity, "validation_failed", "room_id"},
+		{"unknown room", `{"room_id":99,` + guest + `}`, http.StatusUnprocessableEntity, "validation_failed", "room_id"},
+		{"inactive room", `{"room_id":4,` + guest + `}`, http.StatusUnprocessableEntity, "validation_failed", "room_id"},
+		{"room taken", `{"room_id":3,` + guest + `}`, http.StatusConflict, "room_not_available", ""},
+		{"database error", `{"room_id":2,` + guest + `}`, http.StatusInternalServerError, "internal_error", ""},
+		{"stay too long", `{"room_id":1,"first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"555","start_date":"2050-01-01","end_date":"2052-01-01"}`, http.StatusUnprocessableEntity, "validation_failed", "end_date"},
+	}
+	for _, e := range tests {
+		rr, resp := callAPI(t, Repo.APICreateReservation, "POST", "/api/v1/reservations", "", e.body)
+		if rr.Code != e.expectedStatus || resp.Error.Code != e.expectedCode {
+			t.Errorf("%s: expected %d %q, got %d %s", e.name, e.expectedStatus, e.expectedCode, rr.Code, rr.Body.String())
+		}
+		if e.expectedField != "" && resp.Error.Fields[e.expectedField] == "" {
+			t.Errorf("%s: expected an error on %s, got %s", e.name, e.expectedField, rr.Body.String())
+		}
+		if rr.Code == http.StatusCreated && rr.Header().Get("Location") != "/api/v1/reservations/1" {
+			t.Errorf("%s: expected the new reservation's location, got %q", e.name, rr.Header().Get("Location"))
+		}
+		if rr.Code == http.StatusCreated {
+			var res apiReservation
+			if err := json.Unmarshal(resp.Data, &res); err != nil {
+				t.Fatal(err)
+			}
+			// a Saturday night at the weekend rate and a Sunday night
+			if res.TotalCents != 22000 || res.Currency != "USD" {
+				t.Errorf("%s: expected the total of the stay, got %d %q", e.name, res.TotalCents, res.Currency)
+			}
+		}
+	}
+}
+
+func TestRepository_APIReservation(t *testing.T) {
+	rr, resp := callAPI(t, Repo.APIReservation, "GET", "/api/v1/reservations/1", "1", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", rr.Code, rr.Body.String())
+	}
+	var res apiReservation
+	if err := json.Unmarshal(resp.Data, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != 1 || res.Email != "jane@example.com" || res.StartDate != "2050-01-01" {
+		t.Errorf("unexpected reservation %+v", res)
+	}
+
+	rr, resp = callAPI(t, Repo.APIReservation, "GET", "/api/v1/reservations/101", "101", "")
+	if rr.Code != http.StatusNotFound || resp.Error.Code != "not_found" {
+		t.Errorf("expected 404 for an unknown reservation, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRepository_APIUpdateReservation(t *testing.T) {
+	tests := []struct {
+		name           string
+		id             string
+		body           string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"rename", "1", `{"first_name":"Janet","processed":true}`, http.StatusOK, ""},
+		{"invalid email", "1", `{"email":"jane"}`, http.StatusUnprocessableEntity, "validation_failed"},
+		{"change the stay", "1", `{"start_date":"2050-02-01"}`, http.StatusUnprocessableEntity, "validation_failed"},
+		{"unknown reservation", "101", `{"first_name":"Janet"}`, http.StatusNotFound, "not_found"},
+		{"database error", "1000000", `{"first_name":"Janet"}`, http.StatusInternalServerError, "internal_error"},
+	}
+	for _, e := range tests {
+		rr, resp := callAPI(t, Repo.APIUpdateReservation, "PATCH", "/api/v1/reservations/"+e.id, e.id, e.body)
+		if rr.Code != e.expectedStatus || resp.Error.Code != e.expectedCode {
+			t.Errorf("%s: expected %d %q, got %d %s", e.name, e.expectedStatus, e.expectedCode, rr.Code, rr.Body.String())
+		}
+		if rr.Code == http.StatusOK {
+			var res apiReservation
+			_ = json.Unmarshal(resp.Data, &res)
+			if res.FirstName != "Janet" || res.LastName != "Doe" || !res.Processed {
+				t.Errorf("%s: expected the changes on top of the reservation, got %+v", e.name, res)
+			}
+		}
+	}
+}
+
+func TestRepository_APIDeleteReservation(t *testing.T) {
+	tests := []struct {
+		id             string
+		expectedStatus int
+	}{
+		{"1", http.StatusNoContent},
+		{"101", http.StatusNotFound},
+		{"1000000", http.StatusInternalServerError},
+	}
+	for _, e := range tests {
+		rr, _ := callAPI(t, Repo.APIDeleteReservation, "DELETE", "/api/v1/reservations/"+e.id, e.id, "")
+		if rr.Code != e.expectedStatus {
+			t.Errorf("deleting %s: expected %d, got %d %s", e.id, e.expectedStatus, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestRepository_OpenAPI(t *testing.T) {
+	rr, _ := callAPI(t, Repo.OpenAPI, "GET", "/api/openapi.json", "", "")
+	var doc map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil || rr.Code != http.StatusOK || doc["openapi"] == nil {
+		t.Errorf("expected the OpenAPI document, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRepository_APIDocs(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/api/docs", nil)
+	req = req.WithContext(getCtx(req))
+	rr := httptest.NewRecorder()
+	Repo.APIDocs(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	for _, want := range []string{"/api/v1/reservations/{id}", "PATCH", "Some fields are invalid", "schema-Reservation", "/api/openapi.json"} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected %q in the page", want)
+		}
+	}
+}
+
+func TestRepository_APICreateReservationIdempotency(t *testing.T) {
+	// room 3 is taken in the test repository, so only a replay can succeed
+	const body = `{"room_id":3,"first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"555","start_date":"2050-01-01","end_date":"2050-01-03"}`
+	tests := []struct {
+		name           string
+		key            string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"retry", "replayed", http.StatusCreated, ""},
+		{"key used for another request", "reused", http.StatusUnprocessableEntity, "idempotency_key_reused"},
+		{"key too long", strings.Repeat("k", 256), http.StatusBadRequest, "invalid_idempotency_key"},
+		{"new key", "fresh", http.StatusConflict, "room_not_available"},
+	}
+	for _, e := range tests {
+		before := lastWebhookID()
+		req := httptest.NewRequest("POST", "/api/v1/reservations", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", e.key)
+		rr := httptest.NewRecorder()
+		Repo.APICreateReservation(rr, req)
+		if lastWebhookID() != before {
+			t.Errorf("%s: expected no webhook, the reservation was made by the first request", e.name)
+		}
+
+		var resp apiResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: invalid JSON %q", e.name, rr.Body.String())
+		}
+		if rr.Code != e.expectedStatus || resp.Error.Code != e.expectedCode {
+			t.Errorf("%s: expected %d %q, got %d %s", e.name, e.expectedStatus, e.expectedCode, rr.Code, rr.Body.String())
+		}
+		if rr.Code != http.StatusCreated {
+			continue
+		}
+		var res apiReservation
+		_ = json.Unmarshal(resp.Data, &res)
+		if res.ID != 1 || res.Email != "jane@example.com" || rr.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("%s: expected the first reservation, replayed, got %+v", e.name, res)
+		}
+	}
+}
@@ -1,10 +1,15 @@
 package handlers
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -12,12 +17,19 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/mrkouhadi/go-booking-app/internal/config"
 	"github.com/mrkouhadi/go-booking-app/internal/driver"
+	"github.com/mrkouhadi/go-booking-app/internal/emails"
 	"github.com/mrkouhadi/go-booking-app/internal/forms"
 	"github.com/mrkouhadi/go-booking-app/internal/helpers"
+	"github.com/mrkouhadi/go-booking-app/internal/invoice"
+	"github.com/mrkouhadi/go-booking-app/internal/limiter"
 	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/pricing"
+	"github.com/mrkouhadi/go-booking-app/internal/promo"
 	"github.com/mrkouhadi/go-booking-app/internal/render"
 	"github.com/mrkouhadi/go-booking-app/internal/repository"
 	"github.com/mrkouhadi/go-booking-app/internal/repository/dbrepo"
+	"github.com/mrkouhadi/go-booking-app/internal/token"
+	"github.com/mrkouhadi/go-booking-app/internal/totp"
 )
 
 // the repository used by the handlers
@@ -27,13 +39,37 @@ var Repo *Repository
 type Repository struct {
 	App *config.AppConfig
 	DB  repository.DatabaseRepo
+
+	// LoginIP and LoginAccount limit the login attempts from an IP address and on an email address
+	LoginIP      *limiter.Limiter
+	LoginAccount *limiter.Limiter
+	// ResetIP and ResetAccount limit the password reset requests the same way, with counts of their own
+	// so that asking for resets doesn't lock anyone out of the login
+	ResetIP      *limiter.Limiter
+	ResetAccount *limiter.Limiter
+
+	// Pricing quotes the stays, its total is frozen onto the reservations when they are booked
+	Pricing *pricing.Service
+	// Promos checks the promo codes typed by the guests and takes their discount off the quotes
+	Promos *promo.Service
 }
 
 // NewRepo creates the new repository
 func NewRepo(a *config.AppConfig, db *driver.DB) *Repository {
+	var store limiter.Store = limiter.NewMemory()
+	if a.Login.Store == "postgres" {
+		store = limiter.NewPostgres(db.SQL, a.DB.QueryTimeout)
+	}
+	repo := dbrepo.NewPostgresRepo(db.SQL, a)
 	return &Repository{
-		App: a,
-		DB:  dbrepo.NewPostgresRepo(db.SQL, a),
+		App:          a,
+		DB:           repo,
+		LoginIP:      limiter.New(store, "login-ip", a.Login.IPLimit, a.Login.Window),
+		LoginAccount: limiter.New(store, "login-account", a.Login.AccountLimit, a.Login.Window),
+		ResetIP:      limiter.New(store, "reset-ip", a.Login.IPLimit, a.Login.Window),
+		ResetAccount: limiter.New(store, "reset-account", a.Login.AccountLimit, a.Login.Window),
+		Pricing:      pricing.New(repo, a.Currency),
+		Promos:       promo.New(repo),
 	}
 }
 
@@ -60,7 +96,6 @@ func (m *Repository) Features(w http.ResponseWriter, r *http.Request) {
 
 // /////// contact page
 func (m *Repository) Contact(w http.ResponseWriter, r *http.Request) {
-	m.DB.AllUsers()
 	render.Template(w, r, "contact.page.tmpl", &models.TemplateData{})
 }
 
@@ -72,23 +107,44 @@ func (m *Repository) MakeReservation(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		m.App.Session.Put(r.Context(), "error", "can't get reservation from session")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
 	}
-	room, err := m.DB.GetRoomById(res.RoomId)
+	room, err := m.DB.GetRoomById(r.Context(), res.RoomId)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't find room")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	res.Room = room
+	if res.Adults == 0 {
+		// booked from the page of a room, the guest says who is coming in the form
+		res.Adults = 1
 	}
-	res.Room.RoomName = room.RoomName
 	m.App.Session.Put(r.Context(), "reservation", res)
 
+	quote, err := m.Pricing.QuoteStay(r.Context(), room, res.StartDate, res.EndDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't price the stay, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
 	sd := res.StartDate.Format("2006-01-02")
 	ed := res.EndDate.Format("2006-01-02")
+	// a double click or a resent form books once, see PostMakeReservation
+	formKey, err := token.New()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
 	stringMap := make(map[string]string)
 	stringMap["start_date"] = sd
 	stringMap["end_date"] = ed
+	stringMap["idempotency_key"] = formKey
 
 	data := make(map[string]interface{})
 	data["reservation"] = res
+	data["quote"] = quote
 	render.Template(w, r, "make-reservation.page.tmpl", &models.TemplateData{
 		Form:      forms.New(nil),
 		Data:      data,
@@ -150,96 +206,183 @@ func (m *Repository) PostMakeReservation(w http.ResponseWriter, r *http.Request)
 	form.MinLength("first_name", 3)
 	form.IsEmail("email")
 
+	// the price is frozen onto the reservation, later changes of the rates don't change it
+	var quote pricing.Quote
+	room, err := m.DB.GetRoomById(r.Context(), roomID)
+	if err == nil && !room.Active {
+		// the room has been deactivated since it was chosen
+		err = repository.ErrNotFound
+	}
+	if err == nil {
+		reservation.Room = room
+		reservation.Adults, reservation.Children = partyFromForm(form, &room)
+		quote, err = m.Pricing.QuoteStay(r.Context(), room, startDate, endDate)
+	}
+	var code models.PromoCode
+	if err == nil {
+		err = form.Check("promo_code", func(value string) (string, error) {
+			var err error
+			quote, code, err = m.Promos.Redeem(r.Context(), value, reservation.Email, quote)
+			var rule *promo.RuleError
+			if errors.As(err, &rule) {
+				return rule.Reason, nil
+			}
+			return "", err
+		})
+	}
+	if errors.Is(err, repository.ErrNotFound) || errors.Is(err, pricing.ErrInvalidStay) {
+		m.App.Session.Put(r.Context(), "error", "Please search again for available rooms and dates.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "can't price the reservation")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	reservation.TotalCents, reservation.Currency = quote.TotalCents, quote.Currency
+	reservation.PromoCode, reservation.PromoCents = quote.PromoCode, quote.PromoCents
+
 	if !form.Valid() {
 		data := make(map[string]interface{})
 		data["reservation"] = reservation
-		http.Error(w, "my own error message", http.StatusSeeOther)
+		data["quote"] = quote
 		render.Template(w, r, "make-reservation.page.tmpl", &models.TemplateData{
 			Form: form,
 			Data: data,
+			// the form sent again is the same form, it keeps its key
+			StringMap: map[string]string{"start_date": sd, "end_date": ed, "idempotency_key": form.Get("idempotency_key")},
 		})
 		return
 	}
-	// store reservation data in db
-	newReservationId, err := m.DB.InsertReservation(reservation)
+
+	inv, err := m.bookingInvoice(r.Context(), reservation)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't insert reservation into database")
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "can't price the reservation")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
 	}
-	restriction := models.RoomRestrictions{
-		StartDate:     reservation.StartDate,
-		EndDate:       reservation.EndDate,
-		RoomId:        reservation.RoomId,
-		ReservationId: newReservationId,
-		RestrictionId: 1,
+	var redeemed *models.PromoCode
+	if reservation.PromoCode != "" {
+		redeemed = &code
 	}
-	// store restriction in db
-	err = m.DB.InsertRoomRestriction(restriction)
-	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "can't insert room restriction")
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+
+	// store the reservation, its room restriction and the notification emails in db, all or nothing
+	reservation, err = m.DB.CreateBooking(r.Context(), models.Booking{
+		Reservation: reservation,
+		Invoice:     inv,
+		Promo:       redeemed,
+		Mail:        m.reservationMail,
+		Webhooks:    createdWebhooks,
+		Idempotency: idempotencyKey("form", form.Get("idempotency_key"),
+			reservation.FirstName, reservation.LastName, reservation.Email, reservation.Phone, sd, ed, strconv.Itoa(roomID),
+			reservation.PromoCode, strconv.Itoa(reservation.Adults), strconv.Itoa(reservation.Children)),
+	})
+	if errors.Is(err, repository.ErrDuplicateRequest) {
+		// the form has already been sent, e.g. by a double click: show what the first one booked
+		err = nil
+	}
+	if errors.Is(err, repository.ErrIdempotencyKeyReused) {
+		m.App.Session.Put(r.Context(), "error", "This form has already been sent. Please search again to make another reservation.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
 		return
 	}
-
-	//  send a notification (email) to a customer
-	room, err := m.DB.GetRoomById(reservation.RoomId)
-	if err != nil {
-		helpers.ServerError(w, err)
+	if errors.Is(err, repository.ErrPromoCodeUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, this promo code has just been used up. Please book again without it or with another code.")
+		http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
 		return
 	}
-	mailContent := fmt.Sprintf(`
-		<strong>Your reservation Confirmation</strong> <br>
-		Dear %s, <br>
-			Your Reservation for romm " %s" from %s to %s has been done succefully <br>
-		Regards  <br>
-	`, reservation.FirstName, room.RoomName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"))
-
-	msg := models.MailData{
-		To:       reservation.Email,
-		From:     "kouhadibakr@gmail.com",
-		Subject:  "Confirming your reservation",
-		Content:  mailContent,
-		Template: "basic.html",
+	if errors.Is(err, repository.ErrRoomNotAvailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, this room has just been booked for some of your dates. Please search again for available rooms.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
 	}
-	m.App.MailChan <- msg
-
-	//  send a notification (email)
-	mailContent = fmt.Sprintf(`
-			<strong> A Reservation Notification</strong> <br>
-			Hi, <br>
-				A Reservation for the room " %s " from %s to %s  has been made succefully by %s %s <br>
-			Regards  <br>
-		`, room.RoomName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"), reservation.FirstName, reservation.LastName)
-
-	msg = models.MailData{
-		To:       "kouhadibakr@gmail.com",
-		From:     "contact@bookingapp.com",
-		Subject:  "Reservation Notification",
-		Content:  mailContent,
-		Template: "basic.html",
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "can't insert reservation into database")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
 	}
-	m.App.MailChan <- msg
-
 	// store reservation details into session
 	m.App.Session.Put(r.Context(), "reservation", reservation)
 	// redirect the user to a different url after submitting the form
 	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
 }
 
+// idempotencyTTL is how long a retried booking returns the reservation of the first one instead of booking again
+const idempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKey is the longest idempotency key a client may send
+const maxIdempotencyKey = 255
+
+// idempotencyKey scopes the key a client sent with a booking to where it comes from, e.g. "form", and
+// fingerprints what the booking asks for. There is no key when the client didn't send one.
+func idempotencyKey(scope, key string, request ...string) models.IdempotencyKey {
+	if key == "" || len(key) > maxIdempotencyKey {
+		return models.IdempotencyKey{}
+	}
+	return models.IdempotencyKey{
+		Key:         scope + ":" + key,
+		RequestHash: token.Hash(strings.Join(request, "\x00")),
+		ExpiresAt:   time.Now().Add(idempotencyTTL),
+	}
+}
+
+// reservationMail returns the emails sent when a reservation has been made: a confirmation to the
+// guest and a notification to the owner. They are stored in the outbox along with the reservation.
+// The PDF of the invoice, when there is one, is attached to the confirmation unless it's turned off.
+func (m *Repository) reservationMail(res models.Reservation, inv *models.Invoice) ([]models.MailData, error) {
+	confirmation, err := m.App.Emails.Mail(m.App.Mail.From, res.Email, emails.ReservationConfirmation{Reservation: res})
+	if err != nil {
+		return nil, err
+	}
+	if inv != nil && m.App.Invoice.Attach {
+		confirmation.Attachments = append(confirmation.Attachments, models.MailAttachment{
+			Name:        inv.Number + ".pdf",
+			ContentType: invoice.ContentTypePDF,
+			Data:        invoice.PDF(*inv, m.App.Property),
+		})
+	}
+	notification, err := m.App.Emails.Mail(m.App.Mail.From, m.App.Mail.Owner, emails.OwnerNotification{Reservation: res})
+	if err != nil {
+		return nil, err
+	}
+	return []models.MailData{confirmation, notification}, nil
+}
+
 // /////// make a search-availability page
 // GET
 
 func (m *Repository) SearchAvailability(w http.ResponseWriter, r *http.Request) {
 
-	render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{})
+	render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
 }
 
 // Post
 func (m *Repository) PostSearchAvailability(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
 	start := r.Form.Get("start")
 	end := r.Form.Get("end")
 
+	// only the rooms that can hold the whole party are offered
+	form := forms.New(r.PostForm)
+	adults, children := partyFromForm(form, nil)
+	if !form.Valid() {
+		render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{
+			Form:      form,
+			StringMap: map[string]string{"start": start, "end": end},
+		})
+		return
+	}
+
 	layout := "2006-01-02"
 	startDate, err := time.Parse(layout, start)
 	if err != nil {
@@ -251,13 +394,13 @@ func (m *Repository) PostSearchAvailability(w http.ResponseWriter, r *http.Reque
 		helpers.ServerError(w, err)
 		return
 	}
-	rooms, err := m.DB.SearchAvailablityForAllRooms(startDate, endDate)
+	rooms, err := m.DB.SearchAvailablityForAllRooms(r.Context(), startDate, endDate, adults+children)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 	if len(rooms) == 0 {
-		m.App.Session.Put(r.Context(), "error", " No available rooms for your Dates ")
+		m.App.Session.Put(r.Context(), "error", "No available rooms for your dates and party")
 		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
 		return
 	}
@@ -267,6 +410,8 @@ func (m *Repository) PostSearchAvailability(w http.ResponseWriter, r *http.Reque
 	res := models.Reservation{
 		StartDate: startDate,
 		EndDate:   endDate,
+		Adults:    adults,
+		Children:  children,
 	}
 
 	m.App.Session.Put(r.Context(), "reservation", res)
@@ -305,7 +450,7 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 	endDate, _ := time.Parse(layout, ed)
 	roomId, _ := strconv.Atoi(r.Form.Get("room_id"))
 	// get available room
-	available, err := m.DB.SearchAvailabilityByDatesByRoomID(startDate, endDate, roomId)
+	available, err := m.DB.SearchAvailabilityByDatesByRoomID(r.Context(), startDate, endDate, roomId)
 	if err != nil {
 		resp := jsonResponse{
 			OK:      false,
@@ -331,16 +476,6 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 	w.Write(out)
 }
 
-// /////// general rooms page handler
-func (m *Repository) GeneralRooms(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "generals.page.tmpl", &models.TemplateData{})
-}
-
-// /////// major suite rooms page handler
-func (m *Repository) MajorSuite(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "majors.page.tmpl", &models.TemplateData{})
-}
-
 // //////// ReservationSummary shows the summary of the newly made reservation.
 func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request) {
 	reservation, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
@@ -399,11 +534,16 @@ func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
 
 	var res models.Reservation
 
-	room, err := m.DB.GetRoomById(ID)
+	room, err := m.DB.GetRoomById(r.Context(), ID)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
+	if !room.Active {
+		m.App.Session.Put(r.Context(), "error", "This room can no longer be booked")
+		http.Redirect(w, r, "/rooms", http.StatusSeeOther)
+		return
+	}
 	res.Room.RoomName = room.RoomName
 	res.RoomId = ID
 	res.StartDate = startDate
@@ -431,38 +571,259 @@ func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	email := r.Form.Get("email")
+	email := strings.TrimSpace(r.Form.Get("email"))
 	password := r.Form.Get("password")
 
 	// check the validity of the form inputs
 	form := forms.New(r.PostForm)
 	form.Required("email", "password")
-	form.IsEmail(email)
+	form.IsEmail("email")
 	form.MinLength("password", 4)
-	///************************************* Here is the probelm. when this part is commented, it works fine
-	// email: admin@kouhadi.com
-	// password:pass12
-
-	// if !form.Valid() {
-	// 	render.Template(w, r, "login.page.tmpl", &models.TemplateData{
-	// 		Form: form,
-	// 	})
-	// 	return
-	// }
-	//*************************************/
+	if !form.Valid() {
+		render.Template(w, r, "login.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	// every attempt counts towards the rate limits, whether the password is right or not
+	ip := helpers.ClientIP(r)
+	hits, ok := m.countLoginAttempt(w, r, email, ip, "/user/login")
+	if !ok {
+		return
+	}
+
 	// check the credentials
-	id, _, err := m.DB.Authenticate(email, password)
-	if err != nil {
-		log.Println(err)
+	id, _, err := m.DB.Authenticate(r.Context(), email, password)
+	if errors.Is(err, repository.ErrAccountDisabled) {
+		m.refuseLogin(r, email, ip, models.LoginAccountDisabled)
+		m.App.Session.Put(r.Context(), "error", "This account has been deactivated")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, repository.ErrInvalidCredentials) || errors.Is(err, repository.ErrAccountLocked) {
+		// a locked account gets the same answer as a wrong password, so that it doesn't tell which emails
+		// have an account, only the audit log records why
+		reason := models.LoginInvalidCredentials
+		if errors.Is(err, repository.ErrAccountLocked) {
+			reason = models.LoginAccountLocked
+		}
+		m.refuseLogin(r, email, ip, reason)
+
+		// every failed attempt in a row makes the next response slower
+		_ = limiter.Wait(r.Context(), limiter.Delay(hits, m.App.Login.DelayBase, m.App.Login.DelayMax))
+
 		m.App.Session.Put(r.Context(), "error", "Invalid Login Credentials !")
 		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 		return
 	}
-	m.App.Session.Put(r.Context(), "user_id", id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if user.TOTPEnabled {
+		// the password is right, but the session only gets the user once the second factor is too
+		m.App.Session.Put(r.Context(), "two_factor_user_id", user.ID)
+		m.App.Session.Put(r.Context(), "two_factor_session_version", user.SessionVersion)
+		m.App.Session.Put(r.Context(), "two_factor_expires", time.Now().Add(twoFactorTimeout).Unix())
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+	m.logIn(r, user, email)
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// twoFactorTimeout is how long the second step of a login waits for its code
+const twoFactorTimeout = 5 * time.Minute
+
+// TwoFactor shows the second step of the login, asking for a code of the authenticator app or a recovery code
+func (m *Repository) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := m.pendingLogin(r); !ok {
+		m.App.Session.Put(r.Context(), "error", "Please Log in first !")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+	render.Template(w, r, "two-factor.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostTwoFactor checks the code of the second step of the login and logs the user in. The attempts count
+// towards the same rate limits as the passwords.
+func (m *Repository) PostTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, version, ok := m.pendingLogin(r)
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "Your login has expired, please log in again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+	user, err := m.DB.GetUserByID(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if !user.Active || !user.TOTPEnabled || user.SessionVersion != version {
+		// the account has changed since the password was checked
+		m.clearPendingLogin(r)
+		m.App.Session.Put(r.Context(), "error", "Please log in again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	if !form.Valid() {
+		render.Template(w, r, "two-factor.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	ip := helpers.ClientIP(r)
+	hits, ok := m.countLoginAttempt(w, r, user.Email, ip, "/user/two-factor")
+	if !ok {
+		return
+	}
+	left, err := m.checkSecondFactor(r.Context(), user, form.Get("code"))
+	if errors.Is(err, repository.ErrInvalidCode) {
+		m.refuseLogin(r, user.Email, ip, models.LoginInvalidCode)
+		_ = limiter.Wait(r.Context(), limiter.Delay(hits, m.App.Login.DelayBase, m.App.Login.DelayMax))
+		m.App.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.logIn(r, user, user.Email)
+	if left >= 0 && left <= recoveryCodesLow {
+		m.App.Session.Put(r.Context(), "warning", fmt.Sprintf("You have %d recovery codes left, make new ones from the two-factor authentication page", left))
+	}
 	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// recoveryCodesLow is the number of unused recovery codes under which users are told to make new ones
+const recoveryCodesLow = 3
+
+// countLoginAttempt counts an attempt from ip on email towards both login rate limits and returns the number
+// of attempts in a row. Once a limit is exceeded the attempt is refused: the browser is sent to redirect and
+// false is returned.
+func (m *Repository) countLoginAttempt(w http.ResponseWriter, r *http.Request, email, ip, redirect string) (int, bool) {
+	byIP, err := m.LoginIP.Allow(r.Context(), ip)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return 0, false
+	}
+	byAccount, err := m.LoginAccount.Allow(r.Context(), strings.ToLower(email))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return 0, false
+	}
+	if !byIP.Allowed || !byAccount.Allowed {
+		// the attempts are allowed again once every exceeded limit has been reset
+		var reset time.Time
+		if !byIP.Allowed {
+			reset = byIP.Reset
+		}
+		if !byAccount.Allowed && byAccount.Reset.After(reset) {
+			reset = byAccount.Reset
+		}
+		m.refuseLogin(r, email, ip, models.LoginRateLimited)
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Too many login attempts, try again in %s", waitTime(reset)))
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return 0, false
+	}
+
+	hits := byAccount.Hits
+	if byIP.Hits > hits {
+		hits = byIP.Hits
+	}
+	return hits, true
+}
+
+// checkSecondFactor accepts a code of the user's authenticator app or one of their recovery codes, and uses it
+// up. It returns how many recovery codes are left when one was used, -1 otherwise, and ErrInvalidCode for a
+// wrong or reused code.
+func (m *Repository) checkSecondFactor(ctx context.Context, user models.User, code string) (int, error) {
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		return -1, m.DB.UseTOTPStep(ctx, user.ID, step)
+	}
+	return m.DB.UseRecoveryCode(ctx, user.ID, token.Hash(totp.NormalizeRecoveryCode(code)))
+}
+
+// pendingLogin returns the user whose password has been checked by PostShowLogin and who still has to give
+// their second factor, with the session version they logged in with
+func (m *Repository) pendingLogin(r *http.Request) (int, int, bool) {
+	id := m.App.Session.GetInt(r.Context(), "two_factor_user_id")
+	if id == 0 {
+		return 0, 0, false
+	}
+	if time.Now().Unix() > m.App.Session.GetInt64(r.Context(), "two_factor_expires") {
+		m.clearPendingLogin(r)
+		return 0, 0, false
+	}
+	return id, m.App.Session.GetInt(r.Context(), "two_factor_session_version"), true
+}
+
+// clearPendingLogin forgets the login waiting for its second factor
+func (m *Repository) clearPendingLogin(r *http.Request) {
+	m.App.Session.Remove(r.Context(), "two_factor_user_id")
+	m.App.Session.Remove(r.Context(), "two_factor_session_version")
+	m.App.Session.Remove(r.Context(), "two_factor_expires")
+}
+
+// logIn starts the session of user, once every factor has been checked. The attempts counted on email are
+// forgotten.
+func (m *Repository) logIn(r *http.Request, user models.User, email string) {
+	_ = m.App.Session.RenewToken(r.Context())
+	if err := m.LoginAccount.Reset(r.Context(), strings.ToLower(email)); err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+	m.clearPendingLogin(r)
+	m.App.Session.Put(r.Context(), "user_id", user.ID)
+	// the session ends when the password changes, see the Auth middleware
+	m.App.Session.Put(r.Context(), "session_version", user.SessionVersion)
+}
+
+// refuseLogin stores a refused login attempt for auditing, failing to do so doesn't stop the response
+func (m *Repository) refuseLogin(r *http.Request, email, ip, reason string) {
+	m.App.InfoLog.Printf("login refused for %q from %s: %s", email, ip, reason)
+	err := m.DB.InsertLoginAttempt(r.Context(), models.LoginAttempt{
+		Email:     email,
+		IPAddress: ip,
+		Reason:    reason,
+	})
+	if err != nil {
+		m.App.ErrorLog.Println("cannot store the login attempt:", err)
+	}
+}
+
+// waitTime tells how long until t in words, rounded up to the minute
+func waitTime(t time.Time) string {
+	minutes := int(time.Until(t).Minutes()) + 1
+	if minutes <= 1 {
+		return "a minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
 // ///// Logout
 func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
 	_ = m.App.Session.Destroy(r.Context()) // destroy all data in the session
@@ -479,7 +840,7 @@ func (m *Repository) AminDashboard(w http.ResponseWriter, r *http.Request) {
 
 // shows al new reservations in admin tool
 func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllNewReservations()
+	reservations, err := m.DB.AllNewReservations(r.Context())
 
 	if err != nil {
 		helpers.ServerError(w, err)
@@ -494,7 +855,7 @@ func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request
 
 // all reservations
 func (m *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllReservations()
+	reservations, err := m.DB.AllReservations(r.Context())
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
@@ -524,13 +885,20 @@ func (m *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request
 	strmap["month"] = month
 	strmap["year"] = year
 
-	res, err := m.DB.GetReservationByID(ID)
+	res, err := m.DB.GetReservationByID(r.Context(), ID)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 	datamap := make(map[string]interface{})
 	datamap["reservation"] = res
+	inv, err := m.DB.GetInvoiceByReservationID(r.Context(), ID)
+	if err == nil {
+		datamap["invoice"] = inv
+	} else if !errors.Is(err, repository.ErrNotFound) {
+		helpers.ServerError(w, err)
+		return
+	}
 	render.Template(w, r, "admin-reservations-show.page.tmpl", &models.TemplateData{
 		StringMap: strmap,
 		Data:      datamap,
@@ -555,7 +923,7 @@ func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Req
 	src := exploded[3]
 	strmap := make(map[string]string)
 	strmap["src"] = src
-	res, err := m.DB.GetReservationByID(ID)
+	res, err := m.DB.GetReservationByID(r.Context(), ID)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
@@ -565,8 +933,13 @@ func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Req
 	res.LastName = r.Form.Get("last_name")
 	res.Email = r.Form.Get("email")
 	res.Phone = r.Form.Get("phone")
-	error := m.DB.UpdateReservation(res)
-	if error != nil {
+	webhooks, err := reservationWebhooks(res, models.EventReservationUpdated)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	err = m.DB.UpdateReservation(r.Context(), res, webhooks)
+	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
@@ -586,13 +959,25 @@ func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Requ
 	ID, _ := strconv.Atoi(chi.URLParam(r, "id"))
 	src := chi.URLParam(r, "src")
 
-	error := m.DB.UpdateProcessedForReservation(ID, 1)
-	if error != nil {
-		helpers.ServerError(w, error)
+	res, err := m.DB.GetReservationByID(r.Context(), ID)
+	if err != nil {
+		helpers.ServerError(w, err)
 		return
 	}
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
+	res.Processed = 1
+	webhooks, err := reservationWebhooks(res, models.EventReservationProcessed)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	err = m.DB.UpdateProcessedForReservation(r.Context(), ID, 1, webhooks)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	// the calendar sends the month it was showing along with the form
+	year := r.FormValue("y")
+	month := r.FormValue("m")
 
 	m.App.Session.Put(r.Context(), "flash", "Reservation has been marked as processed succesfully")
 	if year == "" {
@@ -607,9 +992,20 @@ func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Reque
 	ID, _ := strconv.Atoi(chi.URLParam(r, "id"))
 	src := chi.URLParam(r, "src")
 
-	error := m.DB.DeleteReservation(ID)
-	if error != nil {
-		helpers.ServerError(w, error)
+	// the webhook tells what has been deleted, read it while it's there
+	res, err := m.DB.GetReservationByID(r.Context(), ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	webhooks, err := reservationWebhooks(res, models.EventReservationDeleted)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	err = m.DB.DeleteReservation(r.Context(), ID, webhooks)
+	if err != nil {
+		helpers.ServerError(w, err)
 		return
 	}
 	m.App.Session.Put(r.Context(), "flash", "Reservation has been deleted succesfully")
@@ -654,7 +1050,7 @@ func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Re
 
 	intMap := make(map[string]int)
 	intMap["days_in_month"] = lastOfMonth.Day()
-	rooms, err := m.DB.AllRooms()
+	rooms, err := m.DB.AllRooms(r.Context())
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
@@ -669,7 +1065,7 @@ func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Re
 			blockMap[d.Format("2006-01-02")] = 0
 		}
 		// get all restrictions
-		restrictions, err := m.DB.GetRestrictionsFoorRoomByDate(x.ID, firstOfMonth, lastOfMonth)
+		restrictions, err := m.DB.GetRestrictionsFoorRoomByDate(r.Context(), x.ID, firstOfMonth, lastOfMonth)
 		if err != nil {
 			helpers.ServerError(w, err)
 			return
@@ -707,7 +1103,7 @@ func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *htt
 	month, _ := strconv.Atoi(r.Form.Get("m"))
 
 	// get rooms
-	rooms, err := m.DB.AllRooms()
+	rooms, err := m.DB.AllRooms(r.Context())
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
@@ -719,7 +1115,11 @@ func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *htt
 		// get the block map from the session. loop through the map and if we have the entry in the map
 		// that doesn't exist in our posted data, and if the resteriction id > 0, then  it is a block
 		// that we need to remove
-		currMap := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", rm.ID)).(map[string]int) // cast it from interface{} to map[string]int
+		currMap, ok := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", rm.ID)).(map[string]int) // cast it from interface{} to map[string]int
+		if !ok {
+			// the room was added after the calendar was shown, it has no blocks to remove
+			continue
+		}
 		for name, value := range currMap {
 			// ok will be false if the value is in the map
 			if val, ok := currMap[name]; ok {
@@ -728,7 +1128,7 @@ func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *htt
 				if val > 0 {
 					if !form.Has(fmt.Sprintf("remove_block_%d_%s", rm.ID, name), r) {
 						// delete the restriction by id
-						err := m.DB.DeleteBlockByID(value)
+						err := m.DB.DeleteBlockByID(r.Context(), value)
 						if err != nil {
 							log.Println(err)
 						}
@@ -743,7 +1143,7 @@ func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *htt
 			exploded := strings.Split(name, "_")
 			roomID, _ := strconv.Atoi(exploded[2])
 			t, _ := time.Parse("2006-01-02", exploded[3])
-			err := m.DB.InsertBlockForRoom(roomID, t)
+			err := m.DB.InsertBlockForRoom(r.Context(), roomID, t)
 			if err != nil {
 				log.Println(err)
 			}
@@ -756,10 +1156,826 @@ func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *htt
 	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
 }
 
+// AdminFailedMail lists the emails that couldn't be delivered yet, or ever
+func (m *Repository) AdminFailedMail(w http.ResponseWriter, r *http.Request) {
+	mails, err := m.DB.AllFailedMail(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	data := make(map[string]interface{})
+	data["mails"] = mails
+
+	render.Template(w, r, "admin-mail-failed.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminResendMail puts a failed email back in the outbox to be delivered again
+func (m *Repository) AdminResendMail(w http.ResponseWriter, r *http.Request) {
+	ID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.RetryMail(r.Context(), ID)
+	if errors.Is(err, repository.ErrNotFound) {
+		m.App.Session.Put(r.Context(), "error", "This email doesn't exist, was already sent or is being sent right now")
+		http.Redirect(w, r, "/admin/mail-failed", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "The email will be sent again shortly")
+	http.Redirect(w, r, "/admin/mail-failed", http.StatusSeeOther)
+}
+
+// AdminUsers lists the staff accounts
+func (m *Repository) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := m.DB.AllUsers(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	data := make(map[string]interface{})
+	data["users"] = users
+
+	render.Template(w, r, "admin-users.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminNewUser shows the form to create a staff account
+func (m *Repository) AdminNewUser(w http.ResponseWriter, r *http.Request) {
+	m.renderUser(w, r, models.User{AccessLevel: int(models.RoleReadOnly), Active: true, PasswordResetRequired: true}, forms.New(nil))
+}
+
+// AdminPostNewUser creates a staff account
+func (m *Repository) AdminPostNewUser(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	user := userFromForm(form)
+	user.Active = true
+	user.PasswordResetRequired = form.Get("password_reset_required") != ""
+
+	form.Required("password")
+	form.StrongPassword("password", user.FirstName, user.LastName, user.Email)
+	if !validateUser(form, user) {
+		m.renderUser(w, r, user, form)
+		return
+	}
+
+	_, err = m.DB.InsertUser(r.Context(), user, form.Get("password"))
+	if errors.Is(err, repository.ErrDuplicateEmail) {
+		form.Errors.Add("email", "Another user has this email")
+		m.renderUser(w, r, user, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s %s can now log in", user.FirstName, user.LastName))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminShowUser shows the form to edit a staff account
+func (m *Repository) AdminShowUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.userFromURL(w, r)
+	if !ok {
+		return
+	}
+	m.renderUser(w, r, user, forms.New(nil))
+}
+
+// AdminPostUser saves the name, email and role of a staff account
+func (m *Repository) AdminPostUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.userFromURL(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	edited := userFromForm(form)
+	user.FirstName, user.LastName, user.Email = edited.FirstName, edited.LastName, edited.Email
+	// nobody may change their own role, so that the last owner can't lock everyone out
+	if edited.AccessLevel != user.AccessLevel && m.isCurrentUser(r, user.ID) {
+		form.Errors.Add("access_level", "You can't change your own role")
+	}
+	user.AccessLevel = edited.AccessLevel
+	if !validateUser(form, user) {
+		m.renderUser(w, r, user, form)
+		return
+	}
+
+	err = m.DB.UpdateUser(r.Context(), user)
+	if errors.Is(err, repository.ErrDuplicateEmail) {
+		form.Errors.Add("email", "Another user has this email")
+		m.renderUser(w, r, user, form)
+		return
+	}
+	if errors.Is(err, repository.ErrLastOwner) {
+		form.Errors.Add("access_level", lastOwnerError)
+		m.renderUser(w, r, user, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// lastOwnerError is shown when a change would leave nobody able to manage the staff
+const lastOwnerError = "There must be at least one active owner"
+
+// AdminDeactivateUser keeps a staff member from logging in, without deleting the account
+func (m *Repository) AdminDeactivateUser(w http.ResponseWriter, r *http.Request) {
+	m.setUserActive(w, r, false)
+}
+
+// AdminActivateUser lets a deactivated staff member log in again
+func (m *Repository) AdminActivateUser(w http.ResponseWriter, r *http.Request) {
+	m.setUserActive(w, r, true)
+}
+
+func (m *Repository) setUserActive(w http.ResponseWriter, r *http.Request, active bool) {
+	user, ok := m.userFromURL(w, r)
+	if !ok {
+		return
+	}
+	if !active && m.isCurrentUser(r, user.ID) {
+		m.App.Session.Put(r.Context(), "error", "You can't deactivate your own account")
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+		return
+	}
+
+	err := m.DB.SetUserActive(r.Context(), user.ID, active)
+	if errors.Is(err, repository.ErrLastOwner) {
+		m.App.Session.Put(r.Context(), "error", lastOwnerError)
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	msg := fmt.Sprintf("%s %s can log in again", user.FirstName, user.LastName)
+	if !active {
+		msg = fmt.Sprintf("%s %s can no longer log in", user.FirstName, user.LastName)
+	}
+	m.App.Session.Put(r.Context(), "flash", msg)
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminResetUserPassword makes a staff member choose a new password the next time they use the admin.
+// A temporary password can be given for staff who have forgotten theirs.
+func (m *Repository) AdminResetUserPassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.userFromURL(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	if form.Has("password", r) {
+		if !form.StrongPassword("password", user.FirstName, user.LastName, user.Email) {
+			m.renderUser(w, r, user, form)
+			return
+		}
+		_, err = m.DB.UpdatePassword(r.Context(), user.ID, form.Get("password"))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+	// setting a password ends a required reset, so the reset is required afterwards
+	err = m.DB.RequirePasswordReset(r.Context(), user.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s %s has to choose a new password", user.FirstName, user.LastName))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminResetUserTwoFactor turns off two-factor authentication for a staff member who has lost both their phone
+// and their recovery codes. If their role requires it, they have to set it up again before using the admin.
+func (m *Repository) AdminResetUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.userFromURL(w, r)
+	if !ok {
+		return
+	}
+	err := m.DB.DisableTOTP(r.Context(), user.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Two-factor authentication is off for %s %s", user.FirstName, user.LastName))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminDeleteUser deletes a staff account
+func (m *Repository) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.userFromURL(w, r)
+	if !ok {
+		return
+	}
+	if m.isCurrentUser(r, user.ID) {
+		m.App.Session.Put(r.Context(), "error", "You can't delete your own account")
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+		return
+	}
+
+	err := m.DB.DeleteUser(r.Context(), user.ID)
+	if errors.Is(err, repository.ErrLastOwner) {
+		m.App.Session.Put(r.Context(), "error", lastOwnerError)
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s %s has been deleted", user.FirstName, user.LastName))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminAPIKeys lists the API keys and has the form to make a new one
+func (m *Repository) AdminAPIKeys(w http.ResponseWriter, r *http.Request) {
+	m.renderAPIKeys(w, r, models.APIKey{}, forms.New(nil))
+}
+
+// AdminPostAPIKey makes an API key, which is shown once: only its hash is stored
+func (m *Repository) AdminPostAPIKey(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name")
+	apiKey := models.APIKey{Name: strings.TrimSpace(form.Get("name"))}
+	for _, name := range r.PostForm["scopes"] {
+		scope, ok := models.ParseAPIScope(name)
+		if !ok {
+			form.Errors.Add("scopes", "Unknown scope")
+			break
+		}
+		apiKey.Scopes = append(apiKey.Scopes, scope)
+	}
+	if len(apiKey.Scopes) == 0 && form.Errors.Get("scopes") == "" {
+		form.Errors.Add("scopes", "Choose at least one scope")
+	}
+	if !form.Valid() {
+		m.renderAPIKeys(w, r, apiKey, form)
+		return
+	}
+
+	key, prefix, err := token.NewAPIKey()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	apiKey.Prefix = prefix
+	apiKey.KeyHash = token.Hash(key)
+	if user, ok := helpers.CurrentUser(r); ok {
+		apiKey.CreatedBy = user.ID
+	}
+	_, err = m.DB.InsertAPIKey(r.Context(), apiKey)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["api_key"] = apiKey
+	render.Template(w, r, "admin-api-key-created.page.tmpl", &models.TemplateData{
+		StringMap: map[string]string{"key": key},
+		Data:      data,
+	})
+}
+
+// AdminRevokeAPIKey stops an API key from working, for good
+func (m *Repository) AdminRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	err = m.DB.RevokeAPIKey(r.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		m.App.Session.Put(r.Context(), "error", "This API key doesn't exist or has already been revoked")
+		http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "The API key has been revoked")
+	http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+}
+
+// ChangePassword shows the form to choose a new password
+func (m *Repository) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "admin-change-password.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostChangePassword stores the new password of the logged in user
+func (m *Repository) PostChangePassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(r.Context(), m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	if !validateNewPassword(form, user) {
+		render.Template(w, r, "admin-change-password.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	version, err := m.DB.UpdatePassword(r.Context(), user.ID, form.Get("password"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	// every other session of the user has ended, this one goes on with a new token
+	_ = m.App.Session.RenewToken(r.Context())
+	m.App.Session.Put(r.Context(), "session_version", version)
+	m.App.Session.Put(r.Context(), "flash", "Your password has been changed")
+	http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+}
+
+// totpIssuer names the app in the authenticator apps of the staff
+const totpIssuer = "Booking-app"
+
+// AdminTwoFactor shows the two-factor authentication of the logged in user: how to set it up while it's off,
+// how many recovery codes are left once it's on
+func (m *Repository) AdminTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.sessionUser(w, r)
+	if !ok {
+		return
+	}
+	m.renderTwoFactor(w, r, user, forms.New(nil))
+}
+
+// AdminPostEnableTwoFactor turns on two-factor authentication once the user has typed a code of the secret
+// shown by AdminTwoFactor, and shows their recovery codes
+func (m *Repository) AdminPostEnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	user, ok := m.sessionUser(w, r)
+	if !ok {
+		return
+	}
+	secret := m.App.Session.GetString(r.Context(), "two_factor_secret")
+	if user.TOTPEnabled || secret == "" {
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	step, valid := totp.Validate(secret, form.Get("code"), time.Now())
+	if form.Valid() && !valid {
+		form.Errors.Add("code", "This code is wrong, check that the time of your phone is right")
+	}
+	if !form.Valid() {
+		m.renderTwoFactor(w, r, user, form)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	err = m.DB.EnableTOTP(r.Context(), user.ID, secret, step, hashes)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Remove(r.Context(), "two_factor_secret")
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication is on")
+	renderRecoveryCodes(w, r, codes)
+}
+
+// AdminPostRecoveryCodes replaces the recovery codes of the logged in user with new ones, which takes a code
+func (m *Repository) AdminPostRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.confirmSecondFactor(w, r)
+	if !ok {
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	err = m.DB.ReplaceRecoveryCodes(r.Context(), user.ID, hashes)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "Your old recovery codes no longer work")
+	renderRecoveryCodes(w, r, codes)
+}
+
+// AdminPostDisableTwoFactor turns off two-factor authentication for the logged in user, which takes a code.
+// Users whose role requires it can't.
+func (m *Repository) AdminPostDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.confirmSecondFactor(w, r)
+	if !ok {
+		return
+	}
+	if m.App.Login.RequiresTwoFactor(user.Role()) {
+		m.App.Session.Put(r.Context(), "error", "Your role requires two-factor authentication")
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return
+	}
+	err := m.DB.DisableTOTP(r.Context(), user.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication is off")
+	http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+}
+
+// confirmSecondFactor checks the code posted by the logged in user, who has two-factor authentication on,
+// before a change to it. It writes the response and returns false when the code is missing or wrong.
+func (m *Repository) confirmSecondFactor(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.User{}, false
+	}
+	user, ok := m.sessionUser(w, r)
+	if !ok {
+		return user, false
+	}
+	if !user.TOTPEnabled {
+		http.Redirect(w, r, "/admin/two-factor", http.StatusSeeOther)
+		return user, false
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	if form.Valid() {
+		_, err = m.checkSecondFactor(r.Context(), user, form.Get("code"))
+		if errors.Is(err, repository.ErrInvalidCode) {
+			form.Errors.Add("code", "Invalid code")
+		} else if err != nil {
+			helpers.ServerError(w, err)
+			return user, false
+		}
+	}
+	if !form.Valid() {
+		m.renderTwoFactor(w, r, user, form)
+		return user, false
+	}
+	return user, true
+}
+
+// renderTwoFactor shows the two-factor authentication page of user. While it's off, the secret to set up is
+// kept in the session until a code confirms it, so that reloading the page doesn't change the QR code.
+func (m *Repository) renderTwoFactor(w http.ResponseWriter, r *http.Request, user models.User, form *forms.Form) {
+	data := make(map[string]interface{})
+	data["user"] = user
+	data["required"] = m.App.Login.RequiresTwoFactor(user.Role())
+	stringMap := make(map[string]string)
+
+	if user.TOTPEnabled {
+		left, err := m.DB.RecoveryCodesLeft(r.Context(), user.ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["recovery_codes_left"] = left
+	} else {
+		secret := m.App.Session.GetString(r.Context(), "two_factor_secret")
+		if secret == "" {
+			var err error
+			secret, err = totp.NewSecret()
+			if err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+			m.App.Session.Put(r.Context(), "two_factor_secret", secret)
+		}
+		png, err := totp.QRCode(totp.URI(totpIssuer, user.Email, secret), 200)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		stringMap["secret"] = secret
+		data["qr"] = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+
+	render.Template(w, r, "admin-two-factor.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+		Form:      form,
+	})
+}
+
+// renderRecoveryCodes shows new recovery codes, it's the only time they can be seen
+func renderRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string) {
+	data := make(map[string]interface{})
+	data["codes"] = codes
+	render.Template(w, r, "admin-recovery-codes.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// newRecoveryCodes returns a new set of recovery codes with their hashes, which is what gets stored
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, err := totp.NewRecoveryCodes(totp.RecoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, c := range codes {
+		hashes[i] = token.Hash(c)
+	}
+	return codes, hashes, nil
+}
+
+// ForgotPassword shows the form to ask for a password reset link
+func (m *Repository) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "forgot-password.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostForgotPassword emails a password reset link to the user with the email. The response is the same
+// whether there is such a user or not, so that it can't be used to find out who works here.
+func (m *Repository) PostForgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		render.Template(w, r, "forgot-password.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+	email := strings.TrimSpace(form.Get("email"))
+
+	// the rate limits keep the form from being used to flood someone's inbox
+	byIP, err := m.ResetIP.Allow(r.Context(), helpers.ClientIP(r))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	byAccount, err := m.ResetAccount.Allow(r.Context(), strings.ToLower(email))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if byIP.Allowed && byAccount.Allowed {
+		err = m.sendPasswordReset(r, email)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+	m.App.Session.Put(r.Context(), "flash", "If an account has this email, we have sent it a link to reset the password")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// sendPasswordReset stores a new password reset link for the active user with the email and puts the email
+// in the outbox, it does nothing when there is no such user
+func (m *Repository) sendPasswordReset(r *http.Request, email string) error {
+	user, err := m.DB.GetUserByEmail(r.Context(), email)
+	if errors.Is(err, repository.ErrUserNotFound) || (err == nil && !user.Active) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	secret, err := token.New()
+	if err != nil {
+		return err
+	}
+	err = m.DB.InsertPasswordReset(r.Context(), models.PasswordReset{
+		UserID:    user.ID,
+		TokenHash: token.Hash(secret),
+		ExpiresAt: time.Now().Add(m.App.Login.ResetTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	msg, err := m.App.Emails.Mail(m.App.Mail.From, user.Email, emails.PasswordReset{
+		User:     user,
+		Link:     strings.TrimRight(m.App.BaseURL, "/") + "/user/reset-password?token=" + url.QueryEscape(secret),
+		ValidFor: m.App.Login.ResetTTL,
+	})
+	if err != nil {
+		return err
+	}
+	// the outbox sends it, so that a busy mail queue doesn't hold up the request
+	_, err = m.DB.InsertMail(r.Context(), msg)
+	return err
+}
+
+// ResetPassword shows the form to choose a new password, for the link emailed by PostForgotPassword.
+// The link is only used once the form is posted, so that opening it doesn't use it up.
+func (m *Repository) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	form := forms.New(nil)
+	stringMap := make(map[string]string)
+	stringMap["token"] = r.URL.Query().Get("token")
+
+	render.Template(w, r, "reset-password.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Form:      form,
+	})
+}
+
+// PostResetPassword changes the password of the user the link was sent to
+func (m *Repository) PostResetPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("token")
+	if !validateNewPassword(form, models.User{}) {
+		stringMap := make(map[string]string)
+		stringMap["token"] = form.Get("token")
+		render.Template(w, r, "reset-password.page.tmpl", &models.TemplateData{
+			StringMap: stringMap,
+			Form:      form,
+		})
+		return
+	}
+
+	_, err = m.DB.ResetPassword(r.Context(), token.Hash(form.Get("token")), form.Get("password"))
+	if errors.Is(err, repository.ErrInvalidResetToken) {
+		m.App.Session.Put(r.Context(), "error", "This link is invalid or has expired, please ask for a new one")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "Your password has been changed, you can log in with it")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// validateNewPassword checks the password and confirm_password fields of a form choosing a new password for user
+func validateNewPassword(form *forms.Form, user models.User) bool {
+	form.Required("password", "confirm_password")
+	form.StrongPassword("password", user.FirstName, user.LastName, user.Email)
+	if form.Get("password") != form.Get("confirm_password") {
+		form.Errors.Add("confirm_password", "The passwords don't match")
+	}
+	return form.Valid()
+}
+
+// userFromURL loads the user whose id is in the URL, it writes the error response and returns false when it can't
+func (m *Repository) userFromURL(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.User{}, false
+	}
+	user, err := m.DB.GetUserByID(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// renderAPIKeys shows the API keys and the form to make a new one, filled with apiKey
+func (m *Repository) renderAPIKeys(w http.ResponseWriter, r *http.Request, apiKey models.APIKey, form *forms.Form) {
+	keys, err := m.DB.AllAPIKeys(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	chosen := make(map[models.APIScope]bool)
+	for _, s := range apiKey.Scopes {
+		chosen[s] = true
+	}
+
+	data := make(map[string]interface{})
+	data["keys"] = keys
+	data["api_key"] = apiKey
+	data["scopes"] = models.APIScopes
+	data["chosen"] = chosen
+	render.Template(w, r, "admin-api-keys.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// sessionUser loads the logged in user, it writes the error response and returns false when it can't
+func (m *Repository) sessionUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	user, err := m.DB.GetUserByID(r.Context(), m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// isCurrentUser reports whether id is the logged in user
+func (m *Repository) isCurrentUser(r *http.Request, id int) bool {
+	return m.App.Session.GetInt(r.Context(), "user_id") == id
+}
+
+// userFromForm reads the name, email and role of a user from the posted form
+func userFromForm(form *forms.Form) models.User {
+	level, _ := strconv.Atoi(form.Get("access_level"))
+	return models.User{
+		FirstName:   strings.TrimSpace(form.Get("first_name")),
+		LastName:    strings.TrimSpace(form.Get("last_name")),
+		Email:       strings.TrimSpace(form.Get("email")),
+		AccessLevel: level,
+	}
+}
+
+// validateUser checks the fields userFromForm reads and reports whether the whole form is valid
+func validateUser(form *forms.Form, user models.User) bool {
+	form.Required("first_name", "last_name", "email")
+	form.IsEmail("email")
+	if !user.Role().Valid() {
+		form.Errors.Add("access_level", "Choose a role")
+	}
+	return form.Valid()
+}
+
+// renderUser shows the form of a new user (with a zero ID) or of an existing one
+func (m *Repository) renderUser(w http.ResponseWriter, r *http.Request, user models.User, form *forms.Form) {
+	data := make(map[string]interface{})
+	data["user"] = user
+	data["roles"] = models.Roles
+
+	render.Template(w, r, "admin-user.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
 // ////////////////////////// This is only for TESTing purposes
 func NewTestRepo(a *config.AppConfig) *Repository {
+	store := limiter.NewMemory()
+	repo := dbrepo.NewTestingRepo(a)
 	return &Repository{
-		App: a,
-		DB:  dbrepo.NewTestingRepo(a),
+		App:          a,
+		DB:           repo,
+		LoginIP:      limiter.New(store, "login-ip", a.Login.IPLimit, a.Login.Window),
+		LoginAccount: limiter.New(store, "login-account", a.Login.AccountLimit, a.Login.Window),
+		ResetIP:      limiter.New(store, "reset-ip", a.Login.IPLimit, a.Login.Window),
+		ResetAccount: limiter.New(store, "reset-account", a.Login.AccountLimit, a.Login.Window),
+		Pricing:      pricing.New(repo, a.Currency),
+		Promos:       promo.New(repo),
 	}
 }
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -8,10 +9,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/repository/dbrepo"
+	"github.com/mrkouhadi/go-booking-app/internal/totp"
 )
 
 type postData struct {
@@ -28,10 +34,34 @@ var theTests = []struct {
 }{
 	{"home", "/", "GET", []postData{}, http.StatusOK},
 	{"about", "/about", "GET", []postData{}, http.StatusOK},
-	{"generals-quarters", "/generals-quarters", "GET", []postData{}, http.StatusOK},
-	{"majors-suite", "/majors-suite", "GET", []postData{}, http.StatusOK},
+	{"rooms", "/rooms", "GET", []postData{}, http.StatusOK},
+	{"room", "/rooms/room-1", "GET", []postData{}, http.StatusOK},
+	{"unknown-room", "/rooms/nowhere", "GET", []postData{}, http.StatusNotFound},
+	{"inactive-room", "/rooms/room-4", "GET", []postData{}, http.StatusNotFound},
 	{"search-availability", "/search-availability", "GET", []postData{}, http.StatusOK},
 	{"contact", "/contact", "GET", []postData{}, http.StatusOK},
+	{"mail-failed", "/admin/mail-failed", "GET", []postData{}, http.StatusOK},
+	{"users", "/admin/users", "GET", []postData{}, http.StatusOK},
+	{"new-user", "/admin/users/new", "GET", []postData{}, http.StatusOK},
+	{"show-user", "/admin/users/2", "GET", []postData{}, http.StatusOK},
+	{"unknown-user", "/admin/users/99", "GET", []postData{}, http.StatusInternalServerError},
+	{"change-password", "/admin/change-password", "GET", []postData{}, http.StatusOK},
+	{"webhooks", "/admin/webhooks", "GET", []postData{}, http.StatusOK},
+	{"new-webhook", "/admin/webhooks/new", "GET", []postData{}, http.StatusOK},
+	{"show-webhook", "/admin/webhooks/1", "GET", []postData{}, http.StatusOK},
+	{"webhook-deliveries", "/admin/webhooks/deliveries", "GET", []postData{}, http.StatusOK},
+	{"promo-codes", "/admin/promo-codes", "GET", []postData{}, http.StatusOK},
+	{"new-promo-code", "/admin/promo-codes/new", "GET", []postData{}, http.StatusOK},
+	{"show-promo-code", "/admin/promo-codes/3", "GET", []postData{}, http.StatusOK},
+	{"promo-report", "/admin/promo-codes/report", "GET", []postData{}, http.StatusOK},
+	{"room-types", "/admin/room-types", "GET", []postData{}, http.StatusOK},
+	{"new-room-type", "/admin/room-types/new", "GET", []postData{}, http.StatusOK},
+	{"show-room-type", "/admin/room-types/2", "GET", []postData{}, http.StatusOK},
+	{"admin-rooms", "/admin/rooms", "GET", []postData{}, http.StatusOK},
+	{"new-room", "/admin/rooms/new", "GET", []postData{}, http.StatusOK},
+	{"show-room", "/admin/rooms/4", "GET", []postData{}, http.StatusOK},
+	{"forgot-password", "/user/forgot-password", "GET", []postData{}, http.StatusOK},
+	{"reset-password", "/user/reset-password?token=abc", "GET", []postData{}, http.StatusOK},
 	// {"make-res", "/make-reservation", "GET", []postData{}, http.StatusOK},
 	// {"search-availability", "/search-availability", "POST", []postData{
 	// 	{key: "start", value: "2020-03-09"},
@@ -70,7 +100,9 @@ func TestHandlers(t *testing.T) {
 
 func TestRepository_Resrvation(t *testing.T) {
 	reservation := models.Reservation{
-		RoomId: 1,
+		RoomId:    1,
+		StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
 		Room: models.Room{
 			ID:       1,
 			RoomName: "General's Quarters",
@@ -88,6 +120,26 @@ func TestRepository_Resrvation(t *testing.T) {
 	if rr.Code != http.StatusOK {
 		t.Errorf("MakeReservation handler returns wrong response code. got %d, wanted %d", rr.Code, http.StatusOK)
 	}
+	if !regexp.MustCompile(`name="idempotency_key" value="[A-Za-z0-9_-]{43}"`).MatchString(rr.Body.String()) {
+		t.Error("expected the form to have an idempotency key")
+	}
+	// a Saturday night at the weekend rate and a Sunday night
+	if !strings.Contains(rr.Body.String(), "$120.00") || !strings.Contains(rr.Body.String(), "$220.00") {
+		t.Error("expected the price of the nights and the total of the stay")
+	}
+
+	// test a stay that can't be priced
+	req, _ = http.NewRequest("GET", "/make-reservation", nil)
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	rr = httptest.NewRecorder()
+	invalid := reservation
+	invalid.EndDate = invalid.StartDate
+	session.Put(ctx, "reservation", invalid)
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/search-availability" {
+		t.Errorf("expected a stay without nights to be searched again, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
 
 	// test case where reservation is not in the session (reset everything)
 	req, _ = http.NewRequest("GET", "/make-reservation", nil)
@@ -230,7 +282,7 @@ func TestRepository_PostReservation(t *testing.T) {
 	}
 	// testing wrong data
 	postedData = url.Values{}
-	postedData.Add("start_date", "invalid")
+	postedData.Add("start_date", "2050-01-01")
 	postedData.Add("end_date", "2050-01-10")
 	postedData.Add("first_name", "B")
 	postedData.Add("last_name", "Kouhadi")
@@ -247,13 +299,17 @@ func TestRepository_PostReservation(t *testing.T) {
 	handler = http.HandlerFunc(Repo.PostMakeReservation)
 
 	handler.ServeHTTP(rr, req)
-	if rr.Code != http.StatusSeeOther {
-		t.Errorf("PostMakeReservation handler returns wrong response code for invalid DATA. got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	// the form is shown again with its errors
+	if rr.Code != http.StatusOK {
+		t.Errorf("PostMakeReservation handler returns wrong response code for invalid DATA. got %d, wanted %d", rr.Code, http.StatusOK)
+	}
+	if !strings.Contains(rr.Body.String(), "first_name") {
+		t.Error("PostMakeReservation handler doesn't show the form again for invalid DATA")
 	}
 
-	// testing failure of inserting a reservation to the database
+	// testing failure of the booking transaction
 	postedData = url.Values{}
-	postedData.Add("start_date", "invalid")
+	postedData.Add("start_date", "2050-01-01")
 	postedData.Add("end_date", "2050-01-10")
 	postedData.Add("first_name", "Bryan")
 	postedData.Add("last_name", "Kouhadi")
@@ -274,15 +330,15 @@ func TestRepository_PostReservation(t *testing.T) {
 		t.Errorf("PostMakeReservation handler failed when trying to fail inserting reservation to DB. got %d, wanted %d", rr.Code, http.StatusTemporaryRedirect)
 	}
 
-	// testing failure of inserting a restriction to the database
+	// testing a room that has been booked by someone else in the meantime
 	postedData = url.Values{}
-	postedData.Add("start_date", "invalid")
+	postedData.Add("start_date", "2050-01-01")
 	postedData.Add("end_date", "2050-01-10")
 	postedData.Add("first_name", "Bryan")
 	postedData.Add("last_name", "Kouhadi")
 	postedData.Add("email", "Kouhadi@bryan.com")
 	postedData.Add("phone", "15598789198")
-	postedData.Add("room_id", "1000000") // giving an imposible number to generate failure
+	postedData.Add("room_id", "3") // the test repo reports room 3 as no longer available
 
 	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
 	ctx = getCtx(req)
@@ -292,11 +348,159 @@ func TestRepository_PostReservation(t *testing.T) {
 
 	handler = http.HandlerFunc(Repo.PostMakeReservation)
 
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("PostMakeReservation handler returns wrong response code for a room no longer available. got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+	if loc := rr.Header().Get("Location"); loc != "/search-availability" {
+		t.Errorf("PostMakeReservation handler redirects to the wrong page for a room no longer available. got %s, wanted %s", loc, "/search-availability")
+	}
+}
+func TestRepository_PostReservationCancelled(t *testing.T) {
+	postedData := url.Values{}
+	postedData.Add("start_date", "2050-01-01")
+	postedData.Add("end_date", "2050-01-10")
+	postedData.Add("first_name", "Bryan")
+	postedData.Add("last_name", "Kouhadi")
+	postedData.Add("email", "Kouhadi@bryan.com")
+	postedData.Add("phone", "15598789198")
+	postedData.Add("room_id", "1")
+
+	req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+	// the client went away before the reservation could be stored
+	ctx, cancel := context.WithCancel(getCtx(req))
+	cancel()
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.PostMakeReservation)
+
 	handler.ServeHTTP(rr, req)
 	if rr.Code != http.StatusTemporaryRedirect {
-		t.Errorf("PostMakeReservation handler failed when trying to fail inserting restriction to DB. got %d, wanted %d", rr.Code, http.StatusTemporaryRedirect)
+		t.Errorf("PostMakeReservation handler returns wrong response code for a cancelled request. got %d, wanted %d", rr.Code, http.StatusTemporaryRedirect)
+	}
+	if session.Exists(ctx, "reservation") {
+		t.Error("PostMakeReservation stored a reservation in the session although the request was cancelled")
+	}
+}
+
+func TestRepository_PostReservationQueuesMail(t *testing.T) {
+	// a repo of its own so that the outbox only holds the mail of this reservation
+	repo := NewTestRepo(&app)
+
+	postedData := url.Values{}
+	postedData.Add("start_date", "2050-01-01")
+	postedData.Add("end_date", "2050-01-10")
+	postedData.Add("first_name", "Bryan")
+	postedData.Add("last_name", "Kouhadi")
+	postedData.Add("email", "Kouhadi@bryan.com")
+	postedData.Add("phone", "15598789198")
+	postedData.Add("room_id", "1")
+
+	req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(repo.PostMakeReservation)
+
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("PostMakeReservation handler returns wrong response code. got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+
+	mails, err := repo.DB.ClaimMail(context.Background(), 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 2 {
+		t.Fatalf("expected the confirmation and the notification in the outbox, got %d emails", len(mails))
+	}
+	if mails[0].To != "Kouhadi@bryan.com" || mails[0].Template != "reservation-confirmation" {
+		t.Errorf("expected the confirmation to go to the guest, got %s to %s", mails[0].Template, mails[0].To)
+	}
+	if mails[1].To != "owner@bookingapp.com" || mails[1].Template != "owner-notification" {
+		t.Errorf("expected the notification to go to the owner, got %s to %s", mails[1].Template, mails[1].To)
+	}
+	if !strings.Contains(mails[0].Text, "Dear Bryan") {
+		t.Errorf("expected the guest's name in the text part, got:\n%s", mails[0].Text)
+	}
+	// 3 weekend and 6 week nights, less 10% for a stay of a week
+	if !strings.Contains(mails[0].Text, "$864.00") || !strings.Contains(mails[1].Text, "$864.00") {
+		t.Errorf("expected the total of the stay in the emails, got:\n%s", mails[0].Text)
+	}
+	res, ok := session.Get(ctx, "reservation").(models.Reservation)
+	if !ok || res.TotalCents != 86400 || res.Currency != "USD" {
+		t.Errorf("expected the total to be frozen onto the reservation, got %d %q", res.TotalCents, res.Currency)
+	}
+	if len(mails[0].Attachments) != 1 || mails[0].Attachments[0].Name != "INV-000001.pdf" ||
+		!bytes.HasPrefix(mails[0].Attachments[0].Data, []byte("%PDF-")) {
+		t.Errorf("expected the invoice attached to the confirmation, got %+v", mails[0].Attachments)
+	}
+	if len(mails[1].Attachments) != 0 {
+		t.Errorf("expected no attachment to the owner's notification, got %d", len(mails[1].Attachments))
+	}
+	inv, err := repo.DB.GetInvoiceByReservationID(context.Background(), res.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stay, the cleaning and resort fees, VAT and the city tax
+	if len(inv.Lines) != 5 || inv.SubtotalCents != 86400+5000+9*1500 || inv.TotalCents <= inv.SubtotalCents {
+		t.Errorf("expected the invoice to be issued with the reservation, got %+v", inv)
+	}
+
+	deliveries, err := repo.DB.RecentWebhookDeliveries(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Event != models.EventReservationCreated {
+		t.Errorf("expected a reservation.created webhook for the subscribed endpoint, got %+v", deliveries)
 	}
 }
+
+func TestRepository_AdminResendMail(t *testing.T) {
+	ctx := context.Background()
+	failed, err := Repo.DB.InsertMail(ctx, models.MailData{To: "failed@example.com", Subject: "failed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Repo.DB.MarkMailFailed(ctx, failed, "mailbox full", time.Now(), true); err != nil {
+		t.Fatal(err)
+	}
+	sent, err := Repo.DB.InsertMail(ctx, models.MailData{To: "sent@example.com", Subject: "sent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Repo.DB.MarkMailSent(ctx, sent); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		id             string
+		expectedStatus int
+		expectedFlash  string
+	}{
+		{"resend", strconv.Itoa(failed), http.StatusSeeOther, "flash"},
+		{"already sent", strconv.Itoa(sent), http.StatusSeeOther, "error"},
+		{"unknown email", "99999", http.StatusSeeOther, "error"},
+		{"invalid id", "x", http.StatusInternalServerError, ""},
+		{"database error", "1000000", http.StatusInternalServerError, ""},
+	}
+
+	for _, e := range tests {
+		rr, ctx := postAdminUser(Repo.AdminResendMail, e.id, nil)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: AdminResendMail returns wrong response code. got %d, wanted %d", e.name, rr.Code, e.expectedStatus)
+		}
+		if e.expectedFlash != "" && (rr.Header().Get("Location") != "/admin/mail-failed" || session.GetString(ctx, e.expectedFlash) == "") {
+			t.Errorf("%s: expected a redirect to the failed emails with a %s message", e.name, e.expectedFlash)
+		}
+	}
+}
+
 func TestRepository_AvailabilityJSON(t *testing.T) {
 	// first case: rooms are not available
 	reqBody := "start=2050-01-01"
@@ -331,3 +535,550 @@ func getCtx(req *http.Request) context.Context {
 	}
 	return ctx
 }
+
+// postLogin posts the login form from ip and returns the response and the error flashed to the user
+func postLogin(email, password, ip string) (*httptest.ResponseRecorder, string) {
+	form := url.Values{}
+	form.Add("email", email)
+	form.Add("password", password)
+	rr, ctx := postForm(Repo.PostShowLogin, "/user/login", ip, form)
+	return rr, session.GetString(ctx, "error")
+}
+
+func TestRepository_PostShowLogin(t *testing.T) {
+	tests := []struct {
+		name             string
+		email            string
+		password         string
+		expectedStatus   int
+		expectedLocation string
+		expectedError    string
+	}{
+		{"valid", "admin@example.com", "password", http.StatusSeeOther, "/", ""},
+		{"invalid email", "admin", "password", http.StatusOK, "", ""},
+		{"missing password", "admin@example.com", "", http.StatusOK, "", ""},
+		{"wrong password", "admin@example.com", "wrong-password", http.StatusSeeOther, "/user/login", "Invalid Login Credentials !"},
+		{"locked account", "locked@example.com", "password", http.StatusSeeOther, "/user/login", "Invalid Login Credentials !"},
+		{"deactivated account", "inactive@example.com", "password", http.StatusSeeOther, "/user/login", "deactivated"},
+		{"database error", "error@example.com", "password", http.StatusInternalServerError, "", ""},
+	}
+
+	for i, e := range tests {
+		// every case comes from its own address so that the rate limits don't get in the way
+		rr, flash := postLogin(e.email, e.password, fmt.Sprintf("10.0.1.%d", i))
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: PostShowLogin returns wrong response code. got %d, wanted %d", e.name, rr.Code, e.expectedStatus)
+		}
+		if e.expectedLocation != "" && rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+		if !strings.Contains(flash, e.expectedError) {
+			t.Errorf("%s: expected the error %q, got %q", e.name, e.expectedError, flash)
+		}
+	}
+}
+
+func TestRepository_PostShowLoginRateLimits(t *testing.T) {
+	// app.Login.AccountLimit is 3: the 4th attempt on an account is refused, whatever the address
+	for i := 1; i <= 3; i++ {
+		rr, _ := postLogin("guessed@example.com", "wrong-password", fmt.Sprintf("10.0.2.%d", i))
+		if rr.Header().Get("Retry-After") != "" {
+			t.Fatalf("attempt %d on the account was rate limited", i)
+		}
+	}
+	rr, flash := postLogin("guessed@example.com", "password", "10.0.2.4")
+	if rr.Code != http.StatusSeeOther || !strings.Contains(flash, "Too many login attempts") {
+		t.Errorf("expected the account to be rate limited, got %d and %q", rr.Code, flash)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+
+	// app.Login.IPLimit is 5: the 6th attempt from an address is refused, whatever the account
+	for i := 1; i <= 5; i++ {
+		if rr, _ := postLogin(fmt.Sprintf("user%d@example.com", i), "wrong-password", "10.0.3.1"); rr.Header().Get("Retry-After") != "" {
+			t.Fatalf("attempt %d from the address was rate limited", i)
+		}
+	}
+	if _, flash := postLogin("user6@example.com", "password", "10.0.3.1"); !strings.Contains(flash, "Too many login attempts") {
+		t.Errorf("expected the address to be rate limited, got %q", flash)
+	}
+
+	// a successful login clears the attempts on the account
+	for i := 1; i <= 2; i++ {
+		postLogin("forgetful@example.com", "wrong-password", "10.0.4.1")
+	}
+	postLogin("forgetful@example.com", "password", "10.0.4.1")
+	for i := 1; i <= 3; i++ {
+		if _, flash := postLogin("forgetful@example.com", "wrong-password", "10.0.4.2"); strings.Contains(flash, "Too many") {
+			t.Fatalf("attempt %d after a successful login was rate limited", i)
+		}
+	}
+}
+
+// postAdminUser posts form to handler as the logged in user 1, with id as the {id} URL parameter
+func postAdminUser(handler http.HandlerFunc, id string, form url.Values) (*httptest.ResponseRecorder, context.Context) {
+	return serve(handler, testRequest{
+		method:  "POST",
+		target:  "/admin/users/" + id,
+		params:  map[string]string{"id": id},
+		session: map[string]interface{}{"user_id": 1},
+		form:    form,
+	})
+}
+
+func TestRepository_AdminPostNewUser(t *testing.T) {
+	valid := url.Values{
+		"first_name":   {"Jane"},
+		"last_name":    {"Doe"},
+		"email":        {"jane@example.com"},
+		"access_level": {"2"},
+		"password":     {"a long password 1"},
+	}
+	with := func(key, value string) url.Values {
+		form := url.Values{}
+		for k, v := range valid {
+			form[k] = v
+		}
+		form.Set(key, value)
+		return form
+	}
+
+	tests := []struct {
+		name           string
+		form           url.Values
+		expectedStatus int
+	}{
+		{"valid", valid, http.StatusSeeOther},
+		{"missing name", with("first_name", ""), http.StatusOK},
+		{"invalid email", with("email", "jane"), http.StatusOK},
+		{"unknown role", with("access_level", "9"), http.StatusOK},
+		{"short password", with("password", "short"), http.StatusOK},
+		{"email taken", with("email", "taken@example.com"), http.StatusOK},
+	}
+
+	for _, e := range tests {
+		rr, _ := postAdminUser(Repo.AdminPostNewUser, "new", e.form)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: AdminPostNewUser returns wrong response code. got %d, wanted %d", e.name, rr.Code, e.expectedStatus)
+		}
+		if e.expectedStatus == http.StatusSeeOther && rr.Header().Get("Location") != "/admin/users" {
+			t.Errorf("%s: expected redirect to /admin/users, got %s", e.name, rr.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRepository_AdminPostUser(t *testing.T) {
+	form := func(level string) url.Values {
+		return url.Values{
+			"first_name":   {"Staff"},
+			"last_name":    {"Member"},
+			"email":        {"staff@example.com"},
+			"access_level": {level},
+		}
+	}
+
+	tests := []struct {
+		name           string
+		id             string
+		form           url.Values
+		expectedStatus int
+	}{
+		{"change a role", "2", form("3"), http.StatusSeeOther},
+		{"edit yourself", "1", form("1"), http.StatusSeeOther},
+		{"change your own role", "1", form("4"), http.StatusOK},
+		{"demote the last owner", "4", form("3"), http.StatusOK},
+		{"edit the last owner", "4", form("4"), http.StatusSeeOther},
+		{"unknown user", "99", form("1"), http.StatusInternalServerError},
+	}
+
+	for _, e := range tests {
+		rr, _ := postAdminUser(Repo.AdminPostUser, e.id, e.form)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: AdminPostUser returns wrong response code. got %d, wanted %d", e.name, rr.Code, e.expectedStatus)
+		}
+	}
+}
+
+func TestRepository_AdminUserActions(t *testing.T) {
+	tests := []struct {
+		name             string
+		handler          http.HandlerFunc
+		id               string
+		form             url.Values
+		expectedStatus   int
+		expectedLocation string
+		expectedError    string
+	}{
+		{"deactivate", Repo.AdminDeactivateUser, "2", nil, http.StatusSeeOther, "/admin/users", ""},
+		{"deactivate yourself", Repo.AdminDeactivateUser, "1", nil, http.StatusSeeOther, "/admin/users/1", "You can't deactivate your own account"},
+		{"activate", Repo.AdminActivateUser, "5", nil, http.StatusSeeOther, "/admin/users", ""},
+		{"delete", Repo.AdminDeleteUser, "2", nil, http.StatusSeeOther, "/admin/users", ""},
+		{"delete yourself", Repo.AdminDeleteUser, "1", nil, http.StatusSeeOther, "/admin/users/1", "You can't delete your own account"},
+		{"deactivate the last owner", Repo.AdminDeactivateUser, "4", nil, http.StatusSeeOther, "/admin/users/4", "There must be at least one active owner"},
+		{"delete the last owner", Repo.AdminDeleteUser, "4", nil, http.StatusSeeOther, "/admin/users/4", "There must be at least one active owner"},
+		{"delete unknown user", Repo.AdminDeleteUser, "99", nil, http.StatusInternalServerError, "", ""},
+		{"require a new password", Repo.AdminResetUserPassword, "2", nil, http.StatusSeeOther, "/admin/users", ""},
+		{"temporary password", Repo.AdminResetUserPassword, "2", url.Values{"password": {"temporary password 1"}}, http.StatusSeeOther, "/admin/users", ""},
+		{"short temporary password", Repo.AdminResetUserPassword, "2", url.Values{"password": {"short"}}, http.StatusOK, "", ""},
+	}
+
+	for _, e := range tests {
+		rr, ctx := postAdminUser(e.handler, e.id, e.form)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong response code. got %d, wanted %d", e.name, rr.Code, e.expectedStatus)
+		}
+		if e.expectedLocation != "" && rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+		if flash := session.GetString(ctx, "error"); flash != e.expectedError {
+			t.Errorf("%s: expected the error %q, got %q", e.name, e.expectedError, flash)
+		}
+	}
+}
+
+func TestRepository_PostChangePassword(t *testing.T) {
+	tests := []struct {
+		name           string
+		form           url.Values
+		expectedStatus int
+	}{
+		{"valid", url.Values{"password": {"a new password 1"}, "confirm_password": {"a new password 1"}}, http.StatusSeeOther},
+		{"too short", url.Values{"password": {"short"}, "confirm_password": {"short"}}, http.StatusOK},
+		{"not confirmed", url.Values{"password": {"a new password 1"}, "confirm_password": {"another password 1"}}, http.StatusOK},
+		{"no digits or symbols", url.Values{"password": {"a new password"}, "confirm_password": {"a new password"}}, http.StatusOK},
+		{"contains the email", url.Values{"password": {"staff1-secret"}, "confirm_password": {"staff1-secret"}}, http.StatusOK},
+	}
+
+	for _, e := range tests {
+		rr, _ := postAdminUser(Repo.PostChangePassword, "", e.form)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: PostChangePassword returns wrong response code. got %d, wanted %d", e.name, rr.Code, e.expectedStatus)
+		}
+	}
+}
+
+// postForm posts form to handler from ip and returns the response and the session of the request
+func postForm(handler http.HandlerFunc, target, ip string, form url.Values) (*httptest.ResponseRecorder, context.Context) {
+	return serve(handler, testRequest{method: "POST", target: target, ip: ip, form: form})
+}
+
+func TestRepository_PostForgotPassword(t *testing.T) {
+	// a repo of its own so that the outbox only holds the reset emails
+	repo := NewTestRepo(&app)
+
+	tests := []struct {
+		name           string
+		email          string
+		expectedStatus int
+		expectedMail   bool
+	}{
+		{"known user", "staff2@example.com", http.StatusSeeOther, true},
+		{"unknown user", "nobody@example.com", http.StatusSeeOther, false},
+		{"deactivated user", "staff5@example.com", http.StatusSeeOther, false},
+		{"invalid email", "staff2", http.StatusOK, false},
+		{"database error", "error@example.com", http.StatusInternalServerError, false},
+	}
+
+	for i, e := range tests {
+		rr, ctx := postForm(repo.PostForgotPassword, "/user/forgot-password", fmt.Sprintf("10.0.5.%d", i), url.Values{"email": {e.email}})
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: PostForgotPassword returns wrong response code. got %d, wanted %d", e.name, rr.Code, e.expectedStatus)
+		}
+		// the answer doesn't tell whether the user exists
+		if rr.Code == http.StatusSeeOther && !strings.Contains(session.GetString(ctx, "flash"), "If an account has this email") {
+			t.Errorf("%s: expected the same answer for every email, got %q", e.name, session.GetString(ctx, "flash"))
+		}
+
+		mails, err := repo.DB.ClaimMail(context.Background(), 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !e.expectedMail {
+			if len(mails) != 0 {
+				t.Errorf("%s: expected no email, got one to %s", e.name, mails[0].To)
+			}
+			continue
+		}
+		if len(mails) != 1 {
+			t.Errorf("%s: expected the reset email in the outbox, got %d emails", e.name, len(mails))
+			continue
+		}
+		if mails[0].To != e.email || mails[0].Template != "password-reset" {
+			t.Errorf("%s: expected the reset email to %s, got %s to %s", e.name, e.email, mails[0].Template, mails[0].To)
+		}
+		if !strings.Contains(mails[0].Text, "https://bookings.example.com/user/reset-password?token=") {
+			t.Errorf("%s: expected the reset link in the email, got:\n%s", e.name, mails[0].Text)
+		}
+	}
+}
+
+func TestRepository_PostForgotPasswordRateLimits(t *testing.T) {
+	repo := NewTestRepo(&app)
+
+	// app.Login.AccountLimit is 3: the 4th request for an account sends no email
+	for i := 1; i <= 4; i++ {
+		rr, _ := postForm(repo.PostForgotPassword, "/user/forgot-password", fmt.Sprintf("10.0.12.%d", i), url.Values{"email": {"staff2@example.com"}})
+		if rr.Code != http.StatusSeeOther {
+			t.Fatalf("request %d: PostForgotPassword returns wrong response code. got %d, wanted %d", i, rr.Code, http.StatusSeeOther)
+		}
+	}
+	mails, err := repo.DB.ClaimMail(context.Background(), 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 3 {
+		t.Errorf("expected 3 reset emails, got %d", len(mails))
+	}
+
+	// the requests have limits of their own, the user can still log in
+	allowed, err := repo.LoginAccount.Allow(context.Background(), "staff2@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowed.Allowed || allowed.Hits != 1 {
+		t.Errorf("expected the reset requests not to count as login attempts, got %+v", allowed)
+	}
+}
+
+func TestRepository_PostResetPassword(t *testing.T) {
+	tests := []struct {
+		name             string
+		form             url.Values
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"valid", url.Values{"token": {"valid-token"}, "password": {"a new password 1"}, "confirm_password": {"a new password 1"}}, http.StatusSeeOther, "/user/login"},
+		{"used or expired token", url.Values{"token": {"old-token"}, "password": {"a new password 1"}, "confirm_password": {"a new password 1"}}, http.StatusSeeOther, "/user/forgot-password"},
+		{"missing token", url.Values{"password": {"a new password 1"}, "confirm_password": {"a new password 1"}}, http.StatusOK, ""},
+		{"weak password", url.Values{"token": {"valid-token"}, "password": {"password"}, "confirm_password": {"password"}}, http.StatusOK, ""},
+	}
+
+	for _, e := range tests {
+		rr, _ := postForm(Repo.PostResetPassword, "/user/reset-password", "10.0.6.1", e.form)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: PostResetPassword returns wrong response code. got %d, wanted %d", e.name, rr.Code, e.expectedStatus)
+		}
+		if e.expectedLocation != "" && rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRepository_PostShowLoginTwoFactor(t *testing.T) {
+	// user 7 of the test repo has two-factor authentication on
+	form := url.Values{"email": {"staff7@example.com"}, "password": {"password"}}
+	rr, ctx := postForm(Repo.PostShowLogin, "/user/login", "10.0.7.1", form)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/user/two-factor" {
+		t.Fatalf("expected a redirect to the second step, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if session.Exists(ctx, "user_id") {
+		t.Error("expected the user not to be logged in before the second factor")
+	}
+	if session.GetInt(ctx, "two_factor_user_id") != 7 {
+		t.Errorf("expected the login of user 7 to wait for the second factor, got %d", session.GetInt(ctx, "two_factor_user_id"))
+	}
+}
+
+func TestRepository_PostTwoFactor(t *testing.T) {
+	code, err := totp.Code(dbrepo.TestTOTPSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := func(expires time.Duration, version int) map[string]interface{} {
+		return map[string]interface{}{
+			"two_factor_user_id":         7,
+			"two_factor_session_version": version,
+			"two_factor_expires":         time.Now().Add(expires).Unix(),
+		}
+	}
+
+	tests := []struct {
+		name             string
+		session          map[string]interface{}
+		code             string
+		expectedStatus   int
+		expectedLocation string
+		loggedIn         bool
+	}{
+		{"authenticator code", pending(time.Minute, 0), code, http.StatusSeeOther, "/", true},
+		{"recovery code", pending(time.Minute, 0), strings.ToUpper(dbrepo.TestRecoveryCode), http.StatusSeeOther, "/", true},
+		{"wrong code", pending(time.Minute, 0), "12345", http.StatusSeeOther, "/user/two-factor", false},
+		{"missing code", pending(time.Minute, 0), "", http.StatusOK, "", false},
+		{"expired", pending(-time.Second, 0), code, http.StatusSeeOther, "/user/login", false},
+		{"password changed since", pending(time.Minute, 3), code, http.StatusSeeOther, "/user/login", false},
+		{"no password checked", nil, code, http.StatusSeeOther, "/user/login", false},
+	}
+
+	for i, e := range tests {
+		rr, ctx := serve(Repo.PostTwoFactor, testRequest{method: "POST", target: "/user/two-factor", ip: fmt.Sprintf("10.0.8.%d", i), session: e.session, form: url.Values{"code": {e.code}}})
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: PostTwoFactor returns wrong response code. got %d, wanted %d", e.name, rr.Code, e.expectedStatus)
+		}
+		if e.expectedLocation != "" && rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+		if session.Exists(ctx, "user_id") != e.loggedIn {
+			t.Errorf("%s: expected the user to be logged in: %v", e.name, e.loggedIn)
+		}
+		if e.loggedIn && session.Exists(ctx, "two_factor_user_id") {
+			t.Errorf("%s: expected the pending login to be cleared", e.name)
+		}
+		// the test repo has 2 recovery codes left after one is used
+		if e.name == "recovery code" && !strings.Contains(session.GetString(ctx, "warning"), "2 recovery codes left") {
+			t.Errorf("%s: expected a warning about the recovery codes left, got %q", e.name, session.GetString(ctx, "warning"))
+		}
+	}
+}
+
+func TestRepository_AdminPostEnableTwoFactor(t *testing.T) {
+	secret, _ := totp.NewSecret()
+	code, _ := totp.Code(secret, time.Now())
+
+	tests := []struct {
+		name           string
+		session        map[string]interface{}
+		code           string
+		expectedStatus int
+		enabled        bool
+	}{
+		{"valid code", map[string]interface{}{"user_id": 1, "two_factor_secret": secret}, code, http.StatusOK, true},
+		{"wrong code", map[string]interface{}{"user_id": 1, "two_factor_secret": secret}, "12345", http.StatusOK, false},
+		{"no secret shown", map[string]interface{}{"user_id": 1}, code, http.StatusSeeOther, false},
+		{"already on", map[string]interface{}{"user_id": 7, "two_factor_secret": secret}, code, http.StatusSeeOther, false},
+	}
+
+	for _, e := range tests {
+		rr, ctx := serve(Repo.AdminPostEnableTwoFactor, testRequest{method: "POST", target: "/admin/two-factor/enable", ip: "10.0.9.1", session: e.session, form: url.Values{"code": {e.code}}})
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: AdminPostEnableTwoFactor returns wrong response code. got %d, wanted %d", e.name, rr.Code, e.expectedStatus)
+		}
+		if strings.Contains(rr.Body.String(), "only time they are shown") != e.enabled {
+			t.Errorf("%s: expected the recovery codes to be shown: %v", e.name, e.enabled)
+		}
+		// a wrong code shows the QR code again, drawn by the app rather than by a script from elsewhere
+		if rr.Code == http.StatusOK && !e.enabled && !strings.Contains(rr.Body.String(), `src="data:image/png;base64,`) {
+			t.Errorf("%s: expected the QR code to be shown again", e.name)
+		}
+		// the secret is forgotten once it's stored
+		if e.enabled && session.Exists(ctx, "two_factor_secret") {
+			t.Errorf("%s: expected the secret to be removed from the session", e.name)
+		}
+	}
+}
+
+func TestRepository_AdminPostDisableTwoFactor(t *testing.T) {
+	code, _ := totp.Code(dbrepo.TestTOTPSecret, time.Now())
+	post := func(code string) (*httptest.ResponseRecorder, context.Context) {
+		return serve(Repo.AdminPostDisableTwoFactor, testRequest{method: "POST", target: "/admin/two-factor/disable", ip: "10.0.9.2", session: map[string]interface{}{"user_id": 7}, form: url.Values{"code": {code}}})
+	}
+
+	if rr, _ := post("12345"); rr.Code != http.StatusOK {
+		t.Errorf("expected the form again for a wrong code, got %d", rr.Code)
+	}
+	rr, ctx := post(code)
+	if rr.Code != http.StatusSeeOther || !strings.Contains(session.GetString(ctx, "flash"), "is off") {
+		t.Errorf("expected two-factor authentication to be turned off, got %d and %q", rr.Code, session.GetString(ctx, "flash"))
+	}
+
+	// user 7 is front desk
+	app.Login.TwoFactorRoles = []models.Role{models.RoleFrontDesk}
+	defer func() { app.Login.TwoFactorRoles = nil }()
+	rr, ctx = post(code)
+	if rr.Code != http.StatusSeeOther || !strings.Contains(session.GetString(ctx, "error"), "requires two-factor") {
+		t.Errorf("expected a role that requires it to keep two-factor authentication, got %d and %q", rr.Code, session.GetString(ctx, "error"))
+	}
+}
+
+func TestRepository_AdminPostAPIKey(t *testing.T) {
+	tests := []struct {
+		name          string
+		form          url.Values
+		expectedText  string
+		expectedError string
+	}{
+		{"created", url.Values{"name": {"front desk tablet"}, "scopes": {"availability:read", "reservations:write"}}, "only time", ""},
+		{"no name", url.Values{"scopes": {"admin"}}, "New API key", "name"},
+		{"no scope", url.Values{"name": {"tablet"}}, "Choose at least one scope", "scopes"},
+		{"unknown scope", url.Values{"name": {"tablet"}, "scopes": {"rooms:delete"}}, "Unknown scope", "scopes"},
+	}
+	for _, e := range tests {
+		rr, _ := postAdminUser(Repo.AdminPostAPIKey, "", e.form)
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", e.name, rr.Code)
+		}
+		body := rr.Body.String()
+		if !strings.Contains(body, e.expectedText) {
+			t.Errorf("%s: expected %q in the page", e.name, e.expectedText)
+		}
+		if e.expectedError == "" && !regexp.MustCompile(`bk_[0-9a-f]{8}_[A-Za-z0-9_-]{43}`).MatchString(body) {
+			t.Errorf("%s: expected the new key in the page", e.name)
+		}
+	}
+}
+
+func TestRepository_AdminRevokeAPIKey(t *testing.T) {
+	tests := []struct {
+		name           string
+		id             string
+		expectedStatus int
+		expectedFlash  string
+	}{
+		{"revoked", "1", http.StatusSeeOther, "flash"},
+		{"already revoked", "4", http.StatusSeeOther, "error"},
+		{"invalid id", "x", http.StatusInternalServerError, ""},
+		{"database error", "1000000", http.StatusInternalServerError, ""},
+	}
+	for _, e := range tests {
+		rr, ctx := postAdminUser(Repo.AdminRevokeAPIKey, e.id, nil)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedFlash != "" && (rr.Header().Get("Location") != "/admin/api-keys" || session.GetString(ctx, e.expectedFlash) == "") {
+			t.Errorf("%s: expected a redirect to the API keys with a %s message", e.name, e.expectedFlash)
+		}
+	}
+}
+
+func TestRepository_PostReservationIdempotency(t *testing.T) {
+	tests := []struct {
+		name             string
+		key              string
+		expectedLocation string
+		expectedID       int
+	}{
+		{"sent twice", "replayed", "/reservation-summary", 1},
+		{"key of another form", "reused", "/search-availability", 0},
+	}
+	for _, e := range tests {
+		// a repo of its own so that the outbox only holds the mail of this reservation
+		repo := NewTestRepo(&app)
+		form := url.Values{
+			"start_date":      {"2050-01-01"},
+			"end_date":        {"2050-01-10"},
+			"first_name":      {"Bryan"},
+			"last_name":       {"Kouhadi"},
+			"email":           {"Kouhadi@bryan.com"},
+			"phone":           {"15598789198"},
+			"room_id":         {"1"},
+			"idempotency_key": {e.key},
+		}
+		rr, ctx := postForm(repo.PostMakeReservation, "/make-reservation", "10.0.10.1", form)
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected a redirect to %s, got %d to %q", e.name, e.expectedLocation, rr.Code, rr.Header().Get("Location"))
+		}
+		if res, _ := session.Get(ctx, "reservation").(models.Reservation); res.ID != e.expectedID {
+			t.Errorf("%s: expected reservation %d in the session, got %d", e.name, e.expectedID, res.ID)
+		}
+		mails, err := repo.DB.ClaimMail(context.Background(), 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mails) != 0 {
+			t.Errorf("%s: expected no email for a form sent again, got %d", e.name, len(mails))
+		}
+		if deliveries, _ := repo.DB.RecentWebhookDeliveries(context.Background(), 10); len(deliveries) != 0 {
+			t.Errorf("%s: expected no webhook for a form sent again, got %d", e.name, len(deliveries))
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mrkouhadi/go-booking-app/internal/helpers"
+	"github.com/mrkouhadi/go-booking-app/internal/invoice"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
+)
+
+// bookingInvoice returns the invoice issued along with a new reservation, there is none when the stay
+// has no price
+func (m *Repository) bookingInvoice(ctx context.Context, res models.Reservation) (*models.Invoice, error) {
+	if res.TotalCents == 0 {
+		return nil, nil
+	}
+	charges, err := m.DB.AllCharges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inv := invoice.Build(res, charges)
+	return &inv, nil
+}
+
+// AdminReservationInvoice downloads the invoice of a reservation as an HTML page
+func (m *Repository) AdminReservationInvoice(w http.ResponseWriter, r *http.Request) {
+	inv, ok := m.invoiceFromURL(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", inv.Number+".html"))
+	if err := invoice.HTML(w, inv, m.App.Property); err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+}
+
+// AdminReservationInvoicePDF downloads the invoice of a reservation as a PDF document
+func (m *Repository) AdminReservationInvoicePDF(w http.ResponseWriter, r *http.Request) {
+	inv, ok := m.invoiceFromURL(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", invoice.ContentTypePDF)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", inv.Number+".pdf"))
+	_, _ = w.Write(invoice.PDF(inv, m.App.Property))
+}
+
+// AdminIssueInvoice issues the invoice of a priced reservation made before invoices existed. Issuing it
+// again does nothing, an invoice never changes once issued.
+func (m *Repository) AdminIssueInvoice(w http.ResponseWriter, r *http.Request) {
+	src := chi.URLParam(r, "src")
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	show := fmt.Sprintf("/admin/reservations/%s/%d/show", src, id)
+
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if res.TotalCents == 0 {
+		m.App.Session.Put(r.Context(), "error", "This reservation has no price to invoice")
+		http.Redirect(w, r, show, http.StatusSeeOther)
+		return
+	}
+	charges, err := m.DB.AllCharges(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	inv, err := m.DB.IssueInvoice(r.Context(), invoice.Build(res, charges))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "Invoice "+inv.Number+" has been issued")
+	http.Redirect(w, r, show, http.StatusSeeOther)
+}
+
+// invoiceFromURL loads the invoice of the reservation of the {id} URL parameter, it writes the error
+// response and returns false when it can't
+func (m *Repository) invoiceFromURL(w http.ResponseWriter, r *http.Request) (models.Invoice, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.Invoice{}, false
+	}
+	inv, err := m.DB.GetInvoiceByReservationID(r.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.NotFound(w, r)
+		return models.Invoice{}, false
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.Invoice{}, false
+	}
+	return inv, true
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// invoiceRequest is a request to an invoice handler of reservation id of the new reservations
+func invoiceRequest(method, id string) testRequest {
+	return testRequest{method: method, target: "/admin/reservations/new/" + id + "/invoice", params: map[string]string{"src": "new", "id": id}}
+}
+
+func TestRepository_AdminIssueInvoice(t *testing.T) {
+	// a repo of its own so that no other test has issued invoices yet
+	repo := NewTestRepo(&app)
+
+	tests := []struct {
+		name           string
+		id             string
+		expectedStatus int
+		expectedFlash  string
+	}{
+		{"issued", "7", http.StatusSeeOther, "flash"},
+		{"issued again", "7", http.StatusSeeOther, "flash"},
+		{"unknown reservation", "101", http.StatusInternalServerError, ""},
+		{"invalid id", "x", http.StatusInternalServerError, ""},
+		{"database error", "1000000", http.StatusInternalServerError, ""},
+	}
+	for _, e := range tests {
+		rr, ctx := serve(repo.AdminIssueInvoice, invoiceRequest("POST", e.id))
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedFlash != "" && (rr.Header().Get("Location") != "/admin/reservations/new/"+e.id+"/show" || session.GetString(ctx, e.expectedFlash) == "") {
+			t.Errorf("%s: expected a redirect to the reservation with a %s message", e.name, e.expectedFlash)
+		}
+	}
+
+	inv, err := repo.DB.GetInvoiceByReservationID(context.Background(), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// issuing again keeps the first invoice
+	if inv.Number != "INV-000001" || inv.ReservationID != 7 {
+		t.Errorf("expected a single invoice for reservation 7, got %s for %d", inv.Number, inv.ReservationID)
+	}
+	// $220.00 for the stay, $50.00 of cleaning and $30.00 of resort fee, 10% VAT and $5.00 of city tax
+	if inv.SubtotalCents != 30000 || inv.TaxCents != 3500 || inv.TotalCents != 33500 {
+		t.Errorf("expected 300.00 + 35.00 = 335.00, got %d + %d = %d", inv.SubtotalCents, inv.TaxCents, inv.TotalCents)
+	}
+}
+
+func TestRepository_AdminReservationInvoice(t *testing.T) {
+	repo := NewTestRepo(&app)
+	if rr, _ := serve(repo.AdminIssueInvoice, invoiceRequest("POST", "8")); rr.Code != http.StatusSeeOther {
+		t.Fatalf("can't issue the invoice, got %d", rr.Code)
+	}
+
+	tests := []struct {
+		name           string
+		handler        http.HandlerFunc
+		id             string
+		expectedStatus int
+		expectedType   string
+		expectedBody   string
+	}{
+		{"html", repo.AdminReservationInvoice, "8", http.StatusOK, "text/html; charset=utf-8", "INV-000001"},
+		{"pdf", repo.AdminReservationInvoicePDF, "8", http.StatusOK, "application/pdf", "%PDF-"},
+		{"no invoice", repo.AdminReservationInvoice, "9", http.StatusNotFound, "", ""},
+		{"no pdf", repo.AdminReservationInvoicePDF, "9", http.StatusNotFound, "", ""},
+		{"invalid id", repo.AdminReservationInvoice, "x", http.StatusInternalServerError, "", ""},
+		{"database error", repo.AdminReservationInvoicePDF, "1000000", http.StatusInternalServerError, "", ""},
+	}
+	for _, e := range tests {
+		rr, _ := serve(e.handler, invoiceRequest("GET", e.id))
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if e.expectedType == "" {
+			continue
+		}
+		if got := rr.Header().Get("Content-Type"); got != e.expectedType {
+			t.Errorf("%s: expected content type %q, got %q", e.name, e.expectedType, got)
+		}
+		if !strings.HasPrefix(rr.Header().Get("Content-Disposition"), `attachment; filename="INV-000001.`) {
+			t.Errorf("%s: expected a download, got %q", e.name, rr.Header().Get("Content-Disposition"))
+		}
+		if !bytes.Contains(rr.Body.Bytes(), []byte(e.expectedBody)) {
+			t.Errorf("%s: expected %q in the document", e.name, e.expectedBody)
+		}
+	}
+}
+
+func TestRepository_AdminShowReservationInvoice(t *testing.T) {
+	repo := NewTestRepo(&app)
+	show := func() string {
+		rr, _ := serve(repo.AdminShowReservation, testRequest{method: "GET", target: "/admin/reservations/new/10/show"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("AdminShowReservation returns %d", rr.Code)
+		}
+		return rr.Body.String()
+	}
+
+	if body := show(); !strings.Contains(body, `value="Issue invoice"`) {
+		t.Error("expected a button to issue the missing invoice")
+	}
+	if rr, _ := serve(repo.AdminIssueInvoice, invoiceRequest("POST", "10")); rr.Code != http.StatusSeeOther {
+		t.Fatalf("can't issue the invoice, got %d", rr.Code)
+	}
+	body := show()
+	if !strings.Contains(body, "INV-000001") || !strings.Contains(body, "/admin/reservations/new/10/invoice.pdf") {
+		t.Error("expected the number of the invoice and its downloads")
+	}
+	if strings.Contains(body, `value="Issue invoice"`) {
+		t.Error("expected no button to issue an invoice that has been issued")
+	}
+}
@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mrkouhadi/go-booking-app/internal/forms"
+	"github.com/mrkouhadi/go-booking-app/internal/helpers"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/promo"
+	"github.com/mrkouhadi/go-booking-app/internal/render"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
+)
+
+// Guests type promo codes when they book, PostMakeReservation checks them with m.Promos and the redemption is
+// recorded along with the reservation. The staff manage the codes and follow their redemptions here.
+
+// promoReportSize is how many redemptions the report lists
+const promoReportSize = 200
+
+// AdminPromoCodes lists the promo codes with how often they have been redeemed
+func (m *Repository) AdminPromoCodes(w http.ResponseWriter, r *http.Request) {
+	codes, err := m.DB.AllPromoCodes(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	data := make(map[string]interface{})
+	data["promo_codes"] = codes
+
+	render.Template(w, r, "admin-promo-codes.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: map[string]string{"currency": m.App.Currency},
+	})
+}
+
+// AdminNewPromoCode shows the form to add a promo code
+func (m *Repository) AdminNewPromoCode(w http.ResponseWriter, r *http.Request) {
+	m.renderPromoCode(w, r, models.PromoCode{Kind: models.PromoPercent, Active: true}, forms.New(nil))
+}
+
+// AdminPostNewPromoCode adds a promo code
+func (m *Repository) AdminPostNewPromoCode(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	p := promoCodeFromForm(form)
+	if !form.Valid() {
+		m.renderPromoCode(w, r, p, form)
+		return
+	}
+
+	_, err = m.DB.InsertPromoCode(r.Context(), p)
+	if errors.Is(err, repository.ErrDuplicatePromoCode) {
+		form.Errors.Add("code", "Another promo code has this code")
+		m.renderPromoCode(w, r, p, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "The promo code "+p.Code+" has been added")
+	http.Redirect(w, r, "/admin/promo-codes", http.StatusSeeOther)
+}
+
+// AdminShowPromoCode shows the form to edit a promo code
+func (m *Repository) AdminShowPromoCode(w http.ResponseWriter, r *http.Request) {
+	p, ok := m.promoCodeFromURL(w, r)
+	if !ok {
+		return
+	}
+	m.renderPromoCode(w, r, p, forms.New(nil))
+}
+
+// AdminPostPromoCode saves a promo code. The redemptions already made keep their discount.
+func (m *Repository) AdminPostPromoCode(w http.ResponseWriter, r *http.Request) {
+	stored, ok := m.promoCodeFromURL(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	p := promoCodeFromForm(form)
+	p.ID = stored.ID
+	if !form.Valid() {
+		m.renderPromoCode(w, r, p, form)
+		return
+	}
+
+	err = m.DB.UpdatePromoCode(r.Context(), p)
+	if errors.Is(err, repository.ErrDuplicatePromoCode) {
+		form.Errors.Add("code", "Another promo code has this code")
+		m.renderPromoCode(w, r, p, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, "/admin/promo-codes", http.StatusSeeOther)
+}
+
+// AdminDeletePromoCode deletes a promo code that has never been redeemed, the others can only be deactivated
+func (m *Repository) AdminDeletePromoCode(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	err = m.DB.DeletePromoCode(r.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		m.App.Session.Put(r.Context(), "error", "This promo code doesn't exist")
+		http.Redirect(w, r, "/admin/promo-codes", http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, repository.ErrPromoCodeRedeemed) {
+		m.App.Session.Put(r.Context(), "error", "This promo code has been redeemed, deactivate it instead")
+		http.Redirect(w, r, fmt.Sprintf("/admin/promo-codes/%d", id), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "The promo code has been deleted")
+	http.Redirect(w, r, "/admin/promo-codes", http.StatusSeeOther)
+}
+
+// AdminPromoReport shows what every promo code has been redeemed for, along with the latest redemptions
+func (m *Repository) AdminPromoReport(w http.ResponseWriter, r *http.Request) {
+	codes, err := m.DB.AllPromoCodes(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	redemptions, err := m.DB.PromoRedemptions(r.Context(), promoReportSize)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	var uses, discount int
+	for _, p := range codes {
+		uses += p.Uses
+		discount += p.RedeemedCents
+	}
+
+	data := make(map[string]interface{})
+	data["promo_codes"] = codes
+	data["redemptions"] = redemptions
+	render.Template(w, r, "admin-promo-report.page.tmpl", &models.TemplateData{
+		Data:      data,
+		IntMap:    map[string]int{"uses": uses, "discount_cents": discount},
+		StringMap: map[string]string{"currency": m.App.Currency},
+	})
+}
+
+// promoCodeFromURL loads the promo code of the {id} URL parameter, it writes the error response and returns
+// false when it can't
+func (m *Repository) promoCodeFromURL(w http.ResponseWriter, r *http.Request) (models.PromoCode, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.PromoCode{}, false
+	}
+	p, err := m.DB.GetPromoCodeByID(r.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		m.App.Session.Put(r.Context(), "error", "This promo code doesn't exist")
+		http.Redirect(w, r, "/admin/promo-codes", http.StatusSeeOther)
+		return models.PromoCode{}, false
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.PromoCode{}, false
+	}
+	return p, true
+}
+
+// promoCodeFromForm reads and checks the fields of the promo code form, the errors are added to the form
+func promoCodeFromForm(form *forms.Form) models.PromoCode {
+	p := models.PromoCode{
+		Code:        promo.Normalize(form.Get("code")),
+		Description: strings.TrimSpace(form.Get("description")),
+		Kind:        models.PromoKind(form.Get("kind")),
+		Active:      form.Get("active") != "",
+	}
+
+	form.Required("code")
+	if p.Code != "" && !promo.ValidCode(p.Code) {
+		form.Errors.Add("code", fmt.Sprintf("Use up to %d letters, digits and dashes", promo.MaxCodeLength))
+	}
+
+	switch p.Kind {
+	case models.PromoPercent:
+		p.Percent = formInt(form, "percent")
+		if form.Errors.Get("percent") == "" && (p.Percent < 1 || p.Percent > 100) {
+			form.Errors.Add("percent", "Enter a percentage from 1 to 100")
+		}
+	case models.PromoFixed:
+		p.AmountCents = formCents(form, "amount")
+		if form.Errors.Get("amount") == "" && p.AmountCents <= 0 {
+			form.Errors.Add("amount", "Enter the amount taken off")
+		}
+	default:
+		form.Errors.Add("kind", "Choose a percentage or a fixed amount")
+	}
+
+	p.ValidFrom = formDate(form, "valid_from")
+	p.ValidUntil = formDate(form, "valid_until")
+	if !p.ValidFrom.IsZero() && !p.ValidUntil.IsZero() && p.ValidUntil.Before(p.ValidFrom) {
+		form.Errors.Add("valid_until", "The last day can't be before the first one")
+	}
+
+	for _, v := range form.Values["rooms"] {
+		if id, err := strconv.Atoi(v); err == nil && id > 0 {
+			p.RoomIDs = append(p.RoomIDs, id)
+		}
+	}
+	p.MinNights = formInt(form, "min_nights")
+	p.MaxUses = formInt(form, "max_uses")
+	p.MaxUsesPerGuest = formInt(form, "max_uses_per_guest")
+	return p
+}
+
+// formInt reads a whole number of 0 or more from field, a blank field is 0
+func formInt(form *forms.Form, field string) int {
+	value := strings.TrimSpace(form.Get(field))
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		form.Errors.Add(field, "Enter a whole number")
+		return 0
+	}
+	return n
+}
+
+// formCents reads an amount of money such as 50 or 12.50 from field and returns it in cents
+func formCents(form *forms.Form, field string) int {
+	value := strings.TrimSpace(form.Get(field))
+	if value == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 || f > 1e9 {
+		form.Errors.Add(field, "Enter an amount such as 50 or 12.50")
+		return 0
+	}
+	return int(math.Round(f * 100))
+}
+
+// formDate reads a date such as 2050-01-31 from field, a blank field is the zero time
+func formDate(form *forms.Form, field string) time.Time {
+	value := strings.TrimSpace(form.Get(field))
+	if value == "" {
+		return time.Time{}
+	}
+	d, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		form.Errors.Add(field, "Enter a date such as 2050-01-31")
+		return time.Time{}
+	}
+	return d
+}
+
+// renderPromoCode shows the form of a new promo code (with a zero ID) or of an existing one
+func (m *Repository) renderPromoCode(w http.ResponseWriter, r *http.Request, p models.PromoCode, form *forms.Form) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	chosen := make(map[int]bool)
+	for _, id := range p.RoomIDs {
+		chosen[id] = true
+	}
+
+	stringMap := map[string]string{"currency": m.App.Currency}
+	if p.AmountCents > 0 {
+		stringMap["amount"] = fmt.Sprintf("%d.%02d", p.AmountCents/100, p.AmountCents%100)
+	}
+
+	data := make(map[string]interface{})
+	data["promo_code"] = p
+	data["rooms"] = rooms
+	data["chosen_rooms"] = chosen
+	render.Template(w, r, "admin-promo-code.page.tmpl", &models.TemplateData{
+		Data:      data,
+		Form:      form,
+		StringMap: stringMap,
+	})
+}
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+)
+
+// promoReservation is the form of a 9 night stay in room 1 with the promo code
+func promoReservation(code, email string) url.Values {
+	return url.Values{
+		"start_date": {"2050-01-01"},
+		"end_date":   {"2050-01-10"},
+		"first_name": {"Bryan"},
+		"last_name":  {"Kouhadi"},
+		"email":      {email},
+		"phone":      {"15598789198"},
+		"room_id":    {"1"},
+		"promo_code": {code},
+	}
+}
+
+func TestRepository_PostReservationPromoCode(t *testing.T) {
+	repo := NewTestRepo(&app)
+
+	rr, ctx := postForm(repo.PostMakeReservation, "/make-reservation", "10.0.11.1", promoReservation(" summer10 ", "Guest@example.com"))
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/reservation-summary" {
+		t.Fatalf("expected a redirect to the summary, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+	res, _ := session.Get(ctx, "reservation").(models.Reservation)
+	// $864.00 for the stay less 10% for a stay of a week, then 10% off with the code
+	if res.PromoCode != "SUMMER10" || res.PromoCents != 8640 || res.TotalCents != 77760 {
+		t.Errorf("expected 86.40 off with SUMMER10, got %d off with %q for %d", res.PromoCents, res.PromoCode, res.TotalCents)
+	}
+
+	redemptions, err := repo.DB.PromoRedemptions(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var redeemed *models.PromoRedemption
+	for i := range redemptions {
+		if redemptions[i].ReservationID == res.ID {
+			redeemed = &redemptions[i]
+		}
+	}
+	if redeemed == nil || redeemed.Code != "SUMMER10" || redeemed.DiscountCents != 8640 || redeemed.GuestEmail != "guest@example.com" {
+		t.Errorf("expected the redemption recorded against reservation %d, got %+v", res.ID, redeemed)
+	}
+
+	inv, err := repo.DB.GetInvoiceByReservationID(context.Background(), res.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inv.Lines) != 6 || inv.Lines[1].Kind != models.InvoiceLineDiscount || inv.Lines[1].AmountCents != -8640 {
+		t.Errorf("expected the discount on the invoice after the stay, got %+v", inv.Lines)
+	}
+}
+
+func TestRepository_PostReservationInvalidPromoCode(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  string
+		email string
+	}{
+		{"unknown", "NOPE", "guest@example.com"},
+		{"expired", "EXPIRED", "guest@example.com"},
+		{"used up", "USEDUP", "guest@example.com"},
+		{"deactivated", "OLD", "guest@example.com"},
+		{"other room", "SUITE", "guest@example.com"},
+		{"used by the guest", "WELCOME", "Used@example.com"},
+	}
+	for _, e := range tests {
+		repo := NewTestRepo(&app)
+		rr, ctx := postForm(repo.PostMakeReservation, "/make-reservation", "10.0.11.2", promoReservation(e.code, e.email))
+		if rr.Code != http.StatusOK || rr.Header().Get("Location") != "" {
+			t.Errorf("%s: expected the form shown again, got %d to %q", e.name, rr.Code, rr.Header().Get("Location"))
+		}
+		if !strings.Contains(rr.Body.String(), "This promo code") && !strings.Contains(rr.Body.String(), "already used") {
+			t.Errorf("%s: expected why the code can't be redeemed in the form", e.name)
+		}
+		if _, ok := session.Get(ctx, "reservation").(models.Reservation); ok {
+			t.Errorf("%s: expected no reservation", e.name)
+		}
+		if redemptions, _ := repo.DB.PromoRedemptions(context.Background(), 10); len(redemptions) != 2 {
+			t.Errorf("%s: expected no redemption, got %d", e.name, len(redemptions))
+		}
+	}
+
+	rr, _ := postForm(Repo.PostMakeReservation, "/make-reservation", "10.0.11.3", promoReservation("BROKEN", "guest@example.com"))
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Errorf("database error: expected %d, got %d", http.StatusTemporaryRedirect, rr.Code)
+	}
+
+	// the last use of the code is taken by another guest between the check and the booking
+	rr, ctx := postForm(Repo.PostMakeReservation, "/make-reservation", "10.0.11.4", promoReservation("LASTONE", "guest@example.com"))
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/make-reservation" || session.GetString(ctx, "error") == "" {
+		t.Errorf("taken: expected a redirect to the form with an error, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func TestRepository_PostReservationPromoCodeOfDeletedReservation(t *testing.T) {
+	repo := NewTestRepo(&app)
+
+	// USEDUP has been used once, by reservation 2
+	if err := repo.DB.DeleteReservation(context.Background(), 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	rr, ctx := postForm(repo.PostMakeReservation, "/make-reservation", "10.0.11.5", promoReservation("USEDUP", "guest@example.com"))
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/reservation-summary" {
+		t.Fatalf("expected the redemption of a deleted reservation not to count, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if res, _ := session.Get(ctx, "reservation").(models.Reservation); res.PromoCode != "USEDUP" {
+		t.Errorf("expected the reservation to be made with USEDUP, got %q", res.PromoCode)
+	}
+	// the redemption of the deleted reservation stays for the report
+	if redemptions, _ := repo.DB.PromoRedemptions(context.Background(), 10); len(redemptions) != 3 {
+		t.Errorf("expected 3 redemptions, got %d", len(redemptions))
+	}
+}
+
+func TestRepository_AdminPostNewPromoCode(t *testing.T) {
+	valid := url.Values{
+		"code":               {"spring-25"},
+		"kind":               {"percent"},
+		"percent":            {"25"},
+		"valid_from":         {"2050-03-01"},
+		"valid_until":        {"2050-05-31"},
+		"rooms":              {"1", "2"},
+		"min_nights":         {"2"},
+		"max_uses":           {"100"},
+		"max_uses_per_guest": {"1"},
+		"active":             {"1"},
+	}
+	with := func(key, value string) url.Values {
+		form := url.Values{}
+		for k, v := range valid {
+			form[k] = v
+		}
+		form.Set(key, value)
+		return form
+	}
+
+	tests := []struct {
+		name           string
+		form           url.Values
+		expectedStatus int
+	}{
+		{"valid", valid, http.StatusSeeOther},
+		{"fixed amount", with("kind", "fixed"), http.StatusOK},
+		{"missing code", with("code", ""), http.StatusOK},
+		{"invalid code", with("code", "SPRING 25"), http.StatusOK},
+		{"code taken", with("code", "summer10"), http.StatusOK},
+		{"unknown kind", with("kind", "free"), http.StatusOK},
+		{"too much off", with("percent", "120"), http.StatusOK},
+		{"invalid date", with("valid_until", "May 31"), http.StatusOK},
+		{"ends before it starts", with("valid_until", "2050-02-01"), http.StatusOK},
+		{"negative limit", with("max_uses", "-1"), http.StatusOK},
+		{"database error", with("code", "BROKEN"), http.StatusInternalServerError},
+	}
+	for _, e := range tests {
+		repo := NewTestRepo(&app)
+		rr, _ := postAdminUser(repo.AdminPostNewPromoCode, "new", e.form)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedStatus == http.StatusSeeOther && rr.Header().Get("Location") != "/admin/promo-codes" {
+			t.Errorf("%s: expected a redirect to /admin/promo-codes, got %q", e.name, rr.Header().Get("Location"))
+		}
+	}
+
+	repo := NewTestRepo(&app)
+	form := with("kind", "fixed")
+	form.Set("amount", "12.50")
+	if rr, _ := postAdminUser(repo.AdminPostNewPromoCode, "new", form); rr.Code != http.StatusSeeOther {
+		t.Fatalf("can't add a fixed amount, got %d", rr.Code)
+	}
+	p, err := repo.DB.GetPromoCodeByCode(context.Background(), "SPRING-25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Kind != models.PromoFixed || p.AmountCents != 1250 || len(p.RoomIDs) != 2 || p.MinNights != 2 || p.MaxUsesPerGuest != 1 || !p.Active {
+		t.Errorf("expected the code stored as typed, got %+v", p)
+	}
+}
+
+func TestRepository_AdminPostPromoCode(t *testing.T) {
+	form := url.Values{"code": {"SUMMER10"}, "kind": {"percent"}, "percent": {"15"}}
+
+	tests := []struct {
+		name             string
+		id               string
+		form             url.Values
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"saved", "1", form, http.StatusSeeOther, "/admin/promo-codes"},
+		{"code of another", "1", url.Values{"code": {"WELCOME"}, "kind": {"percent"}, "percent": {"15"}}, http.StatusOK, ""},
+		{"invalid", "1", url.Values{"code": {"SUMMER10"}, "kind": {"percent"}}, http.StatusOK, ""},
+		{"unknown code", "99", form, http.StatusSeeOther, "/admin/promo-codes"},
+		{"invalid id", "x", form, http.StatusInternalServerError, ""},
+		{"database error", "1000000", form, http.StatusInternalServerError, ""},
+	}
+	for _, e := range tests {
+		repo := NewTestRepo(&app)
+		rr, _ := postAdminUser(repo.AdminPostPromoCode, e.id, e.form)
+		if rr.Code != e.expectedStatus || rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected %d to %q, got %d to %q", e.name, e.expectedStatus, e.expectedLocation, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+
+	repo := NewTestRepo(&app)
+	if rr, _ := postAdminUser(repo.AdminPostPromoCode, "1", form); rr.Code != http.StatusSeeOther {
+		t.Fatalf("can't save the code, got %d", rr.Code)
+	}
+	p, err := repo.DB.GetPromoCodeByID(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the form has no active box ticked, saving it deactivates the code
+	if p.Percent != 15 || p.Active {
+		t.Errorf("expected 15%% off and deactivated, got %+v", p)
+	}
+}
+
+func TestRepository_AdminDeletePromoCode(t *testing.T) {
+	tests := []struct {
+		name             string
+		id               string
+		expectedStatus   int
+		expectedLocation string
+		expectedFlash    string
+	}{
+		{"never redeemed", "1", http.StatusSeeOther, "/admin/promo-codes", "flash"},
+		{"redeemed", "5", http.StatusSeeOther, "/admin/promo-codes/5", "error"},
+		{"unknown code", "99", http.StatusSeeOther, "/admin/promo-codes", "error"},
+		{"invalid id", "x", http.StatusInternalServerError, "", ""},
+		{"database error", "1000000", http.StatusInternalServerError, "", ""},
+	}
+	for _, e := range tests {
+		repo := NewTestRepo(&app)
+		rr, ctx := postAdminUser(repo.AdminDeletePromoCode, e.id, url.Values{})
+		if rr.Code != e.expectedStatus || rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected %d to %q, got %d to %q", e.name, e.expectedStatus, e.expectedLocation, rr.Code, rr.Header().Get("Location"))
+		}
+		if e.expectedFlash != "" && session.GetString(ctx, e.expectedFlash) == "" {
+			t.Errorf("%s: expected a %s message", e.name, e.expectedFlash)
+		}
+	}
+}
+
+func TestRepository_AdminPromoReport(t *testing.T) {
+	repo := NewTestRepo(&app)
+	if rr, _ := postForm(repo.PostMakeReservation, "/make-reservation", "10.0.11.5", promoReservation("WELCOME", "guest@example.com")); rr.Code != http.StatusSeeOther {
+		t.Fatalf("can't book with WELCOME, got %d", rr.Code)
+	}
+
+	rr, _ := postAdminUser(repo.AdminPromoReport, "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("AdminPromoReport returns %d", rr.Code)
+	}
+	body := rr.Body.String()
+	// USEDUP once for $10.00, WELCOME twice for $50.00
+	if !strings.Contains(body, "3 redemptions have taken $110.00 off") {
+		t.Error("expected the totals of the redemptions")
+	}
+	if !strings.Contains(body, "guest@example.com") {
+		t.Error("expected the latest redemption to be listed")
+	}
+}
@@ -0,0 +1,567 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mrkouhadi/go-booking-app/internal/forms"
+	"github.com/mrkouhadi/go-booking-app/internal/helpers"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/render"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
+)
+
+// A room type tells how many guests its rooms sleep, the search only offers the rooms that can hold the
+// party and the reservation form refuses a party too large for the room. The staff manage the types here.
+
+// maxParty is the largest party of guests a search or a reservation takes
+const maxParty = 20
+
+// checkParty returns what is wrong with a party of adults and children by field, e.g. when room can't hold
+// it. room is nil when the room hasn't been chosen yet.
+func checkParty(adults, children int, room *models.Room) map[string]string {
+	fields := make(map[string]string)
+	switch {
+	case adults < 1:
+		fields["adults"] = "At least one adult has to stay"
+	case children < 0:
+		fields["children"] = "Enter a number of children"
+	case adults+children > maxParty:
+		fields["adults"] = fmt.Sprintf("We take parties of up to %d guests", maxParty)
+	case room != nil && !room.Sleeps(adults+children):
+		fields["adults"] = fmt.Sprintf("This room sleeps up to %d guests", room.RoomType.MaxOccupancy)
+	}
+	return fields
+}
+
+// partyFromForm reads and checks the adults and children fields of form, a blank adults field is 1 adult.
+// The errors are added to the form.
+func partyFromForm(form *forms.Form, room *models.Room) (int, int) {
+	adults := 1
+	if strings.TrimSpace(form.Get("adults")) != "" {
+		adults = formInt(form, "adults")
+	}
+	children := formInt(form, "children")
+	if form.Errors.Get("adults") != "" || form.Errors.Get("children") != "" {
+		return adults, children
+	}
+	for field, problem := range checkParty(adults, children, room) {
+		form.Errors.Add(field, problem)
+	}
+	return adults, children
+}
+
+// AdminRoomTypes lists the room types with their rooms
+func (m *Repository) AdminRoomTypes(w http.ResponseWriter, r *http.Request) {
+	types, err := m.DB.AllRoomTypes(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	data := make(map[string]interface{})
+	data["room_types"] = types
+	data["rooms"] = rooms
+	render.Template(w, r, "admin-room-types.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminNewRoomType shows the form to add a room type
+func (m *Repository) AdminNewRoomType(w http.ResponseWriter, r *http.Request) {
+	m.renderRoomType(w, r, models.RoomType{}, forms.New(nil))
+}
+
+// AdminPostNewRoomType adds a room type and moves the chosen rooms to it
+func (m *Repository) AdminPostNewRoomType(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	t := roomTypeFromForm(form)
+	if !form.Valid() {
+		m.renderRoomType(w, r, t, form)
+		return
+	}
+
+	_, err = m.DB.InsertRoomType(r.Context(), t)
+	if errors.Is(err, repository.ErrDuplicateRoomType) {
+		form.Errors.Add("name", "Another room type has this name")
+		m.renderRoomType(w, r, t, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "The room type "+t.Name+" has been added")
+	http.Redirect(w, r, "/admin/room-types", http.StatusSeeOther)
+}
+
+// AdminShowRoomType shows the form to edit a room type
+func (m *Repository) AdminShowRoomType(w http.ResponseWriter, r *http.Request) {
+	t, ok := m.roomTypeFromURL(w, r)
+	if !ok {
+		return
+	}
+	m.renderRoomType(w, r, t, forms.New(nil))
+}
+
+// AdminPostRoomType saves a room type, its rooms are the ones ticked. The reservations already made keep
+// their guests even when the room sleeps fewer now.
+func (m *Repository) AdminPostRoomType(w http.ResponseWriter, r *http.Request) {
+	stored, ok := m.roomTypeFromURL(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	t := roomTypeFromForm(form)
+	t.ID = stored.ID
+	if !form.Valid() {
+		m.renderRoomType(w, r, t, form)
+		return
+	}
+
+	err = m.DB.UpdateRoomType(r.Context(), t)
+	if errors.Is(err, repository.ErrDuplicateRoomType) {
+		form.Errors.Add("name", "Another room type has this name")
+		m.renderRoomType(w, r, t, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, "/admin/room-types", http.StatusSeeOther)
+}
+
+// AdminDeleteRoomType deletes a room type, its rooms are left without a type and take parties of any size
+func (m *Repository) AdminDeleteRoomType(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	err = m.DB.DeleteRoomType(r.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		m.App.Session.Put(r.Context(), "error", "This room type doesn't exist")
+		http.Redirect(w, r, "/admin/room-types", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "The room type has been deleted")
+	http.Redirect(w, r, "/admin/room-types", http.StatusSeeOther)
+}
+
+// roomTypeFromURL loads the room type of the {id} URL parameter, it writes the error response and returns
+// false when it can't
+func (m *Repository) roomTypeFromURL(w http.ResponseWriter, r *http.Request) (models.RoomType, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.RoomType{}, false
+	}
+	t, err := m.DB.GetRoomTypeByID(r.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		m.App.Session.Put(r.Context(), "error", "This room type doesn't exist")
+		http.Redirect(w, r, "/admin/room-types", http.StatusSeeOther)
+		return models.RoomType{}, false
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.RoomType{}, false
+	}
+	return t, true
+}
+
+// roomTypeFromForm reads and checks the fields of the room type form, the errors are added to the form
+func roomTypeFromForm(form *forms.Form) models.RoomType {
+	t := models.RoomType{
+		Name:        strings.TrimSpace(form.Get("name")),
+		Description: strings.TrimSpace(form.Get("description")),
+		Beds:        strings.TrimSpace(form.Get("beds")),
+	}
+	form.Required("name", "max_occupancy")
+
+	t.MaxOccupancy = formInt(form, "max_occupancy")
+	if form.Errors.Get("max_occupancy") == "" && (t.MaxOccupancy < 1 || t.MaxOccupancy > maxParty) {
+		form.Errors.Add("max_occupancy", fmt.Sprintf("Enter a number of guests from 1 to %d", maxParty))
+	}
+	t.Amenities = formLines(form, "amenities")
+	for _, v := range form.Values["rooms"] {
+		if id, err := strconv.Atoi(v); err == nil && id > 0 {
+			t.RoomIDs = append(t.RoomIDs, id)
+		}
+	}
+	return t
+}
+
+// renderRoomType shows the form of a new room type (with a zero ID) or of an existing one
+func (m *Repository) renderRoomType(w http.ResponseWriter, r *http.Request, t models.RoomType, form *forms.Form) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	chosen := make(map[int]bool)
+	for _, id := range t.RoomIDs {
+		chosen[id] = true
+	}
+
+	data := make(map[string]interface{})
+	data["room_type"] = t
+	data["rooms"] = rooms
+	data["chosen_rooms"] = chosen
+	render.Template(w, r, "admin-room-type.page.tmpl", &models.TemplateData{
+		Data:      data,
+		Form:      form,
+		StringMap: map[string]string{"amenities": strings.Join(t.Amenities, "\n")},
+	})
+}
+
+// The rooms have a page of their own at /rooms/{slug}, made from what the staff type in the admin, so adding a
+// room doesn't take a change of the code. An inactive room keeps its reservations but isn't shown or offered.
+
+// OldRoomPages are the URLs the rooms had before /rooms/{slug}, they redirect to the new pages
+var OldRoomPages = map[string]string{
+	"/generals-quarters": "/rooms/generals-quarters",
+	"/majors-suite":      "/rooms/majors-suite",
+}
+
+// Rooms lists the rooms guests can book
+func (m *Repository) Rooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	var active []models.Room
+	for _, room := range rooms {
+		if room.Active {
+			active = append(active, room)
+		}
+	}
+	data := make(map[string]interface{})
+	data["rooms"] = active
+	render.Template(w, r, "rooms.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// RoomPage shows the room with the {slug} of the URL, the inactive rooms aren't found
+func (m *Repository) RoomPage(w http.ResponseWriter, r *http.Request) {
+	room, err := m.DB.GetRoomBySlug(r.Context(), chi.URLParam(r, "slug"))
+	if errors.Is(err, repository.ErrNotFound) || err == nil && !room.Active {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	data := make(map[string]interface{})
+	data["room"] = room
+	render.Template(w, r, "room.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminRooms lists the rooms in the order guests see them
+func (m *Repository) AdminRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+	render.Template(w, r, "admin-rooms.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: map[string]string{"currency": m.App.Currency},
+	})
+}
+
+// AdminNewRoom shows the form to add a room
+func (m *Repository) AdminNewRoom(w http.ResponseWriter, r *http.Request) {
+	m.renderRoom(w, r, models.Room{Active: true}, forms.New(nil))
+}
+
+// AdminPostNewRoom adds a room after the others
+func (m *Repository) AdminPostNewRoom(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	room := roomFromForm(form)
+	if !form.Valid() {
+		m.renderRoom(w, r, room, form)
+		return
+	}
+
+	_, err = m.DB.InsertRoom(r.Context(), room)
+	if errors.Is(err, repository.ErrDuplicateRoom) {
+		form.Errors.Add("slug", "Another room has this address")
+		m.renderRoom(w, r, room, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "The room "+room.RoomName+" has been added")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminShowRoom shows the form to edit a room
+func (m *Repository) AdminShowRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := m.roomFromURL(w, r)
+	if !ok {
+		return
+	}
+	m.renderRoom(w, r, room, forms.New(nil))
+}
+
+// AdminPostRoom saves a room. The reservations already made keep their price when the rates change.
+func (m *Repository) AdminPostRoom(w http.ResponseWriter, r *http.Request) {
+	stored, ok := m.roomFromURL(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	room := roomFromForm(form)
+	room.ID = stored.ID
+	if !form.Valid() {
+		m.renderRoom(w, r, room, form)
+		return
+	}
+
+	err = m.DB.UpdateRoom(r.Context(), room)
+	if errors.Is(err, repository.ErrDuplicateRoom) {
+		form.Errors.Add("slug", "Another room has this address")
+		m.renderRoom(w, r, room, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminDeactivateRoom stops showing and offering a room, its reservations are kept
+func (m *Repository) AdminDeactivateRoom(w http.ResponseWriter, r *http.Request) {
+	m.setRoomActive(w, r, false)
+}
+
+// AdminActivateRoom shows and offers a deactivated room again
+func (m *Repository) AdminActivateRoom(w http.ResponseWriter, r *http.Request) {
+	m.setRoomActive(w, r, true)
+}
+
+func (m *Repository) setRoomActive(w http.ResponseWriter, r *http.Request, active bool) {
+	room, ok := m.roomFromURL(w, r)
+	if !ok {
+		return
+	}
+	err := m.DB.SetRoomActive(r.Context(), room.ID, active)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	msg := room.RoomName + " can be booked again"
+	if !active {
+		msg = room.RoomName + " can no longer be booked"
+	}
+	m.App.Session.Put(r.Context(), "flash", msg)
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminMoveRoomUp shows a room before the one listed before it
+func (m *Repository) AdminMoveRoomUp(w http.ResponseWriter, r *http.Request) {
+	m.moveRoom(w, r, -1)
+}
+
+// AdminMoveRoomDown shows a room after the one listed after it
+func (m *Repository) AdminMoveRoomDown(w http.ResponseWriter, r *http.Request) {
+	m.moveRoom(w, r, 1)
+}
+
+// moveRoom swaps the room of the URL with its neighbour by offset in the list, the first room can't move up
+// and the last one can't move down
+func (m *Repository) moveRoom(w http.ResponseWriter, r *http.Request, offset int) {
+	room, ok := m.roomFromURL(w, r)
+	if !ok {
+		return
+	}
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	ids := make([]int, len(rooms))
+	for i := range rooms {
+		ids[i] = rooms[i].ID
+	}
+	for i, id := range ids {
+		if id == room.ID && i+offset >= 0 && i+offset < len(ids) {
+			ids[i], ids[i+offset] = ids[i+offset], ids[i]
+			break
+		}
+	}
+
+	err = m.DB.ReorderRooms(r.Context(), ids)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// roomFromURL loads the room of the {id} URL parameter, it writes the error response and returns false when
+// it can't
+func (m *Repository) roomFromURL(w http.ResponseWriter, r *http.Request) (models.Room, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.Room{}, false
+	}
+	room, err := m.DB.GetRoomById(r.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		m.App.Session.Put(r.Context(), "error", "This room doesn't exist")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return models.Room{}, false
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.Room{}, false
+	}
+	return room, true
+}
+
+// roomFromForm reads and checks the fields of the room form, the errors are added to the form. A blank slug
+// is made from the name.
+func roomFromForm(form *forms.Form) models.Room {
+	room := models.Room{
+		RoomName:    strings.TrimSpace(form.Get("name")),
+		Slug:        strings.TrimSpace(form.Get("slug")),
+		Description: strings.TrimSpace(form.Get("description")),
+		Photos:      formLines(form, "photos"),
+		Amenities:   formLines(form, "amenities"),
+		Active:      form.Get("active") != "",
+	}
+	form.Required("name", "nightly_rate")
+
+	if room.Slug == "" {
+		room.Slug = slugify(room.RoomName)
+	}
+	if room.Slug != slugify(room.Slug) {
+		form.Errors.Add("slug", "Use lower case letters, digits and dashes")
+	}
+	for _, photo := range room.Photos {
+		if !strings.HasPrefix(photo, "/") && !strings.HasPrefix(photo, "https://") && !strings.HasPrefix(photo, "http://") {
+			form.Errors.Add("photos", "Enter paths such as /static/images/room.jpeg or URLs, one per line")
+			break
+		}
+	}
+
+	room.NightlyRateCents = formCents(form, "nightly_rate")
+	if form.Errors.Get("nightly_rate") == "" && room.NightlyRateCents <= 0 {
+		form.Errors.Add("nightly_rate", "Enter the price of a night")
+	}
+	room.WeekendRateCents = formCents(form, "weekend_rate")
+	room.RoomTypeID = formInt(form, "room_type_id")
+	return room
+}
+
+// formLines reads the lines of a text area, the blank ones are left out
+func formLines(form *forms.Form, field string) []string {
+	var lines []string
+	for _, line := range strings.Split(form.Get(field), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// slugify makes the slug of a room from its name, e.g. generals-quarters from General's Quarters
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(name) {
+		switch {
+		case c >= 'a' && c <= 'z' || c >= '0' && c <= '9':
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(c)
+			dash = false
+		case c == '\'' || c == '’':
+			// General's is generals
+		default:
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// renderRoom shows the form of a new room (with a zero ID) or of an existing one
+func (m *Repository) renderRoom(w http.ResponseWriter, r *http.Request, room models.Room, form *forms.Form) {
+	types, err := m.DB.AllRoomTypes(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	stringMap := map[string]string{
+		"currency":  m.App.Currency,
+		"photos":    strings.Join(room.Photos, "\n"),
+		"amenities": strings.Join(room.Amenities, "\n"),
+	}
+	if room.NightlyRateCents > 0 {
+		stringMap["nightly_rate"] = fmt.Sprintf("%d.%02d", room.NightlyRateCents/100, room.NightlyRateCents%100)
+	}
+	if room.WeekendRateCents > 0 {
+		stringMap["weekend_rate"] = fmt.Sprintf("%d.%02d", room.WeekendRateCents/100, room.WeekendRateCents%100)
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+	data["room_types"] = types
+	render.Template(w, r, "admin-room.page.tmpl", &models.TemplateData{
+		Data:      data,
+		Form:      form,
+		StringMap: stringMap,
+	})
+}
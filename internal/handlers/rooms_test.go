@@ -0,0 +1,568 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+)
+
+// the test repository has rooms free in February 2050, room 1 sleeps 2 guests, room 2 sleeps 4 and room 3
+// has no type
+
+func TestRepository_PostSearchAvailabilityParty(t *testing.T) {
+	search := func(adults, children string) url.Values {
+		return url.Values{"start": {"2050-02-01"}, "end": {"2050-02-03"}, "adults": {adults}, "children": {children}}
+	}
+
+	rr, ctx := postForm(Repo.PostSearchAvailability, "/search-availability", "10.0.12.1", search("2", "1"))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the rooms to choose from, got %d", rr.Code)
+	}
+	body := rr.Body.String()
+	if strings.Contains(body, "/choose-room/1") || !strings.Contains(body, "/choose-room/2") || !strings.Contains(body, "/choose-room/3") {
+		t.Error("expected only the rooms sleeping 3 guests to be offered")
+	}
+	res, _ := session.Get(ctx, "reservation").(models.Reservation)
+	if res.Adults != 2 || res.Children != 1 {
+		t.Errorf("expected the party kept on the reservation, got %d adults and %d children", res.Adults, res.Children)
+	}
+
+	tests := []struct {
+		name           string
+		form           url.Values
+		expectedStatus int
+	}{
+		{"no adult", search("0", "2"), http.StatusOK},
+		{"invalid children", search("2", "two"), http.StatusOK},
+		{"party too large", search("15", "6"), http.StatusOK},
+	}
+	for _, e := range tests {
+		rr, ctx := postForm(Repo.PostSearchAvailability, "/search-availability", "10.0.12.2", e.form)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if _, ok := session.Get(ctx, "reservation").(models.Reservation); ok {
+			t.Errorf("%s: expected no reservation in the session", e.name)
+		}
+	}
+
+	// room 3 has no type and takes a party of any size
+	rr, _ = postForm(Repo.PostSearchAvailability, "/search-availability", "10.0.12.3", search("5", "0"))
+	if body := rr.Body.String(); strings.Contains(body, "/choose-room/2") || !strings.Contains(body, "/choose-room/3") {
+		t.Error("expected only the room without a type to be offered to 5 guests")
+	}
+
+	form := search("1", "0")
+	form.Set("start", "2050-03-01")
+	form.Set("end", "2050-03-03")
+	rr, ctx = postForm(Repo.PostSearchAvailability, "/search-availability", "10.0.12.4", form)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/search-availability" || session.GetString(ctx, "error") == "" {
+		t.Errorf("no rooms: expected a redirect to the search with an error, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func TestRepository_PostReservationParty(t *testing.T) {
+	reservation := func(room, adults, children string) url.Values {
+		form := promoReservation("", "guest@example.com")
+		form.Set("room_id", room)
+		form.Set("adults", adults)
+		form.Set("children", children)
+		return form
+	}
+
+	rr, ctx := postForm(Repo.PostMakeReservation, "/make-reservation", "10.0.12.5", reservation("1", "2", "1"))
+	if !strings.Contains(rr.Body.String(), "This room sleeps up to 2 guests") {
+		t.Error("expected the party too large for room 1 to be refused")
+	}
+	if _, ok := session.Get(ctx, "reservation").(models.Reservation); ok {
+		t.Error("expected no reservation for a party too large")
+	}
+
+	rr, ctx = postForm(Repo.PostMakeReservation, "/make-reservation", "10.0.12.6", reservation("1", "1", "1"))
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/reservation-summary" {
+		t.Fatalf("expected a redirect to the summary, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+	res, _ := session.Get(ctx, "reservation").(models.Reservation)
+	if res.Adults != 1 || res.Children != 1 {
+		t.Errorf("expected the party stored on the reservation, got %d adults and %d children", res.Adults, res.Children)
+	}
+
+	// the form without the guest fields books a single adult
+	rr, ctx = postForm(Repo.PostMakeReservation, "/make-reservation", "10.0.12.7", promoReservation("", "guest@example.com"))
+	if res, _ := session.Get(ctx, "reservation").(models.Reservation); rr.Code != http.StatusSeeOther || res.Adults != 1 || res.Children != 0 {
+		t.Errorf("expected 1 adult by default, got %d with %d adults and %d children", rr.Code, res.Adults, res.Children)
+	}
+}
+
+func TestRepository_APIAvailabilityParty(t *testing.T) {
+	rr, resp := callAPI(t, Repo.APIAvailability, "GET", "/api/v1/availability?start=2050-02-01&end=2050-02-03&adults=2&children=1", "", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", rr.Code, rr.Body.String())
+	}
+	var rooms []apiRoom
+	if err := json.Unmarshal(resp.Data, &rooms); err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 2 || rooms[0].ID != 2 || rooms[1].ID != 3 {
+		t.Fatalf("expected rooms 2 and 3, got %+v", rooms)
+	}
+	if rooms[0].Type == nil || rooms[0].Type.Name != "Suite" || rooms[0].Type.MaxOccupancy != 4 || rooms[1].Type != nil {
+		t.Errorf("expected the type of room 2 only, got %+v and %+v", rooms[0].Type, rooms[1].Type)
+	}
+
+	for _, query := range []string{"adults=0", "adults=two", "children=-1", "adults=20&children=1"} {
+		rr, resp := callAPI(t, Repo.APIAvailability, "GET", "/api/v1/availability?start=2050-02-01&end=2050-02-03&"+query, "", "")
+		if rr.Code != http.StatusUnprocessableEntity || len(resp.Error.Fields) == 0 {
+			t.Errorf("%s: expected 422 with the field in error, got %d %s", query, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestRepository_APICreateReservationParty(t *testing.T) {
+	const guest = `"first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"555-555-5555","start_date":"2050-01-01","end_date":"2050-01-03"`
+
+	rr, resp := callAPI(t, Repo.APICreateReservation, "POST", "/api/v1/reservations", "", `{"room_id":1,"adults":2,"children":1,`+guest+`}`)
+	if rr.Code != http.StatusUnprocessableEntity || resp.Error.Fields["adults"] == "" {
+		t.Errorf("expected the party too large for room 1 to be refused, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr, resp = callAPI(t, Repo.APICreateReservation, "POST", "/api/v1/reservations", "", `{"room_id":1,"children":1,`+guest+`}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected the reservation to be made, got %d %s", rr.Code, rr.Body.String())
+	}
+	var res apiReservation
+	if err := json.Unmarshal(resp.Data, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Adults != 1 || res.Children != 1 {
+		t.Errorf("expected 1 adult by default and 1 child, got %d and %d", res.Adults, res.Children)
+	}
+}
+
+func TestRepository_AdminPostNewRoomType(t *testing.T) {
+	valid := url.Values{
+		"name":          {" Family Room "},
+		"description":   {"Room for the whole family"},
+		"max_occupancy": {"5"},
+		"beds":          {"2 double beds"},
+		"amenities":     {"Wi-Fi\r\n\r\n Cot \r\n"},
+		"rooms":         {"1", "3"},
+	}
+	with := func(key, value string) url.Values {
+		form := url.Values{}
+		for k, v := range valid {
+			form[k] = v
+		}
+		form.Set(key, value)
+		return form
+	}
+
+	tests := []struct {
+		name           string
+		form           url.Values
+		expectedStatus int
+	}{
+		{"valid", valid, http.StatusSeeOther},
+		{"missing name", with("name", ""), http.StatusOK},
+		{"name taken", with("name", "Suite"), http.StatusOK},
+		{"missing occupancy", with("max_occupancy", ""), http.StatusOK},
+		{"nobody sleeps", with("max_occupancy", "0"), http.StatusOK},
+		{"too many guests", with("max_occupancy", "21"), http.StatusOK},
+		{"database error", with("name", "Broken"), http.StatusInternalServerError},
+	}
+	for _, e := range tests {
+		repo := NewTestRepo(&app)
+		rr, _ := postAdminUser(repo.AdminPostNewRoomType, "new", e.form)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedStatus == http.StatusSeeOther && rr.Header().Get("Location") != "/admin/room-types" {
+			t.Errorf("%s: expected a redirect to /admin/room-types, got %q", e.name, rr.Header().Get("Location"))
+		}
+	}
+
+	repo := NewTestRepo(&app)
+	if rr, _ := postAdminUser(repo.AdminPostNewRoomType, "new", valid); rr.Code != http.StatusSeeOther {
+		t.Fatalf("can't add the room type, got %d", rr.Code)
+	}
+	room, err := repo.DB.GetRoomById(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := room.RoomType
+	if rt.Name != "Family Room" || rt.MaxOccupancy != 5 || len(rt.Amenities) != 2 || rt.Amenities[1] != "Cot" {
+		t.Errorf("expected room 1 moved to the new type as typed, got %+v", rt)
+	}
+	quarters, err := repo.DB.GetRoomTypeByID(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarters.RoomIDs) != 0 {
+		t.Errorf("expected room 1 taken away from Quarters, got %v", quarters.RoomIDs)
+	}
+}
+
+func TestRepository_AdminPostRoomType(t *testing.T) {
+	form := url.Values{"name": {"Quarters"}, "max_occupancy": {"3"}, "rooms": {"1", "2"}}
+
+	tests := []struct {
+		name             string
+		id               string
+		form             url.Values
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"saved", "1", form, http.StatusSeeOther, "/admin/room-types"},
+		{"name of another", "1", url.Values{"name": {"Suite"}, "max_occupancy": {"3"}}, http.StatusOK, ""},
+		{"invalid", "1", url.Values{"name": {"Quarters"}, "max_occupancy": {"lots"}}, http.StatusOK, ""},
+		{"unknown type", "99", form, http.StatusSeeOther, "/admin/room-types"},
+		{"invalid id", "x", form, http.StatusInternalServerError, ""},
+		{"database error", "1000000", form, http.StatusInternalServerError, ""},
+	}
+	for _, e := range tests {
+		repo := NewTestRepo(&app)
+		rr, _ := postAdminUser(repo.AdminPostRoomType, e.id, e.form)
+		if rr.Code != e.expectedStatus || rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected %d to %q, got %d to %q", e.name, e.expectedStatus, e.expectedLocation, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+
+	repo := NewTestRepo(&app)
+	if rr, _ := postAdminUser(repo.AdminPostRoomType, "1", form); rr.Code != http.StatusSeeOther {
+		t.Fatalf("can't save the room type, got %d", rr.Code)
+	}
+	room, err := repo.DB.GetRoomById(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.RoomTypeID != 1 || room.RoomType.MaxOccupancy != 3 {
+		t.Errorf("expected room 2 moved to Quarters sleeping 3, got %+v", room.RoomType)
+	}
+}
+
+func TestRepository_AdminDeleteRoomType(t *testing.T) {
+	tests := []struct {
+		name           string
+		id             string
+		expectedStatus int
+		expectedFlash  string
+	}{
+		{"deleted", "2", http.StatusSeeOther, "flash"},
+		{"unknown type", "99", http.StatusSeeOther, "error"},
+		{"invalid id", "x", http.StatusInternalServerError, ""},
+		{"database error", "1000000", http.StatusInternalServerError, ""},
+	}
+	for _, e := range tests {
+		repo := NewTestRepo(&app)
+		rr, ctx := postAdminUser(repo.AdminDeleteRoomType, e.id, url.Values{})
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedFlash != "" && session.GetString(ctx, e.expectedFlash) == "" {
+			t.Errorf("%s: expected a %s message", e.name, e.expectedFlash)
+		}
+	}
+
+	repo := NewTestRepo(&app)
+	if rr, _ := postAdminUser(repo.AdminDeleteRoomType, "2", url.Values{}); rr.Code != http.StatusSeeOther {
+		t.Fatalf("can't delete the room type, got %d", rr.Code)
+	}
+	room, err := repo.DB.GetRoomById(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.RoomTypeID != 0 || !room.Sleeps(maxParty) {
+		t.Errorf("expected room 2 left without a type, got %+v", room.RoomType)
+	}
+}
+
+// getRoomPage gets the page of the room with the slug from handler
+func getRoomPage(handler http.HandlerFunc, slug string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/rooms/"+slug, nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("slug", slug)
+	req = req.WithContext(context.WithValue(getCtx(req), chi.RouteCtxKey, rctx))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRepository_RoomPage(t *testing.T) {
+	rr := getRoomPage(Repo.RoomPage, "room-1")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the page of room 1, got %d", rr.Code)
+	}
+	body := rr.Body.String()
+	for _, expected := range []string{"<h1 class=\"text-center mt-4\">Room 1</h1>", "The room number 1", "/static/images/generals.jpeg",
+		"<li>Wi-Fi</li>", "<li>Sea view</li>", `formDT.append("room_id", "1")`} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %s on the page", expected)
+		}
+	}
+
+	tests := []struct {
+		name           string
+		slug           string
+		expectedStatus int
+	}{
+		{"unknown room", "nowhere", http.StatusNotFound},
+		{"inactive room", "room-4", http.StatusNotFound},
+		{"database error", "broken", http.StatusInternalServerError},
+	}
+	for _, e := range tests {
+		if rr := getRoomPage(Repo.RoomPage, e.slug); rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func TestRepository_Rooms(t *testing.T) {
+	rr := getRoomPage(Repo.Rooms, "")
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK || !strings.Contains(body, "/rooms/room-1") || !strings.Contains(body, "/rooms/room-3") {
+		t.Errorf("expected the rooms to be listed, got %d", rr.Code)
+	}
+	if strings.Contains(body, "/rooms/room-4") {
+		t.Error("expected the inactive room to be left out")
+	}
+}
+
+func TestOldRoomPages(t *testing.T) {
+	ts := httptest.NewTLSServer(getRoutes())
+	defer ts.Close()
+	client := ts.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	for old, page := range OldRoomPages {
+		resp, err := client.Get(ts.URL + old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != page {
+			t.Errorf("%s: expected a permanent redirect to %s, got %d to %q", old, page, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+}
+
+func TestRepository_AdminPostNewRoom(t *testing.T) {
+	valid := url.Values{
+		"name":         {" General's Loft "},
+		"description":  {"Under the roof"},
+		"nightly_rate": {"150"},
+		"weekend_rate": {"175.50"},
+		"room_type_id": {"2"},
+		"photos":       {"/static/images/house.jpeg\r\n\r\nhttps://example.com/loft.jpeg"},
+		"amenities":    {"Skylight"},
+		"active":       {"1"},
+	}
+	with := func(key, value string) url.Values {
+		form := url.Values{}
+		for k, v := range valid {
+			form[k] = v
+		}
+		form.Set(key, value)
+		return form
+	}
+
+	tests := []struct {
+		name           string
+		form           url.Values
+		expectedStatus int
+	}{
+		{"valid", valid, http.StatusSeeOther},
+		{"own slug", with("slug", "the-loft"), http.StatusSeeOther},
+		{"missing name", with("name", ""), http.StatusOK},
+		{"invalid slug", with("slug", "The Loft"), http.StatusOK},
+		{"slug taken", with("slug", "room-2"), http.StatusOK},
+		{"missing rate", with("nightly_rate", ""), http.StatusOK},
+		{"free", with("nightly_rate", "0"), http.StatusOK},
+		{"invalid rate", with("weekend_rate", "a lot"), http.StatusOK},
+		{"invalid photo", with("photos", "loft.jpeg"), http.StatusOK},
+		{"database error", with("name", "Broken"), http.StatusInternalServerError},
+	}
+	for _, e := range tests {
+		repo := NewTestRepo(&app)
+		rr, _ := postAdminUser(repo.AdminPostNewRoom, "new", e.form)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedStatus == http.StatusSeeOther && rr.Header().Get("Location") != "/admin/rooms" {
+			t.Errorf("%s: expected a redirect to /admin/rooms, got %q", e.name, rr.Header().Get("Location"))
+		}
+	}
+
+	repo := NewTestRepo(&app)
+	if rr, _ := postAdminUser(repo.AdminPostNewRoom, "new", valid); rr.Code != http.StatusSeeOther {
+		t.Fatalf("can't add the room, got %d", rr.Code)
+	}
+	room, err := repo.DB.GetRoomBySlug(context.Background(), "generals-loft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.RoomName != "General's Loft" || room.NightlyRateCents != 15000 || room.WeekendRateCents != 17550 || room.Position != 5 ||
+		room.RoomType.Name != "Suite" || len(room.Photos) != 2 || len(room.Amenities) != 1 || !room.Active {
+		t.Errorf("expected the room stored as typed after the others, got %+v", room)
+	}
+
+	// the new room has a page of its own
+	if rr := getRoomPage(repo.RoomPage, "generals-loft"); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Under the roof") {
+		t.Errorf("expected the page of the new room, got %d", rr.Code)
+	}
+}
+
+func TestRepository_AdminPostRoom(t *testing.T) {
+	form := url.Values{"name": {"Room 3"}, "slug": {"room-3"}, "nightly_rate": {"300"}, "room_type_id": {"2"}, "active": {"1"}}
+
+	tests := []struct {
+		name             string
+		id               string
+		form             url.Values
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"saved", "3", form, http.StatusSeeOther, "/admin/rooms"},
+		{"slug of another", "3", url.Values{"name": {"Room 3"}, "slug": {"room-1"}, "nightly_rate": {"300"}}, http.StatusOK, ""},
+		{"invalid", "3", url.Values{"name": {"Room 3"}}, http.StatusOK, ""},
+		{"unknown room", "99", form, http.StatusSeeOther, "/admin/rooms"},
+		{"invalid id", "x", form, http.StatusInternalServerError, ""},
+		{"database error", "1000000", form, http.StatusInternalServerError, ""},
+	}
+	for _, e := range tests {
+		repo := NewTestRepo(&app)
+		rr, _ := postAdminUser(repo.AdminPostRoom, e.id, e.form)
+		if rr.Code != e.expectedStatus || rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected %d to %q, got %d to %q", e.name, e.expectedStatus, e.expectedLocation, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+
+	repo := NewTestRepo(&app)
+	if rr, _ := postAdminUser(repo.AdminPostRoom, "3", form); rr.Code != http.StatusSeeOther {
+		t.Fatalf("can't save the room, got %d", rr.Code)
+	}
+	room, err := repo.DB.GetRoomById(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.RoomTypeID != 2 || room.NightlyRateCents != 30000 || room.Position != 3 {
+		t.Errorf("expected room 3 to be a suite at its place, got %+v", room)
+	}
+	suite, err := repo.DB.GetRoomTypeByID(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suite.RoomIDs) != 2 {
+		t.Errorf("expected the suites to be rooms 2 and 3, got %v", suite.RoomIDs)
+	}
+}
+
+func TestRepository_AdminDeactivateRoom(t *testing.T) {
+	tests := []struct {
+		name           string
+		id             string
+		expectedStatus int
+		expectedFlash  string
+	}{
+		{"deactivated", "1", http.StatusSeeOther, "flash"},
+		{"unknown room", "99", http.StatusSeeOther, "error"},
+		{"invalid id", "x", http.StatusInternalServerError, ""},
+		{"database error", "1000000", http.StatusInternalServerError, ""},
+	}
+	for _, e := range tests {
+		repo := NewTestRepo(&app)
+		rr, ctx := postAdminUser(repo.AdminDeactivateRoom, e.id, url.Values{})
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedFlash != "" && session.GetString(ctx, e.expectedFlash) == "" {
+			t.Errorf("%s: expected a %s message", e.name, e.expectedFlash)
+		}
+	}
+
+	repo := NewTestRepo(&app)
+	if rr, _ := postAdminUser(repo.AdminDeactivateRoom, "1", url.Values{}); rr.Code != http.StatusSeeOther {
+		t.Fatalf("can't deactivate room 1, got %d", rr.Code)
+	}
+	if rr := getRoomPage(repo.RoomPage, "room-1"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected no page for the inactive room, got %d", rr.Code)
+	}
+	search := url.Values{"start": {"2050-02-01"}, "end": {"2050-02-03"}, "adults": {"1"}}
+	if rr, _ := postForm(repo.PostSearchAvailability, "/search-availability", "10.0.12.8", search); strings.Contains(rr.Body.String(), "/choose-room/1") {
+		t.Error("expected the inactive room not to be offered")
+	}
+	rr, ctx := postForm(repo.PostMakeReservation, "/make-reservation", "10.0.12.9", promoReservation("", "guest@example.com"))
+	if rr.Header().Get("Location") != "/search-availability" || session.GetString(ctx, "error") == "" {
+		t.Errorf("expected the inactive room not to be booked, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	if rr, _ := postAdminUser(repo.AdminActivateRoom, "1", url.Values{}); rr.Code != http.StatusSeeOther {
+		t.Fatalf("can't activate room 1, got %d", rr.Code)
+	}
+	if rr := getRoomPage(repo.RoomPage, "room-1"); rr.Code != http.StatusOK {
+		t.Errorf("expected the page of the room activated again, got %d", rr.Code)
+	}
+}
+
+func TestRepository_AdminMoveRoom(t *testing.T) {
+	order := func(repo *Repository) []int {
+		rooms, err := repo.DB.AllRooms(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int
+		for _, room := range rooms {
+			ids = append(ids, room.ID)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name          string
+		handler       func(*Repository) http.HandlerFunc
+		id            string
+		expectedOrder string
+	}{
+		{"up", func(m *Repository) http.HandlerFunc { return m.AdminMoveRoomUp }, "3", "[1 3 2 4]"},
+		{"down", func(m *Repository) http.HandlerFunc { return m.AdminMoveRoomDown }, "1", "[2 1 3 4]"},
+		{"first up", func(m *Repository) http.HandlerFunc { return m.AdminMoveRoomUp }, "1", "[1 2 3 4]"},
+		{"last down", func(m *Repository) http.HandlerFunc { return m.AdminMoveRoomDown }, "4", "[1 2 3 4]"},
+	}
+	for _, e := range tests {
+		repo := NewTestRepo(&app)
+		rr, _ := postAdminUser(e.handler(repo), e.id, url.Values{})
+		if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/admin/rooms" {
+			t.Errorf("%s: expected a redirect to /admin/rooms, got %d to %q", e.name, rr.Code, rr.Header().Get("Location"))
+		}
+		if got := fmt.Sprint(order(repo)); got != e.expectedOrder {
+			t.Errorf("%s: expected the rooms in the order %s, got %s", e.name, e.expectedOrder, got)
+		}
+	}
+
+	if rr, _ := postAdminUser(Repo.AdminMoveRoomUp, "1000000", url.Values{}); rr.Code != http.StatusInternalServerError {
+		t.Errorf("database error: expected %d, got %d", http.StatusInternalServerError, rr.Code)
+	}
+}
+
+func TestRepository_AdminPostReservationsCalendarNewRoom(t *testing.T) {
+	// the calendar was shown before rooms 2 and up were added, only room 1 has a block map in the session
+	rr, _ := serve(Repo.AdminPostReservationsCalendar, testRequest{
+		method:  "POST",
+		target:  "/admin/reservations-calendar",
+		session: map[string]interface{}{"user_id": 1, "block_map_1": map[string]int{"2050-01-01": 0}},
+		form:    url.Values{"y": {"2050"}, "m": {"1"}},
+	})
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/admin/reservations-calendar?y=2050&m=1" {
+		t.Errorf("expected a redirect to the calendar, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
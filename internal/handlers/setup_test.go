@@ -1,14 +1,18 @@
 package handlers
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
-	"text/template"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
@@ -16,14 +20,23 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/justinas/nosurf"
 	"github.com/mrkouhadi/go-booking-app/internal/config"
+	"github.com/mrkouhadi/go-booking-app/internal/emails"
+	"github.com/mrkouhadi/go-booking-app/internal/helpers"
 	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/pricing"
 	"github.com/mrkouhadi/go-booking-app/internal/render"
 )
 
 var app config.AppConfig
 var session *scs.SessionManager
 var pathToTemplates = "./../../templates"
-var functions = template.FuncMap{}
+var functions = template.FuncMap{
+	"HumanDate":  render.HumanDate,
+	"FormatDate": render.FormatDate,
+	"Iterate":    render.Iterate,
+	"Add":        render.Add,
+	"Money":      pricing.FormatMoney,
+}
 
 func TestMain(m *testing.M) {
 	// what am I going to put in the session
@@ -59,12 +72,67 @@ func TestMain(m *testing.M) {
 	app.TemplateCache = tc
 	app.UseCache = true
 
+	emailTemplates, err := emails.Parse()
+	if err != nil {
+		log.Fatal("cannot parse the email templates")
+	}
+	app.Emails = emailTemplates
+	app.Mail.From = "contact@bookingapp.com"
+	app.Mail.Owner = "owner@bookingapp.com"
+
+	app.Login.IPLimit = 5
+	app.Login.AccountLimit = 3
+	app.Login.Window = time.Minute
+	app.Login.DelayBase = time.Millisecond
+	app.Login.DelayMax = 2 * time.Millisecond
+	app.Login.ResetTTL = time.Hour
+	app.BaseURL = "https://bookings.example.com"
+	app.Currency = "USD"
+	app.Property.Name = "Fort Smythe Bed and Breakfast"
+	app.Invoice.Prefix = "INV-"
+	app.Invoice.Attach = true
+
 	repo := NewTestRepo(&app)
 	NewHandlers(repo)
 
 	render.NewRenderer(&app)
+	helpers.Newhelpers(&app)
 	os.Exit(m.Run())
 }
+
+// testRequest is what a test sends to a handler with serve
+type testRequest struct {
+	method  string
+	target  string
+	ip      string                 // the address of the client, the one of httptest when empty
+	params  map[string]string      // the URL parameters of chi, e.g. "id"
+	session map[string]interface{} // put in the session before the handler runs
+	form    url.Values             // sent url encoded as the body
+}
+
+// serve sends req to handler and returns the response along with the context of the session, to read what
+// the handler put in it
+func serve(handler http.HandlerFunc, req testRequest) (*httptest.ResponseRecorder, context.Context) {
+	r := httptest.NewRequest(req.method, req.target, strings.NewReader(req.form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if req.ip != "" {
+		r.RemoteAddr = req.ip + ":1234"
+	}
+	ctx := getCtx(r)
+	for k, v := range req.session {
+		session.Put(ctx, k, v)
+	}
+	rctx := chi.NewRouteContext()
+	for k, v := range req.params {
+		rctx.URLParams.Add(k, v)
+	}
+	r = r.WithContext(context.WithValue(ctx, chi.RouteCtxKey, rctx))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	return rr, ctx
+}
+
 func listenForMail() {
 	go func() {
 		for {
@@ -82,8 +150,11 @@ func getRoutes() http.Handler {
 
 	mux.Get("/", Repo.Home)
 	mux.Get("/about", Repo.About)
-	mux.Get("/generals-quarters", Repo.GeneralRooms)
-	mux.Get("/majors-suite", Repo.MajorSuite)
+	mux.Get("/rooms", Repo.Rooms)
+	mux.Get("/rooms/{slug}", Repo.RoomPage)
+	for old, page := range OldRoomPages {
+		mux.Get(old, http.RedirectHandler(page, http.StatusMovedPermanently).ServeHTTP)
+	}
 
 	mux.Get("/search-availability", Repo.SearchAvailability)
 	mux.Post("/search-availability", Repo.PostSearchAvailability)
@@ -95,6 +166,31 @@ func getRoutes() http.Handler {
 	mux.Post("/make-reservation", Repo.PostMakeReservation)
 	mux.Get("/reservation-summary", Repo.ReservationSummary)
 
+	mux.Get("/user/login", Repo.ShowLogin)
+	mux.Get("/user/forgot-password", Repo.ForgotPassword)
+	mux.Get("/user/reset-password", Repo.ResetPassword)
+	mux.Post("/user/login", Repo.PostShowLogin)
+
+	mux.Get("/admin/mail-failed", Repo.AdminFailedMail)
+	mux.Get("/admin/users", Repo.AdminUsers)
+	mux.Get("/admin/users/new", Repo.AdminNewUser)
+	mux.Get("/admin/users/{id}", Repo.AdminShowUser)
+	mux.Get("/admin/change-password", Repo.ChangePassword)
+	mux.Get("/admin/webhooks", Repo.AdminWebhooks)
+	mux.Get("/admin/webhooks/new", Repo.AdminNewWebhook)
+	mux.Get("/admin/webhooks/deliveries", Repo.AdminWebhookDeliveries)
+	mux.Get("/admin/webhooks/{id}", Repo.AdminShowWebhook)
+	mux.Get("/admin/promo-codes", Repo.AdminPromoCodes)
+	mux.Get("/admin/promo-codes/new", Repo.AdminNewPromoCode)
+	mux.Get("/admin/promo-codes/report", Repo.AdminPromoReport)
+	mux.Get("/admin/promo-codes/{id}", Repo.AdminShowPromoCode)
+	mux.Get("/admin/room-types", Repo.AdminRoomTypes)
+	mux.Get("/admin/room-types/new", Repo.AdminNewRoomType)
+	mux.Get("/admin/room-types/{id}", Repo.AdminShowRoomType)
+	mux.Get("/admin/rooms", Repo.AdminRooms)
+	mux.Get("/admin/rooms/new", Repo.AdminNewRoom)
+	mux.Get("/admin/rooms/{id}", Repo.AdminShowRoom)
+
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mrkouhadi/go-booking-app/internal/forms"
+	"github.com/mrkouhadi/go-booking-app/internal/helpers"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/render"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
+	"github.com/mrkouhadi/go-booking-app/internal/webhook"
+)
+
+// Other systems, e.g. the accounting and the housekeeping, are told about the reservations through webhooks.
+// The handlers hand the repository the events along with the change, which queues a delivery for every
+// endpoint subscribed to them in the same transaction. The webhook workers of cmd/web send them.
+
+// webhookLogSize is how many deliveries the delivery log shows
+const webhookLogSize = 200
+
+// webhookPayload is the JSON body of every webhook, its data is the reservation as the API shows it
+type webhookPayload struct {
+	Event      models.WebhookEvent `json:"event"`
+	OccurredAt time.Time           `json:"occurred_at"`
+	Data       apiReservation      `json:"data"`
+}
+
+// reservationWebhook returns event about res, it's queued in the same transaction as the change it tells about
+func reservationWebhook(event models.WebhookEvent, res models.Reservation) (models.WebhookMessage, error) {
+	payload, err := json.Marshal(webhookPayload{Event: event, OccurredAt: time.Now().UTC(), Data: toAPIReservation(res)})
+	return models.WebhookMessage{Event: event, Payload: payload}, err
+}
+
+// reservationWebhooks returns the webhooks about res for each of events
+func reservationWebhooks(res models.Reservation, events ...models.WebhookEvent) ([]models.WebhookMessage, error) {
+	webhooks := make([]models.WebhookMessage, 0, len(events))
+	for _, event := range events {
+		w, err := reservationWebhook(event, res)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, nil
+}
+
+// createdWebhooks returns the webhooks queued along with a new reservation
+func createdWebhooks(res models.Reservation) ([]models.WebhookMessage, error) {
+	return reservationWebhooks(res, models.EventReservationCreated)
+}
+
+// AdminWebhooks lists the webhook endpoints
+func (m *Repository) AdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	endpoints, err := m.DB.AllWebhookEndpoints(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	data := make(map[string]interface{})
+	data["endpoints"] = endpoints
+
+	render.Template(w, r, "admin-webhooks.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminNewWebhook shows the form to add a webhook endpoint
+func (m *Repository) AdminNewWebhook(w http.ResponseWriter, r *http.Request) {
+	m.renderWebhook(w, r, models.WebhookEndpoint{Events: models.WebhookEvents, Active: true}, forms.New(nil))
+}
+
+// AdminPostNewWebhook adds a webhook endpoint with a new secret
+func (m *Repository) AdminPostNewWebhook(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	endpoint := webhookFromForm(form)
+	if !validateWebhook(form, endpoint) {
+		m.renderWebhook(w, r, endpoint, form)
+		return
+	}
+
+	endpoint.Secret, err = webhook.NewSecret()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	id, err := m.DB.InsertWebhookEndpoint(r.Context(), endpoint)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "The endpoint has been added, give it the secret below to check the signatures")
+	http.Redirect(w, r, "/admin/webhooks/"+strconv.Itoa(id), http.StatusSeeOther)
+}
+
+// AdminShowWebhook shows the form to edit a webhook endpoint, along with its secret
+func (m *Repository) AdminShowWebhook(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := m.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+	m.renderWebhook(w, r, endpoint, forms.New(nil))
+}
+
+// AdminPostWebhook saves the URL, description, events and active flag of a webhook endpoint
+func (m *Repository) AdminPostWebhook(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := m.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	edited := webhookFromForm(form)
+	endpoint.URL, endpoint.Description, endpoint.Events, endpoint.Active = edited.URL, edited.Description, edited.Events, edited.Active
+	if !validateWebhook(form, endpoint) {
+		m.renderWebhook(w, r, endpoint, form)
+		return
+	}
+
+	err = m.DB.UpdateWebhookEndpoint(r.Context(), endpoint)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// AdminDeleteWebhook deletes a webhook endpoint along with its deliveries
+func (m *Repository) AdminDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	err = m.DB.DeleteWebhookEndpoint(r.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		m.App.Session.Put(r.Context(), "error", "This endpoint doesn't exist")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "The endpoint has been deleted")
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// AdminWebhookDeliveries shows the log of the latest deliveries
+func (m *Repository) AdminWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := m.DB.RecentWebhookDeliveries(r.Context(), webhookLogSize)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	data := make(map[string]interface{})
+	data["deliveries"] = deliveries
+
+	render.Template(w, r, "admin-webhook-deliveries.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminRedeliverWebhook queues a delivery again, e.g. once a failing endpoint has been fixed
+func (m *Repository) AdminRedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	err = m.DB.RedeliverWebhook(r.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		m.App.Session.Put(r.Context(), "error", "This delivery doesn't exist or is being sent right now")
+		http.Redirect(w, r, "/admin/webhooks/deliveries", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Put(r.Context(), "flash", "The webhook will be delivered again shortly")
+	http.Redirect(w, r, "/admin/webhooks/deliveries", http.StatusSeeOther)
+}
+
+// webhookFromURL loads the endpoint of the {id} URL parameter, it writes the error response and returns
+// false when it can't
+func (m *Repository) webhookFromURL(w http.ResponseWriter, r *http.Request) (models.WebhookEndpoint, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.WebhookEndpoint{}, false
+	}
+	endpoint, err := m.DB.GetWebhookEndpoint(r.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		m.App.Session.Put(r.Context(), "error", "This endpoint doesn't exist")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return models.WebhookEndpoint{}, false
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.WebhookEndpoint{}, false
+	}
+	return endpoint, true
+}
+
+// webhookFromForm reads the fields of the webhook form, unknown events are ignored
+func webhookFromForm(form *forms.Form) models.WebhookEndpoint {
+	endpoint := models.WebhookEndpoint{
+		URL:         strings.TrimSpace(form.Get("url")),
+		Description: strings.TrimSpace(form.Get("description")),
+		Active:      form.Get("active") != "",
+	}
+	for _, name := range form.Values["events"] {
+		if event, ok := models.ParseWebhookEvent(name); ok {
+			endpoint.Events = append(endpoint.Events, event)
+		}
+	}
+	return endpoint
+}
+
+// validateWebhook checks the webhook form, it returns true when the form is valid
+func validateWebhook(form *forms.Form, endpoint models.WebhookEndpoint) bool {
+	form.Required("url")
+	form.IsURL("url")
+	if len(endpoint.Events) == 0 {
+		form.Errors.Add("events", "Choose at least one event")
+	}
+	return form.Valid()
+}
+
+// renderWebhook shows the form of a new endpoint (with a zero ID) or of an existing one
+func (m *Repository) renderWebhook(w http.ResponseWriter, r *http.Request, endpoint models.WebhookEndpoint, form *forms.Form) {
+	chosen := make(map[models.WebhookEvent]bool)
+	for _, e := range endpoint.Events {
+		chosen[e] = true
+	}
+
+	data := make(map[string]interface{})
+	data["endpoint"] = endpoint
+	data["events"] = models.WebhookEvents
+	data["chosen_events"] = chosen
+	render.Template(w, r, "admin-webhook.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
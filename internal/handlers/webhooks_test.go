@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+)
+
+// lastWebhook returns the latest delivery queued in the test repository
+func lastWebhook(t *testing.T) (models.WebhookDelivery, webhookPayload) {
+	t.Helper()
+	deliveries, err := Repo.DB.RecentWebhookDeliveries(context.Background(), 1)
+	if err != nil || len(deliveries) == 0 {
+		t.Fatalf("expected a queued webhook, got %v %v", deliveries, err)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(deliveries[0].Payload, &payload); err != nil {
+		t.Fatalf("invalid payload %s: %s", deliveries[0].Payload, err)
+	}
+	return deliveries[0], payload
+}
+
+// lastWebhookID returns the id of the latest delivery queued in the test repository, 0 when there is none
+func lastWebhookID() int {
+	deliveries, _ := Repo.DB.RecentWebhookDeliveries(context.Background(), 1)
+	if len(deliveries) == 0 {
+		return 0
+	}
+	return deliveries[0].ID
+}
+
+// reservation5 is the URL parameters of the admin pages of reservation 5 of the new reservations
+var reservation5 = map[string]string{"src": "new", "id": "5"}
+
+func TestRepository_ReservationWebhooks(t *testing.T) {
+	tests := []struct {
+		name     string
+		call     func() int
+		expected models.WebhookEvent
+	}{
+		{"admin edit", func() int {
+			form := url.Values{"first_name": {"Janet"}, "last_name": {"Doe"}, "email": {"jane@example.com"}, "phone": {"1"}}
+			rr, _ := serve(Repo.AdminPostShowReservation, testRequest{method: "POST", target: "/admin/reservations/new/5", params: reservation5, form: form})
+			return rr.Code
+		}, models.EventReservationUpdated},
+		{"admin process", func() int {
+			rr, _ := serve(Repo.AdminProcessReservation, testRequest{method: "POST", target: "/admin/process-reservation/new/5/do", params: reservation5})
+			return rr.Code
+		}, models.EventReservationProcessed},
+		{"admin delete", func() int {
+			rr, _ := serve(Repo.AdminDeleteReservation, testRequest{method: "POST", target: "/admin/delete-reservation/new/5/do", params: reservation5})
+			return rr.Code
+		}, models.EventReservationDeleted},
+		{"API create", func() int {
+			body := `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com","phone":"555","room_id":1,"start_date":"2050-01-01","end_date":"2050-01-03"}`
+			rr, _ := callAPI(t, Repo.APICreateReservation, "POST", "/api/v1/reservations", "", body)
+			return rr.Code
+		}, models.EventReservationCreated},
+		{"API processed", func() int {
+			rr, _ := callAPI(t, Repo.APIUpdateReservation, "PATCH", "/api/v1/reservations/5", "5", `{"processed":true}`)
+			return rr.Code
+		}, models.EventReservationProcessed},
+		{"API delete", func() int {
+			rr, _ := callAPI(t, Repo.APIDeleteReservation, "DELETE", "/api/v1/reservations/5", "5", "")
+			return rr.Code
+		}, models.EventReservationDeleted},
+	}
+	for _, e := range tests {
+		before := lastWebhookID()
+		if code := e.call(); code >= 400 {
+			t.Fatalf("%s: unexpected status %d", e.name, code)
+		}
+		d, payload := lastWebhook(t)
+		if d.ID == before {
+			t.Errorf("%s: expected a webhook to be queued", e.name)
+			continue
+		}
+		if d.Event != e.expected || payload.Event != e.expected || d.EndpointID != 1 {
+			t.Errorf("%s: expected %s to endpoint 1, got %s to %d", e.name, e.expected, d.Event, d.EndpointID)
+		}
+		if payload.Data.ID == 0 || payload.OccurredAt.IsZero() {
+			t.Errorf("%s: expected the reservation in the payload, got %s", e.name, d.Payload)
+		}
+	}
+}
+
+func TestRepository_FailedChangesQueueNoWebhook(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		// the test repository refuses room 3 as taken and fails storing a booking of room 2
+		{"room taken", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com","phone":"555","room_id":3,"start_date":"2050-01-01","end_date":"2050-01-03"}`},
+		{"database error", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com","phone":"555","room_id":2,"start_date":"2050-01-01","end_date":"2050-01-03"}`},
+	}
+	for _, e := range tests {
+		before := lastWebhookID()
+		if rr, _ := callAPI(t, Repo.APICreateReservation, "POST", "/api/v1/reservations", "", e.body); rr.Code < 400 {
+			t.Fatalf("%s: expected the booking to fail, got %d", e.name, rr.Code)
+		}
+		if lastWebhookID() != before {
+			t.Errorf("%s: expected no webhook for a booking that wasn't stored", e.name)
+		}
+	}
+}
+
+func TestRepository_AdminPostNewWebhook(t *testing.T) {
+	tests := []struct {
+		name             string
+		form             url.Values
+		expectedStatus   int
+		expectedLocation string
+		expectedError    string
+	}{
+		{"added", url.Values{"url": {"https://housekeeping.example.com/hooks"}, "events": {"reservation.created", "reservation.deleted"}, "active": {"1"}}, http.StatusSeeOther, "/admin/webhooks/", ""},
+		{"no url", url.Values{"events": {"reservation.created"}}, http.StatusOK, "", "This field cannot be Blank"},
+		{"not a url", url.Values{"url": {"housekeeping"}, "events": {"reservation.created"}}, http.StatusOK, "", "Enter a URL"},
+		{"no event", url.Values{"url": {"https://housekeeping.example.com/hooks"}}, http.StatusOK, "", "Choose at least one event"},
+		{"unknown event", url.Values{"url": {"https://housekeeping.example.com/hooks"}, "events": {"room.painted"}}, http.StatusOK, "", "Choose at least one event"},
+	}
+	for _, e := range tests {
+		rr, _ := postAdminUser(Repo.AdminPostNewWebhook, "", e.form)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if !strings.HasPrefix(rr.Header().Get("Location"), e.expectedLocation) {
+			t.Errorf("%s: expected a redirect to %s, got %q", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+		if e.expectedError != "" && !strings.Contains(rr.Body.String(), e.expectedError) {
+			t.Errorf("%s: expected %q in the page", e.name, e.expectedError)
+		}
+	}
+
+	endpoints, _ := Repo.DB.AllWebhookEndpoints(context.Background())
+	added := endpoints[len(endpoints)-1]
+	if added.URL != "https://housekeeping.example.com/hooks" || !added.Active || len(added.Events) != 2 || !strings.HasPrefix(added.Secret, "whsec_") {
+		t.Errorf("expected the endpoint to be stored with a secret, got %+v", added)
+	}
+	if err := Repo.DB.DeleteWebhookEndpoint(context.Background(), added.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepository_AdminPostWebhook(t *testing.T) {
+	valid := url.Values{"url": {"https://accounting.example.com/hooks"}, "description": {"accounting"}, "events": {"reservation.created", "reservation.updated", "reservation.processed", "reservation.deleted"}, "active": {"1"}}
+	tests := []struct {
+		name           string
+		id             string
+		form           url.Values
+		expectedStatus int
+		expectedFlash  string
+	}{
+		{"saved", "1", valid, http.StatusSeeOther, "flash"},
+		{"invalid", "1", url.Values{"url": {"accounting"}}, http.StatusOK, ""},
+		{"unknown endpoint", "99", valid, http.StatusSeeOther, "error"},
+		{"invalid id", "x", valid, http.StatusInternalServerError, ""},
+		{"database error", "1000000", valid, http.StatusInternalServerError, ""},
+	}
+	for _, e := range tests {
+		rr, ctx := postAdminUser(Repo.AdminPostWebhook, e.id, e.form)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedFlash != "" && (rr.Header().Get("Location") != "/admin/webhooks" || session.GetString(ctx, e.expectedFlash) == "") {
+			t.Errorf("%s: expected a redirect to the webhooks with a %s message", e.name, e.expectedFlash)
+		}
+	}
+
+	endpoint, _ := Repo.DB.GetWebhookEndpoint(context.Background(), 1)
+	if endpoint.Secret == "" || !endpoint.Active || len(endpoint.Events) != 4 {
+		t.Errorf("expected the endpoint to keep its secret and every event, got %+v", endpoint)
+	}
+}
+
+func TestRepository_AdminDeleteWebhook(t *testing.T) {
+	id, err := Repo.DB.InsertWebhookEndpoint(context.Background(), models.WebhookEndpoint{URL: "https://old.example.com", Secret: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		id             string
+		expectedStatus int
+		expectedFlash  string
+	}{
+		{"deleted", strconv.Itoa(id), http.StatusSeeOther, "flash"},
+		{"already deleted", strconv.Itoa(id), http.StatusSeeOther, "error"},
+		{"invalid id", "x", http.StatusInternalServerError, ""},
+		{"database error", "1000000", http.StatusInternalServerError, ""},
+	}
+	for _, e := range tests {
+		rr, ctx := postAdminUser(Repo.AdminDeleteWebhook, e.id, nil)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedFlash != "" && (rr.Header().Get("Location") != "/admin/webhooks" || session.GetString(ctx, e.expectedFlash) == "") {
+			t.Errorf("%s: expected a redirect to the webhooks with a %s message", e.name, e.expectedFlash)
+		}
+	}
+}
+
+func TestRepository_AdminRedeliverWebhook(t *testing.T) {
+	if _, err := Repo.DB.QueueWebhook(context.Background(), models.EventReservationCreated, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	d, _ := Repo.DB.RecentWebhookDeliveries(context.Background(), 1)
+
+	tests := []struct {
+		name           string
+		id             string
+		expectedStatus int
+		expectedFlash  string
+	}{
+		{"redelivered", strconv.Itoa(d[0].ID), http.StatusSeeOther, "flash"},
+		{"unknown delivery", "99999", http.StatusSeeOther, "error"},
+		{"invalid id", "x", http.StatusInternalServerError, ""},
+		{"database error", "1000000", http.StatusInternalServerError, ""},
+	}
+	for _, e := range tests {
+		rr, ctx := postAdminUser(Repo.AdminRedeliverWebhook, e.id, nil)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedFlash != "" && (rr.Header().Get("Location") != "/admin/webhooks/deliveries" || session.GetString(ctx, e.expectedFlash) == "") {
+			t.Errorf("%s: expected a redirect to the delivery log with a %s message", e.name, e.expectedFlash)
+		}
+	}
+}
@@ -1,11 +1,16 @@
 package helpers
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"runtime/debug"
+	"strings"
 
 	"github.com/mrkouhadi/go-booking-app/internal/config"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
 )
 
 var app *config.AppConfig
@@ -28,7 +33,86 @@ func ServerError(w http.ResponseWriter, err error) {
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
+// APIError is the error of every failed API response, sent as {"error": {...}}
+type APIError struct {
+	Status  int               `json:"status"`
+	Code    string            `json:"code"` // stable, for programs to check, e.g. "not_found"
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"` // what is wrong with each invalid field of the request
+}
+
+// WriteJSON sends v as the JSON body of a response with the status
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		APIServerError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(out)
+}
+
+// WriteAPIError sends e in the error envelope of the API
+func WriteAPIError(w http.ResponseWriter, e APIError) {
+	WriteJSON(w, e.Status, map[string]APIError{"error": e})
+}
+
+// APIServerError is ServerError for the API, the client gets the error envelope without the details
+func APIServerError(w http.ResponseWriter, err error) {
+	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
+	app.ErrorLog.Println(trace)
+	WriteAPIError(w, APIError{Status: http.StatusInternalServerError, Code: "internal_error", Message: "Something went wrong on our side"})
+}
+
 func IsAuthenticated(r *http.Request) bool {
 	exists := app.Session.Exists(r.Context(), "user_id")
 	return exists
 }
+
+type contextKey string
+
+// userKey is where the Auth middleware puts the logged in user
+const userKey contextKey = "user"
+
+// WithUser returns a copy of ctx holding the logged in user
+func WithUser(ctx context.Context, u models.User) context.Context {
+	return context.WithValue(ctx, userKey, u)
+}
+
+// CurrentUser returns the user the Auth middleware loaded for the request
+func CurrentUser(r *http.Request) (models.User, bool) {
+	u, ok := r.Context().Value(userKey).(models.User)
+	return u, ok
+}
+
+// apiKeyKey is where the APIAuth middleware puts the API key of the caller
+const apiKeyKey contextKey = "api_key"
+
+// WithAPIKey returns a copy of ctx holding the API key of the caller
+func WithAPIKey(ctx context.Context, k models.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyKey, k)
+}
+
+// CurrentAPIKey returns the API key the APIAuth middleware authenticated the request with
+func CurrentAPIKey(r *http.Request) (models.APIKey, bool) {
+	k, ok := r.Context().Value(apiKeyKey).(models.APIKey)
+	return k, ok
+}
+
+// WantsJSON reports whether the client expects a JSON response rather than a page
+func WantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") ||
+		strings.Contains(r.Header.Get("Content-Type"), "application/json") ||
+		r.Header.Get("X-Requested-With") == "XMLHttpRequest"
+}
+
+// ClientIP returns the IP address the request came from. X-Forwarded-For isn't trusted since anyone can set it,
+// so behind a proxy this is the address of the proxy unless the proxy rewrites RemoteAddr.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,150 @@
+// Package invoice builds the invoices of the reservations from the taxes and fees of the property, and
+// writes them as an HTML page or a PDF document.
+package invoice
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/config"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/pricing"
+)
+
+//go:embed invoice.html.tmpl
+var files embed.FS
+
+// ContentTypePDF is the content type of the documents written by PDF
+const ContentTypePDF = "application/pdf"
+
+// kindOrder is the order the kinds of charges are applied in
+var kindOrder = map[models.ChargeKind]int{
+	models.ChargeFeePerStay:  1,
+	models.ChargeFeePerNight: 1,
+	models.ChargeTaxPercent:  2,
+	models.ChargeTaxPerNight: 3,
+}
+
+// Build returns the invoice of res: its stay at the price frozen onto it, less its promo code, then the fees,
+// then the taxes. The fees come in the order of their position, and so do the taxes. Percentage taxes are
+// taken on the discounted stay and the fees, each rounded to the nearest cent. The invoice has no number until it's issued.
+func Build(res models.Reservation, charges []models.Charge) models.Invoice {
+	nights := Nights(res.StartDate, res.EndDate)
+	inv := models.Invoice{
+		ReservationID: res.ID,
+		Currency:      res.Currency,
+		GuestName:     strings.TrimSpace(res.FirstName + " " + res.LastName),
+		GuestEmail:    res.Email,
+		RoomName:      res.Room.RoomName,
+		StartDate:     res.StartDate,
+		EndDate:       res.EndDate,
+	}
+	add := func(kind, description string, quantity, unit int) {
+		inv.Lines = append(inv.Lines, models.InvoiceLine{
+			Position:    len(inv.Lines) + 1,
+			Kind:        kind,
+			Description: description,
+			Quantity:    quantity,
+			UnitCents:   unit,
+			AmountCents: quantity * unit,
+		})
+		if kind == models.InvoiceLineTax {
+			inv.TaxCents += quantity * unit
+		} else {
+			inv.SubtotalCents += quantity * unit
+		}
+	}
+
+	add(models.InvoiceLineStay, fmt.Sprintf("%s, %s to %s (%s)", res.Room.RoomName,
+		res.StartDate.Format("Jan 2, 2006"), res.EndDate.Format("Jan 2, 2006"), plural(nights, "night")), 1, res.TotalCents+res.PromoCents)
+	if res.PromoCents > 0 {
+		add(models.InvoiceLineDiscount, "Promo code "+res.PromoCode, 1, -res.PromoCents)
+	}
+
+	sorted := make([]models.Charge, len(charges))
+	copy(sorted, charges)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if kindOrder[a.Kind] != kindOrder[b.Kind] {
+			return kindOrder[a.Kind] < kindOrder[b.Kind]
+		}
+		if a.Position != b.Position {
+			return a.Position < b.Position
+		}
+		return a.ID < b.ID
+	})
+
+	for _, c := range sorted {
+		switch c.Kind {
+		case models.ChargeFeePerStay:
+			add(models.InvoiceLineFee, c.Name, 1, c.AmountCents)
+		case models.ChargeFeePerNight:
+			add(models.InvoiceLineFee, c.Name+" per night", nights, c.AmountCents)
+		case models.ChargeTaxPercent:
+			// the fees are all in the subtotal by now, and taxes aren't taxed
+			add(models.InvoiceLineTax, fmt.Sprintf("%s (%s)", c.Name, Percent(c.RateBasisPoints)), 1, percentOf(inv.SubtotalCents, c.RateBasisPoints))
+		case models.ChargeTaxPerNight:
+			add(models.InvoiceLineTax, c.Name+" per night", nights, c.AmountCents)
+		}
+	}
+	inv.TotalCents = inv.SubtotalCents + inv.TaxCents
+	return inv
+}
+
+// percentOf returns basisPoints of cents, rounded half up to the nearest cent
+func percentOf(cents, basisPoints int) int {
+	return (cents*basisPoints + 5000) / 10000
+}
+
+// Percent writes a rate in basis points as a percentage, e.g. 1000 is 10% and 550 is 5.5%
+func Percent(basisPoints int) string {
+	s := strconv.Itoa(basisPoints / 100)
+	if cents := basisPoints % 100; cents != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%02d", cents), "0")
+	}
+	return s + "%"
+}
+
+// Nights returns the number of nights of a stay from start to end
+func Nights(start, end time.Time) int {
+	return int(end.Sub(start).Hours()+12) / 24
+}
+
+// plural writes n things, e.g. 1 night or 3 nights
+func plural(n int, thing string) string {
+	if n == 1 {
+		return "1 " + thing
+	}
+	return fmt.Sprintf("%d %ss", n, thing)
+}
+
+// addressLines splits an address on its commas
+func addressLines(address string) []string {
+	var lines []string
+	for _, l := range strings.Split(address, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+var page = template.Must(template.New("invoice.html.tmpl").Funcs(template.FuncMap{
+	"money":   pricing.FormatMoney,
+	"date":    func(t time.Time) string { return t.Format("January 2, 2006") },
+	"address": addressLines,
+}).ParseFS(files, "invoice.html.tmpl"))
+
+// HTML writes inv as a standalone HTML page, issued by the property p
+func HTML(w io.Writer, inv models.Invoice, p config.PropertyConfig) error {
+	return page.Execute(w, struct {
+		Invoice  models.Invoice
+		Property config.PropertyConfig
+	}{inv, p})
+}
@@ -0,0 +1,189 @@
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/config"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+)
+
+var reservation = models.Reservation{
+	ID:         42,
+	FirstName:  "Jane",
+	LastName:   "Doe",
+	Email:      "jane@example.com",
+	StartDate:  time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+	EndDate:    time.Date(2050, 1, 4, 0, 0, 0, 0, time.UTC),
+	Room:       models.Room{ID: 1, RoomName: "General's Quarters"},
+	TotalCents: 33333,
+	Currency:   "USD",
+}
+
+// charges are given out of order, Build sorts them
+var charges = []models.Charge{
+	{ID: 1, Name: "City tax", Kind: models.ChargeTaxPerNight, AmountCents: 250},
+	{ID: 2, Name: "VAT", Kind: models.ChargeTaxPercent, RateBasisPoints: 1000, Position: 1},
+	{ID: 3, Name: "Resort fee", Kind: models.ChargeFeePerNight, AmountCents: 1500, Position: 2},
+	{ID: 4, Name: "Cleaning", Kind: models.ChargeFeePerStay, AmountCents: 5000, Position: 1},
+	{ID: 5, Name: "Tourism levy", Kind: models.ChargeTaxPercent, RateBasisPoints: 55, Position: 2},
+}
+
+func TestBuild(t *testing.T) {
+	inv := Build(reservation, charges)
+
+	want := []struct {
+		kind        string
+		description string
+		quantity    int
+		amount      int
+	}{
+		{models.InvoiceLineStay, "General's Quarters, Jan 1, 2050 to Jan 4, 2050 (3 nights)", 1, 33333},
+		{models.InvoiceLineFee, "Cleaning", 1, 5000},
+		{models.InvoiceLineFee, "Resort fee per night", 3, 4500},
+		{models.InvoiceLineTax, "VAT (10%)", 1, 4283},           // 10% of 42833, rounded down
+		{models.InvoiceLineTax, "Tourism levy (0.55%)", 1, 236}, // 0.55% of 42833, rounded up, not of the VAT
+		{models.InvoiceLineTax, "City tax per night", 3, 750},
+	}
+	if len(inv.Lines) != len(want) {
+		t.Fatalf("expected %d lines, got %+v", len(want), inv.Lines)
+	}
+	for i, w := range want {
+		l := inv.Lines[i]
+		if l.Position != i+1 || l.Kind != w.kind || l.Description != w.description || l.Quantity != w.quantity || l.AmountCents != w.amount {
+			t.Errorf("line %d: expected %+v, got %+v", i+1, w, l)
+		}
+	}
+	if inv.SubtotalCents != 42833 || inv.TaxCents != 5269 || inv.TotalCents != 48102 {
+		t.Errorf("unexpected totals %d + %d = %d", inv.SubtotalCents, inv.TaxCents, inv.TotalCents)
+	}
+	if inv.ReservationID != 42 || inv.GuestName != "Jane Doe" || inv.Currency != "USD" || inv.Number != "" {
+		t.Errorf("unexpected invoice %+v", inv)
+	}
+
+	// the same reservation and charges always make the same invoice
+	again := Build(reservation, []models.Charge{charges[4], charges[3], charges[2], charges[1], charges[0]})
+	if fmt.Sprint(again) != fmt.Sprint(inv) {
+		t.Errorf("expected the order of the charges not to matter, got\n%+v\n%+v", again, inv)
+	}
+}
+
+func TestBuild_Promo(t *testing.T) {
+	res := reservation
+	res.TotalCents, res.PromoCode, res.PromoCents = 30000, "SUMMER", 3333
+	inv := Build(res, charges)
+
+	if len(inv.Lines) != 7 {
+		t.Fatalf("expected the stay, the discount, 2 fees and 3 taxes, got %+v", inv.Lines)
+	}
+	if stay := inv.Lines[0]; stay.AmountCents != 33333 {
+		t.Errorf("expected the stay before the discount, got %+v", stay)
+	}
+	if d := inv.Lines[1]; d.Kind != models.InvoiceLineDiscount || d.Description != "Promo code SUMMER" || d.AmountCents != -3333 {
+		t.Errorf("expected the discount of the promo code after the stay, got %+v", d)
+	}
+	// the taxes are taken on the discounted stay: 10% and 0.55% of 39500, and 3 nights of city tax
+	if inv.SubtotalCents != 39500 || inv.TaxCents != 3950+217+750 || inv.TotalCents != 44417 {
+		t.Errorf("unexpected totals %d + %d = %d", inv.SubtotalCents, inv.TaxCents, inv.TotalCents)
+	}
+}
+
+func TestPercent(t *testing.T) {
+	for bp, want := range map[int]string{1000: "10%", 550: "5.5%", 1234: "12.34%", 5: "0.05%", 0: "0%"} {
+		if got := Percent(bp); got != want {
+			t.Errorf("Percent(%d) = %q, want %q", bp, got, want)
+		}
+	}
+}
+
+func issued() models.Invoice {
+	inv := Build(reservation, charges)
+	inv.Number = "INV-000001"
+	inv.IssuedAt = time.Date(2049, 12, 1, 10, 0, 0, 0, time.UTC)
+	return inv
+}
+
+var property = config.PropertyConfig{Name: "Fort Smythe", Address: "1 Main Street, Springfield", TaxID: "FR123"}
+
+func TestHTML(t *testing.T) {
+	inv := issued()
+	inv.GuestName = `<script>alert("hi")</script>`
+	var buf bytes.Buffer
+	if err := HTML(&buf, inv, property); err != nil {
+		t.Fatal(err)
+	}
+	page := buf.String()
+	for _, want := range []string{"INV-000001", "December 1, 2049", "1 Main Street<br>", "Tax ID: FR123", "$481.02", "$42.83", "&lt;script&gt;"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("expected %q in the page", want)
+		}
+	}
+	if strings.Contains(page, "<script>") {
+		t.Error("the guest's name is not escaped")
+	}
+}
+
+func TestPDF(t *testing.T) {
+	doc := PDF(issued(), property)
+	checkPDF(t, doc, 1)
+	for _, want := range []string{"(Number: INV-000001)", "(General's Quarters, Jan 1, 2050 to Jan 4, 2050 \\(3)", "(nights\\))", "($481.02)", "(Tax ID: FR123)"} {
+		if !bytes.Contains(doc, []byte(want)) {
+			t.Errorf("expected %s in the document", want)
+		}
+	}
+
+	// euros are written in WinAnsiEncoding
+	inv := issued()
+	inv.Currency = "EUR"
+	if doc := PDF(inv, property); !bytes.Contains(doc, []byte(`(\200481.02)`)) {
+		t.Error("expected the euro sign to be encoded")
+	}
+
+	// the lines that don't fit go on other pages
+	for i := 0; i < 60; i++ {
+		inv.Lines = append(inv.Lines, models.InvoiceLine{Description: strings.Repeat("long description ", 5), Quantity: 1})
+	}
+	checkPDF(t, PDF(inv, property), 3)
+}
+
+// checkPDF checks that every object is where the cross-reference table says it is
+func checkPDF(t *testing.T, doc []byte, pages int) {
+	t.Helper()
+	if !bytes.HasPrefix(doc, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(doc, []byte("%%EOF\n")) {
+		t.Fatal("not a PDF document")
+	}
+	start := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(doc)
+	if start == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(start[1]))
+	if !bytes.HasPrefix(doc[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d doesn't point at the xref table", xref)
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(doc[xref:], -1)
+	for i, e := range entries {
+		offset, _ := strconv.Atoi(string(e[1]))
+		if !bytes.HasPrefix(doc[offset:], []byte(fmt.Sprintf("%d 0 obj\n", i+1))) {
+			t.Errorf("object %d isn't at %d", i+1, offset)
+		}
+	}
+	if !bytes.Contains(doc, []byte(fmt.Sprintf("/Count %d >>", pages))) {
+		t.Errorf("expected %d pages", pages)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	got := wrap("the quick brown fox jumps over the lazy dog", 10)
+	want := []string{"the quick", "brown fox", "jumps over", "the lazy", "dog"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got := wrap("abcdefghijkl", 5); fmt.Sprint(got) != "[abcde fghij kl]" {
+		t.Errorf("expected a long word to be cut, got %q", got)
+	}
+}
@@ -0,0 +1,258 @@
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mrkouhadi/go-booking-app/internal/config"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/pricing"
+)
+
+// the A4 page the invoices are printed on, in points
+const (
+	pageWidth    = 595.28
+	pageHeight   = 841.89
+	marginLeft   = 50.0
+	marginRight  = pageWidth - 50
+	marginTop    = pageHeight - 50
+	marginBottom = 60.0
+)
+
+// the standard fonts used, every PDF reader has them so they aren't embedded
+const (
+	fontRegular = "F1" // Helvetica
+	fontBold    = "F2" // Helvetica-Bold
+	fontFixed   = "F3" // Courier, for the figures which are aligned on the right
+)
+
+// descriptionWidth is how many characters of a description fit in its column, longer ones are wrapped
+const descriptionWidth = 50
+
+// PDF writes inv as a PDF document, issued by the property p
+func PDF(inv models.Invoice, p config.PropertyConfig) []byte {
+	d := &pdfDoc{}
+	d.newPage()
+
+	d.text(marginLeft, d.y, fontBold, 20, "INVOICE")
+	top := d.y
+	d.y -= 28
+	d.text(marginLeft, d.y, fontRegular, 10, "Number: "+inv.Number)
+	d.advance(14)
+	d.text(marginLeft, d.y, fontRegular, 10, "Issued: "+inv.IssuedAt.Format("January 2, 2006"))
+	d.advance(14)
+	d.text(marginLeft, d.y, fontRegular, 10, fmt.Sprintf("Reservation: %d", inv.ReservationID))
+	left := d.y
+
+	// the property on the right of the title
+	d.y = top
+	d.text(330, d.y, fontBold, 11, p.Name)
+	for _, l := range addressLines(p.Address) {
+		d.advance(14)
+		d.text(330, d.y, fontRegular, 10, l)
+	}
+	if p.TaxID != "" {
+		d.advance(14)
+		d.text(330, d.y, fontRegular, 10, "Tax ID: "+p.TaxID)
+	}
+	if left < d.y {
+		d.y = left
+	}
+
+	d.advance(32)
+	d.text(marginLeft, d.y, fontBold, 10, "Billed to")
+	d.advance(14)
+	d.text(marginLeft, d.y, fontRegular, 10, inv.GuestName)
+	d.advance(14)
+	d.text(marginLeft, d.y, fontRegular, 10, inv.GuestEmail)
+	d.advance(24)
+	d.text(marginLeft, d.y, fontBold, 10, "Stay")
+	d.advance(14)
+	d.text(marginLeft, d.y, fontRegular, 10, fmt.Sprintf("%s, %s to %s", inv.RoomName,
+		inv.StartDate.Format("January 2, 2006"), inv.EndDate.Format("January 2, 2006")))
+
+	d.advance(32)
+	d.tableHeader()
+	for _, l := range inv.Lines {
+		lines := wrap(l.Description, descriptionWidth)
+		d.advance(16 + 12*float64(len(lines)-1))
+		if d.y == marginTop {
+			// a new page was started, repeat the header of the table
+			d.tableHeader()
+			d.advance(16 + 12*float64(len(lines)-1))
+		}
+		y := d.y + 12*float64(len(lines)-1)
+		for _, text := range lines {
+			d.text(marginLeft, y, fontRegular, 10, text)
+			y -= 12
+		}
+		top := d.y + 12*float64(len(lines)-1)
+		d.right(360, top, fmt.Sprint(l.Quantity))
+		d.right(455, top, pricing.FormatMoney(l.UnitCents, inv.Currency))
+		d.right(marginRight, top, pricing.FormatMoney(l.AmountCents, inv.Currency))
+	}
+	d.advance(8)
+	d.line(marginLeft, d.y, marginRight, d.y)
+
+	for _, total := range []struct {
+		label string
+		cents int
+		font  string
+	}{
+		{"Subtotal", inv.SubtotalCents, fontRegular},
+		{"Taxes", inv.TaxCents, fontRegular},
+		{"Total", inv.TotalCents, fontBold},
+	} {
+		d.advance(16)
+		d.text(360, d.y, total.font, 10, total.label)
+		d.right(marginRight, d.y, pricing.FormatMoney(total.cents, inv.Currency))
+	}
+	return d.bytes()
+}
+
+// pdfDoc is a minimal PDF 1.4 writer: text and lines on pages of the same size
+type pdfDoc struct {
+	pages []*bytes.Buffer // the content stream of every page
+	y     float64         // where the next line goes on the current page
+}
+
+// newPage starts a page, writing from its top
+func (d *pdfDoc) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = marginTop
+}
+
+// advance moves down by height, on a new page when the current one is full
+func (d *pdfDoc) advance(height float64) {
+	if d.y-height < marginBottom {
+		d.newPage()
+		return
+	}
+	d.y -= height
+}
+
+// tableHeader writes the header of the lines of the invoice
+func (d *pdfDoc) tableHeader() {
+	d.text(marginLeft, d.y, fontBold, 10, "Description")
+	d.text(330, d.y, fontBold, 10, "Qty")
+	d.text(405, d.y, fontBold, 10, "Unit price")
+	d.text(503, d.y, fontBold, 10, "Amount")
+	d.advance(6)
+	d.line(marginLeft, d.y, marginRight, d.y)
+}
+
+func (d *pdfDoc) text(x, y float64, font string, size float64, s string) {
+	fmt.Fprintf(d.pages[len(d.pages)-1], "BT /%s %g Tf %.2f %.2f Td %s Tj ET\n", font, size, x, y, pdfString(s))
+}
+
+// right writes s in the fixed font so that it ends at x
+func (d *pdfDoc) right(x, y float64, s string) {
+	const size = 10
+	// every character of Courier is 600/1000 of the font size wide
+	width := 0.6 * size * float64(utf8.RuneCountInString(s))
+	d.text(x-width, y, fontFixed, size, s)
+}
+
+func (d *pdfDoc) line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(d.pages[len(d.pages)-1], "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, y1, x2, y2)
+}
+
+// bytes writes the document: the catalog, the page tree, the fonts, then every page and its content
+func (d *pdfDoc) bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	const firstPage = 6 // the objects before are the catalog, the page tree and the 3 fonts
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	for _, font := range []string{"Helvetica", "Helvetica-Bold", "Courier"} {
+		object(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", font))
+	}
+	for i, content := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R /F3 5 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, firstPage+2*i+1))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.Bytes()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// winAnsi maps the characters of WinAnsiEncoding that aren't in Latin-1 to their code
+var winAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+}
+
+// pdfString writes s as a PDF string in WinAnsiEncoding, the characters it lacks become '?'
+func pdfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range s {
+		c, ok := winAnsi[r]
+		switch {
+		case ok:
+		case r >= 0x20 && r < 0x7f, r >= 0xa0 && r <= 0xff:
+			c = byte(r)
+		default:
+			c = '?'
+		}
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c >= 0x7f:
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// wrap splits s into lines of at most width characters, on spaces when it can
+func wrap(s string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(s) {
+		for utf8.RuneCountInString(word) > width {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			r := []rune(word)
+			lines = append(lines, string(r[:width]))
+			word = string(r[width:])
+		}
+		switch {
+		case line == "":
+			line = word
+		case utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) <= width:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" || len(lines) == 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,89 @@
+// Package limiter counts hits on a key, e.g. login attempts from an IP address, within a fixed window
+// and tells when there have been too many. The counters live in a Store: Memory for a single instance,
+// Postgres when several instances of the app have to share them.
+package limiter
+
+import (
+	"context"
+	"time"
+)
+
+// Store keeps the counters of the limiters
+type Store interface {
+	// Hit counts a hit on key and returns the hits in the current window and when the window ends,
+	// a window starts with the first hit after the previous one ended
+	Hit(ctx context.Context, key string, window time.Duration) (int, time.Time, error)
+	// Reset forgets the hits on key
+	Reset(ctx context.Context, key string) error
+}
+
+// Result is what a limiter decided about a hit
+type Result struct {
+	Allowed bool      // the hit is within the limit
+	Hits    int       // hits in the current window, this one included
+	Reset   time.Time // end of the current window
+}
+
+// Limiter allows Limit hits on a key per window
+type Limiter struct {
+	store  Store
+	prefix string
+	limit  int
+	window time.Duration
+}
+
+// New returns a limiter allowing limit hits per window. The prefix keeps the keys of limiters sharing
+// a store apart, e.g. "login-ip" and "login-account".
+func New(store Store, prefix string, limit int, window time.Duration) *Limiter {
+	return &Limiter{
+		store:  store,
+		prefix: prefix,
+		limit:  limit,
+		window: window,
+	}
+}
+
+// Allow counts a hit on key and reports whether it's within the limit
+func (l *Limiter) Allow(ctx context.Context, key string) (Result, error) {
+	hits, reset, err := l.store.Hit(ctx, l.prefix+":"+key, l.window)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Allowed: hits <= l.limit, Hits: hits, Reset: reset}, nil
+}
+
+// Reset forgets the hits on key, e.g. after a successful login
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	return l.store.Reset(ctx, l.prefix+":"+key)
+}
+
+// Delay returns how long to wait after the nth hit: nothing for the first one, then base doubled
+// after every other hit, up to max
+func Delay(n int, base, max time.Duration) time.Duration {
+	if n <= 1 || base <= 0 {
+		return 0
+	}
+	d := base
+	for i := 2; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Wait sleeps for d, or less if ctx is done first
+func Wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
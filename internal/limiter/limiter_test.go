@@ -0,0 +1,107 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	store := NewMemory()
+	now := time.Date(2050, 1, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	l := New(store, "login-ip", 3, time.Minute)
+
+	for i := 1; i <= 3; i++ {
+		res, err := l.Allow(ctx, "10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Allowed || res.Hits != i {
+			t.Fatalf("hit %d: expected to be allowed, got %+v", i, res)
+		}
+	}
+	res, _ := l.Allow(ctx, "10.0.0.1")
+	if res.Allowed {
+		t.Error("expected the 4th hit to be over the limit")
+	}
+	if !res.Reset.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected the window to end a minute after the first hit, got %s", res.Reset)
+	}
+
+	// other keys and other limiters sharing the store have their own counters
+	if res, _ := l.Allow(ctx, "10.0.0.2"); !res.Allowed {
+		t.Error("expected another key to be allowed")
+	}
+	if res, _ := New(store, "login-account", 3, time.Minute).Allow(ctx, "10.0.0.1"); !res.Allowed {
+		t.Error("expected another prefix to be allowed")
+	}
+
+	now = now.Add(time.Minute)
+	if res, _ := l.Allow(ctx, "10.0.0.1"); !res.Allowed || res.Hits != 1 {
+		t.Errorf("expected a new window once the previous one ended, got %+v", res)
+	}
+
+	l.Allow(ctx, "10.0.0.1")
+	l.Allow(ctx, "10.0.0.1")
+	if err := l.Reset(ctx, "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := l.Allow(ctx, "10.0.0.1"); res.Hits != 1 {
+		t.Errorf("expected the hits to be forgotten after a reset, got %d", res.Hits)
+	}
+}
+
+func TestMemory_Sweep(t *testing.T) {
+	store := NewMemory()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	store.Hit(ctx, "a", time.Second)
+	store.Hit(ctx, "b", time.Hour)
+
+	now = now.Add(2 * sweepInterval)
+	store.Hit(ctx, "c", time.Second)
+	if _, ok := store.counters["a"]; ok {
+		t.Error("expected the ended window to be dropped")
+	}
+	if _, ok := store.counters["b"]; !ok {
+		t.Error("expected the running window to be kept")
+	}
+}
+
+func TestDelay(t *testing.T) {
+	base, max := 250*time.Millisecond, 4*time.Second
+	tests := []struct {
+		n        int
+		expected time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 250 * time.Millisecond},
+		{3, 500 * time.Millisecond},
+		{4, time.Second},
+		{6, 4 * time.Second},
+		{100, 4 * time.Second},
+	}
+	for _, tt := range tests {
+		if d := Delay(tt.n, base, max); d != tt.expected {
+			t.Errorf("hit %d: expected %s, got %s", tt.n, tt.expected, d)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := Wait(ctx, time.Hour); err == nil {
+		t.Error("expected an error for a cancelled context")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("expected Wait to return as soon as the context is done")
+	}
+}
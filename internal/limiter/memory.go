@@ -0,0 +1,70 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the memory store drops the counters of windows that have ended
+const sweepInterval = time.Minute
+
+type counter struct {
+	hits  int
+	reset time.Time
+}
+
+// Memory keeps the counters in the memory of the process, they are lost on a restart
+// and not shared with other instances of the app
+type Memory struct {
+	mu        sync.Mutex
+	counters  map[string]*counter
+	nextSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemory returns an empty memory store
+func NewMemory() *Memory {
+	return &Memory{
+		counters: map[string]*counter{},
+		now:      time.Now,
+	}
+}
+
+// Hit counts a hit on key
+func (m *Memory) Hit(ctx context.Context, key string, window time.Duration) (int, time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, time.Time{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if now.After(m.nextSweep) {
+		for k, c := range m.counters {
+			if !now.Before(c.reset) {
+				delete(m.counters, k)
+			}
+		}
+		m.nextSweep = now.Add(sweepInterval)
+	}
+
+	c, ok := m.counters[key]
+	if !ok || !now.Before(c.reset) {
+		c = &counter{reset: now.Add(window)}
+		m.counters[key] = c
+	}
+	c.hits++
+	return c.hits, c.reset, nil
+}
+
+// Reset forgets the hits on key
+func (m *Memory) Reset(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.counters, key)
+	return nil
+}
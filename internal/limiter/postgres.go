@@ -0,0 +1,71 @@
+package limiter
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// Postgres keeps the counters in the rate_limits table so that every instance of the app shares them
+type Postgres struct {
+	db      *sql.DB
+	timeout time.Duration
+
+	mu        sync.Mutex
+	nextSweep time.Time
+}
+
+// NewPostgres returns a store using db, every query is cancelled after timeout
+func NewPostgres(db *sql.DB, timeout time.Duration) *Postgres {
+	return &Postgres{db: db, timeout: timeout}
+}
+
+// Hit counts a hit on key, starting a new window when the previous one has ended
+func (p *Postgres) Hit(ctx context.Context, key string, window time.Duration) (int, time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	if err := p.sweep(ctx); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	query := `
+		insert into rate_limits (key, hits, reset_at)
+		values ($1, 1, now() + $2 * interval '1 millisecond')
+		on conflict (key) do update set
+			hits = case when rate_limits.reset_at <= now() then 1 else rate_limits.hits + 1 end,
+			reset_at = case when rate_limits.reset_at <= now() then excluded.reset_at else rate_limits.reset_at end
+		returning hits, reset_at
+	`
+	var hits int
+	var reset time.Time
+	err := p.db.QueryRowContext(ctx, query, key, window.Milliseconds()).Scan(&hits, &reset)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return hits, reset, nil
+}
+
+// Reset forgets the hits on key
+func (p *Postgres) Reset(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	_, err := p.db.ExecContext(ctx, "delete from rate_limits where key = $1", key)
+	return err
+}
+
+// sweep drops the counters of windows that have ended, at most once every sweepInterval per instance
+func (p *Postgres) sweep(ctx context.Context) error {
+	p.mu.Lock()
+	if time.Now().Before(p.nextSweep) {
+		p.mu.Unlock()
+		return nil
+	}
+	p.nextSweep = time.Now().Add(sweepInterval)
+	p.mu.Unlock()
+
+	_, err := p.db.ExecContext(ctx, "delete from rate_limits where reset_at <= now()")
+	return err
+}
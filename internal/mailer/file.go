@@ -0,0 +1,84 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Writer writes every email, as it would be sent, to w. It's meant for development.
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriter returns a mailer writing to w, e.g. os.Stdout
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Send writes msg followed by a separator line
+func (m *Writer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	email := build(msg)
+	if err := email.GetError(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.w, "%s\n%s\n", email.GetMessage(), separator)
+	return err
+}
+
+// Close does nothing
+func (m *Writer) Close() error {
+	return nil
+}
+
+const separator = "----------------------------------------------------------------"
+
+// File writes every email to its own .eml file, which most mail clients can open
+type File struct {
+	dir string
+
+	mu   sync.Mutex
+	sent int
+}
+
+// NewFile returns a mailer writing to dir, creating it when needed
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("cannot create the mail directory: %w", err)
+	}
+	return &File{dir: dir}, nil
+}
+
+// Send writes msg to a file named after the time it was sent
+func (m *File) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	email := build(msg)
+	if err := email.GetError(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.sent++
+	name := fmt.Sprintf("%s-%d.eml", time.Now().Format("20060102-150405"), m.sent)
+	m.mu.Unlock()
+
+	return os.WriteFile(filepath.Join(m.dir, name), []byte(email.GetMessage()), 0o644)
+}
+
+// Close does nothing
+func (m *File) Close() error {
+	return nil
+}
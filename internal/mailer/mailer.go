@@ -0,0 +1,71 @@
+// Package mailer sends email. The app talks to the Mailer interface so that the transport, an SMTP
+// server, files on disk or memory in tests, is picked by the config.
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/mrkouhadi/go-booking-app/internal/config"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// Message is an email ready to be sent. At least one of HTML and Text must be set,
+// when both are the client picks which one to show.
+type Message struct {
+	From        string
+	To          string
+	Subject     string
+	HTML        string
+	Text        string
+	Attachments []Attachment
+}
+
+// Attachment is a file attached to a Message
+type Attachment struct {
+	Name        string
+	ContentType string // guessed from Name when empty
+	Data        []byte
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+	// Close releases the connections of the mailer, it can't be used afterwards
+	Close() error
+}
+
+// New returns the mailer of the transport set in c: smtp, file or stdout
+func New(c config.MailConfig, s config.SMTPConfig) (Mailer, error) {
+	switch c.Transport {
+	case "smtp":
+		return NewSMTP(s)
+	case "file":
+		return NewFile(c.Dir)
+	case "stdout":
+		return NewWriter(os.Stdout), nil
+	}
+	return nil, fmt.Errorf("unknown mail transport %q", c.Transport)
+}
+
+// build turns msg into the email of go-simple-mail
+func build(msg Message) *mail.Email {
+	email := mail.NewMSG()
+	email.SetFrom(msg.From).AddTo(msg.To).SetSubject(msg.Subject)
+
+	switch {
+	case msg.HTML != "" && msg.Text != "":
+		email.SetBody(mail.TextPlain, msg.Text)
+		email.AddAlternative(mail.TextHTML, msg.HTML)
+	case msg.HTML != "":
+		email.SetBody(mail.TextHTML, msg.HTML)
+	default:
+		email.SetBody(mail.TextPlain, msg.Text)
+	}
+
+	for _, a := range msg.Attachments {
+		email.Attach(&mail.File{Name: a.Name, MimeType: a.ContentType, Data: a.Data})
+	}
+	return email
+}
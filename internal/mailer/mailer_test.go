@@ -0,0 +1,294 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/config"
+)
+
+// smtpServer is a fake SMTP server that records the connections, logins and messages it gets
+type smtpServer struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	conns    int
+	logins   []string
+	messages []string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for _, l := range lines {
+			conn.Write([]byte(l + "\r\n"))
+		}
+	}
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			reply("250-localhost", "250 AUTH PLAIN LOGIN")
+		case "AUTH":
+			fields := strings.Fields(line)
+			creds, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			s.mu.Lock()
+			s.logins = append(s.logins, string(creds))
+			s.mu.Unlock()
+			reply("235 authenticated")
+		case "DATA":
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			// MAIL, RCPT, RSET and NOOP
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *smtpServer) config() config.SMTPConfig {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return config.SMTPConfig{
+		Host:       "127.0.0.1",
+		Port:       addr.Port,
+		Encryption: "none",
+		Auth:       "plain",
+		Timeout:    time.Second,
+	}
+}
+
+var testMessage = Message{
+	From:    "contact@bookingapp.com",
+	To:      "guest@example.com",
+	Subject: "Confirming your reservation",
+	HTML:    "<strong>Thank you</strong>",
+	Text:    "Thank you",
+}
+
+func TestSMTP_ReusesConnections(t *testing.T) {
+	server := newSMTPServer(t)
+	c := server.config()
+	c.PoolSize = 1
+	c.Username = "bookings"
+	c.Password = "secret"
+
+	m, err := NewSMTP(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := m.Send(context.Background(), testMessage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Close()
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(server.messages))
+	}
+	if server.conns != 1 {
+		t.Errorf("expected the 3 messages to share 1 connection, got %d", server.conns)
+	}
+	if len(server.logins) != 1 || server.logins[0] != "\x00bookings\x00secret" {
+		t.Errorf("expected a single PLAIN login, got %q", server.logins)
+	}
+	if !strings.Contains(server.messages[0], "Subject: Confirming your reservation") {
+		t.Errorf("the subject is missing from the message:\n%s", server.messages[0])
+	}
+}
+
+func TestSMTP_WithoutPool(t *testing.T) {
+	server := newSMTPServer(t)
+	c := server.config()
+	c.Auth = "none"
+
+	m, err := NewSMTP(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := m.Send(context.Background(), testMessage); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.conns != 2 {
+		t.Errorf("expected a connection per message, got %d", server.conns)
+	}
+	if len(server.logins) != 0 {
+		t.Errorf("expected no login, got %q", server.logins)
+	}
+}
+
+func TestSMTP_ConnectionRefused(t *testing.T) {
+	server := newSMTPServer(t)
+	c := server.config()
+	server.ln.Close()
+
+	m, err := NewSMTP(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Send(context.Background(), testMessage); err == nil {
+		t.Error("expected an error when the server is down")
+	}
+}
+
+func TestNewSMTP_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *config.SMTPConfig)
+	}{
+		{"encryption", func(c *config.SMTPConfig) { c.Encryption = "ssl3" }},
+		{"auth", func(c *config.SMTPConfig) { c.Auth = "cram" }},
+		{"dkim key", func(c *config.SMTPConfig) { c.DKIM.PrivateKeyFile = filepath.Join(t.TempDir(), "missing.pem") }},
+	}
+	for _, tt := range tests {
+		c := config.SMTPConfig{Host: "localhost", Port: 25}
+		tt.change(&c)
+		if _, err := NewSMTP(c); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewWriter(&buf)
+	msg := testMessage
+	msg.Attachments = []Attachment{{Name: "invoice.txt", Data: []byte("total: 100")}}
+
+	if err := m.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{"To: <guest@example.com>", "multipart/alternative", "text/plain", "text/html", `filename="invoice.txt"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in the written message:\n%s", want, out)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	m, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := m.Send(context.Background(), testMessage); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected a file per message, got %d", len(files))
+	}
+	data, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(data), "Subject: Confirming your reservation") {
+		t.Errorf("the subject is missing from the file:\n%s", data)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	if err := m.Send(context.Background(), testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Fail(errors.New("down"))
+	if err := m.Send(context.Background(), testMessage); err == nil {
+		t.Error("expected the error set by Fail")
+	}
+
+	sent := m.Sent()
+	if len(sent) != 1 || sent[0].To != "guest@example.com" {
+		t.Errorf("expected the first message only, got %+v", sent)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Fail(nil)
+	if err := m.Send(ctx, testMessage); err == nil {
+		t.Error("expected an error for a cancelled context")
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(config.MailConfig{Transport: "pigeon"}, config.SMTPConfig{}); err == nil {
+		t.Error("expected an error for an unknown transport")
+	}
+	m, err := New(config.MailConfig{Transport: "file", Dir: t.TempDir()}, config.SMTPConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(*File); !ok {
+		t.Errorf("expected the file mailer, got %T", m)
+	}
+}
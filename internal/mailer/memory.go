@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory keeps the emails it's given so that tests can check what has been sent
+type Memory struct {
+	mu   sync.Mutex
+	sent []Message
+	err  error
+}
+
+// NewMemory returns an empty in-memory mailer
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Send records msg, or returns the error set by Fail
+func (m *Memory) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Fail makes every following Send return err, nil makes them succeed again
+func (m *Memory) Fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
+
+// Sent returns the emails sent so far
+func (m *Memory) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sent := make([]Message, len(m.sent))
+	copy(sent, m.sent)
+	return sent
+}
+
+// Close does nothing
+func (m *Memory) Close() error {
+	return nil
+}
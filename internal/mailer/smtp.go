@@ -0,0 +1,150 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/mrkouhadi/go-booking-app/internal/config"
+	"github.com/toorop/go-dkim"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// SMTP sends email through an SMTP server. Connections are kept open after an email has been sent
+// and reused by the next one, up to the pool size of the config.
+type SMTP struct {
+	server *mail.SMTPServer
+	dkim   *dkim.SigOptions
+
+	mu     sync.Mutex
+	idle   []*mail.SMTPClient
+	size   int
+	closed bool
+}
+
+// NewSMTP returns a mailer for the server of c. It doesn't connect until the first email is sent.
+func NewSMTP(c config.SMTPConfig) (*SMTP, error) {
+	server := mail.NewSMTPClient()
+	server.Host = c.Host
+	server.Port = c.Port
+	server.Username = c.Username
+	server.Password = c.Password
+	server.KeepAlive = c.PoolSize > 0
+	server.ConnectTimeout = c.Timeout
+	server.SendTimeout = c.Timeout
+
+	switch c.Encryption {
+	case "none", "":
+		server.Encryption = mail.EncryptionNone
+	case "starttls":
+		server.Encryption = mail.EncryptionSTARTTLS
+	case "tls":
+		server.Encryption = mail.EncryptionSSLTLS
+	default:
+		return nil, fmt.Errorf("unknown smtp encryption %q", c.Encryption)
+	}
+
+	switch c.Auth {
+	case "plain", "":
+		server.Authentication = mail.AuthPlain
+	case "login":
+		server.Authentication = mail.AuthLogin
+	case "none":
+		server.Authentication = mail.AuthNone
+	default:
+		return nil, fmt.Errorf("unknown smtp auth %q", c.Auth)
+	}
+
+	s := &SMTP{server: server, size: c.PoolSize}
+	if c.DKIM.PrivateKeyFile != "" {
+		key, err := os.ReadFile(c.DKIM.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the dkim key: %w", err)
+		}
+		options := dkim.NewSigOptions()
+		options.PrivateKey = key
+		options.Domain = c.DKIM.Domain
+		options.Selector = c.DKIM.Selector
+		options.Headers = []string{"from", "to", "subject", "date", "mime-version", "content-type"}
+		s.dkim = &options
+	}
+	return s, nil
+}
+
+// Send sends msg on an idle connection, or a new one when there is none
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	email := build(msg)
+	if s.dkim != nil {
+		email.SetDkim(*s.dkim)
+	}
+	if err := email.GetError(); err != nil {
+		return err
+	}
+
+	client, err := s.conn()
+	if err != nil {
+		return err
+	}
+	if err := email.Send(client); err != nil {
+		// the state of the connection is unknown after a failure, don't reuse it
+		client.Close()
+		return err
+	}
+	s.release(client)
+	return nil
+}
+
+// conn takes an idle connection that is still alive, or opens a new one
+func (s *SMTP) conn() (*mail.SMTPClient, error) {
+	for {
+		s.mu.Lock()
+		if len(s.idle) == 0 {
+			s.mu.Unlock()
+			return s.server.Connect()
+		}
+		client := s.idle[len(s.idle)-1]
+		s.idle = s.idle[:len(s.idle)-1]
+		s.mu.Unlock()
+
+		// the server may have hung up on an idle connection
+		if err := client.Noop(); err == nil {
+			return client, nil
+		}
+		client.Close()
+	}
+}
+
+// release puts a connection back in the pool, or closes it when the pool is full
+func (s *SMTP) release(client *mail.SMTPClient) {
+	if !s.server.KeepAlive {
+		// go-simple-mail usually hangs up itself after sending, closing twice is harmless
+		client.Close()
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || len(s.idle) >= s.size {
+		client.Quit()
+		client.Close()
+		return
+	}
+	s.idle = append(s.idle, client)
+}
+
+// Close closes the idle connections
+func (s *SMTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, client := range s.idle {
+		client.Quit()
+		client.Close()
+	}
+	s.idle = nil
+	return nil
+}
@@ -0,0 +1,65 @@
+package models
+
+import "time"
+
+// ChargeKind is how a tax or a fee is added to the price of a stay
+type ChargeKind string
+
+// the kinds of charges, fees are applied first, then the percentage taxes on the stay and the fees,
+// then the taxes per night
+const (
+	ChargeFeePerStay  ChargeKind = "fee_per_stay"  // AmountCents once, e.g. cleaning
+	ChargeFeePerNight ChargeKind = "fee_per_night" // AmountCents every night, e.g. a resort fee
+	ChargeTaxPercent  ChargeKind = "tax_percent"   // RateBasisPoints of the stay and the fees, e.g. VAT
+	ChargeTaxPerNight ChargeKind = "tax_per_night" // AmountCents every night, e.g. a city tax
+)
+
+// Charge is a tax or a fee of the property, added to the invoice of every reservation
+type Charge struct {
+	ID              int
+	Name            string
+	Kind            ChargeKind
+	AmountCents     int // of the fees and the taxes per night
+	RateBasisPoints int // of the percentage taxes, 1000 is 10%
+	Position        int // order among the charges of the same kind
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// the kinds of invoice lines
+const (
+	InvoiceLineStay     = "stay"
+	InvoiceLineDiscount = "discount" // of a promo code, a negative amount
+	InvoiceLineFee      = "fee"
+	InvoiceLineTax      = "tax"
+)
+
+// InvoiceLine is a line of an invoice
+type InvoiceLine struct {
+	ID          int
+	Position    int // order on the invoice, from 1
+	Kind        string
+	Description string
+	Quantity    int
+	UnitCents   int
+	AmountCents int
+}
+
+// Invoice is the numbered invoice of a reservation. It can't be changed once issued, so it keeps its own
+// copy of the guest and the stay.
+type Invoice struct {
+	ID            int
+	Number        string // e.g. INV-000042, numbers follow each other without gaps
+	ReservationID int
+	Currency      string
+	GuestName     string
+	GuestEmail    string
+	RoomName      string
+	StartDate     time.Time
+	EndDate       time.Time
+	Lines         []InvoiceLine
+	SubtotalCents int // of the stay and the fees
+	TaxCents      int
+	TotalCents    int
+	IssuedAt      time.Time
+}
@@ -14,12 +14,84 @@ type User struct {
 	AccessLevel int
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
+
+	FailedLoginAttempts   int       // failed logins since the last successful one
+	LockedUntil           time.Time // zero unless the account has been locked after too many failed logins
+	Active                bool      // deactivated users can't log in
+	PasswordResetRequired bool      // the user has to choose a new password before doing anything else
+	SessionVersion        int       // bumped when the password changes, which ends the sessions of the older versions
+
+	TOTPSecret   string // base32 secret of the authenticator app, empty until two-factor authentication is set up
+	TOTPEnabled  bool   // logging in takes a code from the authenticator app or a recovery code after the password
+	TOTPLastStep int64  // time step of the last code used, older and equal ones are refused so that codes work once
+}
+
+// PasswordReset is a link emailed to a user who forgot their password, only the hash of its token is stored
+type PasswordReset struct {
+	ID        int
+	UserID    int
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    time.Time // zero until the link has been used
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
 // Room is the Room model
 type Room struct {
+	ID               int
+	RoomName         string
+	Slug             string // the room's page is /rooms/{slug}
+	Description      string
+	Photos           []string // paths or URLs of the photos, the first one is the cover
+	Amenities        []string // on top of the amenities of the type
+	NightlyRateCents int      // price of a night, in cents of app.Currency
+	WeekendRateCents int      // price of a Friday or Saturday night, 0 when it's the nightly rate
+	RoomTypeID       int      // 0 when the room has no type
+	Active           bool     // inactive rooms aren't shown or offered to guests
+	Position         int      // rooms are listed by position
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	RoomType         RoomType // optional
+}
+
+// Sleeps reports whether the room can hold a party of guests, a room without a type holds any party
+func (r Room) Sleeps(guests int) bool {
+	return r.RoomTypeID == 0 || guests <= r.RoomType.MaxOccupancy
+}
+
+// RoomType describes rooms that are alike: how many guests they sleep, their beds and their amenities
+type RoomType struct {
+	ID           int
+	Name         string
+	Description  string
+	MaxOccupancy int    // adults and children together
+	Beds         string // e.g. "1 king bed and 1 sofa bed"
+	Amenities    []string
+	RoomIDs      []int // the rooms of this type
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// SeasonalRate overrides the rates of a room, or of every room, for the nights from StartDate to the
+// night before EndDate
+type SeasonalRate struct {
+	ID               int
+	RoomID           int // 0 for every room
+	Name             string
+	StartDate        time.Time
+	EndDate          time.Time
+	NightlyRateCents int
+	WeekendRateCents int // 0 when it's the nightly rate
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+// StayDiscount takes Percent off the price of stays of at least MinNights nights
+type StayDiscount struct {
 	ID        int
-	RoomName  string
+	MinNights int
+	Percent   int
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -42,10 +114,17 @@ type Reservation struct {
 	StartDate time.Time
 	EndDate   time.Time
 	RoomId    int
+	Adults    int
+	Children  int
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	Room      Room // optional
 	Processed int
+
+	TotalCents int    // price of the stay when it was booked, 0 for the reservations made before there were prices
+	Currency   string // of TotalCents
+	PromoCode  string // redeemed when booking, empty when there was none
+	PromoCents int    // taken off the price by PromoCode, TotalCents is what's left
 }
 
 // RoomRestrictions is the model of room_restriction
@@ -68,6 +147,96 @@ type MailData struct {
 	To       string
 	From     string
 	Subject  string
-	Content  string
-	Template string
+	Content  string // html part
+	Text     string // plain-text part
+	Template string // name of the email template it was rendered from, if any
+
+	Attachments []MailAttachment
+}
+
+// MailAttachment is a file attached to an email, e.g. the invoice of a reservation
+type MailAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// the states an email goes through in the outbox
+const (
+	MailPending = "pending" // waiting for its first or next attempt
+	MailSending = "sending" // claimed by a mail worker
+	MailSent    = "sent"
+	MailDead    = "dead" // gave up after too many failed attempts
+)
+
+// OutboxMail is an email stored in the mail_outbox table until it has been delivered
+type OutboxMail struct {
+	ID int
+	MailData
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	SentAt        time.Time // zero until the email has been sent
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// the reasons a login attempt is refused
+const (
+	LoginInvalidCredentials = "invalid_credentials" // unknown email or wrong password
+	LoginAccountLocked      = "account_locked"      // too many failed logins in a row
+	LoginAccountDisabled    = "account_disabled"    // the user has been deactivated
+	LoginRateLimited        = "rate_limited"        // too many attempts from the IP address or on the email
+	LoginInvalidCode        = "invalid_code"        // wrong or reused two-factor code
+)
+
+// LoginAttempt is a refused login, stored in the login_attempts table for auditing
+type LoginAttempt struct {
+	ID        int
+	Email     string
+	IPAddress string
+	UserID    int // 0 when no user has the email
+	Reason    string
+	CreatedAt time.Time
+}
+
+// Booking is everything stored together, in a single transaction, when a guest books a room
+type Booking struct {
+	Reservation Reservation
+	// Invoice is issued along with the reservation, which gives it its number. It may be nil.
+	Invoice *Invoice
+	// Promo is the promo code redeemed by the reservation, its usage limits are checked again when the
+	// redemption is recorded. It may be nil.
+	Promo *PromoCode
+	// Mail returns the emails to put in the outbox along with the reservation. It's given the
+	// stored reservation, with its ID and room, and its invoice, when it has one. It may be nil.
+	Mail func(res Reservation, invoice *Invoice) ([]MailData, error)
+	// Webhooks returns the webhooks to queue along with the reservation, it's given the stored reservation.
+	// It may be nil.
+	Webhooks func(res Reservation) ([]WebhookMessage, error)
+	// Idempotency makes a retry of the booking return the reservation of the first attempt instead of
+	// booking again, it's ignored when its key is empty
+	Idempotency IdempotencyKey
+}
+
+// IdempotencyKey is sent by a client with a request it may retry, e.g. after a timeout or a double click
+type IdempotencyKey struct {
+	Key         string    // scoped by where it comes from, e.g. "api:3:<key>" for API key 3
+	RequestHash string    // what the first request asked for, the key can't be reused for another request
+	ExpiresAt   time.Time // the key can be used again afterwards
+}
+
+// APIKey lets a machine client call the API, only the hash of the key is stored
+type APIKey struct {
+	ID         int
+	Name       string // what the key is for, e.g. "front desk tablet"
+	Prefix     string // start of the key, shown so that it can be told apart from the others
+	KeyHash    string
+	Scopes     []APIScope
+	CreatedBy  int       // 0 once the user who created the key has been deleted
+	LastUsedAt time.Time // zero until the key has been used
+	RevokedAt  time.Time // zero until the key has been revoked
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
 }
@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// PromoKind is how a promo code takes money off a stay
+type PromoKind string
+
+// the kinds of promo codes
+const (
+	PromoPercent PromoKind = "percent" // Percent of the price of the stay
+	PromoFixed   PromoKind = "fixed"   // AmountCents off the price of the stay, down to nothing
+)
+
+// PromoCode is a discount guests get by typing its code when they book, e.g. for a campaign
+type PromoCode struct {
+	ID              int
+	Code            string // in upper case, guests may type it in any case
+	Description     string
+	Kind            PromoKind
+	Percent         int
+	AmountCents     int
+	ValidFrom       time.Time // first day it can be redeemed, zero when it can be right away
+	ValidUntil      time.Time // last day it can be redeemed, zero when it doesn't expire
+	RoomIDs         []int     // the rooms it can be redeemed for, empty for every room
+	MinNights       int       // shortest stay it can be redeemed for, 0 for any
+	MaxUses         int       // redemptions by all guests, 0 for no limit
+	MaxUsesPerGuest int       // redemptions by a guest, known by their email, 0 for no limit
+	Active          bool
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+
+	Uses          int // redemptions so far, only set by AllPromoCodes
+	RedeemedCents int // taken off by the redemptions so far, only set by AllPromoCodes
+}
+
+// PromoRedemption is a promo code redeemed by a reservation. It's kept when the reservation is deleted.
+type PromoRedemption struct {
+	ID            int
+	PromoCodeID   int
+	Code          string
+	ReservationID int
+	GuestEmail    string
+	DiscountCents int
+	Currency      string
+	CreatedAt     time.Time
+}
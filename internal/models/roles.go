@@ -0,0 +1,101 @@
+package models
+
+// Role is what a staff member is allowed to do, it's stored in users.access_level
+type Role int
+
+const (
+	RoleReadOnly  Role = 1 // can look at reservations
+	RoleFrontDesk Role = 2 // handles the guests: edits and processes reservations
+	RoleManager   Role = 3 // runs the place: deletes reservations, blocks rooms, resends email
+	RoleOwner     Role = 4 // can do everything
+)
+
+// Permission is an action on the admin side that not every role may take
+type Permission string
+
+const (
+	PermViewReservations    Permission = "reservations.view"
+	PermEditReservations    Permission = "reservations.edit"
+	PermProcessReservations Permission = "reservations.process"
+	PermDeleteReservations  Permission = "reservations.delete"
+	PermManageCalendar      Permission = "calendar.manage"
+	PermManageMail          Permission = "mail.manage"
+	PermManagePromoCodes    Permission = "promo_codes.manage"
+	PermManageRooms         Permission = "rooms.manage"
+	PermManageUsers         Permission = "users.manage"    // owner only
+	PermManageAPIKeys       Permission = "api_keys.manage" // owner only
+	PermManageWebhooks      Permission = "webhooks.manage" // owner only
+)
+
+// rolePermissions lists what every role may do, the owner may do anything
+var rolePermissions = map[Role][]Permission{
+	RoleReadOnly: {
+		PermViewReservations,
+	},
+	RoleFrontDesk: {
+		PermViewReservations,
+		PermEditReservations,
+		PermProcessReservations,
+	},
+	RoleManager: {
+		PermViewReservations,
+		PermEditReservations,
+		PermProcessReservations,
+		PermDeleteReservations,
+		PermManageCalendar,
+		PermManageMail,
+		PermManagePromoCodes,
+		PermManageRooms,
+	},
+}
+
+// Can reports whether the role has permission p
+func (r Role) Can(p Permission) bool {
+	if r == RoleOwner {
+		return true
+	}
+	for _, granted := range rolePermissions[r] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the name of the role
+func (r Role) String() string {
+	switch r {
+	case RoleReadOnly:
+		return "read-only"
+	case RoleFrontDesk:
+		return "front-desk"
+	case RoleManager:
+		return "manager"
+	case RoleOwner:
+		return "owner"
+	}
+	return "none"
+}
+
+// Roles lists every role, from the least to the most privileged
+var Roles = []Role{RoleReadOnly, RoleFrontDesk, RoleManager, RoleOwner}
+
+// ParseRole finds a role by its name, as returned by String
+func ParseRole(name string) (Role, bool) {
+	for _, r := range Roles {
+		if r.String() == name {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+// Valid reports whether r is one of the roles
+func (r Role) Valid() bool {
+	return r >= RoleReadOnly && r <= RoleOwner
+}
+
+// Role returns the role of the user, a user with an unknown access level may do nothing
+func (u User) Role() Role {
+	return Role(u.AccessLevel)
+}
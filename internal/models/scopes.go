@@ -0,0 +1,41 @@
+package models
+
+// APIScope is what an API key may do
+type APIScope string
+
+const (
+	ScopeReadAvailability  APIScope = "availability:read"  // list the rooms and their availability
+	ScopeWriteReservations APIScope = "reservations:write" // make, read, change and delete reservations
+	ScopeAdmin             APIScope = "admin"              // everything
+)
+
+// APIScopes lists every scope
+var APIScopes = []APIScope{ScopeReadAvailability, ScopeWriteReservations, ScopeAdmin}
+
+// ParseAPIScope finds a scope by its name
+func ParseAPIScope(name string) (APIScope, bool) {
+	for _, s := range APIScopes {
+		if string(s) == name {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// Revoked reports whether the key has been revoked
+func (k APIKey) Revoked() bool {
+	return !k.RevokedAt.IsZero()
+}
+
+// Can reports whether the key has scope s, the admin scope grants every other one and a revoked key can do nothing
+func (k APIKey) Can(s APIScope) bool {
+	if k.Revoked() {
+		return false
+	}
+	for _, granted := range k.Scopes {
+		if granted == s || granted == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
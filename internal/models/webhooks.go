@@ -0,0 +1,82 @@
+package models
+
+import "time"
+
+// WebhookEvent is what happened to a reservation, sent to the webhook endpoints subscribed to it
+type WebhookEvent string
+
+const (
+	EventReservationCreated   WebhookEvent = "reservation.created"
+	EventReservationUpdated   WebhookEvent = "reservation.updated"
+	EventReservationProcessed WebhookEvent = "reservation.processed"
+	EventReservationDeleted   WebhookEvent = "reservation.deleted"
+)
+
+// WebhookEvents lists every event
+var WebhookEvents = []WebhookEvent{EventReservationCreated, EventReservationUpdated, EventReservationProcessed, EventReservationDeleted}
+
+// ParseWebhookEvent finds an event by its name
+func ParseWebhookEvent(name string) (WebhookEvent, bool) {
+	for _, e := range WebhookEvents {
+		if string(e) == name {
+			return e, true
+		}
+	}
+	return "", false
+}
+
+// WebhookMessage is an event, with its JSON payload, to queue for every endpoint subscribed to it. It's stored
+// in the same transaction as the change it tells about.
+type WebhookMessage struct {
+	Event   WebhookEvent
+	Payload []byte
+}
+
+// WebhookEndpoint is a URL of another system, e.g. accounting, that is sent the events it's subscribed to
+type WebhookEndpoint struct {
+	ID          int
+	URL         string
+	Description string
+	Secret      string // signs the payloads, the receiver checks the signature with it
+	Events      []WebhookEvent
+	Active      bool // inactive endpoints aren't sent new events
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Subscribed reports whether the endpoint is sent event e
+func (e WebhookEndpoint) Subscribed(event WebhookEvent) bool {
+	for _, subscribed := range e.Events {
+		if subscribed == event {
+			return true
+		}
+	}
+	return false
+}
+
+// the states a webhook delivery goes through, like the emails of the outbox
+const (
+	WebhookPending   = "pending" // waiting for its first or next attempt
+	WebhookSending   = "sending" // claimed by a webhook worker
+	WebhookDelivered = "delivered"
+	WebhookDead      = "dead" // gave up after too many failed attempts
+)
+
+// WebhookDelivery is an event to send to an endpoint, stored in the webhook_deliveries table until the
+// endpoint has accepted it
+type WebhookDelivery struct {
+	ID             int
+	EndpointID     int
+	URL            string // of the endpoint
+	Secret         string // of the endpoint
+	Event          WebhookEvent
+	Payload        []byte // the JSON body
+	Status         string
+	Attempts       int
+	NextAttemptAt  time.Time
+	LastError      string
+	ResponseStatus int       // HTTP status of the last answer of the endpoint, 0 when it didn't answer
+	DeliveredAt    time.Time // zero until the endpoint has accepted it
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
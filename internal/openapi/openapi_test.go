@@ -0,0 +1,71 @@
+package openapi
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSpec_IsValidJSON(t *testing.T) {
+	out, err := json.Marshal(Spec("https://bookings.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["openapi"] != "3.0.3" {
+		t.Errorf("unexpected openapi version %v", doc["openapi"])
+	}
+}
+
+func TestSpec_RefsResolve(t *testing.T) {
+	doc := Spec("")
+	out, _ := json.Marshal(doc)
+	for _, m := range regexp.MustCompile(`"\$ref":"#/components/(schemas|responses)/([^"]+)"`).FindAllStringSubmatch(string(out), -1) {
+		var ok bool
+		switch m[1] {
+		case "schemas":
+			_, ok = doc.Components.Schemas[m[2]]
+		case "responses":
+			_, ok = doc.Components.Responses[m[2]]
+		}
+		if !ok {
+			t.Errorf("%s/%s is referred to but not defined", m[1], m[2])
+		}
+	}
+}
+
+func TestSpec_Operations(t *testing.T) {
+	doc := Spec("")
+	ids := make(map[string]bool)
+	for _, route := range doc.Routes() {
+		op := route.Operation
+		if op.OperationID == "" || ids[op.OperationID] {
+			t.Errorf("%s %s: the operation id %q is empty or used twice", route.Method, route.Path, op.OperationID)
+		}
+		ids[op.OperationID] = true
+		if op.Summary == "" || len(op.Responses) == 0 {
+			t.Errorf("%s %s: expected a summary and responses", route.Method, route.Path)
+		}
+
+		// every parameter of the path is described
+		for _, m := range regexp.MustCompile(`\{(\w+)\}`).FindAllStringSubmatch(route.Path, -1) {
+			found := false
+			for _, p := range op.Parameters {
+				found = found || (p.In == "path" && p.Name == m[1] && p.Required)
+			}
+			if !found {
+				t.Errorf("%s %s: the path parameter %s isn't described", route.Method, route.Path, m[1])
+			}
+		}
+	}
+	if !doc.Has("GET", "/api/v1/rooms") || doc.Has("PUT", "/api/v1/rooms") || doc.Has("GET", "/api/v1/guests") {
+		t.Error("Has doesn't find exactly the operations of the document")
+	}
+	if routes := doc.Routes(); !strings.HasPrefix(routes[0].Path, "/api/v1/availability") || routes[0].Method != "GET" {
+		t.Errorf("expected the routes sorted by path, got %s %s first", routes[0].Method, routes[0].Path)
+	}
+}
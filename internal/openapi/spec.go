@@ -0,0 +1,325 @@
+package openapi
+
+// Version is the version of the API the document describes, bumped when the document changes
+const Version = "1.2.0"
+
+// dateExample is how the API writes dates
+const dateExample = "2050-01-31"
+
+// Spec returns the document of the API reached at baseURL, e.g. https://bookings.example.com
+func Spec(baseURL string) *Document {
+	return &Document{
+		OpenAPI: "3.0.3",
+		Info: Info{
+			Title:   "Bookings API",
+			Version: Version,
+			Description: "Rooms, their availability and reservations, for the front desk tablet app and partners. " +
+				"A successful response is {\"data\": ...}, a failed one {\"error\": {...}}.",
+		},
+		Servers:  []Server{{URL: baseURL}},
+		Security: []map[string][]string{{"bearerAuth": {}}},
+		Tags: []Tag{
+			{Name: "availability", Description: "Needs an API key with the availability:read scope"},
+			{Name: "reservations", Description: "Needs an API key with the reservations:write scope"},
+			{Name: "website", Description: "Used by the pages of the website, with the session cookie and a CSRF token"},
+		},
+		Paths: map[string]PathItem{
+			"/api/v1/rooms": {
+				"get": {
+					OperationID: "listRooms",
+					Summary:     "List the rooms guests can book",
+					Tags:        []string{"availability"},
+					Responses: apiResponses(map[string]*Response{
+						"200": data("The rooms", arrayOf(ref("Room"))),
+					}),
+				},
+			},
+			"/api/v1/rooms/{id}/availability": {
+				"get": {
+					OperationID: "getRoomAvailability",
+					Summary:     "Tell whether a room is free for a stay",
+					Tags:        []string{"availability"},
+					Parameters:  []Parameter{idParameter("room"), dateParameter("start", "first night"), dateParameter("end", "day of departure")},
+					Responses: apiResponses(map[string]*Response{
+						"200": data("Whether the room is free", ref("Availability")),
+						"404": refResponse("NotFound"),
+						"422": refResponse("ValidationFailed"),
+					}),
+				},
+			},
+			"/api/v1/availability": {
+				"get": {
+					OperationID: "listAvailableRooms",
+					Summary:     "List the rooms free for a stay that can hold the party",
+					Tags:        []string{"availability"},
+					Parameters: []Parameter{dateParameter("start", "first night"), dateParameter("end", "day of departure"),
+						guestsParameter("adults", "number of adults, 1 when it's left out"),
+						guestsParameter("children", "number of children, none when it's left out")},
+					Responses: apiResponses(map[string]*Response{
+						"200": data("The free rooms", arrayOf(ref("Room"))),
+						"422": refResponse("ValidationFailed"),
+					}),
+				},
+			},
+			"/api/v1/reservations": {
+				"post": {
+					OperationID: "createReservation",
+					Summary:     "Book a room",
+					Description: "The guest gets a confirmation email and the owner a notification, like for a booking on the website. " +
+						"Send an Idempotency-Key to retry safely: for 24 hours, the same request with the same key gets the reservation " +
+						"the first one made, with the header Idempotent-Replayed, instead of booking again.",
+					Tags: []string{"reservations"},
+					Parameters: []Parameter{{
+						Name:        "Idempotency-Key",
+						In:          "header",
+						Description: "unique per booking, e.g. a UUID, at most 255 characters",
+						Schema:      &Schema{Type: "string"},
+					}},
+					RequestBody: jsonBody(ref("NewReservation")),
+					Responses: apiResponses(map[string]*Response{
+						"201": withBookingHeaders(data("The reservation", ref("Reservation"))),
+						"400": errorResponse("The body isn't valid JSON for the operation or the Idempotency-Key is too long, the code is invalid_json or invalid_idempotency_key"),
+						"409": errorResponse("The room is already booked or blocked for some of the dates, the code is room_not_available"),
+						"422": errorResponse("Some fields are invalid, the code is validation_failed, or the Idempotency-Key has been used for another request, the code is idempotency_key_reused"),
+					}),
+				},
+			},
+			"/api/v1/reservations/{id}": {
+				"get": {
+					OperationID: "getReservation",
+					Summary:     "Show a reservation",
+					Tags:        []string{"reservations"},
+					Parameters:  []Parameter{idParameter("reservation")},
+					Responses: apiResponses(map[string]*Response{
+						"200": data("The reservation", ref("Reservation")),
+						"404": refResponse("NotFound"),
+					}),
+				},
+				"patch": {
+					OperationID: "updateReservation",
+					Summary:     "Change the guest of a reservation or mark it as processed",
+					Description: "Only the fields that are sent change. The stay can't be changed: delete the reservation and make a new one.",
+					Tags:        []string{"reservations"},
+					Parameters:  []Parameter{idParameter("reservation")},
+					RequestBody: jsonBody(ref("ReservationChanges")),
+					Responses: apiResponses(map[string]*Response{
+						"200": data("The changed reservation", ref("Reservation")),
+						"400": refResponse("InvalidJSON"),
+						"404": refResponse("NotFound"),
+						"422": refResponse("ValidationFailed"),
+					}),
+				},
+				"delete": {
+					OperationID: "deleteReservation",
+					Summary:     "Delete a reservation, which frees its room",
+					Tags:        []string{"reservations"},
+					Parameters:  []Parameter{idParameter("reservation")},
+					Responses: apiResponses(map[string]*Response{
+						"204": &Response{Description: "The reservation has been deleted"},
+						"404": refResponse("NotFound"),
+					}),
+				},
+			},
+			"/search-availability-json": {
+				"post": {
+					OperationID: "searchRoomAvailability",
+					Summary:     "Tell whether a room is free for a stay, for the room pages of the website",
+					Description: "Takes a form with the csrf_token of the page. Unlike the API it answers 200 even when it fails, with ok false.",
+					Tags:        []string{"website"},
+					Security:    []map[string][]string{{"sessionCookie": {}}},
+					RequestBody: &RequestBody{
+						Required: true,
+						Content: map[string]MediaType{"application/x-www-form-urlencoded": {Schema: object(map[string]*Schema{
+							"csrf_token": {Type: "string"},
+							"room_id":    {Type: "integer"},
+							"start":      date("first night"),
+							"end":        date("day of departure"),
+						}, "csrf_token", "room_id", "start", "end")}},
+					},
+					Responses: map[string]*Response{
+						"200": {
+							Description: "Whether the room is free",
+							Content:     map[string]MediaType{"application/json": {Schema: ref("SearchAvailability")}},
+						},
+						"400": {Description: "The CSRF token is missing or wrong"},
+					},
+				},
+			},
+		},
+		Components: Components{
+			Schemas: map[string]*Schema{
+				"Room": object(map[string]*Schema{
+					"id":          {Type: "integer", Example: 1},
+					"name":        {Type: "string", Example: "General's Quarters"},
+					"slug":        {Type: "string", Description: "the room's page on the website is /rooms/{slug}", Example: "generals-quarters"},
+					"description": {Type: "string"},
+					"photos":      arrayOf(&Schema{Type: "string", Description: "path on the website or URL, the first one is the cover", Example: "/static/images/generals.jpeg"}),
+					"amenities":   arrayOf(&Schema{Type: "string", Description: "on top of the amenities of the type", Example: "Sea view"}),
+					"type":        ref("RoomType"),
+				}, "id", "name", "slug", "description", "photos", "amenities"),
+				"RoomType": object(map[string]*Schema{
+					"id":            {Type: "integer"},
+					"name":          {Type: "string", Example: "Suite"},
+					"description":   {Type: "string"},
+					"max_occupancy": {Type: "integer", Description: "how many guests, adults and children, the room sleeps", Example: 4},
+					"beds":          {Type: "string", Example: "1 king bed and 1 sofa bed"},
+					"amenities":     arrayOf(&Schema{Type: "string", Example: "Wi-Fi"}),
+				}, "id", "name", "description", "max_occupancy", "beds", "amenities"),
+				"Availability": object(map[string]*Schema{
+					"room_id":    {Type: "integer"},
+					"start_date": date("first night"),
+					"end_date":   date("day of departure"),
+					"available":  {Type: "boolean"},
+				}, "room_id", "start_date", "end_date", "available"),
+				"Reservation": object(map[string]*Schema{
+					"id":         {Type: "integer"},
+					"first_name": {Type: "string"},
+					"last_name":  {Type: "string"},
+					"email":      {Type: "string", Format: "email"},
+					"phone":      {Type: "string"},
+					"start_date": date("first night"),
+					"end_date":   date("day of departure"),
+					"room_id":    {Type: "integer"},
+					"room":       ref("Room"),
+					"adults":     {Type: "integer"},
+					"children":   {Type: "integer"},
+					"processed":  {Type: "boolean", Description: "the front desk has handled the reservation"},
+					"total_cents": {Type: "integer", Description: "price of the stay when it was booked, in cents of currency; " +
+						"0 for the reservations made before there were prices"},
+					"currency":   {Type: "string", Description: "ISO 4217 code of total_cents, e.g. USD"},
+					"created_at": {Type: "string", Format: "date-time"},
+					"updated_at": {Type: "string", Format: "date-time"},
+				}, "id", "first_name", "last_name", "email", "phone", "start_date", "end_date", "room_id", "adults", "children",
+					"processed", "total_cents", "currency", "created_at", "updated_at"),
+				"NewReservation": object(map[string]*Schema{
+					"first_name": {Type: "string", MinLength: 3},
+					"last_name":  {Type: "string"},
+					"email":      {Type: "string", Format: "email"},
+					"phone":      {Type: "string"},
+					"room_id":    {Type: "integer"},
+					"start_date": date("first night"),
+					"end_date":   date("day of departure, after start_date"),
+					"adults":     {Type: "integer", Description: "1 when it's left out, the room has to sleep the adults and the children"},
+					"children":   {Type: "integer"},
+				}, "first_name", "last_name", "email", "phone", "room_id", "start_date", "end_date"),
+				"ReservationChanges": object(map[string]*Schema{
+					"first_name": {Type: "string", MinLength: 3},
+					"last_name":  {Type: "string"},
+					"email":      {Type: "string", Format: "email"},
+					"phone":      {Type: "string"},
+					"processed":  {Type: "boolean"},
+				}),
+				"Error": object(map[string]*Schema{
+					"error": object(map[string]*Schema{
+						"status":  {Type: "integer", Description: "the HTTP status of the response", Example: 422},
+						"code":    {Type: "string", Description: "stable, for programs to check", Example: "validation_failed"},
+						"message": {Type: "string", Description: "for people to read"},
+						"fields": {
+							Type:                 "object",
+							Description:          "what is wrong with each invalid field of the request",
+							AdditionalProperties: &Schema{Type: "string"},
+						},
+					}, "status", "code", "message"),
+				}, "error"),
+				"SearchAvailability": object(map[string]*Schema{
+					"ok":         {Type: "boolean", Description: "the room is free"},
+					"message":    {Type: "string", Description: "what went wrong, when something did"},
+					"room_id":    {Type: "string"},
+					"start_date": date("first night"),
+					"end_date":   date("day of departure"),
+				}, "ok", "message", "room_id", "start_date", "end_date"),
+			},
+			Responses: map[string]*Response{
+				"Unauthorized":     errorResponse("The API key is missing, unknown or revoked, the code is unauthorized"),
+				"Forbidden":        errorResponse("The API key doesn't have the scope of the operation, the code is forbidden"),
+				"NotFound":         errorResponse("Nothing has this id, the code is not_found"),
+				"InvalidJSON":      errorResponse("The body isn't valid JSON for the operation, the code is invalid_json"),
+				"ValidationFailed": errorResponse("Some fields are invalid, the code is validation_failed and fields tells what is wrong"),
+				"InternalError":    errorResponse("Something went wrong on our side, the code is internal_error"),
+			},
+			SecuritySchemes: map[string]SecurityScheme{
+				"bearerAuth": {
+					Type:        "http",
+					Scheme:      "bearer",
+					Description: "An API key made by the owner in the admin, sent as Authorization: Bearer <key>",
+				},
+				"sessionCookie": {
+					Type: "apiKey",
+					In:   "cookie",
+					Name: "session",
+				},
+			},
+		},
+	}
+}
+
+// apiResponses adds the responses every API operation may answer to the ones of an operation
+func apiResponses(out map[string]*Response) map[string]*Response {
+	out["401"] = refResponse("Unauthorized")
+	out["403"] = refResponse("Forbidden")
+	out["500"] = refResponse("InternalError")
+	return out
+}
+
+// data is a successful response with schema in the data envelope
+func data(description string, schema *Schema) *Response {
+	return &Response{
+		Description: description,
+		Content: map[string]MediaType{"application/json": {Schema: object(map[string]*Schema{
+			"data": schema,
+		}, "data")}},
+	}
+}
+
+// withBookingHeaders adds the headers of the response to a booking to r
+func withBookingHeaders(r *Response) *Response {
+	r.Headers = map[string]Header{
+		"Location":            {Description: "the URL of the new resource", Schema: &Schema{Type: "string"}},
+		"Idempotent-Replayed": {Description: "true when the response is the one of an earlier request with the same Idempotency-Key", Schema: &Schema{Type: "string"}},
+	}
+	return r
+}
+
+// errorResponse is a response with the error envelope
+func errorResponse(description string) *Response {
+	return &Response{
+		Description: description,
+		Content:     map[string]MediaType{"application/json": {Schema: ref("Error")}},
+	}
+}
+
+func refResponse(name string) *Response {
+	return &Response{Ref: "#/components/responses/" + name}
+}
+
+func ref(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+func arrayOf(items *Schema) *Schema {
+	return &Schema{Type: "array", Items: items}
+}
+
+func object(properties map[string]*Schema, required ...string) *Schema {
+	return &Schema{Type: "object", Properties: properties, Required: required}
+}
+
+func date(description string) *Schema {
+	return &Schema{Type: "string", Format: "date", Description: description, Example: dateExample}
+}
+
+func jsonBody(schema *Schema) *RequestBody {
+	return &RequestBody{Required: true, Content: map[string]MediaType{"application/json": {Schema: schema}}}
+}
+
+func idParameter(thing string) Parameter {
+	return Parameter{Name: "id", In: "path", Description: "id of the " + thing, Required: true, Schema: &Schema{Type: "integer"}}
+}
+
+func dateParameter(name, description string) Parameter {
+	return Parameter{Name: name, In: "query", Description: description, Required: true, Schema: date("")}
+}
+
+func guestsParameter(name, description string) Parameter {
+	return Parameter{Name: name, In: "query", Description: description, Schema: &Schema{Type: "integer"}}
+}
@@ -0,0 +1,177 @@
+// Package pricing quotes stays: the rate of the room every night, overridden by the seasons that cover it,
+// less the discount of the longest length of stay reached.
+package pricing
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+)
+
+// maxNights is the longest stay that is quoted
+const maxNights = 366
+
+// ErrInvalidStay is returned when a stay doesn't end after it starts or lasts more than a year
+var ErrInvalidStay = errors.New("a stay must last from one night to a year")
+
+// Store is where the seasons and the discounts are kept, i.e. the database
+type Store interface {
+	SeasonalRates(ctx context.Context, roomID int, start, end time.Time) ([]models.SeasonalRate, error)
+	StayDiscounts(ctx context.Context) ([]models.StayDiscount, error)
+}
+
+// Night is the price of one night of a stay
+type Night struct {
+	Date    time.Time
+	Cents   int
+	Weekend bool   // a Friday or Saturday night
+	Season  string // the season whose rate applies, empty for the rate of the room
+}
+
+// Quote is the price of a stay, night by night
+type Quote struct {
+	RoomID          int
+	Currency        string
+	Nights          []Night
+	SubtotalCents   int // of the nights
+	DiscountPercent int // of the length-of-stay discount, 0 when there is none
+	DiscountCents   int
+	PromoCode       string // applied by the promo package, empty when there is none
+	PromoCents      int
+	TotalCents      int
+}
+
+// Service quotes stays with the seasons and discounts of its store
+type Service struct {
+	store    Store
+	currency string
+}
+
+// New returns a service quoting in currency, the ISO 4217 code the rates are in
+func New(store Store, currency string) *Service {
+	return &Service{store: store, currency: currency}
+}
+
+// QuoteStay prices the nights of room from start to the night before end
+func (s *Service) QuoteStay(ctx context.Context, room models.Room, start, end time.Time) (Quote, error) {
+	start, end = day(start), day(end)
+	if !validStay(start, end) {
+		return Quote{}, ErrInvalidStay
+	}
+	seasons, err := s.store.SeasonalRates(ctx, room.ID, start, end)
+	if err != nil {
+		return Quote{}, err
+	}
+	discounts, err := s.store.StayDiscounts(ctx)
+	if err != nil {
+		return Quote{}, err
+	}
+	return Calculate(room, start, end, seasons, discounts, s.currency)
+}
+
+// Calculate prices the nights of room from start to the night before end. A season of the room wins over
+// a season of every room, and the one starting last wins when several cover the same night.
+func Calculate(room models.Room, start, end time.Time, seasons []models.SeasonalRate, discounts []models.StayDiscount, currency string) (Quote, error) {
+	start, end = day(start), day(end)
+	if !validStay(start, end) {
+		return Quote{}, ErrInvalidStay
+	}
+	q := Quote{RoomID: room.ID, Currency: currency}
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		n := Night{Date: d, Weekend: IsWeekend(d)}
+		nightly, weekend := room.NightlyRateCents, room.WeekendRateCents
+		if s, ok := seasonOf(d, room.ID, seasons); ok {
+			n.Season = s.Name
+			nightly, weekend = s.NightlyRateCents, s.WeekendRateCents
+		}
+		n.Cents = nightly
+		if n.Weekend && weekend > 0 {
+			n.Cents = weekend
+		}
+		q.Nights = append(q.Nights, n)
+		q.SubtotalCents += n.Cents
+	}
+
+	// the discount of the longest stay reached
+	best := 0
+	for _, d := range discounts {
+		if d.MinNights <= len(q.Nights) && d.MinNights > best {
+			best = d.MinNights
+			q.DiscountPercent = d.Percent
+		}
+	}
+	q.DiscountCents = (q.SubtotalCents*q.DiscountPercent + 50) / 100
+	q.TotalCents = q.SubtotalCents - q.DiscountCents
+	return q, nil
+}
+
+// seasonOf returns the season whose rates apply to the night d of room
+func seasonOf(d time.Time, roomID int, seasons []models.SeasonalRate) (models.SeasonalRate, bool) {
+	var found models.SeasonalRate
+	ok := false
+	for _, s := range seasons {
+		if s.RoomID != 0 && s.RoomID != roomID {
+			continue
+		}
+		if d.Before(day(s.StartDate)) || !d.Before(day(s.EndDate)) {
+			continue
+		}
+		if !ok || wins(s, found) {
+			found, ok = s, true
+		}
+	}
+	return found, ok
+}
+
+// wins reports whether season s wins over season other on a night both cover: the season of the room
+// first, then the latest start
+func wins(s, other models.SeasonalRate) bool {
+	if (s.RoomID != 0) != (other.RoomID != 0) {
+		return s.RoomID != 0
+	}
+	return s.StartDate.After(other.StartDate)
+}
+
+// IsWeekend reports whether the night of d is a weekend night, i.e. a Friday or a Saturday
+func IsWeekend(d time.Time) bool {
+	return d.Weekday() == time.Friday || d.Weekday() == time.Saturday
+}
+
+// validStay reports whether a stay from start to end lasts from one night to maxNights
+func validStay(start, end time.Time) bool {
+	return end.After(start) && !end.After(start.AddDate(0, 0, maxNights))
+}
+
+// day returns the date of t at midnight UTC, the way dates of stays are stored
+func day(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// symbols are the currencies written with a symbol before the amount, the others get their code after it
+var symbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+}
+
+// FormatMoney writes an amount in cents of currency for people, e.g. $1,234.50 or 1,234.50 MAD
+func FormatMoney(cents int, currency string) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	units := strconv.Itoa(cents / 100)
+	for i := len(units) - 3; i > 0; i -= 3 {
+		units = units[:i] + "," + units[i:]
+	}
+	amount := units + "." + strconv.Itoa(cents%100/10) + strconv.Itoa(cents%10)
+	if symbol, ok := symbols[currency]; ok {
+		return sign + symbol + amount
+	}
+	return sign + amount + " " + currency
+}
@@ -0,0 +1,172 @@
+package pricing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+)
+
+func date(y int, m time.Month, d int) time.Time {
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// room costs 100.00 a night and 120.00 on Fridays and Saturdays
+var room = models.Room{ID: 1, NightlyRateCents: 10000, WeekendRateCents: 12000}
+
+func TestCalculate_WeekendNights(t *testing.T) {
+	// from Thursday to Monday: Thursday, Friday, Saturday and Sunday nights
+	q, err := Calculate(room, date(2050, 1, 6), date(2050, 1, 10), nil, nil, "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{10000, 12000, 12000, 10000}
+	if len(q.Nights) != len(want) {
+		t.Fatalf("expected %d nights, got %d", len(want), len(q.Nights))
+	}
+	for i, n := range q.Nights {
+		if n.Cents != want[i] {
+			t.Errorf("night %d: expected %d, got %d", i, want[i], n.Cents)
+		}
+		if n.Weekend != (i == 1 || i == 2) {
+			t.Errorf("night %d: unexpected weekend %v", i, n.Weekend)
+		}
+	}
+	if q.SubtotalCents != 44000 || q.TotalCents != 44000 || q.DiscountCents != 0 || q.Currency != "USD" {
+		t.Errorf("unexpected quote %+v", q)
+	}
+
+	// without a weekend rate every night is at the nightly rate
+	flat := models.Room{ID: 2, NightlyRateCents: 10000}
+	q, _ = Calculate(flat, date(2050, 1, 6), date(2050, 1, 10), nil, nil, "USD")
+	if q.TotalCents != 40000 {
+		t.Errorf("expected 40000, got %d", q.TotalCents)
+	}
+}
+
+func TestCalculate_Seasons(t *testing.T) {
+	seasons := []models.SeasonalRate{
+		{Name: "Winter", StartDate: date(2050, 1, 1), EndDate: date(2050, 3, 1), NightlyRateCents: 20000},
+		{Name: "Holidays", StartDate: date(2050, 1, 8), EndDate: date(2050, 1, 9), NightlyRateCents: 40000},
+		{Name: "Room", RoomID: 1, StartDate: date(2050, 2, 1), EndDate: date(2050, 2, 2), NightlyRateCents: 5000, WeekendRateCents: 6000},
+		{Name: "Other room", RoomID: 2, StartDate: date(2049, 1, 1), EndDate: date(2051, 1, 1), NightlyRateCents: 1},
+	}
+	var tests = []struct {
+		name   string
+		night  time.Time
+		cents  int
+		season string
+	}{
+		{"before the seasons", date(2049, 12, 30), 10000, ""},
+		{"in a season of every room", date(2050, 1, 6), 20000, "Winter"},
+		{"weekend in a season without weekend rate", date(2050, 1, 7), 20000, "Winter"},
+		{"the latest season wins", date(2050, 1, 8), 40000, "Holidays"},
+		{"the season of the room wins", date(2050, 2, 1), 5000, "Room"},
+		{"the end date is excluded", date(2050, 3, 1), 10000, ""},
+	}
+	for _, tt := range tests {
+		q, err := Calculate(room, tt.night, tt.night.AddDate(0, 0, 1), seasons, nil, "USD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := q.Nights[0]
+		if n.Cents != tt.cents || n.Season != tt.season {
+			t.Errorf("%s: expected %d in %q, got %d in %q", tt.name, tt.cents, tt.season, n.Cents, n.Season)
+		}
+	}
+}
+
+func TestCalculate_Discounts(t *testing.T) {
+	flat := models.Room{ID: 2, NightlyRateCents: 3333}
+	discounts := []models.StayDiscount{{MinNights: 28, Percent: 20}, {MinNights: 7, Percent: 10}}
+	var tests = []struct {
+		nights   int
+		percent  int
+		discount int
+	}{
+		{6, 0, 0},
+		{7, 10, 2333},   // 10% of 23331, rounded
+		{27, 10, 8999},  // 10% of 89991, rounded
+		{28, 20, 18665}, // 20% of 93324, rounded
+	}
+	for _, tt := range tests {
+		start := date(2050, 1, 1)
+		q, err := Calculate(flat, start, start.AddDate(0, 0, tt.nights), nil, discounts, "USD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.DiscountPercent != tt.percent || q.DiscountCents != tt.discount || q.TotalCents != q.SubtotalCents-tt.discount {
+			t.Errorf("%d nights: unexpected quote %d%% -%d, total %d of %d", tt.nights, q.DiscountPercent, q.DiscountCents, q.TotalCents, q.SubtotalCents)
+		}
+	}
+}
+
+func TestCalculate_InvalidStay(t *testing.T) {
+	for _, end := range []time.Time{date(2050, 1, 1), date(2049, 12, 31), date(2051, 1, 3)} {
+		if _, err := Calculate(room, date(2050, 1, 1), end, nil, nil, "USD"); !errors.Is(err, ErrInvalidStay) {
+			t.Errorf("until %s: expected ErrInvalidStay, got %v", end.Format("2006-01-02"), err)
+		}
+	}
+}
+
+// store is a Store keeping its seasons and discounts in memory
+type store struct {
+	seasons   []models.SeasonalRate
+	discounts []models.StayDiscount
+	err       error
+	asked     int // the room the seasons were asked for
+}
+
+func (s *store) SeasonalRates(ctx context.Context, roomID int, start, end time.Time) ([]models.SeasonalRate, error) {
+	s.asked = roomID
+	return s.seasons, s.err
+}
+
+func (s *store) StayDiscounts(ctx context.Context) ([]models.StayDiscount, error) {
+	return s.discounts, s.err
+}
+
+func TestService_QuoteStay(t *testing.T) {
+	st := &store{
+		seasons:   []models.SeasonalRate{{Name: "Summer", StartDate: date(2050, 7, 1), EndDate: date(2050, 9, 1), NightlyRateCents: 15000}},
+		discounts: []models.StayDiscount{{MinNights: 7, Percent: 10}},
+	}
+	s := New(st, "EUR")
+	// the times of day don't matter
+	q, err := s.QuoteStay(context.Background(), room, date(2050, 6, 27).Add(15*time.Hour), date(2050, 7, 4).Add(11*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Mon 27 to Thu 30 June at 100.00, Fri 1 to Sun 3 July at 150.00, less 10%
+	if len(q.Nights) != 7 || q.SubtotalCents != 85000 || q.TotalCents != 76500 || q.Currency != "EUR" || st.asked != room.ID {
+		t.Errorf("unexpected quote %+v", q)
+	}
+
+	st.err = errors.New("database down")
+	if _, err := s.QuoteStay(context.Background(), room, date(2050, 7, 1), date(2050, 7, 2)); !errors.Is(err, st.err) {
+		t.Errorf("expected the error of the store, got %v", err)
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	var tests = []struct {
+		cents    int
+		currency string
+		want     string
+	}{
+		{0, "USD", "$0.00"},
+		{5, "USD", "$0.05"},
+		{12345, "EUR", "€123.45"},
+		{123450, "GBP", "£1,234.50"},
+		{123456789, "USD", "$1,234,567.89"},
+		{-1000, "USD", "-$10.00"},
+		{123450, "MAD", "1,234.50 MAD"},
+	}
+	for _, tt := range tests {
+		if got := FormatMoney(tt.cents, tt.currency); got != tt.want {
+			t.Errorf("FormatMoney(%d, %s) = %q, want %q", tt.cents, tt.currency, got, tt.want)
+		}
+	}
+}
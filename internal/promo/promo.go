@@ -0,0 +1,164 @@
+// Package promo checks the promo codes guests type when they book against the rules of the code: its validity
+// window, its rooms, its minimum stay and its usage limits, and takes its discount off the quote of the stay.
+package promo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/pricing"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
+)
+
+// MaxCodeLength is the longest promo code
+const MaxCodeLength = 32
+
+// Store is where the promo codes and their redemptions are kept, i.e. the database
+type Store interface {
+	GetPromoCodeByCode(ctx context.Context, code string) (models.PromoCode, error)
+	// PromoCodeUses returns the redemptions of a code by all guests and by the guest with email
+	PromoCodeUses(ctx context.Context, id int, email string) (int, int, error)
+}
+
+// RuleError is returned when a code can't be redeemed for a stay, its message is meant for the guest
+type RuleError struct {
+	Reason string
+}
+
+func (e *RuleError) Error() string {
+	return e.Reason
+}
+
+// refuse returns a RuleError
+func refuse(format string, args ...interface{}) error {
+	return &RuleError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// Service redeems the codes of its store
+type Service struct {
+	store Store
+	now   func() time.Time
+}
+
+// New returns a service looking the codes up in store
+func New(store Store) *Service {
+	return &Service{store: store, now: time.Now}
+}
+
+// Normalize returns code the way it's stored: without spaces around it and in upper case
+func Normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// ValidCode reports whether code, once normalized, can be a promo code: up to MaxCodeLength letters, digits
+// and dashes
+func ValidCode(code string) bool {
+	if code == "" || len(code) > MaxCodeLength {
+		return false
+	}
+	for _, c := range code {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// Redeem checks that code can be redeemed by the guest with email for the stay of q, and returns q less
+// its discount along with the code. The error is a *RuleError when the code can't be redeemed.
+func (s *Service) Redeem(ctx context.Context, code, email string, q pricing.Quote) (pricing.Quote, models.PromoCode, error) {
+	p, err := s.store.GetPromoCodeByCode(ctx, Normalize(code))
+	if errors.Is(err, repository.ErrNotFound) {
+		return q, p, refuse("This promo code doesn't exist")
+	}
+	if err != nil {
+		return q, p, err
+	}
+	if err := Check(p, q.RoomID, len(q.Nights), s.now()); err != nil {
+		return q, p, err
+	}
+	total, guest, err := s.store.PromoCodeUses(ctx, p.ID, email)
+	if err != nil {
+		return q, p, err
+	}
+	if err := CheckUses(p, total, guest); err != nil {
+		return q, p, err
+	}
+	return Apply(q, p), p, nil
+}
+
+// Check returns a *RuleError when p can't be redeemed on the day of now for nights in room, its usage
+// limits aside
+func Check(p models.PromoCode, roomID, nights int, now time.Time) error {
+	today := day(now)
+	if !p.Active {
+		return refuse("This promo code is no longer available")
+	}
+	if !p.ValidFrom.IsZero() && today.Before(day(p.ValidFrom)) {
+		return refuse("This promo code can be used from %s", p.ValidFrom.Format("January 2, 2006"))
+	}
+	if !p.ValidUntil.IsZero() && today.After(day(p.ValidUntil)) {
+		return refuse("This promo code has expired")
+	}
+	if len(p.RoomIDs) > 0 {
+		eligible := false
+		for _, id := range p.RoomIDs {
+			if id == roomID {
+				eligible = true
+			}
+		}
+		if !eligible {
+			return refuse("This promo code isn't valid for this room")
+		}
+	}
+	if nights < p.MinNights {
+		return refuse("This promo code is valid for stays of %d nights or more", p.MinNights)
+	}
+	return nil
+}
+
+// CheckUses returns a *RuleError when p has been redeemed total times, guest of them by the guest, and
+// can't be redeemed again
+func CheckUses(p models.PromoCode, total, guest int) error {
+	if p.MaxUses > 0 && total >= p.MaxUses {
+		return refuse("This promo code has been used up")
+	}
+	if p.MaxUsesPerGuest > 0 && guest >= p.MaxUsesPerGuest {
+		return refuse("You have already used this promo code")
+	}
+	return nil
+}
+
+// Discount returns what p takes off a price of cents: a percentage rounded to the nearest cent, or a fixed
+// amount which can't take more than the price
+func Discount(p models.PromoCode, cents int) int {
+	var d int
+	switch p.Kind {
+	case models.PromoPercent:
+		d = (cents*p.Percent + 50) / 100
+	case models.PromoFixed:
+		d = p.AmountCents
+	}
+	if d > cents {
+		d = cents
+	}
+	return d
+}
+
+// Apply takes the discount of p off the total of q, after the length-of-stay discount
+func Apply(q pricing.Quote, p models.PromoCode) pricing.Quote {
+	q.PromoCode = p.Code
+	q.PromoCents = Discount(p, q.TotalCents)
+	q.TotalCents -= q.PromoCents
+	return q
+}
+
+// day returns the date of t at midnight UTC, the way the validity of the codes is stored
+func day(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,158 @@
+package promo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/pricing"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
+)
+
+var now = time.Date(2050, 6, 15, 22, 0, 0, 0, time.UTC)
+
+func TestCheck(t *testing.T) {
+	valid := models.PromoCode{Code: "SUMMER", Kind: models.PromoPercent, Percent: 10, Active: true}
+	with := func(change func(p *models.PromoCode)) models.PromoCode {
+		p := valid
+		change(&p)
+		return p
+	}
+	tests := []struct {
+		name   string
+		code   models.PromoCode
+		room   int
+		nights int
+		valid  bool
+	}{
+		{"valid", valid, 1, 1, true},
+		{"inactive", with(func(p *models.PromoCode) { p.Active = false }), 1, 1, false},
+		{"first day", with(func(p *models.PromoCode) { p.ValidFrom = time.Date(2050, 6, 15, 0, 0, 0, 0, time.UTC) }), 1, 1, true},
+		{"not yet valid", with(func(p *models.PromoCode) { p.ValidFrom = time.Date(2050, 6, 16, 0, 0, 0, 0, time.UTC) }), 1, 1, false},
+		{"last day", with(func(p *models.PromoCode) { p.ValidUntil = time.Date(2050, 6, 15, 0, 0, 0, 0, time.UTC) }), 1, 1, true},
+		{"expired", with(func(p *models.PromoCode) { p.ValidUntil = time.Date(2050, 6, 14, 0, 0, 0, 0, time.UTC) }), 1, 1, false},
+		{"eligible room", with(func(p *models.PromoCode) { p.RoomIDs = []int{2, 3} }), 3, 1, true},
+		{"other room", with(func(p *models.PromoCode) { p.RoomIDs = []int{2, 3} }), 1, 1, false},
+		{"long enough", with(func(p *models.PromoCode) { p.MinNights = 3 }), 1, 3, true},
+		{"too short", with(func(p *models.PromoCode) { p.MinNights = 3 }), 1, 2, false},
+	}
+	for _, e := range tests {
+		err := Check(e.code, e.room, e.nights, now)
+		if (err == nil) != e.valid {
+			t.Errorf("%s: expected valid to be %t, got %v", e.name, e.valid, err)
+		}
+		var rule *RuleError
+		if err != nil && !errors.As(err, &rule) {
+			t.Errorf("%s: expected a RuleError, got %T", e.name, err)
+		}
+	}
+}
+
+func TestValidCode(t *testing.T) {
+	for code, valid := range map[string]bool{
+		"SUMMER10":                          true,
+		"BLACK-FRIDAY":                      true,
+		"":                                  false,
+		"SUMMER 10":                         false,
+		"summer10":                          false,
+		"ÉTÉ":                               false,
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456": false,
+	} {
+		if ValidCode(code) != valid {
+			t.Errorf("%q: expected valid to be %t", code, valid)
+		}
+	}
+}
+
+func TestCheckUses(t *testing.T) {
+	p := models.PromoCode{MaxUses: 10, MaxUsesPerGuest: 2}
+	tests := []struct {
+		total, guest int
+		valid        bool
+	}{
+		{0, 0, true},
+		{9, 1, true},
+		{10, 0, false},
+		{5, 2, false},
+	}
+	for _, e := range tests {
+		if err := CheckUses(p, e.total, e.guest); (err == nil) != e.valid {
+			t.Errorf("%d uses, %d by the guest: expected valid to be %t, got %v", e.total, e.guest, e.valid, err)
+		}
+	}
+	if err := CheckUses(models.PromoCode{}, 1000, 1000); err != nil {
+		t.Errorf("expected no limits by default, got %v", err)
+	}
+}
+
+func TestDiscount(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     models.PromoCode
+		cents    int
+		expected int
+	}{
+		{"percent", models.PromoCode{Kind: models.PromoPercent, Percent: 10}, 22000, 2200},
+		{"percent rounded", models.PromoCode{Kind: models.PromoPercent, Percent: 15}, 33333, 5000},
+		{"fixed", models.PromoCode{Kind: models.PromoFixed, AmountCents: 5000}, 22000, 5000},
+		{"fixed more than the price", models.PromoCode{Kind: models.PromoFixed, AmountCents: 5000}, 3000, 3000},
+		{"unknown kind", models.PromoCode{Kind: "other", Percent: 10, AmountCents: 100}, 3000, 0},
+	}
+	for _, e := range tests {
+		if got := Discount(e.code, e.cents); got != e.expected {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expected, got)
+		}
+	}
+}
+
+// store is a Store of a single code, used once by guest@example.com
+type store struct {
+	code models.PromoCode
+}
+
+func (s store) GetPromoCodeByCode(ctx context.Context, code string) (models.PromoCode, error) {
+	if code == "BROKEN" {
+		return models.PromoCode{}, errors.New("database down")
+	}
+	if code != s.code.Code {
+		return models.PromoCode{}, repository.ErrNotFound
+	}
+	return s.code, nil
+}
+
+func (s store) PromoCodeUses(ctx context.Context, id int, email string) (int, int, error) {
+	if email == "guest@example.com" {
+		return 1, 1, nil
+	}
+	return 1, 0, nil
+}
+
+func TestService_Redeem(t *testing.T) {
+	s := New(store{models.PromoCode{ID: 1, Code: "WELCOME", Kind: models.PromoFixed, AmountCents: 5000, MaxUsesPerGuest: 1, Active: true}})
+	s.now = func() time.Time { return now }
+	quote := pricing.Quote{RoomID: 1, Currency: "USD", Nights: make([]pricing.Night, 2), SubtotalCents: 22000, TotalCents: 22000}
+
+	q, p, err := s.Redeem(context.Background(), " welcome ", "new@example.com", quote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != 1 || q.PromoCode != "WELCOME" || q.PromoCents != 5000 || q.TotalCents != 17000 || q.SubtotalCents != 22000 {
+		t.Errorf("expected 50.00 off, got %+v", q)
+	}
+
+	var rule *RuleError
+	for _, e := range []struct{ code, email string }{{"WELCOME", "guest@example.com"}, {"NOPE", "new@example.com"}} {
+		q, _, err := s.Redeem(context.Background(), e.code, e.email, quote)
+		if !errors.As(err, &rule) {
+			t.Errorf("%s by %s: expected a RuleError, got %v", e.code, e.email, err)
+		}
+		if q.TotalCents != 22000 {
+			t.Errorf("%s by %s: expected the quote unchanged, got %+v", e.code, e.email, q)
+		}
+	}
+	if _, _, err := s.Redeem(context.Background(), "broken", "new@example.com", quote); err == nil || errors.As(err, &rule) {
+		t.Errorf("expected the error of the store, got %v", err)
+	}
+}
@@ -2,17 +2,16 @@ package render
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
-	"log"
+	"html/template"
 	"net/http"
 	"path/filepath"
-	"text/template"
 	"time"
 
 	"github.com/justinas/nosurf"
 	"github.com/mrkouhadi/go-booking-app/internal/config"
 	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/pricing"
 )
 
 var functions = template.FuncMap{
@@ -20,6 +19,7 @@ var functions = template.FuncMap{
 	"FormatDate": FormatDate,
 	"Iterate":    Iterate,
 	"Add":        Add,
+	"Money":      pricing.FormatMoney,
 }
 var pathToTemplates = "./templates"
 
@@ -70,26 +70,32 @@ func AddDefaultData(tmplData *models.TemplateData, r *http.Request) *models.Temp
 	return tmplData
 }
 
-// RenderTemplate renders the requested template
+// Template renders the requested template. The data is escaped for the context it's written in
+// (html, attributes, urls, js...) so what guests type can't inject markup into the pages.
+// When the template can't be rendered the client gets a 500 and the error is returned.
 func Template(w http.ResponseWriter, r *http.Request, tmpl string, tmplData *models.TemplateData) error {
 	// Get the template cache from the AppConfig
 	var tmplCache map[string]*template.Template
 	if app.UseCache {
 		tmplCache = app.TemplateCache
 	} else {
-		tmplCache, _ = CreateTemplateCache()
+		var err error
+		tmplCache, err = CreateTemplateCache()
+		if err != nil {
+			return templateError(w, err)
+		}
 	}
 
 	// get requested template from cached templates
 	t, ok := tmplCache[tmpl]
 	if !ok {
-		return errors.New("could not get the template from cached templates")
+		return templateError(w, fmt.Errorf("could not get the template %s from cached templates", tmpl))
 	}
 	buf := new(bytes.Buffer)
 	tmplData = AddDefaultData(tmplData, r)
 	err := t.Execute(buf, tmplData)
 	if err != nil {
-		log.Fatal(err)
+		return templateError(w, err)
 	}
 
 	// render template
@@ -101,6 +107,13 @@ func Template(w http.ResponseWriter, r *http.Request, tmpl string, tmplData *mod
 	return nil
 }
 
+// templateError logs err and tells the client that the page couldn't be rendered
+func templateError(w http.ResponseWriter, err error) error {
+	app.ErrorLog.Println(err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	return err
+}
+
 // CreateTemplateCache create cache for templates
 func CreateTemplateCache() (map[string]*template.Template, error) {
 	myCache := map[string]*template.Template{}
@@ -23,9 +23,9 @@ func TestMain(m *testing.M) {
 	testApp.InProduction = false
 
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime) // \t means tab (bunch of spaces)
-	app.InfoLog = infoLog
+	testApp.InfoLog = infoLog
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
-	app.ErrorLog = errorLog
+	testApp.ErrorLog = errorLog
 
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
@@ -42,8 +42,7 @@ func TestMain(m *testing.M) {
 type mywriter struct{}
 
 func (tw *mywriter) Header() http.Header {
-	var h http.Header
-	return h
+	return http.Header{}
 }
 func (tw *mywriter) Write(dt []byte) (int, error) {
 	length := len(dt)
@@ -0,0 +1,266 @@
+package render
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/forms"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/pricing"
+)
+
+// payload breaks out of an attribute and opens a script when it isn't escaped
+const payload = `"><script>alert(1)</script>`
+
+// xssData fills every value the templates read with payload
+func xssData() *models.TemplateData {
+	start := time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+	roomType := models.RoomType{ID: 1, Name: payload, Description: payload, MaxOccupancy: 2, Beds: payload, Amenities: []string{payload}, RoomIDs: []int{1}}
+	room := models.Room{
+		ID:          1,
+		RoomName:    payload,
+		Slug:        payload,
+		Description: payload,
+		Photos:      []string{payload, payload},
+		Amenities:   []string{payload},
+		RoomTypeID:  1,
+		RoomType:    roomType,
+		Active:      true,
+	}
+	res := models.Reservation{
+		ID:        1,
+		FirstName: payload,
+		LastName:  payload,
+		Email:     payload,
+		Phone:     payload,
+		StartDate: start,
+		EndDate:   start.AddDate(0, 0, 3),
+		RoomId:    1,
+		Room:      room,
+		// the currency isn't typed by anyone, it's still escaped
+		TotalCents: 36000,
+		Currency:   payload,
+		PromoCode:  payload,
+		PromoCents: 4000,
+		Adults:     2,
+		Children:   1,
+	}
+	quote := pricing.Quote{
+		RoomID:          1,
+		Currency:        payload,
+		Nights:          []pricing.Night{{Date: start, Cents: 12000, Weekend: true, Season: payload}},
+		SubtotalCents:   40000,
+		DiscountPercent: 10,
+		DiscountCents:   4000,
+		PromoCode:       payload,
+		PromoCents:      4000,
+		TotalCents:      36000,
+	}
+
+	user := models.User{ID: 1, FirstName: payload, LastName: payload, Email: payload, AccessLevel: 4, Active: true}
+	apiKey := models.APIKey{ID: 1, Name: payload, Prefix: payload, Scopes: []models.APIScope{models.APIScope(payload)}}
+	endpoint := models.WebhookEndpoint{ID: 1, URL: payload, Description: payload, Secret: payload, Events: []models.WebhookEvent{models.WebhookEvent(payload)}, Active: true}
+
+	promoCode := models.PromoCode{ID: 1, Code: payload, Description: payload, Kind: models.PromoFixed, AmountCents: 5000, RoomIDs: []int{1}, Active: true}
+	redemption := models.PromoRedemption{ID: 1, PromoCodeID: 1, Code: payload, ReservationID: 1, GuestEmail: payload, DiscountCents: 5000, Currency: payload}
+
+	form := forms.New(url.Values{})
+	for _, field := range []string{"first_name", "last_name", "email", "phone", "password", "confirm_password", "access_level", "code", "name", "scopes", "url", "events", "promo_code", "kind", "percent", "amount", "valid_from", "valid_until", "min_nights", "max_uses", "max_uses_per_guest", "adults", "children", "max_occupancy", "beds", "description", "amenities", "slug", "photos", "nightly_rate", "weekend_rate", "room_type_id"} {
+		form.Errors.Add(field, payload)
+	}
+
+	return &models.TemplateData{
+		StringMap: map[string]string{
+			"src":             payload,
+			"token":           payload,
+			"key":             payload,
+			"secret":          payload,
+			"uri":             payload,
+			"start_date":      payload,
+			"end_date":        payload,
+			"this_month":      payload,
+			"this_month_year": payload,
+			"currency":        payload,
+			"amount":          payload,
+			"last_month":      payload,
+			"last_month_year": payload,
+			"next_month":      payload,
+			"next_month_year": payload,
+			"start":           payload,
+			"end":             payload,
+			"amenities":       payload,
+			"photos":          payload,
+			"nightly_rate":    payload,
+			"weekend_rate":    payload,
+		},
+		IntMap: map[string]int{
+			"days_in_month":   31,
+			"this_month":      1,
+			"this_month_year": 2050,
+			"uses":            1,
+			"discount_cents":  5000,
+		},
+		Data: map[string]interface{}{
+			"reservation":       res,
+			"quote":             quote,
+			"invoice":           models.Invoice{ID: 1, Number: payload, ReservationID: 1, Currency: payload, TotalCents: 39600},
+			"reservations":      []models.Reservation{res},
+			"rooms":             []models.Room{room},
+			"now":               start,
+			"block_map_1":       map[string]int{},
+			"reservation_map_1": map[string]int{},
+			"mails": []models.OutboxMail{{
+				ID:        1,
+				MailData:  models.MailData{To: payload, Subject: payload},
+				Status:    models.MailDead,
+				LastError: payload,
+			}},
+			"user":  user,
+			"users": []models.User{user},
+			"roles": models.Roles,
+			"codes": []string{payload},
+
+			"api_key": apiKey,
+			"keys":    []models.APIKey{apiKey},
+			"scopes":  models.APIScopes,
+			"chosen":  map[models.APIScope]bool{models.ScopeAdmin: true},
+
+			"endpoint":      endpoint,
+			"endpoints":     []models.WebhookEndpoint{endpoint},
+			"events":        models.WebhookEvents,
+			"chosen_events": map[models.WebhookEvent]bool{models.EventReservationCreated: true},
+			"deliveries": []models.WebhookDelivery{{
+				ID:         1,
+				EndpointID: 1,
+				URL:        payload,
+				Event:      models.WebhookEvent(payload),
+				Payload:    []byte(payload),
+				Status:     models.WebhookDead,
+				LastError:  payload,
+			}},
+
+			"promo_code":   promoCode,
+			"promo_codes":  []models.PromoCode{promoCode},
+			"chosen_rooms": map[int]bool{1: true},
+			"redemptions":  []models.PromoRedemption{redemption},
+
+			"room":       room,
+			"room_type":  roomType,
+			"room_types": []models.RoomType{roomType},
+
+			"required":            false,
+			"recovery_codes_left": 3,
+		},
+		Form: form,
+	}
+}
+
+func TestTemplatesEscapeReservationFields(t *testing.T) {
+	pathToTemplates = "./../../templates"
+	tc, err := CreateTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.TemplateCache = tc
+	app.UseCache = true
+	defer func() { app.UseCache = false }()
+
+	pages, err := filepath.Glob(pathToTemplates + "/*.page.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) == 0 {
+		t.Fatal("no templates found")
+	}
+
+	// the pages showing what guests typed, as text or in form fields
+	showsReservation := map[string]bool{
+		"admin-all-reservations.page.tmpl":   true,
+		"admin-new-reservations.page.tmpl":   true,
+		"admin-reservations-show.page.tmpl":  true,
+		"admin-mail-failed.page.tmpl":        true,
+		"admin-users.page.tmpl":              true,
+		"admin-user.page.tmpl":               true,
+		"admin-change-password.page.tmpl":    true,
+		"forgot-password.page.tmpl":          true,
+		"reset-password.page.tmpl":           true,
+		"two-factor.page.tmpl":               true,
+		"admin-two-factor.page.tmpl":         true,
+		"admin-recovery-codes.page.tmpl":     true,
+		"admin-api-keys.page.tmpl":           true,
+		"admin-api-key-created.page.tmpl":    true,
+		"admin-webhooks.page.tmpl":           true,
+		"admin-webhook.page.tmpl":            true,
+		"admin-webhook-deliveries.page.tmpl": true,
+		"make-reservation.page.tmpl":         true,
+		"reservation-summary.page.tmpl":      true,
+	}
+
+	for _, page := range pages {
+		name := filepath.Base(page)
+
+		r, err := getSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// flash messages go through the session, e.g. after a failed form
+		session.Put(r.Context(), "flash", payload)
+		session.Put(r.Context(), "warning", payload)
+		session.Put(r.Context(), "error", payload)
+
+		rr := httptest.NewRecorder()
+		if err := Template(rr, r, name, xssData()); err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", name, rr.Code)
+		}
+
+		body := rr.Body.String()
+		if strings.Contains(body, "<script>alert(1)</script>") {
+			t.Errorf("%s: the payload is written without escaping", name)
+		}
+		if showsReservation[name] && !strings.Contains(body, "&lt;script&gt;alert(1)&lt;/script&gt;") {
+			t.Errorf("%s: expected the escaped payload in the page", name)
+		}
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	pathToTemplates = "./../../templates"
+	tc, err := CreateTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.TemplateCache = tc
+	app.UseCache = true
+	defer func() { app.UseCache = false }()
+
+	r, err := getSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	if err := Template(rr, r, "non-existent.page.tmpl", &models.TemplateData{}); err == nil {
+		t.Error("expected an error for a missing template")
+	}
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected a 500 for a missing template, got %d", rr.Code)
+	}
+
+	// make-reservation can't be rendered without its form
+	rr = httptest.NewRecorder()
+	if err := Template(rr, r, "make-reservation.page.tmpl", &models.TemplateData{}); err == nil {
+		t.Error("expected an error when the template fails")
+	}
+	if rr.Code != http.StatusInternalServerError || strings.Contains(rr.Body.String(), "<html") {
+		t.Errorf("expected a bare 500 when the template fails, got %d", rr.Code)
+	}
+}
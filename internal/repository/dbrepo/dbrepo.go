@@ -2,11 +2,70 @@ package dbrepo
 
 import (
 	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
 
 	"github.com/mrkouhadi/go-booking-app/internal/config"
+	"github.com/mrkouhadi/go-booking-app/internal/models"
 	"github.com/mrkouhadi/go-booking-app/internal/repository"
 )
 
+// defaultQueryTimeout is the per-query deadline used when the config doesn't set one
+const defaultQueryTimeout = 3 * time.Second
+
+// queryTimeout returns how long a single query may run before it is cancelled
+func (m *postgresDBRepo) queryTimeout() time.Duration {
+	if m.App == nil || m.App.DB.QueryTimeout <= 0 {
+		return defaultQueryTimeout
+	}
+	return m.App.DB.QueryTimeout
+}
+
+// exclusionViolation is the postgres error code raised when a row breaks an exclusion constraint
+const exclusionViolation = "23P01"
+
+// uniqueViolation is the postgres error code raised when a row breaks a unique index
+const uniqueViolation = "23505"
+
+// userEmailIndex keeps two users from having the same email
+const userEmailIndex = "users_email_idx"
+
+// promoCodeIndex keeps two promo codes from having the same code
+const promoCodeIndex = "promo_codes_code_idx"
+
+// roomTypeNameIndex keeps two room types from having the same name
+const roomTypeNameIndex = "room_types_name_idx"
+
+// roomSlugIndex keeps two rooms from having the same slug
+const roomSlugIndex = "rooms_slug_idx"
+
+// overlapConstraint keeps two restrictions of the same room from covering the same dates
+const overlapConstraint = "room_restrictions_no_overlap"
+
+// translateError turns database errors the handlers care about into the repository's typed errors
+func translateError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	switch {
+	case pgErr.Code == exclusionViolation && pgErr.ConstraintName == overlapConstraint:
+		return repository.ErrRoomNotAvailable
+	case pgErr.Code == uniqueViolation && pgErr.ConstraintName == userEmailIndex:
+		return repository.ErrDuplicateEmail
+	case pgErr.Code == uniqueViolation && pgErr.ConstraintName == promoCodeIndex:
+		return repository.ErrDuplicatePromoCode
+	case pgErr.Code == uniqueViolation && pgErr.ConstraintName == roomTypeNameIndex:
+		return repository.ErrDuplicateRoomType
+	case pgErr.Code == uniqueViolation && pgErr.ConstraintName == roomSlugIndex:
+		return repository.ErrDuplicateRoom
+	}
+	return err
+}
+
 type postgresDBRepo struct {
 	App *config.AppConfig
 	DB  *sql.DB
@@ -23,10 +82,35 @@ func NewPostgresRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo
 type testDBRepo struct {
 	App *config.AppConfig
 	DB  *sql.DB
+
+	// outbox keeps the emails in memory so that the mail workers can be tested without a database
+	mu     sync.Mutex
+	outbox []models.OutboxMail
+
+	// the webhook endpoints and their deliveries, kept in memory for the same reason
+	webhooks   []models.WebhookEndpoint
+	deliveries []models.WebhookDelivery
+
+	// the invoices issued, a reservation has at most one
+	invoices []models.Invoice
+
+	// the promo codes and their redemptions, and the reservations deleted since the start
+	promoCodes  []models.PromoCode
+	redemptions []models.PromoRedemption
+	deleted     map[int]bool
+
+	// the rooms and the room types, with the rooms of each
+	rooms     []models.Room
+	roomTypes []models.RoomType
 }
 
 func NewTestingRepo(a *config.AppConfig) repository.DatabaseRepo {
 	return &testDBRepo{
-		App: a,
+		App:         a,
+		webhooks:    testWebhookEndpoints(),
+		promoCodes:  testPromoCodes(),
+		redemptions: testPromoRedemptions(),
+		rooms:       testRooms(),
+		roomTypes:   testRoomTypes(),
 	}
 }
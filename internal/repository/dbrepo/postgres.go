@@ -2,26 +2,116 @@ package dbrepo
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func (m *postgresDBRepo) AllUsers() bool {
-	return true
+// userColumns are the columns scanUser reads, in order
+const userColumns = `id, first_name, last_name, email, password, access_level, created_at, updated_at,
+	failed_login_attempts, locked_until, active, password_reset_required, session_version,
+	totp_secret, totp_enabled, totp_last_step`
+
+// rowScanner is a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser reads a user selected with userColumns
+func scanUser(row rowScanner) (models.User, error) {
+	var u models.User
+	var lockedUntil sql.NullTime
+	err := row.Scan(
+		&u.ID,
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.Password,
+		&u.AccessLevel,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+		&u.FailedLoginAttempts,
+		&lockedUntil,
+		&u.Active,
+		&u.PasswordResetRequired,
+		&u.SessionVersion,
+		&u.TOTPSecret,
+		&u.TOTPEnabled,
+		&u.TOTPLastStep,
+	)
+	u.LockedUntil = lockedUntil.Time
+	return u, err
+}
+
+// AllUsers returns every user, sorted by name
+func (m *postgresDBRepo) AllUsers(ctx context.Context) ([]models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `select `+userColumns+` from users order by last_name, first_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// InsertUser stores a new active user with a bcrypt hash of password and returns its id
+func (m *postgresDBRepo) InsertUser(ctx context.Context, u models.User, password string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		insert into users (first_name, last_name, email, password, access_level, password_reset_required, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $7) returning id
+	`
+	var id int
+	err = m.DB.QueryRowContext(ctx, query,
+		u.FirstName,
+		u.LastName,
+		u.Email,
+		string(hash),
+		u.AccessLevel,
+		u.PasswordResetRequired,
+		time.Now(),
+	).Scan(&id)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	return id, nil
 }
 
 // InsertReservation inserts a Reservation into the database
-func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error) {
-	// if the this operation could not succeed within 3 seconds end it immediately
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) InsertReservation(ctx context.Context, res models.Reservation) (int, error) {
+	// end the query when the request goes away or the per-query deadline passes
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 	var newId int
-	statement := `insert into reservations (first_name, last_name, email, phone, start_date, end_date, room_id, created_at, updated_at)
-	values($1,$2,$3,$4,$5,$6,$7,$8,$9) returning id`
+	statement := `insert into reservations (first_name, last_name, email, phone, start_date, end_date, room_id, adults, children,
+	total_cents, currency, created_at, updated_at)
+	values($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13) returning id`
 	err := m.DB.QueryRowContext(ctx, statement,
 		res.FirstName,
 		res.LastName,
@@ -30,6 +120,10 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 		res.StartDate,
 		res.EndDate,
 		res.RoomId,
+		res.Adults,
+		res.Children,
+		res.TotalCents,
+		res.Currency,
 		time.Now(),
 		time.Now(),
 	).Scan(&newId) // store the returned(scan) id to newId
@@ -41,9 +135,9 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 }
 
 // InsertRoomRestriction inserts a room restriction into the database
-func (m *postgresDBRepo) InsertRoomRestriction(res models.RoomRestrictions) error {
-	// if the this operation could not succeed within 3 seconds end it immediately
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) InsertRoomRestriction(ctx context.Context, res models.RoomRestrictions) error {
+	// end the query when the request goes away or the per-query deadline passes
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 	statement := `insert into room_restrictions(start_date, end_date, room_id, reservation_id, created_at, updated_at, restriction_id)
 									values($1,$2,$3,$4,$5,$6,$7)`
@@ -57,16 +151,196 @@ func (m *postgresDBRepo) InsertRoomRestriction(res models.RoomRestrictions) erro
 		res.RestrictionId,
 	)
 	if err != nil {
-		return err
+		return translateError(err)
 	}
 
 	return nil
 }
 
+// CreateBooking inserts a reservation, its room restriction and its emails in a single transaction,
+// re-checking the availability of the room first so nothing is written when it's already taken.
+// A booking whose idempotency key has already been used returns the reservation of the first one
+// along with ErrDuplicateRequest, without writing anything.
+func (m *postgresDBRepo) CreateBooking(ctx context.Context, b models.Booking) (models.Reservation, error) {
+	// end the query when the request goes away or the per-query deadline passes
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	res := b.Reservation
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	// rolling back after a successful commit is a no-op
+	defer tx.Rollback()
+
+	// claim the idempotency key first: a retry waits here until the first attempt commits or rolls back
+	var keyID int
+	if b.Idempotency.Key != "" {
+		keyID, err = claimIdempotencyKey(ctx, tx, b.Idempotency)
+		if errors.Is(err, repository.ErrDuplicateRequest) {
+			_ = tx.Rollback()
+			return m.replayBooking(ctx, b.Idempotency)
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+
+	// lock the room so that concurrent bookings of the same room wait for each other
+	err = tx.QueryRowContext(ctx, `select id, room_name from rooms where id = $1 for update`, res.RoomId).Scan(&res.Room.ID, &res.Room.RoomName)
+	if err != nil {
+		return res, err
+	}
+
+	var numRows int
+	query := `select count(id) from room_restrictions where room_id = $1 and $2 < end_date and $3 > start_date`
+	err = tx.QueryRowContext(ctx, query, res.RoomId, res.StartDate, res.EndDate).Scan(&numRows)
+	if err != nil {
+		return res, err
+	}
+	if numRows > 0 {
+		return res, repository.ErrRoomNotAvailable
+	}
+
+	statement := `insert into reservations (first_name, last_name, email, phone, start_date, end_date, room_id, adults, children,
+	total_cents, currency, created_at, updated_at)
+	values($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13) returning id`
+	err = tx.QueryRowContext(ctx, statement,
+		res.FirstName,
+		res.LastName,
+		res.Email,
+		res.Phone,
+		res.StartDate,
+		res.EndDate,
+		res.RoomId,
+		res.Adults,
+		res.Children,
+		res.TotalCents,
+		res.Currency,
+		time.Now(),
+		time.Now(),
+	).Scan(&res.ID)
+	if err != nil {
+		return res, err
+	}
+
+	statement = `insert into room_restrictions(start_date, end_date, room_id, reservation_id, created_at, updated_at, restriction_id)
+									values($1,$2,$3,$4,$5,$6,$7)`
+	_, err = tx.ExecContext(ctx, statement,
+		res.StartDate,
+		res.EndDate,
+		res.RoomId,
+		res.ID,
+		time.Now(),
+		time.Now(),
+		1, // 1 is a reservation, 2 is an owner block
+	)
+	if err != nil {
+		// another booking may have slipped in between the check and the insert
+		return res, translateError(err)
+	}
+
+	if keyID > 0 {
+		_, err = tx.ExecContext(ctx, "update idempotency_keys set reservation_id = $1 where id = $2", res.ID, keyID)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	if b.Promo != nil {
+		if err = redeemPromoCode(ctx, tx, *b.Promo, res); err != nil {
+			return res, err
+		}
+	}
+
+	var invoice *models.Invoice
+	if b.Invoice != nil {
+		inv := *b.Invoice
+		inv.ReservationID = res.ID
+		if inv, err = insertInvoice(ctx, tx, inv, m.App.Invoice.Prefix); err != nil {
+			return res, err
+		}
+		invoice = &inv
+	}
+
+	// the emails only leave the outbox once the reservation is committed
+	if b.Mail != nil {
+		mails, err := b.Mail(res, invoice)
+		if err != nil {
+			return res, err
+		}
+		for _, msg := range mails {
+			if _, err = insertMail(ctx, tx, msg); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	// and so do the webhooks
+	if b.Webhooks != nil {
+		webhooks, err := b.Webhooks(res)
+		if err != nil {
+			return res, err
+		}
+		for _, w := range webhooks {
+			if _, err = queueWebhook(ctx, tx, w); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// claimIdempotencyKey stores the key and returns its id, or ErrDuplicateRequest when it's already stored.
+// The expired keys are deleted on the way so that they can be used again.
+func claimIdempotencyKey(ctx context.Context, tx *sql.Tx, k models.IdempotencyKey) (int, error) {
+	now := time.Now()
+	if _, err := tx.ExecContext(ctx, "delete from idempotency_keys where expires_at <= $1", now); err != nil {
+		return 0, err
+	}
+	var id int
+	query := `
+		insert into idempotency_keys (key, request_hash, expires_at, created_at, updated_at)
+		values ($1, $2, $3, $4, $4)
+		on conflict (key) do nothing
+		returning id
+	`
+	err := tx.QueryRowContext(ctx, query, k.Key, k.RequestHash, k.ExpiresAt, now).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, repository.ErrDuplicateRequest
+	}
+	return id, err
+}
+
+// replayBooking returns the reservation the first request with the idempotency key made, along with
+// ErrDuplicateRequest, or ErrIdempotencyKeyReused when that request was for another booking
+func (m *postgresDBRepo) replayBooking(ctx context.Context, k models.IdempotencyKey) (models.Reservation, error) {
+	var requestHash string
+	var reservationID sql.NullInt64
+	query := `select request_hash, reservation_id from idempotency_keys where key = $1`
+	err := m.DB.QueryRowContext(ctx, query, k.Key).Scan(&requestHash, &reservationID)
+	if err != nil {
+		return models.Reservation{}, err
+	}
+	if requestHash != k.RequestHash {
+		return models.Reservation{}, repository.ErrIdempotencyKeyReused
+	}
+	res, err := m.GetReservationByID(ctx, int(reservationID.Int64))
+	if err != nil {
+		return res, err
+	}
+	return res, repository.ErrDuplicateRequest
+}
+
 // SearchAvailabilityByDatesByRoomID returns true if availability exists for roomId, and false if it no availability
-func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time, roomId int) (bool, error) {
-	// if the this operation could not succeed within 3 seconds, end it immediately
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(ctx context.Context, start, end time.Time, roomId int) (bool, error) {
+	// end the query when the request goes away or the per-query deadline passes
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 	var numRows int
 	// give me the number of rows from rooom_restrictions where my start_date is less than your end_date
@@ -86,25 +360,52 @@ func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time,
 	return false, nil
 }
 
-// SearchAvailablityForAllRooms returns a slice of available rooms for given date range
-func (m *postgresDBRepo) SearchAvailablityForAllRooms(start, end time.Time) ([]models.Room, error) {
-	// if the this operation could not succeed within 3 seconds, end it immediately
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// roomColumns are the columns of a room r and of its type rt, scanned by scanRoom
+const roomColumns = `r.id, r.room_name, r.slug, r.description, r.photos, r.amenities, r.nightly_rate_cents,
+	r.weekend_rate_cents, r.active, r.position, r.created_at, r.updated_at,
+	coalesce(rt.id, 0), coalesce(rt.name, ''), coalesce(rt.description, ''), coalesce(rt.max_occupancy, 0),
+	coalesce(rt.beds, ''), coalesce(rt.amenities, '')`
+
+// roomsWithTypes is where roomColumns are selected from
+const roomsWithTypes = `rooms r left join room_types rt on (rt.id = r.room_type_id)`
+
+// scanRoom reads a room selected with roomColumns
+func scanRoom(row rowScanner) (models.Room, error) {
+	var room models.Room
+	var photos, amenities, typeAmenities string
+	t := &room.RoomType
+	err := row.Scan(&room.ID, &room.RoomName, &room.Slug, &room.Description, &photos, &amenities, &room.NightlyRateCents,
+		&room.WeekendRateCents, &room.Active, &room.Position, &room.CreatedAt, &room.UpdatedAt,
+		&t.ID, &t.Name, &t.Description, &t.MaxOccupancy, &t.Beds, &typeAmenities)
+	room.RoomTypeID = t.ID
+	room.Photos = splitLines(photos)
+	room.Amenities = splitLines(amenities)
+	t.Amenities = splitLines(typeAmenities)
+	return room, err
+}
+
+// SearchAvailablityForAllRooms returns the active rooms free for the given date range that can hold a party
+// of guests, with their type
+func (m *postgresDBRepo) SearchAvailablityForAllRooms(ctx context.Context, start, end time.Time, guests int) ([]models.Room, error) {
+	// end the query when the request goes away or the per-query deadline passes
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 	var rooms []models.Room
 	query := `
-			select r.id, r.room_name 
-			from rooms r 
+			select ` + roomColumns + `
+			from ` + roomsWithTypes + `
 			where r.id not in 
-			(select rr.room_id from room_restrictions rr where $1 < rr.end_date and $2 > rr.start_date);
+			(select rr.room_id from room_restrictions rr where $1 < rr.end_date and $2 > rr.start_date)
+			and (rt.id is null or rt.max_occupancy >= $3) and r.active
+			order by r.position, r.room_name;
 		`
-	rows, err := m.DB.QueryContext(ctx, query, start, end)
+	rows, err := m.DB.QueryContext(ctx, query, start, end, guests)
 	if err != nil {
 		return rooms, err
 	}
+	defer rows.Close()
 	for rows.Next() {
-		var room models.Room
-		err := rows.Scan(&room.ID, &room.RoomName)
+		room, err := scanRoom(rows)
 		if err != nil {
 			return rooms, err
 		}
@@ -116,165 +417,602 @@ func (m *postgresDBRepo) SearchAvailablityForAllRooms(start, end time.Time) ([]m
 	return rooms, nil
 }
 
-// GetRoomById gets a room by id
-func (m *postgresDBRepo) GetRoomById(id int) (models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// GetRoomById gets a room by id, with its type
+func (m *postgresDBRepo) GetRoomById(ctx context.Context, id int) (models.Room, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 
-	var room models.Room
-
-	query := `
-		select id, room_name, created_at, updated_at from rooms where id=$1
-	`
-	row := m.DB.QueryRowContext(ctx, query, id)
-	err := row.Scan(
-		&room.ID,
-		&room.RoomName,
-		&room.CreatedAt,
-		&room.UpdatedAt,
-	)
-
+	row := m.DB.QueryRowContext(ctx, `select `+roomColumns+` from `+roomsWithTypes+` where r.id = $1`, id)
+	room, err := scanRoom(row)
+	if err == sql.ErrNoRows {
+		return room, repository.ErrNotFound
+	}
 	if err != nil {
 		return room, err
 	}
-
 	return room, nil
 }
 
 // GetUserByID returns user by ID
-func (m *postgresDBRepo) GetUserByID(ID int) (models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+func (m *postgresDBRepo) GetUserByID(ctx context.Context, ID int) (models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 
-	query := `select id, first_name, last_name, email, password, access_level, created_at, updated_at from users where id=$1`
-	row := m.DB.QueryRowContext(ctx, query, ID)
+	row := m.DB.QueryRowContext(ctx, `select `+userColumns+` from users where id=$1`, ID)
+	return scanUser(row)
+}
 
-	var U models.User
-	err := row.Scan(
-		&U.ID,
-		&U.FirstName,
-		&U.LastName,
-		&U.Email,
-		&U.Password,
-		&U.AccessLevel,
-		&U.CreatedAt,
-		&U.UpdatedAt,
-	)
-	if err != nil {
-		return U, err
+// GetUserByEmail returns the user with the email, or ErrUserNotFound
+func (m *postgresDBRepo) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, `select `+userColumns+` from users where email=$1`, email)
+	u, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return u, repository.ErrUserNotFound
 	}
-	return U, nil
+	return u, err
 }
 
-// UpdateUser edits user's data in the DB
-func (m *postgresDBRepo) UpdateUser(u models.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+// UpdateUser edits user's data in the DB, the last active owner keeps their role
+func (m *postgresDBRepo) UpdateUser(ctx context.Context, u models.User) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 
-	query := `update users set first_name=$1, last_name=$2, email=$3, access_level=$4, updated_at=$5`
-	_, err := m.DB.ExecContext(ctx, query,
-		u.FirstName,
-		u.LastName,
-		u.Email,
-		u.AccessLevel,
-		time.Now(),
-	)
+	return m.keepOwner(ctx, func(tx *sql.Tx) error {
+		query := `update users set first_name=$1, last_name=$2, email=$3, access_level=$4, updated_at=$5 where id=$6`
+		_, err := tx.ExecContext(ctx, query,
+			u.FirstName,
+			u.LastName,
+			u.Email,
+			u.AccessLevel,
+			time.Now(),
+			u.ID,
+		)
+		return translateError(err)
+	})
+}
+
+// keepOwner runs change in a transaction and rolls it back with ErrLastOwner when it leaves no active owner.
+// The active owners are locked first, so that two changes at once can't each remove one of the last two.
+func (m *postgresDBRepo) keepOwner(ctx context.Context, change func(tx *sql.Tx) error) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	return nil
-}
+	defer tx.Rollback()
 
-// authenticating a user
-func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
-
-	var id int
-	var hashedPassword string
-	row := m.DB.QueryRowContext(ctx, "select id, password from users where email = $1", email)
-	err := row.Scan(&id, &hashedPassword)
+	query := `select id from users where access_level = $1 and active for update`
+	rows, err := tx.QueryContext(ctx, query, int(models.RoleOwner))
 	if err != nil {
-		return id, "", err
+		return err
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return 0, "", errors.New("incorrect password")
-	} else if err != nil {
-		return 0, "", err
+	owners := 0
+	for rows.Next() {
+		owners++
 	}
-	return id, hashedPassword, nil
+	if err = rows.Close(); err != nil {
+		return err
+	}
+
+	if err = change(tx); err != nil {
+		return err
+	}
+
+	// a database without any owner yet doesn't need to keep one
+	var left bool
+	query = `select exists(select 1 from users where access_level = $1 and active)`
+	if err = tx.QueryRowContext(ctx, query, int(models.RoleOwner)).Scan(&left); err != nil {
+		return err
+	}
+	if owners > 0 && !left {
+		return repository.ErrLastOwner
+	}
+	return tx.Commit()
 }
 
-// AllReservations returns a slice of all reservations
-func (m *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+// SetUserActive activates or deactivates a user, the last active owner can't be deactivated
+func (m *postgresDBRepo) SetUserActive(ctx context.Context, id int, active bool) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 
-	var reservations []models.Reservation
+	return m.keepOwner(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "update users set active = $1, updated_at = $2 where id = $3", active, time.Now(), id)
+		return err
+	})
+}
+
+// RequirePasswordReset makes the user choose a new password the next time they use the admin
+func (m *postgresDBRepo) RequirePasswordReset(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, "update users set password_reset_required = true, updated_at = $1 where id = $2", time.Now(), id)
+	return err
+}
 
+// UpdatePassword stores a bcrypt hash of the user's new password, which ends a required reset and every
+// session of the user. It returns the new session version.
+func (m *postgresDBRepo) UpdatePassword(ctx context.Context, id int, password string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	return setPassword(ctx, m.DB, id, password)
+}
+
+// setPassword changes the password of a user, unlocks the account and bumps the session version
+func setPassword(ctx context.Context, db execQuerier, id int, password string) (int, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
 	query := `
-		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, 
-		r.processed, rm.id, rm.room_name
-		from reservations r
-		left join rooms rm on (r.room_id = rm.id)
-		order by r.start_date asc
+		update users set password = $1, password_reset_required = false, session_version = session_version + 1,
+			failed_login_attempts = 0, locked_until = null, updated_at = $2
+		where id = $3
+		returning session_version
 	`
-	rows, err := m.DB.QueryContext(ctx, query)
+	var version int
+	err = db.QueryRowContext(ctx, query, string(hash), time.Now(), id).Scan(&version)
+	return version, err
+}
+
+// InsertPasswordReset stores a password reset link, the older links of the user stop working
+func (m *postgresDBRepo) InsertPasswordReset(ctx context.Context, reset models.PasswordReset) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return reservations, err
+		return err
 	}
-	defer rows.Close() // we have to defer close it otherwise we will have a memory leak.
-	for rows.Next() {
-		var i models.Reservation
-		err := rows.Scan(
-			&i.ID,
-			&i.FirstName,
-			&i.LastName,
-			&i.Email,
-			&i.Phone,
-			&i.StartDate,
-			&i.EndDate,
-			&i.RoomId,
-			&i.CreatedAt,
-			&i.UpdatedAt,
-			&i.Processed,
-			&i.Room.ID,
-			&i.Room.RoomName,
-		)
-		if err != nil {
-			return reservations, err
-		}
-		reservations = append(reservations, i)
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "delete from password_resets where user_id = $1 and used_at is null", reset.UserID)
+	if err != nil {
+		return err
 	}
-	if err = rows.Err(); err != nil {
-		return reservations, err
+	query := `
+		insert into password_resets (user_id, token_hash, expires_at, created_at, updated_at)
+		values ($1, $2, $3, $4, $4)
+	`
+	_, err = tx.ExecContext(ctx, query, reset.UserID, reset.TokenHash, reset.ExpiresAt, time.Now())
+	if err != nil {
+		return err
 	}
-	return reservations, nil
+	return tx.Commit()
 }
 
-// AllNewReservations
-func (m *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+// ResetPassword uses the password reset link with the token hash to change the password of its user,
+// it returns the user's id. The link can only be used once, before it expires.
+func (m *postgresDBRepo) ResetPassword(ctx context.Context, tokenHash, password string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 
-	var reservations []models.Reservation
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
 
-	query := `
-		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, 
-		rm.id, rm.room_name
-		from reservations r
-		left join rooms rm on (r.room_id = rm.id)
-		where processed = 0
-		order by r.start_date asc
-	`
-	rows, err := m.DB.QueryContext(ctx, query)
+	now := time.Now()
+	var id, userID int
+	query := `select id, user_id from password_resets where token_hash = $1 and used_at is null and expires_at > $2 for update`
+	err = tx.QueryRowContext(ctx, query, tokenHash, now).Scan(&id, &userID)
+	if err == sql.ErrNoRows {
+		return 0, repository.ErrInvalidResetToken
+	} else if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, "update password_resets set used_at = $1, updated_at = $1 where id = $2", now, id)
 	if err != nil {
-		return reservations, err
+		return 0, err
 	}
-	defer rows.Close() // we have to defer close it otherwise we will have a memory leak.
-	for rows.Next() {
-		var i models.Reservation
+	if _, err = setPassword(ctx, tx, userID, password); err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// DeleteUser deletes a user, the last active owner can't be deleted
+func (m *postgresDBRepo) DeleteUser(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	return m.keepOwner(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "delete from users where id = $1", id)
+		return err
+	})
+}
+
+// Authenticate checks the email and the password of a user and returns the user's id and hashed password.
+// Every wrong password counts as a failed login and the account is locked for App.Login.LockoutDuration
+// after App.Login.LockoutAfter of them in a row; a successful login starts the count again.
+// Deactivated users get ErrAccountDisabled, but only once they have given the right password.
+func (m *postgresDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var id int
+	var hashedPassword string
+	var locked, active bool
+	row := m.DB.QueryRowContext(ctx, "select id, password, coalesce(locked_until > now(), false), active from users where email = $1", email)
+	err := row.Scan(&id, &hashedPassword, &locked, &active)
+	if err == sql.ErrNoRows {
+		// take as long as a wrong password so that the response time doesn't tell which emails exist
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(testPassword))
+		return 0, "", repository.ErrInvalidCredentials
+	} else if err != nil {
+		return 0, "", err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
+	if locked {
+		// the password is checked all the same, so that the response time doesn't tell the account is locked
+		return 0, "", repository.ErrAccountLocked
+	}
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return 0, "", m.failLogin(ctx, id)
+	} else if err != nil {
+		return 0, "", err
+	}
+	if !active {
+		return 0, "", repository.ErrAccountDisabled
+	}
+
+	_, err = m.DB.ExecContext(ctx, "update users set failed_login_attempts = 0, locked_until = null where id = $1", id)
+	if err != nil {
+		return 0, "", err
+	}
+	return id, hashedPassword, nil
+}
+
+// dummyHash is compared with the password when no user has the email
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// failLogin counts a wrong password for the user and locks the account once there have been too many,
+// it returns the error Authenticate reports
+func (m *postgresDBRepo) failLogin(ctx context.Context, id int) error {
+	lockoutAfter, lockoutDuration := 5, 15*time.Minute
+	if m.App != nil && m.App.Login.LockoutAfter > 0 {
+		lockoutAfter, lockoutDuration = m.App.Login.LockoutAfter, m.App.Login.LockoutDuration
+	}
+
+	// the count starts again once the account is locked, so that it gets all its attempts when the lock ends
+	query := `
+		update users set
+			failed_login_attempts = case when failed_login_attempts + 1 >= $2 then 0 else failed_login_attempts + 1 end,
+			locked_until = case when failed_login_attempts + 1 >= $2 then now() + $3 * interval '1 millisecond' else locked_until end
+		where id = $1
+		returning coalesce(locked_until > now(), false)
+	`
+	var locked bool
+	err := m.DB.QueryRowContext(ctx, query, id, lockoutAfter, lockoutDuration.Milliseconds()).Scan(&locked)
+	if err != nil {
+		return err
+	}
+	if locked {
+		return repository.ErrAccountLocked
+	}
+	return repository.ErrInvalidCredentials
+}
+
+// InsertLoginAttempt stores a refused login for auditing, linked to the user with the email if there is one
+func (m *postgresDBRepo) InsertLoginAttempt(ctx context.Context, a models.LoginAttempt) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		insert into login_attempts (email, ip_address, user_id, reason, created_at, updated_at)
+		values ($1, $2, (select id from users where email = $1), $3, $4, $4)
+	`
+	_, err := m.DB.ExecContext(ctx, query, a.Email, a.IPAddress, a.Reason, time.Now())
+	return err
+}
+
+// EnableTOTP turns on two-factor authentication for a user with the secret of their authenticator app, step is
+// the time step of the code they confirmed it with. The recovery codes replace any the user had before.
+func (m *postgresDBRepo) EnableTOTP(ctx context.Context, id int, secret string, step int64, recoveryCodeHashes []string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `update users set totp_secret = $1, totp_enabled = true, totp_last_step = $2, updated_at = $3 where id = $4`
+	if _, err = tx.ExecContext(ctx, query, secret, step, time.Now(), id); err != nil {
+		return err
+	}
+	if err = replaceRecoveryCodes(ctx, tx, id, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisableTOTP turns off two-factor authentication for a user and forgets their secret and recovery codes
+func (m *postgresDBRepo) DisableTOTP(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `update users set totp_secret = '', totp_enabled = false, totp_last_step = 0, updated_at = $1 where id = $2`
+	if _, err = tx.ExecContext(ctx, query, time.Now(), id); err != nil {
+		return err
+	}
+	if err = replaceRecoveryCodes(ctx, tx, id, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that the code of a time step has been used, it returns ErrInvalidCode when a code of
+// that step or a later one already has been
+func (m *postgresDBRepo) UseTOTPStep(ctx context.Context, id int, step int64) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, "update users set totp_last_step = $1 where id = $2 and totp_last_step < $1", step, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repository.ErrInvalidCode
+	}
+	return nil
+}
+
+// UseRecoveryCode marks the user's recovery code with the hash as used and returns how many are left,
+// it returns ErrInvalidCode when the user has no such unused code
+func (m *postgresDBRepo) UseRecoveryCode(ctx context.Context, id int, codeHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `update recovery_codes set used_at = $1, updated_at = $1 where user_id = $2 and code_hash = $3 and used_at is null`
+	res, err := m.DB.ExecContext(ctx, query, time.Now(), id, codeHash)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, repository.ErrInvalidCode
+	}
+	return m.RecoveryCodesLeft(ctx, id)
+}
+
+// ReplaceRecoveryCodes throws away the recovery codes of a user, used or not, and stores new ones
+func (m *postgresDBRepo) ReplaceRecoveryCodes(ctx context.Context, id int, codeHashes []string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = replaceRecoveryCodes(ctx, tx, id, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecoveryCodesLeft returns the number of unused recovery codes of a user
+func (m *postgresDBRepo) RecoveryCodesLeft(ctx context.Context, id int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var n int
+	err := m.DB.QueryRowContext(ctx, "select count(*) from recovery_codes where user_id = $1 and used_at is null", id).Scan(&n)
+	return n, err
+}
+
+// replaceRecoveryCodes deletes the recovery codes of a user and inserts the ones with the hashes
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, id int, codeHashes []string) error {
+	if _, err := tx.ExecContext(ctx, "delete from recovery_codes where user_id = $1", id); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, hash := range codeHashes {
+		query := `insert into recovery_codes (user_id, code_hash, created_at, updated_at) values ($1, $2, $3, $3)`
+		if _, err := tx.ExecContext(ctx, query, id, hash, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apiKeyColumns are the columns scanAPIKey reads, in order
+const apiKeyColumns = `id, name, prefix, key_hash, scopes, created_by, last_used_at, revoked_at, created_at, updated_at`
+
+// scanAPIKey reads an API key selected with apiKeyColumns
+func scanAPIKey(row rowScanner) (models.APIKey, error) {
+	var k models.APIKey
+	var scopes string
+	var createdBy sql.NullInt64
+	var lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(&k.ID, &k.Name, &k.Prefix, &k.KeyHash, &scopes, &createdBy, &lastUsedAt, &revokedAt, &k.CreatedAt, &k.UpdatedAt)
+	for _, name := range strings.Split(scopes, ",") {
+		// scopes that have been dropped since the key was made grant nothing
+		if scope, ok := models.ParseAPIScope(name); ok {
+			k.Scopes = append(k.Scopes, scope)
+		}
+	}
+	k.CreatedBy = int(createdBy.Int64)
+	k.LastUsedAt = lastUsedAt.Time
+	k.RevokedAt = revokedAt.Time
+	return k, err
+}
+
+// InsertAPIKey stores a new API key and returns its id
+func (m *postgresDBRepo) InsertAPIKey(ctx context.Context, key models.APIKey) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	scopes := make([]string, len(key.Scopes))
+	for i, s := range key.Scopes {
+		scopes[i] = string(s)
+	}
+	var createdBy sql.NullInt64
+	if key.CreatedBy > 0 {
+		createdBy = sql.NullInt64{Int64: int64(key.CreatedBy), Valid: true}
+	}
+
+	var id int
+	query := `
+		insert into api_keys (name, prefix, key_hash, scopes, created_by, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $6) returning id
+	`
+	err := m.DB.QueryRowContext(ctx, query, key.Name, key.Prefix, key.KeyHash, strings.Join(scopes, ","), createdBy, time.Now()).Scan(&id)
+	return id, err
+}
+
+// AllAPIKeys returns every API key, the newest first
+func (m *postgresDBRepo) AllAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, "select "+apiKeyColumns+" from api_keys order by created_at desc")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []models.APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// GetAPIKeyByHash returns the API key with the hash, revoked or not, or ErrNotFound
+func (m *postgresDBRepo) GetAPIKeyByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, "select "+apiKeyColumns+" from api_keys where key_hash = $1", keyHash)
+	k, err := scanAPIKey(row)
+	if err == sql.ErrNoRows {
+		return k, repository.ErrNotFound
+	}
+	return k, err
+}
+
+// RevokeAPIKey stops an API key from working, it returns ErrNotFound when no key that works has the id
+func (m *postgresDBRepo) RevokeAPIKey(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, "update api_keys set revoked_at = $1, updated_at = $1 where id = $2 and revoked_at is null", time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return affectedOne(result)
+}
+
+// TouchAPIKey records when an API key was used. It's written at most once a minute, not on every request.
+func (m *postgresDBRepo) TouchAPIKey(ctx context.Context, id int, usedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `update api_keys set last_used_at = $1 where id = $2 and (last_used_at is null or last_used_at < $3)`
+	_, err := m.DB.ExecContext(ctx, query, usedAt, id, usedAt.Add(-time.Minute))
+	return err
+}
+
+// AllReservations returns a slice of all reservations
+func (m *postgresDBRepo) AllReservations(ctx context.Context) ([]models.Reservation, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var reservations []models.Reservation
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, 
+		r.processed, r.total_cents, r.currency, rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		order by r.start_date asc
+	`
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close() // we have to defer close it otherwise we will have a memory leak.
+	for rows.Next() {
+		var i models.Reservation
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomId,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Processed,
+			&i.TotalCents,
+			&i.Currency,
+			&i.Room.ID,
+			&i.Room.RoomName,
+		)
+		if err != nil {
+			return reservations, err
+		}
+		reservations = append(reservations, i)
+	}
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+	return reservations, nil
+}
+
+// AllNewReservations
+func (m *postgresDBRepo) AllNewReservations(ctx context.Context) ([]models.Reservation, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var reservations []models.Reservation
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, 
+		r.total_cents, r.currency, rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where processed = 0
+		order by r.start_date asc
+	`
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close() // we have to defer close it otherwise we will have a memory leak.
+	for rows.Next() {
+		var i models.Reservation
 		err := rows.Scan(
 			&i.ID,
 			&i.FirstName,
@@ -286,6 +1024,8 @@ func (m *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
 			&i.RoomId,
 			&i.CreatedAt,
 			&i.UpdatedAt,
+			&i.TotalCents,
+			&i.Currency,
 			&i.Room.ID,
 			&i.Room.RoomName,
 		)
@@ -300,16 +1040,18 @@ func (m *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
 	return reservations, nil
 }
 
-func (m *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+func (m *postgresDBRepo) GetReservationByID(ctx context.Context, id int) (models.Reservation, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 
 	var res models.Reservation
 	query := `
-	select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
+	select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id, r.adults, r.children,
+	r.created_at, r.updated_at, r.processed, r.total_cents, r.currency, coalesce(pr.code, ''), coalesce(pr.discount_cents, 0),
 	rm.id, rm.room_name
 	from reservations r
 	left join rooms rm on (r.room_id = rm.id)
+	left join promo_redemptions pr on (pr.reservation_id = r.id)
 	where r.id = $1
 	`
 	row := m.DB.QueryRowContext(ctx, query, id)
@@ -322,69 +1064,100 @@ func (m *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error)
 		&res.StartDate,
 		&res.EndDate,
 		&res.RoomId,
+		&res.Adults,
+		&res.Children,
 		&res.CreatedAt,
 		&res.UpdatedAt,
 		&res.Processed,
+		&res.TotalCents,
+		&res.Currency,
+		&res.PromoCode,
+		&res.PromoCents,
 		&res.Room.ID,
 		&res.Room.RoomName,
 	)
+	if err == sql.ErrNoRows {
+		return res, repository.ErrNotFound
+	}
 	if err != nil {
 		return res, err
 	}
 	return res, nil
 }
 
-// UpdateReservation edits reservation's data in the DB
-func (m *postgresDBRepo) UpdateReservation(res models.Reservation) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
-
-	query := `update reservations set first_name=$1, last_name=$2, email=$3, phone=$4, updated_at=$5 where id=$6`
-	_, err := m.DB.ExecContext(ctx, query,
+// UpdateReservation edits reservation's data in the DB and queues the webhooks telling about it, all or nothing
+func (m *postgresDBRepo) UpdateReservation(ctx context.Context, res models.Reservation, webhooks []models.WebhookMessage) error {
+	query := `update reservations set first_name=$1, last_name=$2, email=$3, phone=$4, processed=$5, updated_at=$6 where id=$7`
+	return m.changeReservation(ctx, webhooks, query,
 		res.FirstName,
 		res.LastName,
 		res.Email,
 		res.Phone,
+		res.Processed,
 		time.Now(),
 		res.ID,
 	)
-	if err != nil {
-		return err
-	}
-	return nil
 }
 
-// delete a reservation
-func (m *postgresDBRepo) DeleteReservation(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+// delete a reservation and queue the webhooks telling about it, all or nothing
+func (m *postgresDBRepo) DeleteReservation(ctx context.Context, id int, webhooks []models.WebhookMessage) error {
 	query := `delete from reservations where id=$1`
-	_, err := m.DB.ExecContext(ctx, query, id)
+	return m.changeReservation(ctx, webhooks, query, id)
+}
+
+// affectedOne returns ErrNotFound when a statement on a single row didn't find it
+func affectedOne(result sql.Result) error {
+	n, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if n == 0 {
+		return repository.ErrNotFound
+	}
 	return nil
 }
 
-// UpdateProcessedForReservation changes the ststus of the reservation to processed
-func (m *postgresDBRepo) UpdateProcessedForReservation(id, processed int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+// UpdateProcessedForReservation changes the ststus of the reservation to processed and queues the webhooks
+// telling about it, all or nothing
+func (m *postgresDBRepo) UpdateProcessedForReservation(ctx context.Context, id, processed int, webhooks []models.WebhookMessage) error {
+	query := `update reservations set processed=$1, updated_at=$2 where id=$3`
+	return m.changeReservation(ctx, webhooks, query, processed, time.Now(), id)
+}
+
+// changeReservation runs statement on a single reservation and queues the webhooks in the same transaction,
+// so that the other systems are told about every change that is committed and only about those
+func (m *postgresDBRepo) changeReservation(ctx context.Context, webhooks []models.WebhookMessage, statement string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 
-	query := `update reservations set processed=$1 where id=$2`
-	_, err := m.DB.ExecContext(ctx, query, processed, id)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	return nil
+	// rolling back after a successful commit is a no-op
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, statement, args...)
+	if err != nil {
+		return err
+	}
+	if err = affectedOne(result); err != nil {
+		return err
+	}
+	for _, w := range webhooks {
+		if _, err = queueWebhook(ctx, tx, w); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-// get all rooms
-func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+// AllRooms returns the rooms by position, with their type. The inactive rooms are included.
+func (m *postgresDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 	var rooms []models.Room
-	query := `select id, room_name, created_at, updated_at from rooms order by room_name`
+	query := `select ` + roomColumns + ` from ` + roomsWithTypes + ` order by r.position, r.room_name`
 
 	rows, err := m.DB.QueryContext(ctx, query)
 	if err != nil {
@@ -392,13 +1165,7 @@ func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var rm models.Room
-		err := rows.Scan(
-			&rm.ID,
-			&rm.RoomName,
-			&rm.CreatedAt,
-			&rm.UpdatedAt,
-		)
+		rm, err := scanRoom(rows)
 		if err != nil {
 			return rooms, err
 		}
@@ -411,8 +1178,8 @@ func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
 }
 
 // GetRestrictionsFoorRoomByDate returns all restrictions of a specific room by date range
-func (m *postgresDBRepo) GetRestrictionsFoorRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestrictions, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) GetRestrictionsFoorRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestrictions, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 	var restrictions []models.RoomRestrictions
 	query := `
@@ -448,8 +1215,8 @@ func (m *postgresDBRepo) GetRestrictionsFoorRoomByDate(roomID int, start, end ti
 }
 
 // InsertBlockForRoom inserts a room restriction
-func (m *postgresDBRepo) InsertBlockForRoom(id int, startdate time.Time) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) InsertBlockForRoom(ctx context.Context, id int, startdate time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 
 	query := ` insert into 
@@ -460,14 +1227,14 @@ func (m *postgresDBRepo) InsertBlockForRoom(id int, startdate time.Time) error {
 	_, err := m.DB.ExecContext(ctx, query, startdate, startdate.AddDate(0, 0, 1), id, 2, time.Now(), time.Now())
 	if err != nil {
 		log.Println(err)
-		return err
+		return translateError(err)
 	}
 	return nil
 }
 
 // DeleteBlockByID deletes a room restriction
-func (m *postgresDBRepo) DeleteBlockByID(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) DeleteBlockByID(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 
 	query := `delete from  room_restrictions where id = $1`
@@ -479,3 +1246,1263 @@ func (m *postgresDBRepo) DeleteBlockByID(id int) error {
 	}
 	return nil
 }
+
+// execQuerier is satisfied by both *sql.DB and *sql.Tx
+type execQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// insertMail puts an email in the outbox, ready to be sent right away
+func insertMail(ctx context.Context, db execQuerier, msg models.MailData) (int, error) {
+	var id int
+	// the attachments are kept as JSON, empty when there are none
+	var attachments []byte
+	if len(msg.Attachments) > 0 {
+		var err error
+		if attachments, err = json.Marshal(msg.Attachments); err != nil {
+			return 0, err
+		}
+	}
+	statement := `insert into mail_outbox (to_address, from_address, subject, content, text_content, template, attachments, status,
+	next_attempt_at, created_at, updated_at)
+	values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11) returning id`
+	err := db.QueryRowContext(ctx, statement,
+		msg.To,
+		msg.From,
+		msg.Subject,
+		msg.Content,
+		msg.Text,
+		msg.Template,
+		string(attachments),
+		models.MailPending,
+		time.Now(),
+		time.Now(),
+		time.Now(),
+	).Scan(&id)
+	return id, err
+}
+
+// InsertMail puts an email in the outbox
+func (m *postgresDBRepo) InsertMail(ctx context.Context, msg models.MailData) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	return insertMail(ctx, m.DB, msg)
+}
+
+// ClaimMail hands up to limit emails that are due to the calling worker. They are marked as sending
+// for the length of lease, after which they are handed out again in case the worker died.
+// "skip locked" lets several workers claim at the same time without getting the same email.
+func (m *postgresDBRepo) ClaimMail(ctx context.Context, limit int, lease time.Duration) ([]models.OutboxMail, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var mails []models.OutboxMail
+	query := `
+		update mail_outbox set status = $1, attempts = attempts + 1, next_attempt_at = $2, updated_at = $3
+		where id in (
+			select id from mail_outbox
+			where status in ($4, $1) and next_attempt_at <= $3
+			order by next_attempt_at
+			limit $5
+			for update skip locked
+		)
+		returning id, to_address, from_address, subject, content, text_content, template, attachments, status, attempts,
+		next_attempt_at, last_error, created_at, updated_at
+	`
+	now := time.Now()
+	rows, err := m.DB.QueryContext(ctx, query, models.MailSending, now.Add(lease), now, models.MailPending, limit)
+	if err != nil {
+		return mails, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.OutboxMail
+		var attachments string
+		err := rows.Scan(
+			&i.ID,
+			&i.To,
+			&i.From,
+			&i.Subject,
+			&i.Content,
+			&i.Text,
+			&i.Template,
+			&attachments,
+			&i.Status,
+			&i.Attempts,
+			&i.NextAttemptAt,
+			&i.LastError,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		)
+		if err != nil {
+			return mails, err
+		}
+		if attachments != "" {
+			if err := json.Unmarshal([]byte(attachments), &i.Attachments); err != nil {
+				return mails, err
+			}
+		}
+		mails = append(mails, i)
+	}
+	if err = rows.Err(); err != nil {
+		return mails, err
+	}
+	return mails, nil
+}
+
+// MarkMailSent records that an email has been delivered
+func (m *postgresDBRepo) MarkMailSent(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `update mail_outbox set status = $1, sent_at = $2, last_error = '', updated_at = $2 where id = $3`
+	_, err := m.DB.ExecContext(ctx, query, models.MailSent, time.Now(), id)
+	return err
+}
+
+// MarkMailFailed records a failed attempt, scheduling the next one at retryAt unless dead is true
+func (m *postgresDBRepo) MarkMailFailed(ctx context.Context, id int, reason string, retryAt time.Time, dead bool) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	status := models.MailPending
+	if dead {
+		status = models.MailDead
+	}
+	query := `update mail_outbox set status = $1, last_error = $2, next_attempt_at = $3, updated_at = $4 where id = $5`
+	_, err := m.DB.ExecContext(ctx, query, status, reason, retryAt, time.Now(), id)
+	return err
+}
+
+// AllFailedMail returns the dead emails and the ones waiting to be retried, newest first
+func (m *postgresDBRepo) AllFailedMail(ctx context.Context) ([]models.OutboxMail, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var mails []models.OutboxMail
+	query := `
+		select id, to_address, from_address, subject, content, text_content, template, status, attempts, next_attempt_at,
+		last_error, created_at, updated_at
+		from mail_outbox
+		where status = $1 or (status = $2 and attempts > 0)
+		order by updated_at desc
+	`
+	rows, err := m.DB.QueryContext(ctx, query, models.MailDead, models.MailPending)
+	if err != nil {
+		return mails, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.OutboxMail
+		err := rows.Scan(
+			&i.ID,
+			&i.To,
+			&i.From,
+			&i.Subject,
+			&i.Content,
+			&i.Text,
+			&i.Template,
+			&i.Status,
+			&i.Attempts,
+			&i.NextAttemptAt,
+			&i.LastError,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		)
+		if err != nil {
+			return mails, err
+		}
+		mails = append(mails, i)
+	}
+	if err = rows.Err(); err != nil {
+		return mails, err
+	}
+	return mails, nil
+}
+
+// RetryMail puts a failed email back in the queue with a fresh set of attempts. Only the emails listed by
+// AllFailedMail can be retried, one being sent by a worker right now is left alone so it isn't sent twice.
+func (m *postgresDBRepo) RetryMail(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		update mail_outbox set status = $1, attempts = 0, next_attempt_at = $2, updated_at = $2
+		where id = $3 and (status = $4 or (status = $1 and attempts > 0))
+	`
+	result, err := m.DB.ExecContext(ctx, query, models.MailPending, time.Now(), id, models.MailDead)
+	if err != nil {
+		return err
+	}
+	return affectedOne(result)
+}
+
+// webhookEndpointColumns are the columns scanWebhookEndpoint reads, in order
+const webhookEndpointColumns = `id, url, description, secret, events, active, created_at, updated_at`
+
+// scanWebhookEndpoint reads a webhook endpoint selected with webhookEndpointColumns
+func scanWebhookEndpoint(row rowScanner) (models.WebhookEndpoint, error) {
+	var e models.WebhookEndpoint
+	var events string
+	err := row.Scan(&e.ID, &e.URL, &e.Description, &e.Secret, &events, &e.Active, &e.CreatedAt, &e.UpdatedAt)
+	for _, name := range strings.Split(events, ",") {
+		if event, ok := models.ParseWebhookEvent(name); ok {
+			e.Events = append(e.Events, event)
+		}
+	}
+	return e, err
+}
+
+// joinEvents stores the events of an endpoint as a comma separated list
+func joinEvents(events []models.WebhookEvent) string {
+	names := make([]string, len(events))
+	for i, e := range events {
+		names[i] = string(e)
+	}
+	return strings.Join(names, ",")
+}
+
+// AllWebhookEndpoints returns every webhook endpoint, the oldest first
+func (m *postgresDBRepo) AllWebhookEndpoints(ctx context.Context) ([]models.WebhookEndpoint, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, "select "+webhookEndpointColumns+" from webhook_endpoints order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endpoints []models.WebhookEndpoint
+	for rows.Next() {
+		e, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return endpoints, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, rows.Err()
+}
+
+// GetWebhookEndpoint returns the webhook endpoint with the id, or ErrNotFound
+func (m *postgresDBRepo) GetWebhookEndpoint(ctx context.Context, id int) (models.WebhookEndpoint, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, "select "+webhookEndpointColumns+" from webhook_endpoints where id = $1", id)
+	e, err := scanWebhookEndpoint(row)
+	if err == sql.ErrNoRows {
+		return e, repository.ErrNotFound
+	}
+	return e, err
+}
+
+// InsertWebhookEndpoint stores a new webhook endpoint and returns its id
+func (m *postgresDBRepo) InsertWebhookEndpoint(ctx context.Context, e models.WebhookEndpoint) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var id int
+	query := `
+		insert into webhook_endpoints (url, description, secret, events, active, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $6) returning id
+	`
+	err := m.DB.QueryRowContext(ctx, query, e.URL, e.Description, e.Secret, joinEvents(e.Events), e.Active, time.Now()).Scan(&id)
+	return id, err
+}
+
+// UpdateWebhookEndpoint changes the url, description, events and active flag of an endpoint, its secret is kept.
+// It returns ErrNotFound when no endpoint has the id.
+func (m *postgresDBRepo) UpdateWebhookEndpoint(ctx context.Context, e models.WebhookEndpoint) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `update webhook_endpoints set url = $1, description = $2, events = $3, active = $4, updated_at = $5 where id = $6`
+	result, err := m.DB.ExecContext(ctx, query, e.URL, e.Description, joinEvents(e.Events), e.Active, time.Now(), e.ID)
+	if err != nil {
+		return err
+	}
+	return affectedOne(result)
+}
+
+// DeleteWebhookEndpoint deletes an endpoint along with its deliveries, it returns ErrNotFound when no endpoint
+// has the id
+func (m *postgresDBRepo) DeleteWebhookEndpoint(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, "delete from webhook_endpoints where id = $1", id)
+	if err != nil {
+		return err
+	}
+	return affectedOne(result)
+}
+
+// QueueWebhook queues a delivery of the payload to every active endpoint subscribed to the event and returns
+// how many were queued
+func (m *postgresDBRepo) QueueWebhook(ctx context.Context, event models.WebhookEvent, payload []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	return queueWebhook(ctx, m.DB, models.WebhookMessage{Event: event, Payload: payload})
+}
+
+// queueWebhook queues a delivery of w to every active endpoint subscribed to its event and returns how many
+func queueWebhook(ctx context.Context, db execQuerier, w models.WebhookMessage) (int, error) {
+	query := `
+		insert into webhook_deliveries (endpoint_id, event, payload, status, next_attempt_at, created_at, updated_at)
+		select id, $1, $2, $3, $4, $4, $4 from webhook_endpoints
+		where active and $1 = any(string_to_array(events, ','))
+	`
+	result, err := db.ExecContext(ctx, query, string(w.Event), string(w.Payload), models.WebhookPending, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// ClaimWebhooks hands up to limit deliveries that are due to the calling worker, the same way ClaimMail does
+func (m *postgresDBRepo) ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		with claimed as (
+			update webhook_deliveries set status = $1, attempts = attempts + 1, next_attempt_at = $2, updated_at = $3
+			where id in (
+				select id from webhook_deliveries
+				where status in ($4, $1) and next_attempt_at <= $3
+				order by next_attempt_at
+				limit $5
+				for update skip locked
+			)
+			returning *
+		)
+		select c.id, c.endpoint_id, e.url, e.secret, c.event, c.payload, c.status, c.attempts, c.next_attempt_at,
+		c.last_error, c.response_status, c.delivered_at, c.created_at, c.updated_at
+		from claimed c join webhook_endpoints e on e.id = c.endpoint_id
+	`
+	now := time.Now()
+	rows, err := m.DB.QueryContext(ctx, query, models.WebhookSending, now.Add(lease), now, models.WebhookPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanWebhookDeliveries(rows)
+}
+
+// scanWebhookDeliveries reads the deliveries selected by ClaimWebhooks and RecentWebhookDeliveries
+func scanWebhookDeliveries(rows *sql.Rows) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+	for rows.Next() {
+		var d models.WebhookDelivery
+		var event, payload string
+		var deliveredAt sql.NullTime
+		err := rows.Scan(
+			&d.ID,
+			&d.EndpointID,
+			&d.URL,
+			&d.Secret,
+			&event,
+			&payload,
+			&d.Status,
+			&d.Attempts,
+			&d.NextAttemptAt,
+			&d.LastError,
+			&d.ResponseStatus,
+			&deliveredAt,
+			&d.CreatedAt,
+			&d.UpdatedAt,
+		)
+		if err != nil {
+			return deliveries, err
+		}
+		d.Event = models.WebhookEvent(event)
+		d.Payload = []byte(payload)
+		d.DeliveredAt = deliveredAt.Time
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// MarkWebhookDelivered records that the endpoint accepted a delivery with the HTTP status
+func (m *postgresDBRepo) MarkWebhookDelivered(ctx context.Context, id, responseStatus int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		update webhook_deliveries set status = $1, response_status = $2, last_error = '', delivered_at = $3, updated_at = $3
+		where id = $4
+	`
+	_, err := m.DB.ExecContext(ctx, query, models.WebhookDelivered, responseStatus, time.Now(), id)
+	return err
+}
+
+// MarkWebhookFailed records a failed attempt, scheduling the next one at retryAt unless dead is true.
+// responseStatus is 0 when the endpoint didn't answer.
+func (m *postgresDBRepo) MarkWebhookFailed(ctx context.Context, id, responseStatus int, reason string, retryAt time.Time, dead bool) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	status := models.WebhookPending
+	if dead {
+		status = models.WebhookDead
+	}
+	query := `
+		update webhook_deliveries set status = $1, response_status = $2, last_error = $3, next_attempt_at = $4, updated_at = $5
+		where id = $6
+	`
+	_, err := m.DB.ExecContext(ctx, query, status, responseStatus, reason, retryAt, time.Now(), id)
+	return err
+}
+
+// RecentWebhookDeliveries returns the last limit deliveries to any endpoint, newest first
+func (m *postgresDBRepo) RecentWebhookDeliveries(ctx context.Context, limit int) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		select d.id, d.endpoint_id, e.url, e.secret, d.event, d.payload, d.status, d.attempts, d.next_attempt_at,
+		d.last_error, d.response_status, d.delivered_at, d.created_at, d.updated_at
+		from webhook_deliveries d join webhook_endpoints e on e.id = d.endpoint_id
+		order by d.created_at desc, d.id desc
+		limit $1
+	`
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanWebhookDeliveries(rows)
+}
+
+// RedeliverWebhook queues a delivery again with a fresh set of attempts, whether it was delivered or not.
+// It returns ErrNotFound when no delivery has the id or a worker is sending it right now.
+func (m *postgresDBRepo) RedeliverWebhook(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		update webhook_deliveries set status = $1, attempts = 0, next_attempt_at = $2, delivered_at = null, updated_at = $2
+		where id = $3 and status <> $4
+	`
+	result, err := m.DB.ExecContext(ctx, query, models.WebhookPending, time.Now(), id, models.WebhookSending)
+	if err != nil {
+		return err
+	}
+	return affectedOne(result)
+}
+
+// SeasonalRates returns the seasons of the room, and those of every room, that cover some of the nights from start
+// to the night before end
+func (m *postgresDBRepo) SeasonalRates(ctx context.Context, roomID int, start, end time.Time) ([]models.SeasonalRate, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		select id, coalesce(room_id, 0), name, start_date, end_date, nightly_rate_cents, weekend_rate_cents, created_at, updated_at
+		from seasonal_rates
+		where (room_id = $1 or room_id is null) and $2 < end_date and $3 > start_date
+		order by start_date
+	`
+	rows, err := m.DB.QueryContext(ctx, query, roomID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var seasons []models.SeasonalRate
+	for rows.Next() {
+		var s models.SeasonalRate
+		err := rows.Scan(
+			&s.ID,
+			&s.RoomID,
+			&s.Name,
+			&s.StartDate,
+			&s.EndDate,
+			&s.NightlyRateCents,
+			&s.WeekendRateCents,
+			&s.CreatedAt,
+			&s.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		seasons = append(seasons, s)
+	}
+	return seasons, rows.Err()
+}
+
+// StayDiscounts returns the length-of-stay discounts, shortest stay first
+func (m *postgresDBRepo) StayDiscounts(ctx context.Context) ([]models.StayDiscount, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `select id, min_nights, percent, created_at, updated_at from stay_discounts order by min_nights`
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var discounts []models.StayDiscount
+	for rows.Next() {
+		var d models.StayDiscount
+		if err := rows.Scan(&d.ID, &d.MinNights, &d.Percent, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			return nil, err
+		}
+		discounts = append(discounts, d)
+	}
+	return discounts, rows.Err()
+}
+
+// AllCharges returns the taxes and fees of the property
+func (m *postgresDBRepo) AllCharges(ctx context.Context) ([]models.Charge, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `select id, name, kind, amount_cents, rate_basis_points, position, created_at, updated_at from charges order by position, id`
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var charges []models.Charge
+	for rows.Next() {
+		var c models.Charge
+		err := rows.Scan(&c.ID, &c.Name, &c.Kind, &c.AmountCents, &c.RateBasisPoints, &c.Position, &c.CreatedAt, &c.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		charges = append(charges, c)
+	}
+	return charges, rows.Err()
+}
+
+// IssueInvoice numbers and stores the invoice of a reservation. A reservation has a single invoice: when it
+// already has one, that one is returned instead.
+func (m *postgresDBRepo) IssueInvoice(ctx context.Context, inv models.Invoice) (models.Invoice, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return inv, err
+	}
+	// rolling back after a successful commit is a no-op
+	defer tx.Rollback()
+
+	issued, err := insertInvoice(ctx, tx, inv, m.App.Invoice.Prefix)
+	if errors.Is(err, errInvoiceExists) {
+		_ = tx.Rollback()
+		return m.GetInvoiceByReservationID(ctx, inv.ReservationID)
+	}
+	if err != nil {
+		return inv, err
+	}
+	return issued, tx.Commit()
+}
+
+// errInvoiceExists is returned by insertInvoice when the reservation already has an invoice
+var errInvoiceExists = errors.New("the reservation already has an invoice")
+
+// insertInvoice gives inv the next number and stores it with its lines. The invoices table is locked until
+// the transaction ends so that the numbers follow each other without gaps, even when it's rolled back.
+func insertInvoice(ctx context.Context, tx *sql.Tx, inv models.Invoice, prefix string) (models.Invoice, error) {
+	if _, err := tx.ExecContext(ctx, "lock table invoices in share row exclusive mode"); err != nil {
+		return inv, err
+	}
+	var exists bool
+	err := tx.QueryRowContext(ctx, "select exists(select 1 from invoices where reservation_id = $1)", inv.ReservationID).Scan(&exists)
+	if err != nil {
+		return inv, err
+	}
+	if exists {
+		return inv, errInvoiceExists
+	}
+
+	var seq int
+	if err := tx.QueryRowContext(ctx, "select coalesce(max(seq), 0) + 1 from invoices").Scan(&seq); err != nil {
+		return inv, err
+	}
+	inv.Number = fmt.Sprintf("%s%06d", prefix, seq)
+	inv.IssuedAt = time.Now()
+
+	statement := `
+		insert into invoices (seq, number, reservation_id, currency, guest_name, guest_email, room_name, start_date, end_date,
+		subtotal_cents, tax_cents, total_cents, issued_at, created_at, updated_at)
+		values ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$13,$13) returning id
+	`
+	err = tx.QueryRowContext(ctx, statement, seq, inv.Number, inv.ReservationID, inv.Currency, inv.GuestName, inv.GuestEmail,
+		inv.RoomName, inv.StartDate, inv.EndDate, inv.SubtotalCents, inv.TaxCents, inv.TotalCents, inv.IssuedAt).Scan(&inv.ID)
+	if err != nil {
+		return inv, err
+	}
+
+	statement = `
+		insert into invoice_lines (invoice_id, position, kind, description, quantity, unit_cents, amount_cents, created_at, updated_at)
+		values ($1,$2,$3,$4,$5,$6,$7,$8,$8) returning id
+	`
+	for i := range inv.Lines {
+		l := &inv.Lines[i]
+		err := tx.QueryRowContext(ctx, statement, inv.ID, l.Position, l.Kind, l.Description, l.Quantity, l.UnitCents,
+			l.AmountCents, inv.IssuedAt).Scan(&l.ID)
+		if err != nil {
+			return inv, err
+		}
+	}
+	return inv, nil
+}
+
+// GetInvoiceByReservationID returns the invoice of a reservation with its lines
+func (m *postgresDBRepo) GetInvoiceByReservationID(ctx context.Context, reservationID int) (models.Invoice, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var inv models.Invoice
+	query := `
+		select id, number, reservation_id, currency, guest_name, guest_email, room_name, start_date, end_date,
+		subtotal_cents, tax_cents, total_cents, issued_at
+		from invoices where reservation_id = $1
+	`
+	err := m.DB.QueryRowContext(ctx, query, reservationID).Scan(
+		&inv.ID,
+		&inv.Number,
+		&inv.ReservationID,
+		&inv.Currency,
+		&inv.GuestName,
+		&inv.GuestEmail,
+		&inv.RoomName,
+		&inv.StartDate,
+		&inv.EndDate,
+		&inv.SubtotalCents,
+		&inv.TaxCents,
+		&inv.TotalCents,
+		&inv.IssuedAt,
+	)
+	if err == sql.ErrNoRows {
+		return inv, repository.ErrNotFound
+	}
+	if err != nil {
+		return inv, err
+	}
+
+	query = `
+		select id, position, kind, description, quantity, unit_cents, amount_cents
+		from invoice_lines where invoice_id = $1 order by position
+	`
+	rows, err := m.DB.QueryContext(ctx, query, inv.ID)
+	if err != nil {
+		return inv, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var l models.InvoiceLine
+		if err := rows.Scan(&l.ID, &l.Position, &l.Kind, &l.Description, &l.Quantity, &l.UnitCents, &l.AmountCents); err != nil {
+			return inv, err
+		}
+		inv.Lines = append(inv.Lines, l)
+	}
+	return inv, rows.Err()
+}
+
+// promoUsesQuery counts the redemptions of a promo code, by all guests and by the guest with an email.
+// The redemptions of deleted reservations stay for the report, but they don't use up the code.
+const promoUsesQuery = `
+	select count(pr.id), count(pr.id) filter (where pr.guest_email = $2)
+	from promo_redemptions pr
+	join reservations r on (r.id = pr.reservation_id)
+	where pr.promo_code_id = $1
+`
+
+// redeemPromoCode records the redemption of p by res. The code is locked until the transaction ends so that
+// concurrent bookings count each other's redemptions, its usage limits as they are now are checked again.
+func redeemPromoCode(ctx context.Context, tx *sql.Tx, p models.PromoCode, res models.Reservation) error {
+	var active bool
+	var maxUses, maxUsesPerGuest int
+	query := `select active, max_uses, max_uses_per_guest from promo_codes where id = $1 for update`
+	err := tx.QueryRowContext(ctx, query, p.ID).Scan(&active, &maxUses, &maxUsesPerGuest)
+	if err == sql.ErrNoRows {
+		return repository.ErrPromoCodeUnavailable
+	}
+	if err != nil {
+		return err
+	}
+
+	email := strings.ToLower(strings.TrimSpace(res.Email))
+	var total, guest int
+	if err := tx.QueryRowContext(ctx, promoUsesQuery, p.ID, email).Scan(&total, &guest); err != nil {
+		return err
+	}
+	if !active || (maxUses > 0 && total >= maxUses) || (maxUsesPerGuest > 0 && guest >= maxUsesPerGuest) {
+		return repository.ErrPromoCodeUnavailable
+	}
+
+	statement := `
+		insert into promo_redemptions (promo_code_id, code, reservation_id, guest_email, discount_cents, currency, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $7)
+	`
+	_, err = tx.ExecContext(ctx, statement, p.ID, p.Code, res.ID, email, res.PromoCents, res.Currency, time.Now())
+	return err
+}
+
+// promoCodeColumns are the columns scanned by scanPromoCode
+const promoCodeColumns = `p.id, p.code, p.description, p.kind, p.percent, p.amount_cents, p.valid_from, p.valid_until,
+	p.min_nights, p.max_uses, p.max_uses_per_guest, p.active, p.created_at, p.updated_at`
+
+// scanPromoCode scans the promoCodeColumns of a row, followed by the destinations in more
+func scanPromoCode(row interface{ Scan(...interface{}) error }, p *models.PromoCode, more ...interface{}) error {
+	var validFrom, validUntil sql.NullTime
+	dest := []interface{}{&p.ID, &p.Code, &p.Description, &p.Kind, &p.Percent, &p.AmountCents, &validFrom, &validUntil,
+		&p.MinNights, &p.MaxUses, &p.MaxUsesPerGuest, &p.Active, &p.CreatedAt, &p.UpdatedAt}
+	if err := row.Scan(append(dest, more...)...); err != nil {
+		return err
+	}
+	p.ValidFrom, p.ValidUntil = validFrom.Time, validUntil.Time
+	return nil
+}
+
+// nullDate stores the zero time as null
+func nullDate(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// AllPromoCodes returns the promo codes by code, with their rooms and what they have been redeemed for
+func (m *postgresDBRepo) AllPromoCodes(ctx context.Context) ([]models.PromoCode, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		select ` + promoCodeColumns + `, count(r.id), coalesce(sum(r.discount_cents), 0)
+		from promo_codes p
+		left join promo_redemptions r on (r.promo_code_id = p.id)
+		group by p.id
+		order by p.code
+	`
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []models.PromoCode
+	for rows.Next() {
+		var p models.PromoCode
+		if err := scanPromoCode(rows, &p, &p.Uses, &p.RedeemedCents); err != nil {
+			return nil, err
+		}
+		codes = append(codes, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rooms, err := m.promoCodeRooms(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := range codes {
+		codes[i].RoomIDs = rooms[codes[i].ID]
+	}
+	return codes, nil
+}
+
+// promoCodeRooms returns the rooms of the promo code with id, or of every code when id is 0, by code
+func (m *postgresDBRepo) promoCodeRooms(ctx context.Context, id int) (map[int][]int, error) {
+	rows, err := m.DB.QueryContext(ctx, `
+		select promo_code_id, room_id from promo_code_rooms
+		where $1 = 0 or promo_code_id = $1
+		order by room_id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make(map[int][]int)
+	for rows.Next() {
+		var codeID, roomID int
+		if err := rows.Scan(&codeID, &roomID); err != nil {
+			return nil, err
+		}
+		rooms[codeID] = append(rooms[codeID], roomID)
+	}
+	return rooms, rows.Err()
+}
+
+// GetPromoCodeByID returns a promo code with its rooms
+func (m *postgresDBRepo) GetPromoCodeByID(ctx context.Context, id int) (models.PromoCode, error) {
+	return m.getPromoCode(ctx, "p.id = $1", id)
+}
+
+// GetPromoCodeByCode returns the promo code with code, which is in upper case, along with its rooms
+func (m *postgresDBRepo) GetPromoCodeByCode(ctx context.Context, code string) (models.PromoCode, error) {
+	return m.getPromoCode(ctx, "p.code = $1", code)
+}
+
+// getPromoCode returns the promo code matching where, it returns ErrNotFound when there is none
+func (m *postgresDBRepo) getPromoCode(ctx context.Context, where string, arg interface{}) (models.PromoCode, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var p models.PromoCode
+	row := m.DB.QueryRowContext(ctx, "select "+promoCodeColumns+" from promo_codes p where "+where, arg)
+	err := scanPromoCode(row, &p)
+	if err == sql.ErrNoRows {
+		return p, repository.ErrNotFound
+	}
+	if err != nil {
+		return p, err
+	}
+	rooms, err := m.promoCodeRooms(ctx, p.ID)
+	if err != nil {
+		return p, err
+	}
+	p.RoomIDs = rooms[p.ID]
+	return p, nil
+}
+
+// InsertPromoCode stores a promo code with its rooms and returns its id, it returns ErrDuplicatePromoCode
+// when another code has the same code
+func (m *postgresDBRepo) InsertPromoCode(ctx context.Context, p models.PromoCode) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	query := `
+		insert into promo_codes (code, description, kind, percent, amount_cents, valid_from, valid_until, min_nights,
+			max_uses, max_uses_per_guest, active, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $12)
+		returning id
+	`
+	err = tx.QueryRowContext(ctx, query, p.Code, p.Description, p.Kind, p.Percent, p.AmountCents, nullDate(p.ValidFrom),
+		nullDate(p.ValidUntil), p.MinNights, p.MaxUses, p.MaxUsesPerGuest, p.Active, time.Now()).Scan(&id)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	if err := insertPromoCodeRooms(ctx, tx, id, p.RoomIDs); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// UpdatePromoCode saves a promo code along with its rooms. It returns ErrNotFound when no code has its id and
+// ErrDuplicatePromoCode when another code has the same code.
+func (m *postgresDBRepo) UpdatePromoCode(ctx context.Context, p models.PromoCode) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		update promo_codes set code = $1, description = $2, kind = $3, percent = $4, amount_cents = $5, valid_from = $6,
+			valid_until = $7, min_nights = $8, max_uses = $9, max_uses_per_guest = $10, active = $11, updated_at = $12
+		where id = $13
+	`
+	result, err := tx.ExecContext(ctx, query, p.Code, p.Description, p.Kind, p.Percent, p.AmountCents, nullDate(p.ValidFrom),
+		nullDate(p.ValidUntil), p.MinNights, p.MaxUses, p.MaxUsesPerGuest, p.Active, time.Now(), p.ID)
+	if err != nil {
+		return translateError(err)
+	}
+	if err := affectedOne(result); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "delete from promo_code_rooms where promo_code_id = $1", p.ID); err != nil {
+		return err
+	}
+	if err := insertPromoCodeRooms(ctx, tx, p.ID, p.RoomIDs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertPromoCodeRooms stores the rooms the promo code with id can be redeemed for
+func insertPromoCodeRooms(ctx context.Context, tx *sql.Tx, id int, roomIDs []int) error {
+	now := time.Now()
+	for _, roomID := range roomIDs {
+		_, err := tx.ExecContext(ctx, `
+			insert into promo_code_rooms (promo_code_id, room_id, created_at, updated_at) values ($1, $2, $3, $3)
+		`, id, roomID, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeletePromoCode deletes a promo code that has never been redeemed. It returns ErrNotFound when no code
+// has the id and ErrPromoCodeRedeemed when it has been redeemed.
+func (m *postgresDBRepo) DeletePromoCode(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// a booking redeeming the code waits for the delete, or the delete for the booking
+	var found int
+	err = tx.QueryRowContext(ctx, "select id from promo_codes where id = $1 for update", id).Scan(&found)
+	if err == sql.ErrNoRows {
+		return repository.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	var redeemed bool
+	err = tx.QueryRowContext(ctx, "select exists(select 1 from promo_redemptions where promo_code_id = $1)", id).Scan(&redeemed)
+	if err != nil {
+		return err
+	}
+	if redeemed {
+		return repository.ErrPromoCodeRedeemed
+	}
+	if _, err := tx.ExecContext(ctx, "delete from promo_codes where id = $1", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PromoCodeUses returns how many times the promo code with id has been redeemed, by all guests and by the
+// guest with email, for reservations that haven't been deleted
+func (m *postgresDBRepo) PromoCodeUses(ctx context.Context, id int, email string) (int, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var total, guest int
+	err := m.DB.QueryRowContext(ctx, promoUsesQuery, id, strings.ToLower(strings.TrimSpace(email))).Scan(&total, &guest)
+	return total, guest, err
+}
+
+// PromoRedemptions returns the latest limit redemptions, the latest first
+func (m *postgresDBRepo) PromoRedemptions(ctx context.Context, limit int) ([]models.PromoRedemption, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		select id, promo_code_id, code, reservation_id, guest_email, discount_cents, currency, created_at
+		from promo_redemptions
+		order by created_at desc, id desc
+		limit $1
+	`
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var redemptions []models.PromoRedemption
+	for rows.Next() {
+		var r models.PromoRedemption
+		err := rows.Scan(&r.ID, &r.PromoCodeID, &r.Code, &r.ReservationID, &r.GuestEmail, &r.DiscountCents, &r.Currency, &r.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, r)
+	}
+	return redemptions, rows.Err()
+}
+
+// roomTypeColumns are the columns scanned by scanRoomType
+const roomTypeColumns = `id, name, description, max_occupancy, beds, amenities, created_at, updated_at`
+
+// scanRoomType reads a room type selected with roomTypeColumns
+func scanRoomType(row rowScanner) (models.RoomType, error) {
+	var t models.RoomType
+	var amenities string
+	err := row.Scan(&t.ID, &t.Name, &t.Description, &t.MaxOccupancy, &t.Beds, &amenities, &t.CreatedAt, &t.UpdatedAt)
+	t.Amenities = splitLines(amenities)
+	return t, err
+}
+
+// splitLines reads a list stored one item per line, like the amenities or the photos of a room
+func splitLines(lines string) []string {
+	var out []string
+	for _, a := range strings.Split(lines, "\n") {
+		if a = strings.TrimSpace(a); a != "" {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// AllRoomTypes returns the room types by name, with their rooms
+func (m *postgresDBRepo) AllRoomTypes(ctx context.Context) ([]models.RoomType, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, "select "+roomTypeColumns+" from room_types order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var types []models.RoomType
+	for rows.Next() {
+		t, err := scanRoomType(rows)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rooms, err := m.roomTypeRooms(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := range types {
+		types[i].RoomIDs = rooms[types[i].ID]
+	}
+	return types, nil
+}
+
+// roomTypeRooms returns the rooms of the room type with id, or of every type when id is 0, by type
+func (m *postgresDBRepo) roomTypeRooms(ctx context.Context, id int) (map[int][]int, error) {
+	rows, err := m.DB.QueryContext(ctx, `
+		select room_type_id, id from rooms
+		where room_type_id is not null and ($1 = 0 or room_type_id = $1)
+		order by id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make(map[int][]int)
+	for rows.Next() {
+		var typeID, roomID int
+		if err := rows.Scan(&typeID, &roomID); err != nil {
+			return nil, err
+		}
+		rooms[typeID] = append(rooms[typeID], roomID)
+	}
+	return rooms, rows.Err()
+}
+
+// GetRoomTypeByID returns a room type with its rooms, or ErrNotFound
+func (m *postgresDBRepo) GetRoomTypeByID(ctx context.Context, id int) (models.RoomType, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	t, err := scanRoomType(m.DB.QueryRowContext(ctx, "select "+roomTypeColumns+" from room_types where id = $1", id))
+	if err == sql.ErrNoRows {
+		return t, repository.ErrNotFound
+	}
+	if err != nil {
+		return t, err
+	}
+	rooms, err := m.roomTypeRooms(ctx, t.ID)
+	if err != nil {
+		return t, err
+	}
+	t.RoomIDs = rooms[t.ID]
+	return t, nil
+}
+
+// InsertRoomType stores a room type, moves its rooms to it and returns its id. It returns ErrDuplicateRoomType
+// when another type has the same name.
+func (m *postgresDBRepo) InsertRoomType(ctx context.Context, t models.RoomType) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	query := `
+		insert into room_types (name, description, max_occupancy, beds, amenities, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $6)
+		returning id
+	`
+	err = tx.QueryRowContext(ctx, query, t.Name, t.Description, t.MaxOccupancy, t.Beds, strings.Join(t.Amenities, "\n"),
+		time.Now()).Scan(&id)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	if err := assignRoomType(ctx, tx, id, t.RoomIDs); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// UpdateRoomType saves a room type, its rooms are exactly t.RoomIDs afterwards. It returns ErrNotFound when no
+// type has its id and ErrDuplicateRoomType when another type has the same name.
+func (m *postgresDBRepo) UpdateRoomType(ctx context.Context, t models.RoomType) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		update room_types set name = $1, description = $2, max_occupancy = $3, beds = $4, amenities = $5, updated_at = $6
+		where id = $7
+	`
+	result, err := tx.ExecContext(ctx, query, t.Name, t.Description, t.MaxOccupancy, t.Beds, strings.Join(t.Amenities, "\n"),
+		time.Now(), t.ID)
+	if err != nil {
+		return translateError(err)
+	}
+	if err := affectedOne(result); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "update rooms set room_type_id = null, updated_at = $2 where room_type_id = $1", t.ID, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := assignRoomType(ctx, tx, t.ID, t.RoomIDs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// assignRoomType moves the rooms with roomIDs to the room type with id, a room has a single type
+func assignRoomType(ctx context.Context, tx *sql.Tx, id int, roomIDs []int) error {
+	now := time.Now()
+	for _, roomID := range roomIDs {
+		_, err := tx.ExecContext(ctx, "update rooms set room_type_id = $1, updated_at = $2 where id = $3", id, now, roomID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRoomType deletes a room type, its rooms are left without a type. It returns ErrNotFound when no type
+// has the id.
+func (m *postgresDBRepo) DeleteRoomType(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, "delete from room_types where id = $1", id)
+	if err != nil {
+		return err
+	}
+	return affectedOne(result)
+}
+
+// nullID stores the id of an optional row, 0 is null
+func nullID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// GetRoomBySlug returns the room with the slug, with its type, or ErrNotFound
+func (m *postgresDBRepo) GetRoomBySlug(ctx context.Context, slug string) (models.Room, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	room, err := scanRoom(m.DB.QueryRowContext(ctx, `select `+roomColumns+` from `+roomsWithTypes+` where r.slug = $1`, slug))
+	if err == sql.ErrNoRows {
+		return room, repository.ErrNotFound
+	}
+	if err != nil {
+		return room, err
+	}
+	return room, nil
+}
+
+// InsertRoom stores a room after the others and returns its id. It returns ErrDuplicateRoom when another room
+// has the same slug.
+func (m *postgresDBRepo) InsertRoom(ctx context.Context, room models.Room) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var id int
+	query := `
+		insert into rooms (room_name, slug, description, photos, amenities, nightly_rate_cents, weekend_rate_cents,
+			room_type_id, active, position, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, (select coalesce(max(position), 0) + 1 from rooms), $10, $10)
+		returning id
+	`
+	err := m.DB.QueryRowContext(ctx, query, room.RoomName, room.Slug, room.Description, strings.Join(room.Photos, "\n"),
+		strings.Join(room.Amenities, "\n"), room.NightlyRateCents, room.WeekendRateCents, nullID(room.RoomTypeID),
+		room.Active, time.Now()).Scan(&id)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	return id, nil
+}
+
+// UpdateRoom saves a room, its position is changed by ReorderRooms. It returns ErrNotFound when no room has
+// its id and ErrDuplicateRoom when another room has the same slug.
+func (m *postgresDBRepo) UpdateRoom(ctx context.Context, room models.Room) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		update rooms set room_name = $1, slug = $2, description = $3, photos = $4, amenities = $5,
+			nightly_rate_cents = $6, weekend_rate_cents = $7, room_type_id = $8, active = $9, updated_at = $10
+		where id = $11
+	`
+	result, err := m.DB.ExecContext(ctx, query, room.RoomName, room.Slug, room.Description, strings.Join(room.Photos, "\n"),
+		strings.Join(room.Amenities, "\n"), room.NightlyRateCents, room.WeekendRateCents, nullID(room.RoomTypeID),
+		room.Active, time.Now(), room.ID)
+	if err != nil {
+		return translateError(err)
+	}
+	return affectedOne(result)
+}
+
+// SetRoomActive activates or deactivates a room, an inactive room keeps its reservations. It returns
+// ErrNotFound when no room has the id.
+func (m *postgresDBRepo) SetRoomActive(ctx context.Context, id int, active bool) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, "update rooms set active = $1, updated_at = $2 where id = $3", active, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return affectedOne(result)
+}
+
+// ReorderRooms numbers the positions of the rooms with ids from 1 in this order, ids are all the rooms. It
+// returns ErrNotFound when one of the rooms doesn't exist.
+func (m *postgresDBRepo) ReorderRooms(ctx context.Context, ids []int) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, id := range ids {
+		result, err := tx.ExecContext(ctx, "update rooms set position = $1 where id = $2", i+1, id)
+		if err != nil {
+			return err
+		}
+		if err := affectedOne(result); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
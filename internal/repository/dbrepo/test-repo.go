@@ -1,18 +1,47 @@
 package dbrepo
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/repository"
+	"github.com/mrkouhadi/go-booking-app/internal/token"
 )
 
-func (m *testDBRepo) AllUsers() bool {
-	return true
+// AllUsers returns a user for every role
+func (m *testDBRepo) AllUsers(ctx context.Context) ([]models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var users []models.User
+	for id := 1; id <= 4; id++ {
+		u, _ := m.GetUserByID(ctx, id)
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// InsertUser stores a new user, another user already has taken@example.com
+func (m *testDBRepo) InsertUser(ctx context.Context, u models.User, password string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if u.Email == "taken@example.com" {
+		return 0, repository.ErrDuplicateEmail
+	}
+	return 7, nil
 }
 
 // InsertReservation inserts a Reservation into the database
-func (m *testDBRepo) InsertReservation(res models.Reservation) (int, error) {
+func (m *testDBRepo) InsertReservation(ctx context.Context, res models.Reservation) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 
 	// if the room id is 2 then fail otherwise pass
 	if res.RoomId == 2 {
@@ -22,95 +51,549 @@ func (m *testDBRepo) InsertReservation(res models.Reservation) (int, error) {
 }
 
 // InsertRoomRestriction inserts a room restriction into the database
-func (m *testDBRepo) InsertRoomRestriction(res models.RoomRestrictions) error {
+func (m *testDBRepo) InsertRoomRestriction(ctx context.Context, res models.RoomRestrictions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if res.RoomId == 1000000 { //   // giving it imposible data to meet
 		return errors.New("soem error")
 	}
 	return nil
 }
 
+// CreateBooking inserts a reservation, its room restriction and its emails in a single transaction
+func (m *testDBRepo) CreateBooking(ctx context.Context, b models.Booking) (models.Reservation, error) {
+	res := b.Reservation
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	// idempotency keys ending in ":replayed" have already been used for the same booking, which made
+	// reservation 1, and the ones ending in ":reused" for another booking
+	switch {
+	case strings.HasSuffix(b.Idempotency.Key, ":replayed"):
+		original, err := m.GetReservationByID(ctx, 1)
+		if err != nil {
+			return res, err
+		}
+		return original, repository.ErrDuplicateRequest
+	case strings.HasSuffix(b.Idempotency.Key, ":reused"):
+		return res, repository.ErrIdempotencyKeyReused
+	}
+	// room id 2 fails the transaction and 3 has been booked by somebody else in the meantime
+	if res.RoomId == 3 {
+		return res, repository.ErrRoomNotAvailable
+	}
+	if res.RoomId == 2 {
+		return res, errors.New("some error")
+	}
+	res.ID = 1
+	res.Room.ID = res.RoomId
+	if b.Promo != nil {
+		if err := m.redeemPromoCode(*b.Promo, res); err != nil {
+			return res, err
+		}
+	}
+	var invoice *models.Invoice
+	if b.Invoice != nil {
+		inv := *b.Invoice
+		inv.ReservationID = res.ID
+		inv, err := m.IssueInvoice(ctx, inv)
+		if err != nil {
+			return res, err
+		}
+		invoice = &inv
+	}
+	if b.Mail != nil {
+		mails, err := b.Mail(res, invoice)
+		if err != nil {
+			return res, err
+		}
+		for _, msg := range mails {
+			if _, err := m.InsertMail(ctx, msg); err != nil {
+				return res, err
+			}
+		}
+	}
+	if b.Webhooks != nil {
+		webhooks, err := b.Webhooks(res)
+		if err != nil {
+			return res, err
+		}
+		m.queueWebhooks(webhooks)
+	}
+	return res, nil
+}
+
 // SearchAvailabilityByDatesByRoomID returns true if availability exists for roomId, and false if it no availability
-func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time, roomId int) (bool, error) {
+func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(ctx context.Context, start, end time.Time, roomId int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
 	return false, nil
 }
 
-// SearchAvailablityForAllRooms returns a slice of available rooms for given date range
-func (m *testDBRepo) SearchAvailablityForAllRooms(start, end time.Time) ([]models.Room, error) {
+// SearchAvailablityForAllRooms returns the active rooms that can hold a party of guests when the stay starts
+// in February 2050, every room is taken at other dates
+func (m *testDBRepo) SearchAvailablityForAllRooms(ctx context.Context, start, end time.Time, guests int) ([]models.Room, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	var rooms []models.Room
-
+	if start.Year() != 2050 || start.Month() != time.February {
+		return rooms, nil
+	}
+	all, err := m.AllRooms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, room := range all {
+		if room.Active && room.Sleeps(guests) {
+			rooms = append(rooms, room)
+		}
+	}
 	return rooms, nil
 }
 
-// GetRoomById gets a room by id
-func (m *testDBRepo) GetRoomById(id int) (models.Room, error) {
-	var room models.Room
-	if id > 2 {
-		return room, errors.New("an error")
+// GetRoomById gets a room by id, id 1000000 fails
+func (m *testDBRepo) GetRoomById(ctx context.Context, id int) (models.Room, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Room{}, err
+	}
+	if id == 1000000 {
+		return models.Room{}, errors.New("an error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, room := range m.rooms {
+		if room.ID == id {
+			return m.withRoomType(room), nil
+		}
 	}
-	return room, nil
+	return models.Room{}, repository.ErrNotFound
 }
 
-func (m *testDBRepo) GetUserByID(id int) (models.User, error) {
+// GetUserByID returns a user whose access level is its id, from 1 (read-only) to 4 (owner).
+// There is no user with any other id.
+func (m *testDBRepo) GetUserByID(ctx context.Context, id int) (models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return models.User{}, err
+	}
 
+	// users 1 to 4 have the role of their id, 5 is a deactivated owner, 6 an owner who must reset their password
+	// and 7 a front desk user with two-factor authentication, their codes come from TestTOTPSecret
 	var u models.User
+	if id < 1 || id > 7 {
+		return u, errors.New("no such user")
+	}
+	u.ID = id
+	u.FirstName = "Staff"
+	u.LastName = fmt.Sprintf("Member %d", id)
+	u.Email = fmt.Sprintf("staff%d@example.com", id)
+	u.AccessLevel = id
+	u.Active = true
+	switch id {
+	case 5:
+		u.AccessLevel = int(models.RoleOwner)
+		u.Active = false
+	case 6:
+		u.AccessLevel = int(models.RoleOwner)
+		u.PasswordResetRequired = true
+	case 7:
+		u.AccessLevel = int(models.RoleFrontDesk)
+		u.TOTPSecret = TestTOTPSecret
+		u.TOTPEnabled = true
+	}
+	return u, nil
+}
+
+// GetUserByEmail finds the users of GetUserByID by their email, staff1@example.com to staff7@example.com
+func (m *testDBRepo) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return models.User{}, err
+	}
+	if email == "error@example.com" {
+		return models.User{}, errors.New("cannot reach the database")
+	}
+	var id int
+	if _, err := fmt.Sscanf(email, "staff%d@example.com", &id); err != nil {
+		return models.User{}, repository.ErrUserNotFound
+	}
+	u, err := m.GetUserByID(ctx, id)
+	if err != nil {
+		return u, repository.ErrUserNotFound
+	}
 	return u, nil
 }
 
 // UpdateUser edits user's data in the DB
-func (m *testDBRepo) UpdateUser(u models.User) error {
+func (m *testDBRepo) UpdateUser(ctx context.Context, u models.User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if u.Email == "taken@example.com" {
+		return repository.ErrDuplicateEmail
+	}
+	if u.ID == 1000000 {
+		return errors.New("some error")
+	}
+	if u.ID == lastOwnerID && models.Role(u.AccessLevel) != models.RoleOwner {
+		return repository.ErrLastOwner
+	}
+	return nil
+}
+
+// lastOwnerID is the user that stands for the last active owner: it can't be demoted, deactivated or deleted
+const lastOwnerID = 4
+
+// SetUserActive activates or deactivates a user
+func (m *testDBRepo) SetUserActive(ctx context.Context, id int, active bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 1000000 {
+		return errors.New("some error")
+	}
+	if id == lastOwnerID && !active {
+		return repository.ErrLastOwner
+	}
+	return nil
+}
+
+// RequirePasswordReset makes the user choose a new password
+func (m *testDBRepo) RequirePasswordReset(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 1000000 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// UpdatePassword changes the user's password and returns the new session version
+func (m *testDBRepo) UpdatePassword(ctx context.Context, id int, password string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if id == 1000000 {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
 
+// InsertPasswordReset stores a password reset link
+func (m *testDBRepo) InsertPasswordReset(ctx context.Context, reset models.PasswordReset) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ResetPassword accepts the hash of the token "valid-token" only
+func (m *testDBRepo) ResetPassword(ctx context.Context, tokenHash, password string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if tokenHash != token.Hash("valid-token") {
+		return 0, repository.ErrInvalidResetToken
+	}
+	return 1, nil
+}
+
+// DeleteUser deletes a user
+func (m *testDBRepo) DeleteUser(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 1000000 {
+		return errors.New("some error")
+	}
+	if id == lastOwnerID {
+		return repository.ErrLastOwner
+	}
 	return nil
 }
 
 // authenticating a user
-func (m *testDBRepo) Authenticate(email, testPassword string) (int, string, error) {
+func (m *testDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, "", err
+	}
+	switch {
+	case email == "locked@example.com":
+		return 0, "", repository.ErrAccountLocked
+	case email == "inactive@example.com":
+		return 0, "", repository.ErrAccountDisabled
+	case testPassword == "wrong-password":
+		return 0, "", repository.ErrInvalidCredentials
+	case email == "error@example.com":
+		return 0, "", errors.New("cannot reach the database")
+	case email == "staff7@example.com":
+		return 7, "", nil
+	}
 	return 1, "", nil
 }
 
+// InsertLoginAttempt stores a refused login for auditing
+func (m *testDBRepo) InsertLoginAttempt(ctx context.Context, a models.LoginAttempt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// TestTOTPSecret is the two-factor secret of user 7
+const TestTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestRecoveryCode is the only recovery code UseRecoveryCode accepts
+const TestRecoveryCode = "abcde-fghjk"
+
+// EnableTOTP turns on two-factor authentication for a user
+func (m *testDBRepo) EnableTOTP(ctx context.Context, id int, secret string, step int64, recoveryCodeHashes []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 1000000 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// DisableTOTP turns off two-factor authentication for a user
+func (m *testDBRepo) DisableTOTP(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 1000000 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// UseTOTPStep refuses the steps up to 1000, which stand for codes that have already been used
+func (m *testDBRepo) UseTOTPStep(ctx context.Context, id int, step int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if step <= 1000 {
+		return repository.ErrInvalidCode
+	}
+	return nil
+}
+
+// UseRecoveryCode accepts the hash of TestRecoveryCode only and says 2 codes are left
+func (m *testDBRepo) UseRecoveryCode(ctx context.Context, id int, codeHash string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if codeHash != token.Hash(TestRecoveryCode) {
+		return 0, repository.ErrInvalidCode
+	}
+	return 2, nil
+}
+
+// ReplaceRecoveryCodes stores new recovery codes for a user
+func (m *testDBRepo) ReplaceRecoveryCodes(ctx context.Context, id int, codeHashes []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 1000000 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// RecoveryCodesLeft says every user has 10 unused recovery codes
+func (m *testDBRepo) RecoveryCodesLeft(ctx context.Context, id int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return 10, nil
+}
+
+// The API keys GetAPIKeyByHash knows, with ids 1 to 4
+const (
+	TestAPIKeyAvailability = "bk_test0001_availability" // availability:read
+	TestAPIKeyReservations = "bk_test0002_reservations" // reservations:write
+	TestAPIKeyAdmin        = "bk_test0003_admin"        // admin
+	TestAPIKeyRevoked      = "bk_test0004_revoked"      // admin, revoked
+)
+
+// testAPIKeys are the API keys of the test repository
+func testAPIKeys() []models.APIKey {
+	return []models.APIKey{
+		{ID: 1, Name: "availability", Prefix: "bk_test0001", KeyHash: token.Hash(TestAPIKeyAvailability), Scopes: []models.APIScope{models.ScopeReadAvailability}},
+		{ID: 2, Name: "reservations", Prefix: "bk_test0002", KeyHash: token.Hash(TestAPIKeyReservations), Scopes: []models.APIScope{models.ScopeWriteReservations}},
+		{ID: 3, Name: "admin", Prefix: "bk_test0003", KeyHash: token.Hash(TestAPIKeyAdmin), Scopes: []models.APIScope{models.ScopeAdmin}},
+		{ID: 4, Name: "revoked", Prefix: "bk_test0004", KeyHash: token.Hash(TestAPIKeyRevoked), Scopes: []models.APIScope{models.ScopeAdmin}, RevokedAt: time.Now()},
+	}
+}
+
+// InsertAPIKey stores a new API key and returns its id
+func (m *testDBRepo) InsertAPIKey(ctx context.Context, key models.APIKey) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return 5, nil
+}
+
+// AllAPIKeys returns every API key
+func (m *testDBRepo) AllAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return testAPIKeys(), nil
+}
+
+// GetAPIKeyByHash returns the API key with the hash, revoked or not, or ErrNotFound
+func (m *testDBRepo) GetAPIKeyByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return models.APIKey{}, err
+	}
+	for _, k := range testAPIKeys() {
+		if k.KeyHash == keyHash {
+			return k, nil
+		}
+	}
+	return models.APIKey{}, repository.ErrNotFound
+}
+
+// RevokeAPIKey stops an API key from working, key 4 already is revoked and 1000000 fails
+func (m *testDBRepo) RevokeAPIKey(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 1000000 {
+		return errors.New("some error")
+	}
+	if id < 1 || id > 3 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+// TouchAPIKey records when an API key was used
+func (m *testDBRepo) TouchAPIKey(ctx context.Context, id int, usedAt time.Time) error {
+	return ctx.Err()
+}
+
 // AllReservations returns a slice of all reservations
 
-func (m *testDBRepo) AllReservations() ([]models.Reservation, error) {
+func (m *testDBRepo) AllReservations(ctx context.Context) ([]models.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	var reservations []models.Reservation
 	return reservations, nil
 }
 
 // AllNewReservations
-func (m *testDBRepo) AllNewReservations() ([]models.Reservation, error) {
+func (m *testDBRepo) AllNewReservations(ctx context.Context) ([]models.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	var reservations []models.Reservation
 
 	return reservations, nil
 }
 
-func (m *testDBRepo) GetReservationByID(id int) (models.Reservation, error) {
+// GetReservationByID returns a reservation of room 1 for ids up to 100, 1000000 fails and there are no others
+func (m *testDBRepo) GetReservationByID(ctx context.Context, id int) (models.Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Reservation{}, err
+	}
 
 	var res models.Reservation
-
+	if id == 1000000 {
+		return res, errors.New("some error")
+	}
+	if id > 100 {
+		return res, repository.ErrNotFound
+	}
+	res.ID = id
+	res.FirstName = "Jane"
+	res.LastName = "Doe"
+	res.Email = "jane@example.com"
+	res.Phone = "555-0100"
+	res.StartDate = time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+	res.EndDate = time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC)
+	res.RoomId = 1
+	res.Room = models.Room{ID: 1, RoomName: "Room 1", NightlyRateCents: 10000, WeekendRateCents: 12000}
+	// a Saturday and a Sunday night
+	res.TotalCents = 22000
+	res.Currency = "USD"
 	return res, nil
 
 }
 
-func (m *testDBRepo) UpdateReservation(res models.Reservation) error {
+// UpdateReservation knows the reservations of GetReservationByID
+func (m *testDBRepo) UpdateReservation(ctx context.Context, res models.Reservation, webhooks []models.WebhookMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if res.ID == 1000000 {
+		return errors.New("some error")
+	}
+	if res.ID > 100 {
+		return repository.ErrNotFound
+	}
+	m.queueWebhooks(webhooks)
 	return nil
 }
 
-func (m *testDBRepo) DeleteReservation(id int) error {
+// DeleteReservation knows the reservations of GetReservationByID
+func (m *testDBRepo) DeleteReservation(ctx context.Context, id int, webhooks []models.WebhookMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 1000000 {
+		return errors.New("some error")
+	}
+	if id > 100 {
+		return repository.ErrNotFound
+	}
+	m.mu.Lock()
+	if m.deleted == nil {
+		m.deleted = make(map[int]bool)
+	}
+	m.deleted[id] = true
+	m.mu.Unlock()
+	m.queueWebhooks(webhooks)
 	return nil
 }
 
-func (m *testDBRepo) UpdateProcessedForReservation(id, processed int) error {
+func (m *testDBRepo) UpdateProcessedForReservation(ctx context.Context, id, processed int, webhooks []models.WebhookMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
+	m.queueWebhooks(webhooks)
 	return nil
 }
 
-func (m *testDBRepo) AllRooms() ([]models.Room, error) {
-	var rooms []models.Room
+// AllRooms returns the rooms by position, with their type
+func (m *testDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var rooms []models.Room
+	for _, room := range m.rooms {
+		rooms = append(rooms, m.withRoomType(room))
+	}
+	sort.SliceStable(rooms, func(i, j int) bool { return rooms[i].Position < rooms[j].Position })
 	return rooms, nil
 }
 
-func (m *testDBRepo) GetRestrictionsFoorRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestrictions, error) {
+func (m *testDBRepo) GetRestrictionsFoorRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestrictions, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	var restrictions []models.RoomRestrictions
 
@@ -118,13 +601,1110 @@ func (m *testDBRepo) GetRestrictionsFoorRoomByDate(roomID int, start, end time.T
 }
 
 // InsertBlockForRoom inserts a room restriction
-func (m *testDBRepo) InsertBlockForRoom(id int, startdate time.Time) error {
+func (m *testDBRepo) InsertBlockForRoom(ctx context.Context, id int, startdate time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
 // DeleteBlockByID deletes a room restriction
-func (m *testDBRepo) DeleteBlockByID(id int) error {
+func (m *testDBRepo) DeleteBlockByID(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InsertMail puts an email in the outbox, an email to fail@example.com can't be stored
+func (m *testDBRepo) InsertMail(ctx context.Context, msg models.MailData) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if msg.To == "fail@example.com" {
+		return 0, errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	mail := models.OutboxMail{
+		ID:            len(m.outbox) + 1,
+		MailData:      msg,
+		Status:        models.MailPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	m.outbox = append(m.outbox, mail)
+	return mail.ID, nil
+}
+
+// ClaimMail hands up to limit emails that are due to the calling worker
+func (m *testDBRepo) ClaimMail(ctx context.Context, limit int, lease time.Duration) ([]models.OutboxMail, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var mails []models.OutboxMail
+	now := time.Now()
+	for i := range m.outbox {
+		if len(mails) == limit {
+			break
+		}
+		mail := &m.outbox[i]
+		if mail.Status != models.MailPending && mail.Status != models.MailSending {
+			continue
+		}
+		if mail.NextAttemptAt.After(now) {
+			continue
+		}
+		mail.Status = models.MailSending
+		mail.Attempts++
+		mail.NextAttemptAt = now.Add(lease)
+		mails = append(mails, *mail)
+	}
+	return mails, nil
+}
+
+// MarkMailSent records that an email has been delivered
+func (m *testDBRepo) MarkMailSent(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mail, err := m.outboxMail(id)
+	if err != nil {
+		return err
+	}
+	mail.Status = models.MailSent
+	mail.SentAt = time.Now()
+	mail.LastError = ""
+	return nil
+}
+
+// MarkMailFailed records a failed attempt
+func (m *testDBRepo) MarkMailFailed(ctx context.Context, id int, reason string, retryAt time.Time, dead bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mail, err := m.outboxMail(id)
+	if err != nil {
+		return err
+	}
+	mail.Status = models.MailPending
+	if dead {
+		mail.Status = models.MailDead
+	}
+	mail.LastError = reason
+	mail.NextAttemptAt = retryAt
+	return nil
+}
+
+// AllFailedMail returns the dead emails and the ones waiting to be retried
+func (m *testDBRepo) AllFailedMail(ctx context.Context) ([]models.OutboxMail, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var mails []models.OutboxMail
+	for _, mail := range m.outbox {
+		if mail.Status == models.MailDead || (mail.Status == models.MailPending && mail.Attempts > 0) {
+			mails = append(mails, mail)
+		}
+	}
+	return mails, nil
+}
+
+// RetryMail puts a failed email back in the queue, id 1000000 fails
+func (m *testDBRepo) RetryMail(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 1000000 {
+		return errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mail, err := m.outboxMail(id)
+	if err != nil {
+		return repository.ErrNotFound
+	}
+	failed := mail.Status == models.MailDead || (mail.Status == models.MailPending && mail.Attempts > 0)
+	if !failed {
+		return repository.ErrNotFound
+	}
+	mail.Status = models.MailPending
+	mail.Attempts = 0
+	mail.NextAttemptAt = time.Now()
+	return nil
+}
+
+// outboxMail finds an email of the outbox, m.mu must be held
+func (m *testDBRepo) outboxMail(id int) (*models.OutboxMail, error) {
+	for i := range m.outbox {
+		if m.outbox[i].ID == id {
+			return &m.outbox[i], nil
+		}
+	}
+	return nil, errors.New("no such mail")
+}
+
+// TestWebhookSecret is the secret of webhook endpoint 1 of the test repository
+const TestWebhookSecret = "whsec_test0001"
+
+// testWebhookEndpoints are the webhook endpoints a new test repository starts with
+func testWebhookEndpoints() []models.WebhookEndpoint {
+	return []models.WebhookEndpoint{
+		{ID: 1, URL: "https://accounting.example.com/hooks", Description: "accounting", Secret: TestWebhookSecret, Events: models.WebhookEvents, Active: true},
+	}
+}
+
+// AllWebhookEndpoints returns every webhook endpoint
+func (m *testDBRepo) AllWebhookEndpoints(ctx context.Context) ([]models.WebhookEndpoint, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]models.WebhookEndpoint(nil), m.webhooks...), nil
+}
+
+// GetWebhookEndpoint returns the webhook endpoint with the id or ErrNotFound, id 1000000 fails
+func (m *testDBRepo) GetWebhookEndpoint(ctx context.Context, id int) (models.WebhookEndpoint, error) {
+	if err := ctx.Err(); err != nil {
+		return models.WebhookEndpoint{}, err
+	}
+	if id == 1000000 {
+		return models.WebhookEndpoint{}, errors.New("some error")
+	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, err := m.webhookEndpoint(id)
+	if err != nil {
+		return models.WebhookEndpoint{}, err
+	}
+	return *e, nil
+}
+
+// InsertWebhookEndpoint stores a new webhook endpoint and returns its id
+func (m *testDBRepo) InsertWebhookEndpoint(ctx context.Context, e models.WebhookEndpoint) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e.ID = 1
+	if n := len(m.webhooks); n > 0 {
+		e.ID = m.webhooks[n-1].ID + 1
+	}
+	e.CreatedAt = time.Now()
+	e.UpdatedAt = e.CreatedAt
+	m.webhooks = append(m.webhooks, e)
+	return e.ID, nil
+}
+
+// UpdateWebhookEndpoint changes an endpoint but keeps its secret, id 1000000 fails
+func (m *testDBRepo) UpdateWebhookEndpoint(ctx context.Context, e models.WebhookEndpoint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if e.ID == 1000000 {
+		return errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, err := m.webhookEndpoint(e.ID)
+	if err != nil {
+		return err
+	}
+	stored.URL = e.URL
+	stored.Description = e.Description
+	stored.Events = e.Events
+	stored.Active = e.Active
+	stored.UpdatedAt = time.Now()
+	return nil
+}
+
+// DeleteWebhookEndpoint deletes an endpoint and its deliveries, id 1000000 fails
+func (m *testDBRepo) DeleteWebhookEndpoint(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 1000000 {
+		return errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.webhookEndpoint(id); err != nil {
+		return err
+	}
+	var endpoints []models.WebhookEndpoint
+	for _, e := range m.webhooks {
+		if e.ID != id {
+			endpoints = append(endpoints, e)
+		}
+	}
+	m.webhooks = endpoints
+	var deliveries []models.WebhookDelivery
+	for _, d := range m.deliveries {
+		if d.EndpointID != id {
+			deliveries = append(deliveries, d)
+		}
+	}
+	m.deliveries = deliveries
+	return nil
+}
+
+// QueueWebhook queues a delivery to every active endpoint subscribed to the event
+func (m *testDBRepo) QueueWebhook(ctx context.Context, event models.WebhookEvent, payload []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.queueWebhook(models.WebhookMessage{Event: event, Payload: payload}), nil
+}
+
+// queueWebhooks queues the webhooks of a change, they are lost when it fails like in a rolled back transaction
+func (m *testDBRepo) queueWebhooks(webhooks []models.WebhookMessage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, w := range webhooks {
+		m.queueWebhook(w)
+	}
+}
+
+// queueWebhook queues w for every active endpoint subscribed to its event, m.mu must be held
+func (m *testDBRepo) queueWebhook(w models.WebhookMessage) int {
+	queued := 0
+	now := time.Now()
+	for _, e := range m.webhooks {
+		if !e.Active || !e.Subscribed(w.Event) {
+			continue
+		}
+		m.deliveries = append(m.deliveries, models.WebhookDelivery{
+			ID:            len(m.deliveries) + 1,
+			EndpointID:    e.ID,
+			URL:           e.URL,
+			Secret:        e.Secret,
+			Event:         w.Event,
+			Payload:       w.Payload,
+			Status:        models.WebhookPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		})
+		queued++
+	}
+	return queued
+}
+
+// ClaimWebhooks hands up to limit deliveries that are due to the calling worker
+func (m *testDBRepo) ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deliveries []models.WebhookDelivery
+	now := time.Now()
+	for i := range m.deliveries {
+		if len(deliveries) == limit {
+			break
+		}
+		d := &m.deliveries[i]
+		if d.Status != models.WebhookPending && d.Status != models.WebhookSending {
+			continue
+		}
+		if d.NextAttemptAt.After(now) {
+			continue
+		}
+		d.Status = models.WebhookSending
+		d.Attempts++
+		d.NextAttemptAt = now.Add(lease)
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, nil
+}
+
+// MarkWebhookDelivered records that the endpoint accepted a delivery
+func (m *testDBRepo) MarkWebhookDelivered(ctx context.Context, id, responseStatus int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, err := m.webhookDelivery(id)
+	if err != nil {
+		return err
+	}
+	d.Status = models.WebhookDelivered
+	d.ResponseStatus = responseStatus
+	d.LastError = ""
+	d.DeliveredAt = time.Now()
+	return nil
+}
+
+// MarkWebhookFailed records a failed attempt
+func (m *testDBRepo) MarkWebhookFailed(ctx context.Context, id, responseStatus int, reason string, retryAt time.Time, dead bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, err := m.webhookDelivery(id)
+	if err != nil {
+		return err
+	}
+	d.Status = models.WebhookPending
+	if dead {
+		d.Status = models.WebhookDead
+	}
+	d.ResponseStatus = responseStatus
+	d.LastError = reason
+	d.NextAttemptAt = retryAt
+	return nil
+}
+
+// RecentWebhookDeliveries returns the last limit deliveries, newest first
+func (m *testDBRepo) RecentWebhookDeliveries(ctx context.Context, limit int) ([]models.WebhookDelivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deliveries []models.WebhookDelivery
+	for i := len(m.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		deliveries = append(deliveries, m.deliveries[i])
+	}
+	return deliveries, nil
+}
+
+// RedeliverWebhook queues a delivery again, id 1000000 fails
+func (m *testDBRepo) RedeliverWebhook(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 1000000 {
+		return errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, err := m.webhookDelivery(id)
+	if err != nil || d.Status == models.WebhookSending {
+		return repository.ErrNotFound
+	}
+	d.Status = models.WebhookPending
+	d.Attempts = 0
+	d.NextAttemptAt = time.Now()
+	d.DeliveredAt = time.Time{}
+	return nil
+}
+
+// webhookEndpoint finds a webhook endpoint, m.mu must be held
+func (m *testDBRepo) webhookEndpoint(id int) (*models.WebhookEndpoint, error) {
+	for i := range m.webhooks {
+		if m.webhooks[i].ID == id {
+			return &m.webhooks[i], nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+// webhookDelivery finds a webhook delivery, m.mu must be held
+func (m *testDBRepo) webhookDelivery(id int) (*models.WebhookDelivery, error) {
+	for i := range m.deliveries {
+		if m.deliveries[i].ID == id {
+			return &m.deliveries[i], nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+// SeasonalRates returns the seasons of testSeasonalRates that cover some of the nights, room 1000000 fails
+func (m *testDBRepo) SeasonalRates(ctx context.Context, roomID int, start, end time.Time) ([]models.SeasonalRate, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if roomID == 1000000 {
+		return nil, errors.New("some error")
+	}
+	var seasons []models.SeasonalRate
+	for _, s := range testSeasonalRates() {
+		if (s.RoomID == 0 || s.RoomID == roomID) && start.Before(s.EndDate) && end.After(s.StartDate) {
+			seasons = append(seasons, s)
+		}
+	}
+	return seasons, nil
+}
+
+// testSeasonalRates are a summer season for room 1 and a christmas season for every room
+func testSeasonalRates() []models.SeasonalRate {
+	return []models.SeasonalRate{
+		{ID: 1, RoomID: 1, Name: "Summer", StartDate: time.Date(2050, 7, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2050, 9, 1, 0, 0, 0, 0, time.UTC), NightlyRateCents: 15000, WeekendRateCents: 18000},
+		{ID: 2, Name: "Christmas", StartDate: time.Date(2050, 12, 20, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2051, 1, 2, 0, 0, 0, 0, time.UTC), NightlyRateCents: 30000},
+	}
+}
+
+// StayDiscounts takes 10% off stays of a week and 20% off stays of four weeks
+func (m *testDBRepo) StayDiscounts(ctx context.Context) ([]models.StayDiscount, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return []models.StayDiscount{
+		{ID: 1, MinNights: 7, Percent: 10},
+		{ID: 2, MinNights: 28, Percent: 20},
+	}, nil
+}
+
+// AllCharges returns a cleaning fee, a resort fee, VAT and a city tax
+func (m *testDBRepo) AllCharges(ctx context.Context) ([]models.Charge, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return []models.Charge{
+		{ID: 1, Name: "Cleaning", Kind: models.ChargeFeePerStay, AmountCents: 5000, Position: 1},
+		{ID: 2, Name: "Resort fee", Kind: models.ChargeFeePerNight, AmountCents: 1500, Position: 2},
+		{ID: 3, Name: "VAT", Kind: models.ChargeTaxPercent, RateBasisPoints: 1000, Position: 1},
+		{ID: 4, Name: "City tax", Kind: models.ChargeTaxPerNight, AmountCents: 250, Position: 2},
+	}, nil
+}
+
+// IssueInvoice numbers and keeps the invoice of a reservation, or returns the one it already has.
+// Reservation 1000000 fails.
+func (m *testDBRepo) IssueInvoice(ctx context.Context, inv models.Invoice) (models.Invoice, error) {
+	if err := ctx.Err(); err != nil {
+		return inv, err
+	}
+	if inv.ReservationID == 1000000 {
+		return inv, errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, issued := range m.invoices {
+		if issued.ReservationID == inv.ReservationID {
+			return issued, nil
+		}
+	}
+	inv.ID = len(m.invoices) + 1
+	inv.Number = fmt.Sprintf("%s%06d", m.App.Invoice.Prefix, inv.ID)
+	inv.IssuedAt = time.Now()
+	inv.Lines = append([]models.InvoiceLine(nil), inv.Lines...)
+	for i := range inv.Lines {
+		inv.Lines[i].ID = i + 1
+	}
+	m.invoices = append(m.invoices, inv)
+	return inv, nil
+}
+
+// GetInvoiceByReservationID returns the invoice issued for a reservation, reservation 1000000 fails
+func (m *testDBRepo) GetInvoiceByReservationID(ctx context.Context, reservationID int) (models.Invoice, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Invoice{}, err
+	}
+	if reservationID == 1000000 {
+		return models.Invoice{}, errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, inv := range m.invoices {
+		if inv.ReservationID == reservationID {
+			return inv, nil
+		}
+	}
+	return models.Invoice{}, repository.ErrNotFound
+}
+
+// TestPromoCodeTaken is a promo code the guests can redeem, but whose last use is taken by another booking
+// while theirs is being made
+const TestPromoCodeTaken = "LASTONE"
+
+// testPromoCodes are the promo codes a new test repository starts with: 10% off, 50.00 off once per guest,
+// 20% off 3 nights or more in room 2, an expired, a used up and a deactivated code, and TestPromoCodeTaken
+func testPromoCodes() []models.PromoCode {
+	return []models.PromoCode{
+		{ID: 1, Code: "SUMMER10", Description: "Summer campaign", Kind: models.PromoPercent, Percent: 10, Active: true},
+		{ID: 2, Code: "WELCOME", Kind: models.PromoFixed, AmountCents: 5000, MaxUsesPerGuest: 1, Active: true},
+		{ID: 3, Code: "SUITE", Kind: models.PromoPercent, Percent: 20, RoomIDs: []int{2}, MinNights: 3, Active: true},
+		{ID: 4, Code: "EXPIRED", Kind: models.PromoPercent, Percent: 10, ValidUntil: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Active: true},
+		{ID: 5, Code: "USEDUP", Kind: models.PromoFixed, AmountCents: 1000, MaxUses: 1, Active: true},
+		{ID: 6, Code: "OLD", Kind: models.PromoPercent, Percent: 10},
+		{ID: 7, Code: TestPromoCodeTaken, Kind: models.PromoPercent, Percent: 50, MaxUses: 1, Active: true},
+	}
+}
+
+// testPromoRedemptions are the redemptions a new test repository starts with: USEDUP has been used, and
+// WELCOME by used@example.com
+func testPromoRedemptions() []models.PromoRedemption {
+	return []models.PromoRedemption{
+		{ID: 1, PromoCodeID: 5, Code: "USEDUP", ReservationID: 2, GuestEmail: "jane@example.com", DiscountCents: 1000, Currency: "USD"},
+		{ID: 2, PromoCodeID: 2, Code: "WELCOME", ReservationID: 3, GuestEmail: "used@example.com", DiscountCents: 5000, Currency: "USD"},
+	}
+}
+
+// redeemPromoCode records the redemption of p by res, checking the usage limits again like the database does
+func (m *testDBRepo) redeemPromoCode(p models.PromoCode, res models.Reservation) error {
+	if p.Code == TestPromoCodeTaken {
+		return repository.ErrPromoCodeUnavailable
+	}
+	email := strings.ToLower(strings.TrimSpace(res.Email))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, err := m.promoCode(p.ID)
+	if err != nil || !stored.Active {
+		return repository.ErrPromoCodeUnavailable
+	}
+	total, guest := m.promoCodeUses(p.ID, email)
+	if (stored.MaxUses > 0 && total >= stored.MaxUses) || (stored.MaxUsesPerGuest > 0 && guest >= stored.MaxUsesPerGuest) {
+		return repository.ErrPromoCodeUnavailable
+	}
+	m.redemptions = append(m.redemptions, models.PromoRedemption{
+		ID:            len(m.redemptions) + 1,
+		PromoCodeID:   p.ID,
+		Code:          p.Code,
+		ReservationID: res.ID,
+		GuestEmail:    email,
+		DiscountCents: res.PromoCents,
+		Currency:      res.Currency,
+		CreatedAt:     time.Now(),
+	})
+	return nil
+}
+
+// promoCode returns the stored promo code with id, the caller holds m.mu
+func (m *testDBRepo) promoCode(id int) (*models.PromoCode, error) {
+	for i := range m.promoCodes {
+		if m.promoCodes[i].ID == id {
+			return &m.promoCodes[i], nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+// promoCodeUses counts the redemptions of the code with id, by all guests and by email, the caller holds m.mu
+func (m *testDBRepo) promoCodeUses(id int, email string) (int, int) {
+	var total, guest int
+	for _, r := range m.redemptions {
+		// the redemptions of deleted reservations don't use up the code
+		if r.PromoCodeID == id && !m.deleted[r.ReservationID] {
+			total++
+			if r.GuestEmail == email {
+				guest++
+			}
+		}
+	}
+	return total, guest
+}
+
+// AllPromoCodes returns the promo codes by code, with what they have been redeemed for
+func (m *testDBRepo) AllPromoCodes(ctx context.Context) ([]models.PromoCode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	codes := append([]models.PromoCode(nil), m.promoCodes...)
+	for i := range codes {
+		for _, r := range m.redemptions {
+			if r.PromoCodeID == codes[i].ID {
+				codes[i].Uses++
+				codes[i].RedeemedCents += r.DiscountCents
+			}
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i].Code < codes[j].Code })
+	return codes, nil
+}
+
+// GetPromoCodeByID returns the promo code with the id or ErrNotFound, id 1000000 fails
+func (m *testDBRepo) GetPromoCodeByID(ctx context.Context, id int) (models.PromoCode, error) {
+	if err := ctx.Err(); err != nil {
+		return models.PromoCode{}, err
+	}
+	if id == 1000000 {
+		return models.PromoCode{}, errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, err := m.promoCode(id)
+	if err != nil {
+		return models.PromoCode{}, err
+	}
+	return *p, nil
+}
+
+// GetPromoCodeByCode returns the promo code with the code or ErrNotFound, the code BROKEN fails
+func (m *testDBRepo) GetPromoCodeByCode(ctx context.Context, code string) (models.PromoCode, error) {
+	if err := ctx.Err(); err != nil {
+		return models.PromoCode{}, err
+	}
+	if code == "BROKEN" {
+		return models.PromoCode{}, errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.promoCodes {
+		if p.Code == code {
+			return p, nil
+		}
+	}
+	return models.PromoCode{}, repository.ErrNotFound
+}
+
+// InsertPromoCode keeps a promo code and returns its id, the code BROKEN fails
+func (m *testDBRepo) InsertPromoCode(ctx context.Context, p models.PromoCode) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if p.Code == "BROKEN" {
+		return 0, errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, other := range m.promoCodes {
+		if other.Code == p.Code {
+			return 0, repository.ErrDuplicatePromoCode
+		}
+	}
+	p.ID = 1
+	if n := len(m.promoCodes); n > 0 {
+		p.ID = m.promoCodes[n-1].ID + 1
+	}
+	p.CreatedAt = time.Now()
+	p.UpdatedAt = p.CreatedAt
+	m.promoCodes = append(m.promoCodes, p)
+	return p.ID, nil
+}
+
+// UpdatePromoCode changes a promo code, id 1000000 fails
+func (m *testDBRepo) UpdatePromoCode(ctx context.Context, p models.PromoCode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if p.ID == 1000000 {
+		return errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, other := range m.promoCodes {
+		if other.Code == p.Code && other.ID != p.ID {
+			return repository.ErrDuplicatePromoCode
+		}
+	}
+	stored, err := m.promoCode(p.ID)
+	if err != nil {
+		return err
+	}
+	p.CreatedAt = stored.CreatedAt
+	p.UpdatedAt = time.Now()
+	*stored = p
+	return nil
+}
+
+// DeletePromoCode deletes a promo code that has never been redeemed, id 1000000 fails
+func (m *testDBRepo) DeletePromoCode(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 1000000 {
+		return errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.promoCode(id); err != nil {
+		return err
+	}
+	if total, _ := m.promoCodeUses(id, ""); total > 0 {
+		return repository.ErrPromoCodeRedeemed
+	}
+	for i, p := range m.promoCodes {
+		if p.ID == id {
+			m.promoCodes = append(m.promoCodes[:i], m.promoCodes[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// PromoCodeUses counts the redemptions of a promo code, by all guests and by the guest with email
+func (m *testDBRepo) PromoCodeUses(ctx context.Context, id int, email string) (int, int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	total, guest := m.promoCodeUses(id, strings.ToLower(strings.TrimSpace(email)))
+	return total, guest, nil
+}
+
+// PromoRedemptions returns the latest limit redemptions, the latest first
+func (m *testDBRepo) PromoRedemptions(ctx context.Context, limit int) ([]models.PromoRedemption, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var redemptions []models.PromoRedemption
+	for i := len(m.redemptions) - 1; i >= 0 && len(redemptions) < limit; i-- {
+		redemptions = append(redemptions, m.redemptions[i])
+	}
+	return redemptions, nil
+}
+
+// testRoomTypes are the room types a new test repository starts with: room 1 sleeps 2 and room 2 sleeps 4
+func testRoomTypes() []models.RoomType {
+	return []models.RoomType{
+		{ID: 1, Name: "Quarters", MaxOccupancy: 2, Beds: "1 double bed", Amenities: []string{"Wi-Fi", "Desk"}, RoomIDs: []int{1}},
+		{ID: 2, Name: "Suite", MaxOccupancy: 4, Beds: "1 king bed and 1 sofa bed", Amenities: []string{"Wi-Fi", "Kitchenette"}, RoomIDs: []int{2}},
+	}
+}
+
+// roomType returns the stored room type with id, the caller holds m.mu
+func (m *testDBRepo) roomType(id int) (*models.RoomType, error) {
+	for i := range m.roomTypes {
+		if m.roomTypes[i].ID == id {
+			return &m.roomTypes[i], nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+// keepRoomType stores t, moving its rooms away from the other types, the caller holds m.mu
+func (m *testDBRepo) keepRoomType(t models.RoomType) error {
+	for _, other := range m.roomTypes {
+		if other.Name == t.Name && other.ID != t.ID {
+			return repository.ErrDuplicateRoomType
+		}
+	}
+	for i := range m.roomTypes {
+		var kept []int
+		for _, roomID := range m.roomTypes[i].RoomIDs {
+			moved := false
+			for _, id := range t.RoomIDs {
+				moved = moved || id == roomID
+			}
+			if !moved {
+				kept = append(kept, roomID)
+			}
+		}
+		m.roomTypes[i].RoomIDs = kept
+	}
+	if stored, err := m.roomType(t.ID); err == nil {
+		t.CreatedAt = stored.CreatedAt
+		t.UpdatedAt = time.Now()
+		*stored = t
+		return nil
+	}
+	t.CreatedAt = time.Now()
+	t.UpdatedAt = t.CreatedAt
+	m.roomTypes = append(m.roomTypes, t)
+	return nil
+}
+
+// AllRoomTypes returns the room types by name
+func (m *testDBRepo) AllRoomTypes(ctx context.Context) ([]models.RoomType, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	types := append([]models.RoomType(nil), m.roomTypes...)
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return types, nil
+}
+
+// GetRoomTypeByID returns the room type with the id or ErrNotFound, id 1000000 fails
+func (m *testDBRepo) GetRoomTypeByID(ctx context.Context, id int) (models.RoomType, error) {
+	if err := ctx.Err(); err != nil {
+		return models.RoomType{}, err
+	}
+	if id == 1000000 {
+		return models.RoomType{}, errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, err := m.roomType(id)
+	if err != nil {
+		return models.RoomType{}, err
+	}
+	return *t, nil
+}
+
+// InsertRoomType keeps a room type and returns its id, the name Broken fails
+func (m *testDBRepo) InsertRoomType(ctx context.Context, t models.RoomType) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if t.Name == "Broken" {
+		return 0, errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t.ID = 1
+	if n := len(m.roomTypes); n > 0 {
+		t.ID = m.roomTypes[n-1].ID + 1
+	}
+	if err := m.keepRoomType(t); err != nil {
+		return 0, err
+	}
+	return t.ID, nil
+}
+
+// UpdateRoomType changes a room type, id 1000000 fails
+func (m *testDBRepo) UpdateRoomType(ctx context.Context, t models.RoomType) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if t.ID == 1000000 {
+		return errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.roomType(t.ID); err != nil {
+		return err
+	}
+	return m.keepRoomType(t)
+}
+
+// DeleteRoomType deletes a room type, its rooms are left without a type. Id 1000000 fails.
+func (m *testDBRepo) DeleteRoomType(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 1000000 {
+		return errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, t := range m.roomTypes {
+		if t.ID == id {
+			m.roomTypes = append(m.roomTypes[:i], m.roomTypes[i+1:]...)
+			return nil
+		}
+	}
+	return repository.ErrNotFound
+}
+
+// testRooms are the rooms of the test repository. Room 1 costs 100.00 a night and 120.00 on Fridays and
+// Saturdays, the others 100.00 more per room number every night of the week. Room 1 sleeps 2 guests, room 2
+// sleeps 4, room 3 has no type and room 4 is inactive.
+func testRooms() []models.Room {
+	var rooms []models.Room
+	for id := 1; id <= 4; id++ {
+		rooms = append(rooms, models.Room{
+			ID:               id,
+			RoomName:         fmt.Sprintf("Room %d", id),
+			Slug:             fmt.Sprintf("room-%d", id),
+			Description:      fmt.Sprintf("The room number %d", id),
+			Photos:           []string{"/static/images/generals.jpeg"},
+			NightlyRateCents: id * 10000,
+			Active:           id != 4,
+			Position:         id,
+		})
+	}
+	rooms[0].WeekendRateCents = 12000
+	rooms[0].Amenities = []string{"Sea view"}
+	return rooms
+}
+
+// withRoomType returns room with its type, the caller holds m.mu
+func (m *testDBRepo) withRoomType(room models.Room) models.Room {
+	room.RoomTypeID, room.RoomType = 0, models.RoomType{}
+	for _, t := range m.roomTypes {
+		for _, roomID := range t.RoomIDs {
+			if roomID == room.ID {
+				room.RoomTypeID, room.RoomType = t.ID, t
+			}
+		}
+	}
+	return room
+}
+
+// keepRoom stores room and moves it to its type, the caller holds m.mu
+func (m *testDBRepo) keepRoom(room models.Room) error {
+	stored := -1
+	for i, other := range m.rooms {
+		if other.ID == room.ID {
+			stored = i
+		} else if other.Slug == room.Slug {
+			return repository.ErrDuplicateRoom
+		}
+	}
+	for i := range m.roomTypes {
+		var kept []int
+		for _, id := range m.roomTypes[i].RoomIDs {
+			if id != room.ID {
+				kept = append(kept, id)
+			}
+		}
+		if m.roomTypes[i].ID == room.RoomTypeID {
+			kept = append(kept, room.ID)
+		}
+		m.roomTypes[i].RoomIDs = kept
+	}
+	room.RoomType = models.RoomType{}
+	if stored < 0 {
+		room.CreatedAt = time.Now()
+		room.UpdatedAt = room.CreatedAt
+		m.rooms = append(m.rooms, room)
+		return nil
+	}
+	room.CreatedAt = m.rooms[stored].CreatedAt
+	room.UpdatedAt = time.Now()
+	m.rooms[stored] = room
+	return nil
+}
+
+// GetRoomBySlug returns the room with the slug or ErrNotFound, the slug broken fails
+func (m *testDBRepo) GetRoomBySlug(ctx context.Context, slug string) (models.Room, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Room{}, err
+	}
+	if slug == "broken" {
+		return models.Room{}, errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, room := range m.rooms {
+		if room.Slug == slug {
+			return m.withRoomType(room), nil
+		}
+	}
+	return models.Room{}, repository.ErrNotFound
+}
+
+// InsertRoom keeps a room after the others and returns its id, the name Broken fails
+func (m *testDBRepo) InsertRoom(ctx context.Context, room models.Room) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if room.RoomName == "Broken" {
+		return 0, errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room.ID, room.Position = 1, 1
+	for _, other := range m.rooms {
+		if other.ID >= room.ID {
+			room.ID = other.ID + 1
+		}
+		if other.Position >= room.Position {
+			room.Position = other.Position + 1
+		}
+	}
+	if err := m.keepRoom(room); err != nil {
+		return 0, err
+	}
+	return room.ID, nil
+}
+
+// UpdateRoom changes a room but not its position, id 1000000 fails
+func (m *testDBRepo) UpdateRoom(ctx context.Context, room models.Room) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if room.ID == 1000000 {
+		return errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, stored := range m.rooms {
+		if stored.ID == room.ID {
+			room.Position = stored.Position
+			return m.keepRoom(room)
+		}
+	}
+	return repository.ErrNotFound
+}
+
+// SetRoomActive activates or deactivates a room, id 1000000 fails
+func (m *testDBRepo) SetRoomActive(ctx context.Context, id int, active bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 1000000 {
+		return errors.New("some error")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.rooms {
+		if m.rooms[i].ID == id {
+			m.rooms[i].Active = active
+			m.rooms[i].UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return repository.ErrNotFound
+}
+
+// ReorderRooms numbers the positions of the rooms with ids from 1 in this order, id 1000000 fails
+func (m *testDBRepo) ReorderRooms(ctx context.Context, ids []int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	positions := make(map[int]int)
+	for i, id := range ids {
+		if id == 1000000 {
+			return errors.New("some error")
+		}
+		positions[id] = i + 1
+	}
+	found := 0
+	for i := range m.rooms {
+		if position, ok := positions[m.rooms[i].ID]; ok {
+			m.rooms[i].Position = position
+			found++
+		}
+	}
+	if found != len(positions) {
+		return repository.ErrNotFound
+	}
 	return nil
 }
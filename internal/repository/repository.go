@@ -1,29 +1,154 @@
 package repository
 
 import (
+	"context"
+	"errors"
 	"time"
 
 	"github.com/mrkouhadi/go-booking-app/internal/models"
 )
 
+// ErrRoomNotAvailable is returned when a room is already booked or blocked for some of the requested dates
+var ErrRoomNotAvailable = errors.New("room is no longer available for the chosen dates")
+
+// ErrNotFound is returned when the room, the room type, the reservation, the invoice, the promo code, the API key
+// or the webhook asked for doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// ErrInvalidCredentials is returned by Authenticate when no user has the email or the password is wrong
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrAccountDisabled is returned by Authenticate when the password is right but the user has been deactivated
+var ErrAccountDisabled = errors.New("account is deactivated")
+
+// ErrDuplicateEmail is returned when a user is stored with the email of another user
+var ErrDuplicateEmail = errors.New("another user has this email")
+
+// ErrLastOwner is returned when demoting, deactivating or deleting a user would leave no active owner
+var ErrLastOwner = errors.New("there would be no active owner left")
+
+// ErrUserNotFound is returned when no user has the email
+var ErrUserNotFound = errors.New("no user has this email")
+
+// ErrInvalidResetToken is returned when a password reset link is unknown, expired or already used
+var ErrInvalidResetToken = errors.New("the password reset link is invalid or has expired")
+
+// ErrAccountLocked is returned by Authenticate while an account is locked after too many failed logins
+var ErrAccountLocked = errors.New("account is locked")
+
+// ErrInvalidCode is returned when a two-factor code has already been used or a recovery code is unknown
+var ErrInvalidCode = errors.New("the code is invalid or has already been used")
+
+// ErrDuplicateRequest is returned by CreateBooking, along with the reservation of the first request, when
+// the idempotency key has already been used for the same booking
+var ErrDuplicateRequest = errors.New("the request has already been made")
+
+// ErrIdempotencyKeyReused is returned by CreateBooking when the idempotency key has already been used for
+// another booking
+var ErrIdempotencyKeyReused = errors.New("the idempotency key has been used for another request")
+
+// ErrDuplicatePromoCode is returned when a promo code is stored with the code of another one
+var ErrDuplicatePromoCode = errors.New("another promo code has this code")
+
+// ErrPromoCodeUnavailable is returned by CreateBooking when the promo code has been used up or deactivated
+// since it was checked
+var ErrPromoCodeUnavailable = errors.New("the promo code can no longer be redeemed")
+
+// ErrPromoCodeRedeemed is returned by DeletePromoCode when the code has been redeemed, it can be deactivated instead
+var ErrPromoCodeRedeemed = errors.New("the promo code has been redeemed")
+
+// ErrDuplicateRoomType is returned when a room type is stored with the name of another one
+var ErrDuplicateRoomType = errors.New("another room type has this name")
+
+// ErrDuplicateRoom is returned when a room is stored with the slug of another one
+var ErrDuplicateRoom = errors.New("another room has this slug")
+
 type DatabaseRepo interface {
-	AllUsers() bool
-	InsertReservation(res models.Reservation) (int, error)
-	InsertRoomRestriction(res models.RoomRestrictions) error
-	SearchAvailabilityByDatesByRoomID(start, end time.Time, roomId int) (bool, error)
-	SearchAvailablityForAllRooms(start, end time.Time) ([]models.Room, error)
-	GetRoomById(id int) (models.Room, error)
-	GetUserByID(ID int) (models.User, error)
-	UpdateUser(u models.User) error
-	Authenticate(email, testPassword string) (int, string, error)
-	AllReservations() ([]models.Reservation, error)
-	AllNewReservations() ([]models.Reservation, error)
-	GetReservationByID(id int) (models.Reservation, error)
-	UpdateReservation(res models.Reservation) error
-	DeleteReservation(id int) error
-	UpdateProcessedForReservation(id, processed int) error
-	AllRooms() ([]models.Room, error)
-	GetRestrictionsFoorRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestrictions, error)
-	InsertBlockForRoom(id int, startdate time.Time) error
-	DeleteBlockByID(id int) error
+	AllUsers(ctx context.Context) ([]models.User, error)
+	InsertUser(ctx context.Context, u models.User, password string) (int, error)
+	InsertReservation(ctx context.Context, res models.Reservation) (int, error)
+	InsertRoomRestriction(ctx context.Context, res models.RoomRestrictions) error
+	CreateBooking(ctx context.Context, b models.Booking) (models.Reservation, error)
+	SearchAvailabilityByDatesByRoomID(ctx context.Context, start, end time.Time, roomId int) (bool, error)
+	SearchAvailablityForAllRooms(ctx context.Context, start, end time.Time, guests int) ([]models.Room, error)
+	GetRoomById(ctx context.Context, id int) (models.Room, error)
+	GetUserByID(ctx context.Context, ID int) (models.User, error)
+	GetUserByEmail(ctx context.Context, email string) (models.User, error)
+	UpdateUser(ctx context.Context, u models.User) error
+	SetUserActive(ctx context.Context, id int, active bool) error
+	RequirePasswordReset(ctx context.Context, id int) error
+	UpdatePassword(ctx context.Context, id int, password string) (int, error)
+	InsertPasswordReset(ctx context.Context, reset models.PasswordReset) error
+	ResetPassword(ctx context.Context, tokenHash, password string) (int, error)
+	DeleteUser(ctx context.Context, id int) error
+	Authenticate(ctx context.Context, email, testPassword string) (int, string, error)
+	InsertLoginAttempt(ctx context.Context, a models.LoginAttempt) error
+	EnableTOTP(ctx context.Context, id int, secret string, step int64, recoveryCodeHashes []string) error
+	DisableTOTP(ctx context.Context, id int) error
+	UseTOTPStep(ctx context.Context, id int, step int64) error
+	UseRecoveryCode(ctx context.Context, id int, codeHash string) (int, error)
+	ReplaceRecoveryCodes(ctx context.Context, id int, codeHashes []string) error
+	RecoveryCodesLeft(ctx context.Context, id int) (int, error)
+	InsertAPIKey(ctx context.Context, key models.APIKey) (int, error)
+	AllAPIKeys(ctx context.Context) ([]models.APIKey, error)
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id int) error
+	TouchAPIKey(ctx context.Context, id int, usedAt time.Time) error
+	AllReservations(ctx context.Context) ([]models.Reservation, error)
+	AllNewReservations(ctx context.Context) ([]models.Reservation, error)
+	GetReservationByID(ctx context.Context, id int) (models.Reservation, error)
+	UpdateReservation(ctx context.Context, res models.Reservation, webhooks []models.WebhookMessage) error
+	DeleteReservation(ctx context.Context, id int, webhooks []models.WebhookMessage) error
+	UpdateProcessedForReservation(ctx context.Context, id, processed int, webhooks []models.WebhookMessage) error
+	AllRooms(ctx context.Context) ([]models.Room, error)
+	GetRestrictionsFoorRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestrictions, error)
+	InsertBlockForRoom(ctx context.Context, id int, startdate time.Time) error
+	DeleteBlockByID(ctx context.Context, id int) error
+
+	InsertMail(ctx context.Context, msg models.MailData) (int, error)
+	ClaimMail(ctx context.Context, limit int, lease time.Duration) ([]models.OutboxMail, error)
+	MarkMailSent(ctx context.Context, id int) error
+	MarkMailFailed(ctx context.Context, id int, reason string, retryAt time.Time, dead bool) error
+	AllFailedMail(ctx context.Context) ([]models.OutboxMail, error)
+	RetryMail(ctx context.Context, id int) error
+
+	AllWebhookEndpoints(ctx context.Context) ([]models.WebhookEndpoint, error)
+	GetWebhookEndpoint(ctx context.Context, id int) (models.WebhookEndpoint, error)
+	InsertWebhookEndpoint(ctx context.Context, e models.WebhookEndpoint) (int, error)
+	UpdateWebhookEndpoint(ctx context.Context, e models.WebhookEndpoint) error
+	DeleteWebhookEndpoint(ctx context.Context, id int) error
+	QueueWebhook(ctx context.Context, event models.WebhookEvent, payload []byte) (int, error)
+	ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookDelivery, error)
+	MarkWebhookDelivered(ctx context.Context, id, responseStatus int) error
+	MarkWebhookFailed(ctx context.Context, id, responseStatus int, reason string, retryAt time.Time, dead bool) error
+	RecentWebhookDeliveries(ctx context.Context, limit int) ([]models.WebhookDelivery, error)
+	RedeliverWebhook(ctx context.Context, id int) error
+
+	SeasonalRates(ctx context.Context, roomID int, start, end time.Time) ([]models.SeasonalRate, error)
+	StayDiscounts(ctx context.Context) ([]models.StayDiscount, error)
+
+	AllCharges(ctx context.Context) ([]models.Charge, error)
+	IssueInvoice(ctx context.Context, inv models.Invoice) (models.Invoice, error)
+	GetInvoiceByReservationID(ctx context.Context, reservationID int) (models.Invoice, error)
+
+	AllPromoCodes(ctx context.Context) ([]models.PromoCode, error)
+	GetPromoCodeByID(ctx context.Context, id int) (models.PromoCode, error)
+	GetPromoCodeByCode(ctx context.Context, code string) (models.PromoCode, error)
+	InsertPromoCode(ctx context.Context, p models.PromoCode) (int, error)
+	UpdatePromoCode(ctx context.Context, p models.PromoCode) error
+	DeletePromoCode(ctx context.Context, id int) error
+	PromoCodeUses(ctx context.Context, id int, email string) (int, int, error)
+	PromoRedemptions(ctx context.Context, limit int) ([]models.PromoRedemption, error)
+
+	AllRoomTypes(ctx context.Context) ([]models.RoomType, error)
+	GetRoomTypeByID(ctx context.Context, id int) (models.RoomType, error)
+	InsertRoomType(ctx context.Context, t models.RoomType) (int, error)
+	UpdateRoomType(ctx context.Context, t models.RoomType) error
+	DeleteRoomType(ctx context.Context, id int) error
+
+	GetRoomBySlug(ctx context.Context, slug string) (models.Room, error)
+	InsertRoom(ctx context.Context, room models.Room) (int, error)
+	UpdateRoom(ctx context.Context, room models.Room) error
+	SetRoomActive(ctx context.Context, id int, active bool) error
+	ReorderRooms(ctx context.Context, ids []int) error
 }
@@ -0,0 +1,143 @@
+// Package sessionstore keeps the sessions of scs in postgres, so that they survive restarts of the app and are
+// shared by every instance behind a load balancer
+package sessionstore
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// Postgres stores the sessions in the sessions table, it satisfies scs.Store, scs.CtxStore and
+// scs.IterableCtxStore
+type Postgres struct {
+	db      *sql.DB
+	timeout time.Duration
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewPostgres returns a store using db, every query is cancelled after timeout. The expired sessions are
+// deleted every cleanupInterval until Close is called, failures to do so are written to errorLog.
+func NewPostgres(db *sql.DB, timeout, cleanupInterval time.Duration, errorLog *log.Logger) *Postgres {
+	p := &Postgres{
+		db:      db,
+		timeout: timeout,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go p.cleanup(cleanupInterval, errorLog)
+	return p
+}
+
+// Find returns the data of the session with the token, found is false when there is none or it has expired
+func (p *Postgres) Find(token string) ([]byte, bool, error) {
+	return p.FindCtx(context.Background(), token)
+}
+
+// FindCtx is Find within ctx
+func (p *Postgres) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	var b []byte
+	err := p.db.QueryRowContext(ctx, "select data from sessions where token = $1 and expiry > now()", token).Scan(&b)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// Commit stores the data of the session with the token until expiry, replacing what it had
+func (p *Postgres) Commit(token string, b []byte, expiry time.Time) error {
+	return p.CommitCtx(context.Background(), token, b, expiry)
+}
+
+// CommitCtx is Commit within ctx
+func (p *Postgres) CommitCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	query := `
+		insert into sessions (token, data, expiry) values ($1, $2, $3)
+		on conflict (token) do update set data = excluded.data, expiry = excluded.expiry
+	`
+	_, err := p.db.ExecContext(ctx, query, token, b, expiry)
+	return err
+}
+
+// Delete removes the session with the token, it does nothing when there is none
+func (p *Postgres) Delete(token string) error {
+	return p.DeleteCtx(context.Background(), token)
+}
+
+// DeleteCtx is Delete within ctx
+func (p *Postgres) DeleteCtx(ctx context.Context, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	_, err := p.db.ExecContext(ctx, "delete from sessions where token = $1", token)
+	return err
+}
+
+// AllCtx returns the data of every session that hasn't expired, by token
+func (p *Postgres) AllCtx(ctx context.Context) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	rows, err := p.db.QueryContext(ctx, "select token, data from sessions where expiry > now()")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make(map[string][]byte)
+	for rows.Next() {
+		var token string
+		var b []byte
+		if err := rows.Scan(&token, &b); err != nil {
+			return nil, err
+		}
+		sessions[token] = b
+	}
+	return sessions, rows.Err()
+}
+
+// Close stops deleting the expired sessions, it must be called before the database is closed
+func (p *Postgres) Close() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.done
+}
+
+// cleanup deletes the expired sessions every interval until Close is called
+func (p *Postgres) cleanup(interval time.Duration, errorLog *log.Logger) {
+	defer close(p.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.deleteExpired(); err != nil {
+				errorLog.Println("cannot delete the expired sessions:", err)
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// deleteExpired deletes the sessions that have expired
+func (p *Postgres) deleteExpired() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	_, err := p.db.ExecContext(ctx, "delete from sessions where expiry <= now()")
+	return err
+}
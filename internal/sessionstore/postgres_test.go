@@ -0,0 +1,249 @@
+package sessionstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alexedwards/scs/v2"
+	"github.com/mrkouhadi/go-booking-app/internal/driver"
+)
+
+func TestPostgres_Interfaces(t *testing.T) {
+	// scs passes the request context to the stores that take one
+	var store interface{} = &Postgres{}
+	if _, ok := store.(scs.CtxStore); !ok {
+		t.Error("expected Postgres to be an scs.CtxStore")
+	}
+	if _, ok := store.(scs.IterableCtxStore); !ok {
+		t.Error("expected Postgres to be an scs.IterableCtxStore")
+	}
+}
+
+func TestPostgres_Close(t *testing.T) {
+	p := NewPostgres(nil, time.Second, time.Hour, log.New(io.Discard, "", 0))
+
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		p.Close() // closing twice is harmless, e.g. after a failed shutdown
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected Close to stop the cleanup")
+	}
+}
+
+// mockStore returns a store on a mocked database, whose cleanup doesn't run during the test
+func mockStore(t *testing.T) (*Postgres, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPostgres(db, time.Second, time.Hour, log.New(io.Discard, "", 0))
+	t.Cleanup(func() {
+		p.Close()
+		db.Close()
+	})
+	return p, mock
+}
+
+func TestPostgres_Find(t *testing.T) {
+	p, mock := mockStore(t)
+	query := regexp.QuoteMeta("select data from sessions where token = $1 and expiry > now()")
+
+	mock.ExpectQuery(query).WithArgs("found").WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte("data")))
+	b, found, err := p.Find("found")
+	if err != nil || !found || string(b) != "data" {
+		t.Errorf("expected the data of the session, got %q %v %v", b, found, err)
+	}
+
+	// an expired session isn't selected, it's the same as no session
+	mock.ExpectQuery(query).WithArgs("expired").WillReturnError(sql.ErrNoRows)
+	b, found, err = p.Find("expired")
+	if err != nil || found || b != nil {
+		t.Errorf("expected no session, got %q %v %v", b, found, err)
+	}
+
+	mock.ExpectQuery(query).WithArgs("broken").WillReturnError(errors.New("connection lost"))
+	if _, found, err = p.Find("broken"); err == nil || found {
+		t.Errorf("expected the error of the database, got %v %v", found, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgres_Commit(t *testing.T) {
+	p, mock := mockStore(t)
+	expiry := time.Now().Add(time.Hour)
+
+	// committing a token again replaces its data and expiry
+	mock.ExpectExec(regexp.QuoteMeta("on conflict (token) do update set data = excluded.data, expiry = excluded.expiry")).
+		WithArgs("token", []byte("data"), expiry).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := p.Commit("token", []byte("data"), expiry); err != nil {
+		t.Error(err)
+	}
+
+	mock.ExpectExec("insert into sessions").WillReturnError(errors.New("connection lost"))
+	if err := p.CommitCtx(context.Background(), "token", []byte("data"), expiry); err == nil {
+		t.Error("expected the error of the database")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgres_Delete(t *testing.T) {
+	p, mock := mockStore(t)
+	statement := regexp.QuoteMeta("delete from sessions where token = $1")
+
+	mock.ExpectExec(statement).WithArgs("token").WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := p.Delete("token"); err != nil {
+		t.Error(err)
+	}
+	// there is nothing to delete the second time, which isn't an error
+	mock.ExpectExec(statement).WithArgs("token").WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := p.Delete("token"); err != nil {
+		t.Error(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgres_AllCtx(t *testing.T) {
+	p, mock := mockStore(t)
+
+	rows := sqlmock.NewRows([]string{"token", "data"}).AddRow("a", []byte("one")).AddRow("b", []byte("two"))
+	mock.ExpectQuery(regexp.QuoteMeta("select token, data from sessions where expiry > now()")).WillReturnRows(rows)
+	sessions, err := p.AllCtx(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]byte{"a": []byte("one"), "b": []byte("two")}
+	if !reflect.DeepEqual(sessions, expected) {
+		t.Errorf("expected %q, got %q", expected, sessions)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgres_Cleanup(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	statement := regexp.QuoteMeta("delete from sessions where expiry <= now()")
+	mock.ExpectExec(statement).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(statement).WillReturnError(errors.New("connection lost"))
+
+	var logged bytes.Buffer
+	p := NewPostgres(db, time.Second, 10*time.Millisecond, log.New(&logged, "", 0))
+	deadline := time.Now().Add(time.Second)
+	for mock.ExpectationsWereMet() != nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	p.Close()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected the expired sessions to be deleted every interval: %s", err)
+	}
+	// the failure is logged and the cleanup goes on
+	if !strings.Contains(logged.String(), "cannot delete the expired sessions: connection lost") {
+		t.Errorf("expected the failure to be logged, got %q", logged.String())
+	}
+}
+
+// TestPostgres_Database runs the store against the database of BOOKINGS_TEST_DSN, with the sessions table
+// of the migrations. It's skipped when the variable isn't set.
+func TestPostgres_Database(t *testing.T) {
+	dsn := os.Getenv("BOOKINGS_TEST_DSN")
+	if dsn == "" {
+		t.Skip("BOOKINGS_TEST_DSN is not set")
+	}
+	db, err := driver.NewDatabase(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const prefix = "sessionstore-test-"
+	clean := func() {
+		if _, err := db.Exec("delete from sessions where token like $1", prefix+"%"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clean()
+	defer clean()
+
+	p := NewPostgres(db, 5*time.Second, time.Hour, log.New(io.Discard, "", 0))
+	defer p.Close()
+	ctx := context.Background()
+	live, expired := prefix+"live", prefix+"expired"
+
+	// a round trip, then the token is committed again with other data
+	if err := p.CommitCtx(ctx, live, []byte("first"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CommitCtx(ctx, live, []byte("second"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if b, found, err := p.FindCtx(ctx, live); err != nil || !found || string(b) != "second" {
+		t.Errorf("expected the data committed last, got %q %v %v", b, found, err)
+	}
+
+	if err := p.CommitCtx(ctx, expired, []byte("old"), time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := p.FindCtx(ctx, expired); err != nil || found {
+		t.Errorf("expected the expired session not to be found, got %v %v", found, err)
+	}
+
+	all, err := p.AllCtx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(all[live]) != "second" {
+		t.Errorf("expected All to return the live session, got %q", all[live])
+	}
+	if _, ok := all[expired]; ok {
+		t.Error("expected All to leave out the expired session")
+	}
+
+	if err := p.deleteExpired(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow("select count(*) from sessions where token = $1", expired).Scan(&n); err != nil || n != 0 {
+		t.Errorf("expected the cleanup to delete the expired session, %d left %v", n, err)
+	}
+
+	if err := p.DeleteCtx(ctx, live); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := p.FindCtx(ctx, live); err != nil || found {
+		t.Errorf("expected the deleted session not to be found, got %v %v", found, err)
+	}
+}
@@ -0,0 +1,24 @@
+package token
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// apiKeyStart starts every API key, so that leaked keys are easy to spot
+const apiKeyStart = "bk_"
+
+// NewAPIKey returns a random API key and its prefix, the start of the key that is shown to tell it apart
+// from the other keys
+func NewAPIKey() (key, prefix string, err error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	secret, err := New()
+	if err != nil {
+		return "", "", err
+	}
+	prefix = apiKeyStart + hex.EncodeToString(id)
+	return prefix + "_" + secret, prefix, nil
+}
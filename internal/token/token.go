@@ -0,0 +1,28 @@
+// Package token makes the random secrets handed out to users, e.g. in password reset links. Only the hash of
+// a token is stored, so that whoever reads the database can't use the tokens.
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// size is the number of random bytes in a token
+const size = 32
+
+// New returns a random URL-safe token
+func New() (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Hash returns the hex encoded SHA-256 of a token, which is what gets stored
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
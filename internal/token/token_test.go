@@ -0,0 +1,43 @@
+package token
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := New()
+	if a == b {
+		t.Error("expected two tokens to differ")
+	}
+	if len(a) != 43 || strings.ContainsAny(a, "+/=") {
+		t.Errorf("expected 43 URL-safe characters, got %q", a)
+	}
+}
+
+func TestHash(t *testing.T) {
+	if Hash("abc") != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Errorf("unexpected hash %s", Hash("abc"))
+	}
+	if Hash("abc") == Hash("abd") {
+		t.Error("expected different tokens to have different hashes")
+	}
+}
+
+func TestNewAPIKey(t *testing.T) {
+	key, prefix, err := NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, prefix+"_") || !strings.HasPrefix(prefix, "bk_") || len(prefix) != 11 {
+		t.Errorf("unexpected key %q with prefix %q", key, prefix)
+	}
+	other, otherPrefix, _ := NewAPIKey()
+	if key == other || prefix == otherPrefix {
+		t.Error("expected two keys to differ")
+	}
+}
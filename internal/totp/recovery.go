@@ -0,0 +1,42 @@
+package totp
+
+import (
+	"crypto/rand"
+	"strings"
+)
+
+// RecoveryCodeCount is the number of recovery codes a user gets at once
+const RecoveryCodeCount = 10
+
+// recoveryEncoding has no characters that are easy to mix up when copied by hand
+var recoveryEncoding = strings.ToLower("ABCDEFGHJKLMNPQRSTUVWXYZ23456789")
+
+// NewRecoveryCodes returns n random codes like "k7mq2-x9fhd", each can log in once instead of a TOTP code
+func NewRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	b := make([]byte, 10)
+	for i := range codes {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		var sb strings.Builder
+		for j, c := range b {
+			if j == 5 {
+				sb.WriteByte('-')
+			}
+			sb.WriteByte(recoveryEncoding[int(c)%len(recoveryEncoding)])
+		}
+		codes[i] = sb.String()
+	}
+	return codes, nil
+}
+
+// NormalizeRecoveryCode puts a recovery code typed by the user in the form it was handed out in, so that its
+// hash can be looked up
+func NormalizeRecoveryCode(s string) string {
+	s = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(s))
+	if len(s) != 10 {
+		return s
+	}
+	return s[:5] + "-" + s[5:]
+}
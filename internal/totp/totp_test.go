@@ -0,0 +1,118 @@
+package totp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the RFC 6238 test vectors, "12345678901234567890" in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// the last 6 digits of the 8 digit codes of RFC 6238, appendix B
+	tests := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range tests {
+		got, err := Code(rfcSecret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("at %d: expected %s, got %s", unix, want, got)
+		}
+	}
+	if _, err := Code("not base32!", time.Now()); err == nil {
+		t.Error("expected an error for an invalid secret")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+
+	step, ok := Validate(rfcSecret, "081804", now)
+	if !ok || step != Step(now) {
+		t.Errorf("expected the current code to be valid at step %d, got %d %v", Step(now), step, ok)
+	}
+	if _, ok := Validate(rfcSecret, "081 804", now); !ok {
+		t.Error("expected spaces to be ignored")
+	}
+
+	// the previous and next codes are accepted for clocks that drift
+	for _, d := range []time.Duration{-period * time.Second, period * time.Second} {
+		c, _ := Code(rfcSecret, now.Add(d))
+		if step, ok := Validate(rfcSecret, c, now); !ok || step != Step(now.Add(d)) {
+			t.Errorf("expected the code %s away to be valid", d)
+		}
+	}
+	old, _ := Code(rfcSecret, now.Add(-2*period*time.Second))
+	if _, ok := Validate(rfcSecret, old, now); ok {
+		t.Error("expected a code two steps old to be refused")
+	}
+
+	for _, bad := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := Validate(rfcSecret, bad, now); ok {
+			t.Errorf("expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	a, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewSecret()
+	if a == b || len(a) != 32 {
+		t.Errorf("expected two different 32 character secrets, got %q and %q", a, b)
+	}
+	c, _ := Code(a, time.Now())
+	if _, ok := Validate(a, c, time.Now()); !ok {
+		t.Error("expected a new secret to validate its own codes")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Bookings", "jo@example.com", rfcSecret)
+	want := "otpauth://totp/Bookings:jo@example.com?algorithm=SHA1&digits=6&issuer=Bookings&period=30&secret=" + rfcSecret
+	if uri != want {
+		t.Errorf("expected %s, got %s", want, uri)
+	}
+}
+
+func TestQRCode(t *testing.T) {
+	png, err := QRCode(URI("Bookings", "jo@example.com", rfcSecret), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(png, []byte("\x89PNG")) {
+		t.Error("expected a PNG image")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := NewRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("expected %d codes, got %d", RecoveryCodeCount, len(codes))
+	}
+	seen := map[string]bool{}
+	for _, c := range codes {
+		if len(c) != 11 || c[5] != '-' || seen[c] {
+			t.Errorf("unexpected code %q", c)
+		}
+		seen[c] = true
+		if got := NormalizeRecoveryCode(" " + strings.ToUpper(strings.ReplaceAll(c, "-", " ")) + " "); got != c {
+			t.Errorf("expected %q to normalize back to %q", got, c)
+		}
+	}
+}
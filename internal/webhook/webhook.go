@@ -0,0 +1,118 @@
+// Package webhook signs and sends the events other systems subscribe to, e.g. new reservations for
+// the accounting. The receiver checks the signature with the secret of its endpoint, see Verify.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+	"github.com/mrkouhadi/go-booking-app/internal/token"
+)
+
+// the headers sent with every delivery
+const (
+	EventHeader     = "X-Webhook-Event"     // the event, e.g. reservation.created
+	DeliveryHeader  = "X-Webhook-Delivery"  // the id of the delivery, the same on every attempt
+	SignatureHeader = "X-Webhook-Signature" // t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">
+)
+
+// userAgent tells the receiver who is calling
+const userAgent = "go-booking-app-webhooks/1"
+
+// maxErrorBody is how much of the answer of a failing endpoint is kept in the delivery log
+const maxErrorBody = 512
+
+// ErrInvalidSignature is returned by Verify when a signature is malformed, doesn't match or is too old
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// NewSecret returns a random secret for a new endpoint
+func NewSecret() (string, error) {
+	t, err := token.New()
+	if err != nil {
+		return "", err
+	}
+	return "whsec_" + t, nil
+}
+
+// Sign returns the signature header of body sent at t. The time is signed too, so that an old
+// delivery can't be replayed.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + mac(secret, ts, body)
+}
+
+// Verify checks the signature header of body against secret, refusing signatures made more than
+// tolerance away from now
+func Verify(secret, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return ErrInvalidSignature
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > tolerance || d < -tolerance {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(sig), []byte(mac(secret, ts, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// mac returns the hex HMAC-SHA256 of "<ts>.<body>"
+func mac(secret, ts string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Send posts a delivery to its endpoint and returns the HTTP status of the answer, 0 when there was none.
+// Any answer but a 2xx is an error.
+func Send(ctx context.Context, client *http.Client, d models.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(EventHeader, string(d.Event))
+	req.Header.Set(DeliveryHeader, strconv.Itoa(d.ID))
+	req.Header.Set(SignatureHeader, Sign(d.Secret, time.Now(), d.Payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := strings.TrimSpace(string(body))
+		if msg == "" {
+			return resp.StatusCode, fmt.Errorf("endpoint answered %s", resp.Status)
+		}
+		return resp.StatusCode, fmt.Errorf("endpoint answered %s: %s", resp.Status, msg)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,116 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrkouhadi/go-booking-app/internal/models"
+)
+
+func TestSign(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	sig := Sign("secret", at, []byte(`{"a":1}`))
+	if !strings.HasPrefix(sig, "t=1700000000,v1=") || len(sig) != len("t=1700000000,v1=")+64 {
+		t.Errorf("unexpected signature %q", sig)
+	}
+	if sig != Sign("secret", at, []byte(`{"a":1}`)) {
+		t.Error("expected the same body to get the same signature")
+	}
+	if sig == Sign("other", at, []byte(`{"a":1}`)) || sig == Sign("secret", at, []byte(`{"a":2}`)) {
+		t.Error("expected another secret or body to get another signature")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"event":"reservation.created"}`)
+	sig := Sign("secret", now, body)
+
+	var tests = []struct {
+		name   string
+		secret string
+		header string
+		body   []byte
+		valid  bool
+	}{
+		{"valid", "secret", sig, body, true},
+		{"wrong secret", "other", sig, body, false},
+		{"changed body", "secret", sig, []byte(`{"event":"reservation.deleted"}`), false},
+		{"too old", "secret", Sign("secret", now.Add(-10*time.Minute), body), body, false},
+		{"no time", "secret", strings.SplitN(sig, ",", 2)[1], body, false},
+		{"no signature", "secret", "t=" + strings.TrimPrefix(strings.SplitN(sig, ",", 2)[0], "t="), body, false},
+		{"empty", "secret", "", body, false},
+	}
+	for _, e := range tests {
+		err := Verify(e.secret, e.header, e.body, now, 5*time.Minute)
+		if e.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", e.name, err)
+		}
+		if !e.valid && err != ErrInvalidSignature {
+			t.Errorf("%s: expected ErrInvalidSignature, got %v", e.name, err)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	var got *http.Request
+	var gotBody []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	d := models.WebhookDelivery{ID: 7, URL: receiver.URL, Secret: "secret", Event: models.EventReservationCreated, Payload: []byte(`{"a":1}`)}
+	status, err := Send(context.Background(), receiver.Client(), d)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("expected 204 and no error, got %d %v", status, err)
+	}
+	if got.Method != http.MethodPost || got.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected %s with content type %q", got.Method, got.Header.Get("Content-Type"))
+	}
+	if got.Header.Get(EventHeader) != "reservation.created" || got.Header.Get(DeliveryHeader) != "7" {
+		t.Errorf("unexpected headers %v", got.Header)
+	}
+	if string(gotBody) != `{"a":1}` {
+		t.Errorf("unexpected body %s", gotBody)
+	}
+	if err := Verify("secret", got.Header.Get(SignatureHeader), gotBody, time.Now(), time.Minute); err != nil {
+		t.Errorf("expected the receiver to verify the signature, got %v", err)
+	}
+}
+
+func TestSend_Failure(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "accounting is down", http.StatusServiceUnavailable)
+	}))
+	d := models.WebhookDelivery{ID: 1, URL: receiver.URL, Secret: "secret", Payload: []byte(`{}`)}
+
+	status, err := Send(context.Background(), receiver.Client(), d)
+	if status != http.StatusServiceUnavailable || err == nil || !strings.Contains(err.Error(), "accounting is down") {
+		t.Errorf("expected 503 and the answer in the error, got %d %v", status, err)
+	}
+
+	receiver.Close()
+	status, err = Send(context.Background(), receiver.Client(), d)
+	if status != 0 || err == nil {
+		t.Errorf("expected no status and an error once the receiver is gone, got %d %v", status, err)
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	a, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewSecret()
+	if a == b || !strings.HasPrefix(a, "whsec_") {
+		t.Errorf("unexpected secrets %q and %q", a, b)
+	}
+}
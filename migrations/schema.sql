@@ -16,6 +16,12 @@ SET xmloption = content;
 SET client_min_messages = warning;
 SET row_security = off;
 
+--
+-- Name: btree_gist; Type: EXTENSION; Schema: -; Owner: -
+--
+
+CREATE EXTENSION IF NOT EXISTS btree_gist WITH SCHEMA public;
+
 SET default_tablespace = '';
 
 SET default_table_access_method = heap;
@@ -284,6 +290,14 @@ ALTER TABLE ONLY public.room_restrictions
     ADD CONSTRAINT room_restrictions_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: room_restrictions room_restrictions_no_overlap; Type: CONSTRAINT; Schema: public; Owner: kouhadi
+--
+
+ALTER TABLE ONLY public.room_restrictions
+    ADD CONSTRAINT room_restrictions_no_overlap EXCLUDE USING gist (room_id WITH =, daterange(start_date, end_date) WITH &&);
+
+
 --
 -- Name: rooms rooms_pkey; Type: CONSTRAINT; Schema: public; Owner: kouhadi
 --